@@ -0,0 +1,188 @@
+package goheif
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"time"
+
+	"github.com/jdeng/goheif/heif"
+	"github.com/jdeng/goheif/libde265"
+)
+
+// AV1Encoder encodes image sequences into AV1 for EncodeAnimation.
+//
+// High bit depth images are passed to an Encode16([]*libde265.YCbCr16)
+// method, with the results of Encode, if the encoder has one.
+type AV1Encoder interface {
+	// Encode codes frames, whose widths and heights are even, as one AV1
+	// sequence. It returns the av1C record of the sequence and a temporal
+	// unit for each frame, in the low overhead bitstream format and
+	// without temporal delimiters. The first frame must be a key frame
+	// with a sequence header.
+	Encode(frames []*image.YCbCr) (config []byte, units []AV1Frame, err error)
+	Free()
+}
+
+// av1Encoder16 is implemented by AV1 encoders of high bit depth images,
+// which are otherwise coded as by Encode.
+type av1Encoder16 interface {
+	Encode16(frames []*libde265.YCbCr16) (config []byte, units []AV1Frame, err error)
+}
+
+// AV1Frame is a frame coded by an AV1Encoder.
+type AV1Frame struct {
+	Data []byte
+	Key  bool
+}
+
+// AV1EncoderConfig holds the settings EncodeAnimation passes to
+// NewAV1Encoder.
+type AV1EncoderConfig struct {
+	Quality int // 1 to 100
+	CRF     int // 1 to 63 overrides Quality, 0 if unset
+	Speed   int // 1 (slowest) to 10
+
+	// BitDepth and the color settings are those of EncodeOptions.
+	BitDepth         int
+	Color            *heif.NCLX
+	ContentLight     *heif.ContentLight
+	MasteringDisplay *heif.MasteringDisplay
+}
+
+// NewAV1Encoder creates the encoder used by EncodeAnimation. It is nil
+// unless set.
+var NewAV1Encoder func(cfg AV1EncoderConfig) (AV1Encoder, error)
+
+// ErrNoAV1Encoder is returned by EncodeAnimation when no AV1 encoder is
+// available.
+var ErrNoAV1Encoder = errors.New("goheif: no AV1 encoder; set NewAV1Encoder")
+
+// Animation is an image sequence for EncodeAnimation, in the manner of
+// gif.GIF.
+type Animation struct {
+	Frames []image.Image
+	// Durations are the display times of the frames, rounded to
+	// milliseconds.
+	Durations []time.Duration
+	// LoopCount is the number of times the animation is repeated after it
+	// is first shown: 0 repeats forever, -1 shows it once.
+	LoopCount int
+}
+
+// EncodeAnimation writes a to w as an animated AVIF file: an avis track
+// holding the frames, and the first frame as the primary image for
+// readers of still images. Frames must all have the same size and are
+// coded as 4:2:0 without alpha, padded to even sizes as by Encode. Of o,
+// only the quality, speed, bit depth and color settings are used.
+func EncodeAnimation(w io.Writer, a *Animation, o *EncodeOptions) error {
+	var cfg AV1EncoderConfig
+	cfg.Quality, cfg.CRF, cfg.Speed = encoderSettings(o, 63)
+	if o == nil {
+		o = &EncodeOptions{}
+	}
+	depth, err := bitDepth(o)
+	if err != nil {
+		return err
+	}
+	cfg.BitDepth = depth
+	cfg.Color, cfg.ContentLight, cfg.MasteringDisplay = o.Color, o.ContentLight, o.MasteringDisplay
+	if NewAV1Encoder == nil {
+		return ErrNoAV1Encoder
+	}
+	if len(a.Frames) == 0 {
+		return errors.New("goheif: no frames")
+	}
+	if len(a.Durations) != len(a.Frames) {
+		return errors.New("goheif: mismatched frame and duration counts")
+	}
+	size := a.Frames[0].Bounds().Size()
+	if size.X <= 0 || size.Y <= 0 {
+		return errors.New("goheif: empty image")
+	}
+	var frames []*image.YCbCr
+	var frames16 []*libde265.YCbCr16
+	for _, img := range a.Frames {
+		if img.Bounds().Size() != size {
+			return errors.New("goheif: frames of different sizes")
+		}
+		switch {
+		case depth > 8:
+			yuv16, _ := toYCbCr16(img, depth, o.Color)
+			frames16 = append(frames16, yuv16)
+		case o.Color != nil:
+			yuv16, _ := toYCbCr16(img, depth, o.Color)
+			frames = append(frames, narrow(yuv16))
+		default:
+			yuv, _ := toYCbCr420(img)
+			frames = append(frames, yuv)
+		}
+	}
+
+	enc, err := NewAV1Encoder(cfg)
+	if err != nil {
+		return err
+	}
+	defer enc.Free()
+	var config []byte
+	var units []AV1Frame
+	var coded image.Rectangle
+	if depth > 8 {
+		e, ok := enc.(av1Encoder16)
+		if !ok {
+			return fmt.Errorf("goheif: AV1 encoder does not support %d-bit images", depth)
+		}
+		config, units, err = e.Encode16(frames16)
+		coded = frames16[0].Rect
+	} else {
+		config, units, err = enc.Encode(frames)
+		coded = frames[0].Rect
+	}
+	if err != nil {
+		return err
+	}
+	if len(units) != len(a.Frames) || !units[0].Key {
+		return errors.New("goheif: AV1 encoder did not return a key frame and then one unit per frame")
+	}
+
+	width, height := coded.Dx(), coded.Dy()
+	var props []heif.Property
+	if width != size.X || height != size.Y {
+		props = append(props, heif.ClapProperty(image.Rect(0, 0, size.X, size.Y), width, height))
+	}
+	props = append(props, hdrProperties(o)...)
+	m := heif.NewMuxer()
+	if _, err := m.AddItem(heif.MuxItem{
+		Type:       heif.ItemTypeAV1,
+		Data:       units[0].Data,
+		Config:     config,
+		Width:      width,
+		Height:     height,
+		Properties: props,
+	}); err != nil {
+		return err
+	}
+
+	track := heif.MuxTrack{
+		Type:       heif.ItemTypeAV1,
+		Config:     config,
+		Width:      width,
+		Height:     height,
+		Properties: props,
+		Timescale:  1000,
+		LoopCount:  a.LoopCount,
+	}
+	for i, u := range units {
+		track.Samples = append(track.Samples, heif.MuxSample{
+			Data:     u.Data,
+			Duration: uint32(a.Durations[i].Round(time.Millisecond) / time.Millisecond),
+			Sync:     u.Key,
+		})
+	}
+	if _, err := m.AddTrack(track); err != nil {
+		return err
+	}
+	_, err = m.WriteTo(w)
+	return err
+}
@@ -0,0 +1,186 @@
+package goheif
+
+import (
+	"context"
+	"image"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/jdeng/goheif/heif"
+)
+
+// BatchOptions configures DecodeBatch.
+type BatchOptions struct {
+	// Concurrency is the number of images decoded at once. If <= 0,
+	// GOMAXPROCS is used.
+	Concurrency int
+
+	// Options configure the decoding, as for NewDecoder. SafeEncoding is
+	// not consulted.
+	Options []Option
+
+	// MemoryBudget bounds the memory of the images being decoded at once,
+	// estimated at 3 bytes per pixel. An image over the budget is decoded
+	// on its own. Zero means no bound.
+	MemoryBudget int64
+}
+
+// BatchResult is the outcome of decoding one input of DecodeBatch.
+type BatchResult struct {
+	Image image.Image
+	Err   error
+}
+
+// bytesPerPixel estimates the memory used to decode an image: the 4:2:0
+// output plus the decoder's own copy of the picture.
+const bytesPerPixel = 3
+
+// DecodeBatch decodes inputs concurrently, reusing a decoder per worker,
+// and returns a result for each input, in order. Once ctx is done, inputs
+// that have not started get ctx.Err() as their error.
+func DecodeBatch(ctx context.Context, inputs []io.Reader, opts BatchOptions) []BatchResult {
+	results := make([]BatchResult, len(inputs))
+	d := NewDecoder(opts.Options...)
+
+	workers := opts.Concurrency
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(inputs) {
+		workers = len(inputs)
+	}
+
+	var budget *memoryBudget
+	if opts.MemoryBudget > 0 {
+		budget = newMemoryBudget(ctx, opts.MemoryBudget)
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var dec HEVCDecoder
+			defer func() {
+				if dec != nil {
+					dec.Free()
+				}
+			}()
+			// the first image sizes the worker's decoder
+			getDecoder := func(width, height int) (HEVCDecoder, error) {
+				if dec != nil {
+					return dec, nil
+				}
+				var err error
+				dec, err = NewHEVCDecoder(d.hevcConfig(width, height, workers))
+				return dec, err
+			}
+
+			for i := range next {
+				results[i] = decodeBatchInput(ctx, d, inputs[i], budget, getDecoder)
+			}
+		}()
+	}
+
+	for i := range inputs {
+		if ctx.Err() != nil {
+			results[i].Err = ctx.Err()
+			continue
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	return results
+}
+
+func decodeBatchInput(ctx context.Context, d *Decoder, r io.Reader, budget *memoryBudget, getDecoder func(width, height int) (HEVCDecoder, error)) BatchResult {
+	if err := ctx.Err(); err != nil {
+		return BatchResult{Err: err}
+	}
+
+	ra, err := asReaderAt(r)
+	if err != nil {
+		return BatchResult{Err: err}
+	}
+	hf := heif.Open(ra, pixelsOnly)
+	m := &DecodeMetrics{}
+
+	if budget != nil {
+		var n int64
+		start := time.Now()
+		it, err := hf.PrimaryItem()
+		m.add(&m.Parse, start)
+		if err == nil {
+			if w, h, ok := it.SpatialExtents(); ok {
+				n = int64(w) * int64(h) * bytesPerPixel
+			}
+		}
+		n, err = budget.acquire(n)
+		if err != nil {
+			return BatchResult{Err: err}
+		}
+		defer budget.release(n)
+	}
+
+	img, err := decodePrimary(hf, getDecoder, nil, m)
+	img, err = d.finish(hf, img, err)
+	if d.metrics != nil {
+		m.Err = err
+		d.metrics(*m)
+	}
+	return BatchResult{Image: img, Err: err}
+}
+
+// memoryBudget is a counting semaphore over bytes, released when ctx is
+// done.
+type memoryBudget struct {
+	ctx   context.Context
+	total int64
+
+	mu    sync.Mutex
+	cond  sync.Cond
+	avail int64
+}
+
+func newMemoryBudget(ctx context.Context, total int64) *memoryBudget {
+	b := &memoryBudget{ctx: ctx, total: total, avail: total}
+	b.cond.L = &b.mu
+	context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	})
+	return b
+}
+
+// acquire waits until n bytes are available and takes them. Requests over
+// the total take all of it. It returns the amount taken.
+func (b *memoryBudget) acquire(n int64) (int64, error) {
+	if n > b.total {
+		n = b.total
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.avail < n && b.ctx.Err() == nil {
+		b.cond.Wait()
+	}
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	b.avail -= n
+	return n, nil
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	b.avail += n
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
@@ -0,0 +1,95 @@
+package goheif
+
+import (
+	"image"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jdeng/goheif/heif"
+)
+
+// ItemDecoder decodes the coded image items of one type for a codec
+// registered with RegisterCodec. Decode creates one per image, passes it
+// every item of its type, such as the tiles of a grid, then frees it. The
+// images it returns must stay valid after Free.
+type ItemDecoder interface {
+	DecodeItem(hf *heif.File, it *heif.Item) (image.Image, error)
+	Free()
+}
+
+var codecs struct {
+	sync.RWMutex
+	m map[string]func() (ItemDecoder, error)
+}
+
+// RegisterCodec makes Decode decode the coded image items of type
+// itemType, such as "av01" or "vvc1", with decoders made by newDecoder. A
+// registration replaces the previous one for the type, including the
+// built-in HEVC ("hvc1") and JPEG ("jpeg") decoders; a nil newDecoder
+// removes it. Codec packages call it from their init functions.
+func RegisterCodec(itemType string, newDecoder func() (ItemDecoder, error)) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	if newDecoder == nil {
+		delete(codecs.m, itemType)
+		return
+	}
+	if codecs.m == nil {
+		codecs.m = make(map[string]func() (ItemDecoder, error))
+	}
+	codecs.m[itemType] = newDecoder
+}
+
+// Codecs returns the item types Decode decodes, built in or registered,
+// sorted.
+func Codecs() []string {
+	types := []string{heif.ItemTypeHEVC, heif.ItemTypeJPEG}
+	codecs.RLock()
+	for typ := range codecs.m {
+		if typ != heif.ItemTypeHEVC && typ != heif.ItemTypeJPEG {
+			types = append(types, typ)
+		}
+	}
+	codecs.RUnlock()
+	sort.Strings(types)
+	return types
+}
+
+// itemDecoders holds the registered decoders used for one image.
+type itemDecoders struct {
+	m map[string]ItemDecoder
+}
+
+// decode decodes it with the registered decoder for its type, created on
+// first use. ok is false if the type has none.
+func (ds *itemDecoders) decode(hf *heif.File, it *heif.Item, m *DecodeMetrics) (img image.Image, ok bool, err error) {
+	typ := it.Info.ItemType
+	dec, ok := ds.m[typ]
+	if !ok {
+		codecs.RLock()
+		newDecoder := codecs.m[typ]
+		codecs.RUnlock()
+		if newDecoder == nil {
+			return nil, false, nil
+		}
+		if dec, err = newDecoder(); err != nil {
+			return nil, true, err
+		}
+		if ds.m == nil {
+			ds.m = make(map[string]ItemDecoder)
+		}
+		ds.m[typ] = dec
+	}
+
+	m.Tiles++
+	defer m.add(&m.TileDecode, time.Now())
+	img, err = dec.DecodeItem(hf, it)
+	return img, true, err
+}
+
+func (ds *itemDecoders) free() {
+	for _, dec := range ds.m {
+		dec.Free()
+	}
+}
@@ -0,0 +1,716 @@
+package goheif
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+
+	"github.com/jdeng/goheif/heif"
+	"github.com/jdeng/goheif/libde265"
+)
+
+// DefaultQuality is the quality used by Encode when no options are given.
+const DefaultQuality = 50
+
+// Preset trades encoding speed for compression.
+type Preset int
+
+const (
+	PresetBalanced Preset = iota // the default
+	PresetFastest
+	PresetBest
+)
+
+// speed returns the encoder speed of p, from 1 (slowest) to 10.
+func (p Preset) speed() int {
+	switch p {
+	case PresetFastest:
+		return 10
+	case PresetBest:
+		return 2
+	}
+	return 5
+}
+
+// Profile constrains Encode to the files a family of readers accepts.
+type Profile int
+
+const (
+	ProfileDefault Profile = iota
+
+	// ProfileApple writes files laid out like those of iPhones: brands
+	// heic, mif1, MiHE, miaf and MiHB, grids of 512 pixel tiles for images
+	// larger than a tile or of odd sizes, pixi properties and 320 pixel
+	// thumbnails, unless TileSize or Thumbnail say otherwise.
+	ProfileApple
+)
+
+// Brands of files written with ProfileApple.
+var appleCompatible = []string{"mif1", "MiHE", "miaf", "MiHB", "heic"}
+
+// EncodeOptions are the encoding parameters of Encode.
+type EncodeOptions struct {
+	Quality int // 1 to 100, higher is better
+
+	// CRF, if positive, is the constant rate factor or quantizer of the
+	// codec, which overrides Quality: 0 to 51 for HEVC, 0 to 63 for AV1,
+	// lower is better.
+	CRF int
+
+	// Preset sets the encoding speed, unless Speed, from 1 (slowest,
+	// smallest files) to 10, is set.
+	Preset Preset
+	Speed  int
+
+	// Thumbnail, if set, adds a thumbnail item whose longer side is this
+	// many pixels, linked to the image by a thmb reference. Apple devices
+	// write 320 pixel thumbnails.
+	Thumbnail int
+
+	// TileSize, if set, codes images larger than a tile as grids of
+	// TileSize x TileSize tiles, rounded up to even, which decoders can
+	// work on in parallel.
+	TileSize int
+
+	Profile Profile
+
+	Exif []byte // an Exif block, with or without its "Exif\x00\x00" header
+	XMP  []byte // an XMP packet
+	ICC  []byte // an ICC color profile
+
+	// BitDepth is 8 (the default), 10 or 12. High bit depth images are
+	// converted at 16-bit precision and need an encoder with an Encode16
+	// method (see HEVCEncoder).
+	BitDepth int
+
+	// Color, if set, is written as an nclx colr property and signaled to
+	// the encoder, and its matrix and range are used to convert colors,
+	// which are taken to be already encoded with its transfer function,
+	// such as PQ or HLG. Otherwise colors are converted as by image/color.
+	Color *heif.NCLX
+
+	// ContentLight and MasteringDisplay, if set, describe HDR content in
+	// clli and mdcv properties.
+	ContentLight     *heif.ContentLight
+	MasteringDisplay *heif.MasteringDisplay
+
+	// Depth, if set, is a depth map, of any size, written as an auxiliary
+	// image: its luma holds the depth samples, which DepthInfo describes.
+	Depth     image.Image
+	DepthInfo *heif.DepthInfo
+
+	// Alternatives makes EncodeAll group its images as alternatives of
+	// one another, such as the shots of a burst, of which readers show
+	// one. Otherwise they are independent images, such as pages.
+	Alternatives bool
+
+	// Backend, if set, codes the images instead of an encoder created by
+	// NewHEVCEncoder, whose settings it ignores.
+	Backend EncoderBackend
+
+	// Streaming writes each coded image or tile to w as soon as it is
+	// ready, with the meta box at the end of the file, so that memory
+	// does not grow with the coded data of large images.
+	Streaming bool
+}
+
+// HEVCEncoder encodes images into HEVC for Encode. Backends are plugged in
+// by setting NewHEVCEncoder; building with -tags x265 uses libx265.
+//
+// High bit depth images are passed to an Encode16(*libde265.YCbCr16)
+// ([]byte, error) method, if the encoder has one.
+type HEVCEncoder interface {
+	// Encode codes img, whose width and height are even, as a single intra
+	// picture and returns it as an Annex-B byte stream including the
+	// parameter sets.
+	Encode(img *image.YCbCr) ([]byte, error)
+	Free()
+}
+
+// EncoderBackend codes single images and tiles for Encode, which does the
+// tiling and writes the container and metadata. It lets hardware encoders,
+// such as VideoToolbox or VAAPI, or external processes be plugged in with
+// EncodeOptions.Backend.
+type EncoderBackend interface {
+	// EncodeTile codes img, an *image.YCbCr with even dimensions or, for
+	// bit depths above 8, a *libde265.YCbCr16, as a single intra HEVC
+	// picture. It returns the picture as length-prefixed NAL units and the
+	// hvcC record holding the parameter sets, whose lengthSizeMinusOne
+	// gives the size of the lengths.
+	EncodeTile(img image.Image) (data, config []byte, err error)
+}
+
+// hevcBackend is the EncoderBackend of an HEVCEncoder.
+type hevcBackend struct {
+	enc HEVCEncoder
+}
+
+func (b hevcBackend) EncodeTile(img image.Image) (data, config []byte, err error) {
+	var stream []byte
+	switch img := img.(type) {
+	case *image.YCbCr:
+		stream, err = b.enc.Encode(img)
+	case *libde265.YCbCr16:
+		e, ok := b.enc.(encoder16)
+		if !ok {
+			return nil, nil, fmt.Errorf("goheif: HEVC encoder does not support %d-bit images", img.BitDepth)
+		}
+		stream, err = e.Encode16(img)
+	default:
+		return nil, nil, fmt.Errorf("goheif: cannot encode %T", img)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	config, data, err = heif.HEVCItemFromAnnexB(stream)
+	return data, config, err
+}
+
+// HEVCEncoderConfig holds the settings Encode passes to NewHEVCEncoder.
+type HEVCEncoderConfig struct {
+	Quality int // 1 to 100
+	CRF     int // 1 to 51 overrides Quality, 0 if unset
+	Speed   int // 1 (slowest) to 10
+
+	// BitDepth and the color settings are those of EncodeOptions, for
+	// encoders to signal them in the bitstream.
+	BitDepth         int
+	Color            *heif.NCLX
+	ContentLight     *heif.ContentLight
+	MasteringDisplay *heif.MasteringDisplay
+}
+
+// encoder16 is implemented by encoders of high bit depth images.
+type encoder16 interface {
+	Encode16(img *libde265.YCbCr16) ([]byte, error)
+}
+
+// encoderSettings returns the quality, rate factor and speed of o, with
+// the rate factor clamped to maxCRF.
+func encoderSettings(o *EncodeOptions, maxCRF int) (quality, crf, speed int) {
+	quality, speed = DefaultQuality, PresetBalanced.speed()
+	if o == nil {
+		return quality, 0, speed
+	}
+	if o.Quality != 0 {
+		quality = min(max(o.Quality, 1), 100)
+	}
+	if o.CRF > 0 {
+		crf = min(o.CRF, maxCRF)
+	}
+	speed = o.Preset.speed()
+	if o.Speed != 0 {
+		speed = min(max(o.Speed, 1), 10)
+	}
+	return quality, crf, speed
+}
+
+// NewHEVCEncoder creates the encoder used by Encode. It is nil unless an
+// encoder backend is built in.
+var NewHEVCEncoder func(cfg HEVCEncoderConfig) (HEVCEncoder, error)
+
+// ErrNoEncoder is returned by Encode when no HEVC encoder is available.
+var ErrNoEncoder = errors.New("goheif: no HEVC encoder; build with -tags x265 or set NewHEVCEncoder")
+
+// Encode writes img to w as a HEIC file. Images are coded as 4:2:0, at 8
+// bits unless o.BitDepth is set. The alpha channel of images that are not
+// opaque, and any depth map, are coded as separate 8-bit auxiliary images;
+// thumbnails have neither. Odd widths and heights are padded by repeating
+// the last column or row, and a clean aperture property crops the padding
+// off again.
+func Encode(w io.Writer, img image.Image, o *EncodeOptions) error {
+	return EncodeAll(w, []image.Image{img}, o)
+}
+
+// EncodeAll writes imgs to w as a HEIC file holding a collection of
+// images, such as a burst or the pages of a document, coded as by Encode.
+// The first image is the primary one and the only one with the depth map
+// of o; the Exif and XMP metadata and the ICC profile apply to them all.
+// If o.Alternatives is set, the images are also grouped as alternatives.
+func EncodeAll(w io.Writer, imgs []image.Image, o *EncodeOptions) error {
+	var cfg HEVCEncoderConfig
+	cfg.Quality, cfg.CRF, cfg.Speed = encoderSettings(o, 51)
+	if o == nil {
+		o = &EncodeOptions{}
+	}
+	depth, err := bitDepth(o)
+	if err != nil {
+		return err
+	}
+	cfg.BitDepth = depth
+	cfg.Color, cfg.ContentLight, cfg.MasteringDisplay = o.Color, o.ContentLight, o.MasteringDisplay
+	if NewHEVCEncoder == nil && o.Backend == nil {
+		return ErrNoEncoder
+	}
+	if len(imgs) == 0 {
+		return errors.New("goheif: no images")
+	}
+	for _, img := range imgs {
+		if img.Bounds().Empty() {
+			return errors.New("goheif: empty image")
+		}
+	}
+
+	enc := o.Backend
+	if enc == nil {
+		hevc, err := NewHEVCEncoder(cfg)
+		if err != nil {
+			return err
+		}
+		defer hevc.Free()
+		enc = hevcBackend{hevc}
+	}
+
+	var brand string
+	var compatible []string
+	if o.Profile == ProfileApple {
+		brand, compatible = "heic", appleCompatible
+	}
+	var m muxer
+	if o.Streaming {
+		sm := heif.NewStreamMuxer(w)
+		sm.Brand, sm.Compatible = brand, compatible
+		m = sm
+	} else {
+		m = &heif.Muxer{Brand: brand, Compatible: compatible}
+	}
+	var ids []uint32
+	for i, img := range imgs {
+		id, err := encodeImage(m, enc, img, o, i == 0)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if o.Alternatives && len(ids) > 1 {
+		if err := m.AddGroup(heif.GroupAlternatives, ids...); err != nil {
+			return err
+		}
+	}
+
+	for _, meta := range []struct {
+		data []byte
+		item func([]byte) heif.MuxItem
+	}{{o.Exif, heif.ExifItem}, {o.XMP, heif.XMPItem}} {
+		if len(meta.data) == 0 {
+			continue
+		}
+		metaID, err := m.AddItem(meta.item(meta.data))
+		if err != nil {
+			return err
+		}
+		if err := m.AddReference(heif.RefDescribes, metaID, ids...); err != nil {
+			return err
+		}
+	}
+
+	if sm, ok := m.(*heif.StreamMuxer); ok {
+		return sm.Close()
+	}
+	_, err = m.(*heif.Muxer).WriteTo(w)
+	return err
+}
+
+// muxer is implemented by heif.Muxer and heif.StreamMuxer.
+type muxer interface {
+	AddItem(it heif.MuxItem) (uint32, error)
+	AddReference(typ string, from uint32, to ...uint32) error
+	AddGroup(typ string, ids ...uint32) error
+}
+
+// encodeImage adds img to m with its alpha channel and thumbnail, and its
+// depth map if it is the primary image, and returns its item ID.
+func encodeImage(m muxer, enc EncoderBackend, img image.Image, o *EncodeOptions, primary bool) (uint32, error) {
+	b := img.Bounds()
+	var coded image.Image
+	var yuv, alpha *image.YCbCr
+	if o.BitDepth > 8 || o.Color != nil {
+		var yuv16 *libde265.YCbCr16
+		yuv16, alpha = toYCbCr16(img, max(o.BitDepth, 8), o.Color)
+		// thumbnails are 8-bit
+		yuv, coded = narrow(yuv16), yuv16
+		if yuv16.BitDepth == 8 {
+			coded = yuv
+		}
+	} else {
+		yuv, alpha = toYCbCr420(img)
+		coded = yuv
+	}
+	var colorProps []heif.Property
+	if len(o.ICC) > 0 {
+		colorProps = append(colorProps, heif.ICCProperty(o.ICC))
+	}
+	colorProps = append(colorProps, hdrProperties(o)...)
+	id, err := addCoded(m, enc, coded, b.Dx(), b.Dy(), o, false, colorProps)
+	if err != nil {
+		return 0, err
+	}
+
+	if alpha != nil {
+		auxID, err := addCoded(m, enc, alpha, b.Dx(), b.Dy(), o, true, []heif.Property{heif.AuxProperty(heif.AuxTypeAlpha)})
+		if err != nil {
+			return 0, err
+		}
+		if err := m.AddReference(heif.RefAuxiliary, auxID, id); err != nil {
+			return 0, err
+		}
+	}
+
+	if primary && o.Depth != nil && !o.Depth.Bounds().Empty() {
+		var sei [][]byte
+		if o.DepthInfo != nil {
+			sei = append(sei, heif.DepthRepresentationSEI(*o.DepthInfo))
+		}
+		depth, _ := toYCbCr420(o.Depth)
+		db := o.Depth.Bounds()
+		auxID, err := addCoded(m, enc, depth, db.Dx(), db.Dy(), o, true, []heif.Property{heif.AuxProperty(heif.AuxTypeDepth)}, sei...)
+		if err != nil {
+			return 0, err
+		}
+		if err := m.AddReference(heif.RefAuxiliary, auxID, id); err != nil {
+			return 0, err
+		}
+	}
+
+	if size := o.thumbnail(); size > 0 && max(b.Dx(), b.Dy()) > size {
+		thumb := downscale(yuv, size)
+		thumbID, err := addCoded(m, enc, thumb, thumb.Rect.Dx(), thumb.Rect.Dy(), o, false, colorProps)
+		if err != nil {
+			return 0, err
+		}
+		if err := m.AddReference(heif.RefThumbnail, thumbID, id); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// addCoded codes img, an *image.YCbCr or a *libde265.YCbCr16 with even
+// dimensions at the origin, and adds it to m cropped to width x height,
+// and returns the ID of its item. The image is coded as a single item or,
+// if tiled, as a grid item of hidden tiles. props are added to the item and
+// configNALs to the hvcC records.
+func addCoded(m muxer, enc EncoderBackend, img image.Image, width, height int, o *EncodeOptions, hidden bool, props []heif.Property, configNALs ...[]byte) (uint32, error) {
+	var pixi []heif.Property
+	if o.Profile == ProfileApple {
+		depth := 8
+		if img, ok := img.(*libde265.YCbCr16); ok {
+			depth = img.BitDepth
+		}
+		pixi = append(pixi, heif.PixiProperty(depth, depth, depth))
+	}
+
+	size := o.tileSize()
+	if size == 0 || width <= size && height <= size && (o.Profile != ProfileApple || (width|height)&1 == 0) {
+		it, err := encodeItem(enc, img, configNALs...)
+		if err != nil {
+			return 0, err
+		}
+		if it.Width != width || it.Height != height {
+			it.Properties = append(it.Properties, heif.ClapProperty(image.Rect(0, 0, width, height), it.Width, it.Height))
+		}
+		it.Properties = append(it.Properties, pixi...)
+		it.Properties = append(it.Properties, props...)
+		it.Hidden = hidden
+		return m.AddItem(it)
+	}
+
+	// tiles are no larger than the image
+	tw, th := min(size, (width+1)&^1), min(size, (height+1)&^1)
+	rows, cols := (height+th-1)/th, (width+tw-1)/tw
+	if rows > 256 || cols > 256 {
+		return 0, fmt.Errorf("goheif: %dx%d image too large for %d pixel tiles", width, height, size)
+	}
+	grid := heif.GridItem(rows, cols, width, height)
+	grid.Properties = append(pixi, props...)
+	grid.Hidden = hidden
+	id, err := m.AddItem(grid)
+	if err != nil {
+		return 0, err
+	}
+	var tiles []uint32
+	for y := 0; y < height; y += th {
+		for x := 0; x < width; x += tw {
+			it, err := encodeItem(enc, tile(img, image.Rect(x, y, x+tw, y+th)), configNALs...)
+			if err != nil {
+				return 0, err
+			}
+			it.Properties = append(it.Properties, pixi...)
+			it.Hidden = true
+			tileID, err := m.AddItem(it)
+			if err != nil {
+				return 0, err
+			}
+			tiles = append(tiles, tileID)
+		}
+	}
+	return id, m.AddReference(heif.RefDerivedImage, id, tiles...)
+}
+
+// tile returns a copy of the part r, with even coordinates, of img, an
+// *image.YCbCr or a *libde265.YCbCr16 with 4:2:0 subsampling, even
+// dimensions and bounds at the origin. The last column and row of img are
+// repeated past its edges.
+func tile(img image.Image, r image.Rectangle) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	c := image.Rect(r.Min.X/2, r.Min.Y/2, r.Max.X/2, r.Max.Y/2)
+	switch img := img.(type) {
+	case *image.YCbCr:
+		t := image.NewYCbCr(image.Rectangle{Max: r.Size()}, image.YCbCrSubsampleRatio420)
+		cutPlane(t.Y, t.YStride, img.Y, img.YStride, w, h, r)
+		cutPlane(t.Cb, t.CStride, img.Cb, img.CStride, w/2, h/2, c)
+		cutPlane(t.Cr, t.CStride, img.Cr, img.CStride, w/2, h/2, c)
+		return t
+	case *libde265.YCbCr16:
+		t := libde265.NewYCbCr16(image.Rectangle{Max: r.Size()}, image.YCbCrSubsampleRatio420, img.BitDepth)
+		cutPlane(t.Y, t.YStride, img.Y, img.YStride, w, h, r)
+		cutPlane(t.Cb, t.CStride, img.Cb, img.CStride, w/2, h/2, c)
+		cutPlane(t.Cr, t.CStride, img.Cr, img.CStride, w/2, h/2, c)
+		return t
+	}
+	return nil
+}
+
+// cutPlane copies the part r of a w x h plane of samples to dst.
+func cutPlane[T byte | uint16](dst []T, dstStride int, src []T, srcStride, w, h int, r image.Rectangle) {
+	for y := 0; y < r.Dy(); y++ {
+		row := src[min(r.Min.Y+y, h-1)*srcStride:]
+		d := dst[y*dstStride : y*dstStride+r.Dx()]
+		for i := copy(d, row[r.Min.X:min(r.Max.X, w)]); i < len(d); i++ {
+			d[i] = row[w-1]
+		}
+	}
+}
+
+func (o *EncodeOptions) thumbnail() int {
+	if o.Thumbnail == 0 && o.Profile == ProfileApple {
+		return 320
+	}
+	return o.Thumbnail
+}
+
+func (o *EncodeOptions) tileSize() int {
+	if o.TileSize == 0 && o.Profile == ProfileApple {
+		return 512
+	}
+	return (max(o.TileSize, 0) + 1) &^ 1
+}
+
+// bitDepth returns the bit depth set by o.
+func bitDepth(o *EncodeOptions) (int, error) {
+	depth := max(o.BitDepth, 8)
+	if depth != 8 && depth != 10 && depth != 12 {
+		return 0, fmt.Errorf("goheif: unsupported bit depth %d", o.BitDepth)
+	}
+	return depth, nil
+}
+
+// hdrProperties returns the nclx, clli and mdcv properties of o.
+func hdrProperties(o *EncodeOptions) []heif.Property {
+	var props []heif.Property
+	if o.Color != nil {
+		props = append(props, heif.NCLXProperty(*o.Color))
+	}
+	if cl := o.ContentLight; cl != nil {
+		props = append(props, heif.ContentLightProperty(*cl))
+	}
+	if md := o.MasteringDisplay; md != nil {
+		props = append(props, heif.MasteringDisplayProperty(*md))
+	}
+	return props
+}
+
+// encodeItem codes img, an *image.YCbCr or a *libde265.YCbCr16, as an
+// HEVC item. configNALs are added to its hvcC.
+func encodeItem(enc EncoderBackend, img image.Image, configNALs ...[]byte) (heif.MuxItem, error) {
+	data, config, err := enc.EncodeTile(img)
+	if err != nil {
+		return heif.MuxItem{}, err
+	}
+	if len(configNALs) > 0 {
+		if config, err = heif.AppendHEVCConfigNALs(config, configNALs...); err != nil {
+			return heif.MuxItem{}, err
+		}
+	}
+	return heif.MuxItem{
+		Type:   heif.ItemTypeHEVC,
+		Data:   data,
+		Config: config,
+		Width:  img.Bounds().Dx(),
+		Height: img.Bounds().Dy(),
+	}, nil
+}
+
+// toYCbCr420 returns img as a 4:2:0 image with even dimensions at the
+// origin and, unless img is opaque, its alpha channel as the luma of a
+// second image with neutral chroma. Colors are not premultiplied by alpha.
+func toYCbCr420(img image.Image) (yuv, alpha *image.YCbCr) {
+	b := img.Bounds()
+	if m, ok := img.(*image.YCbCr); ok && m.SubsampleRatio == image.YCbCrSubsampleRatio420 &&
+		b.Min == (image.Point{}) && b.Dx()%2 == 0 && b.Dy()%2 == 0 {
+		return m, nil
+	}
+
+	w, h := (b.Dx()+1)&^1, (b.Dy()+1)&^1
+	yuv = image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio420)
+	alpha = image.NewYCbCr(yuv.Rect, image.YCbCrSubsampleRatio420)
+	opaque := true
+	for y := 0; y < h; y += 2 {
+		for x := 0; x < w; x += 2 {
+			var cb, cr int
+			for i := 0; i < 4; i++ {
+				px, py := x+i%2, y+i/2
+				// repeat the last column and row of odd sized images
+				sx, sy := b.Min.X+min(px, b.Dx()-1), b.Min.Y+min(py, b.Dy()-1)
+				var c color.YCbCr
+				a := uint8(0xff)
+				switch v := img.At(sx, sy).(type) {
+				case color.YCbCr:
+					c = v
+				default:
+					n := color.NRGBAModel.Convert(v).(color.NRGBA)
+					c.Y, c.Cb, c.Cr = color.RGBToYCbCr(n.R, n.G, n.B)
+					a = n.A
+				}
+				yuv.Y[yuv.YOffset(px, py)] = c.Y
+				alpha.Y[alpha.YOffset(px, py)] = a
+				opaque = opaque && a == 0xff
+				cb += int(c.Cb)
+				cr += int(c.Cr)
+			}
+			off := yuv.COffset(x, y)
+			yuv.Cb[off] = uint8((cb + 2) / 4)
+			yuv.Cr[off] = uint8((cr + 2) / 4)
+		}
+	}
+	if opaque {
+		return yuv, nil
+	}
+	for i := range alpha.Cb {
+		alpha.Cb[i], alpha.Cr[i] = 0x80, 0x80
+	}
+	return yuv, alpha
+}
+
+// toYCbCr16 returns img as a 4:2:0 image of the given bit depth, like
+// toYCbCr420, converting colors at 16-bit precision with the matrix and
+// range of c, or as image/color does if c is nil.
+func toYCbCr16(img image.Image, depth int, c *heif.NCLX) (yuv *libde265.YCbCr16, alpha *image.YCbCr) {
+	kr, kb := 0.299, 0.114
+	full := true
+	if c != nil {
+		switch c.Matrix {
+		case heif.MatrixBT709:
+			kr, kb = 0.2126, 0.0722
+		case heif.MatrixBT2020:
+			kr, kb = 0.2627, 0.0593
+		}
+		full = c.FullRange
+	}
+	maxv := float64(int(1)<<depth - 1)
+	yScale, yOff, cScale := maxv, 0.0, maxv
+	if !full {
+		unit := float64(int(1) << (depth - 8))
+		yScale, yOff, cScale = 219*unit, 16*unit, 224*unit
+	}
+	mid := float64(int(1) << (depth - 1))
+	sample := func(v float64) uint16 {
+		return uint16(min(max(math.Round(v), 0), maxv))
+	}
+
+	b := img.Bounds()
+	w, h := (b.Dx()+1)&^1, (b.Dy()+1)&^1
+	yuv = libde265.NewYCbCr16(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio420, depth)
+	alpha = image.NewYCbCr(yuv.Rect, image.YCbCrSubsampleRatio420)
+	opaque := true
+	for y := 0; y < h; y += 2 {
+		for x := 0; x < w; x += 2 {
+			var cb, cr float64
+			for i := 0; i < 4; i++ {
+				px, py := x+i%2, y+i/2
+				sx, sy := b.Min.X+min(px, b.Dx()-1), b.Min.Y+min(py, b.Dy()-1)
+				n := color.NRGBA64Model.Convert(img.At(sx, sy)).(color.NRGBA64)
+				r, g, bl := float64(n.R)/0xffff, float64(n.G)/0xffff, float64(n.B)/0xffff
+				luma := kr*r + (1-kr-kb)*g + kb*bl
+				yuv.Y[yuv.YOffset(px, py)] = sample(luma*yScale + yOff)
+				cb += (bl - luma) / (2 * (1 - kb))
+				cr += (r - luma) / (2 * (1 - kr))
+				a := uint8(n.A >> 8)
+				alpha.Y[alpha.YOffset(px, py)] = a
+				opaque = opaque && a == 0xff
+			}
+			off := yuv.COffset(x, y)
+			yuv.Cb[off] = sample(cb/4*cScale + mid)
+			yuv.Cr[off] = sample(cr/4*cScale + mid)
+		}
+	}
+	if opaque {
+		return yuv, nil
+	}
+	for i := range alpha.Cb {
+		alpha.Cb[i], alpha.Cr[i] = 0x80, 0x80
+	}
+	return yuv, alpha
+}
+
+// narrow returns img, whose bounds are at the origin, at 8 bits.
+func narrow(img *libde265.YCbCr16) *image.YCbCr {
+	out := image.NewYCbCr(img.Rect, img.SubsampleRatio)
+	shift := img.BitDepth - 8
+	for _, p := range []struct {
+		dst []byte
+		src []uint16
+	}{{out.Y, img.Y}, {out.Cb, img.Cb}, {out.Cr, img.Cr}} {
+		for i, v := range p.src[:len(p.dst)] {
+			if shift > 0 {
+				v = min((v+1<<(shift-1))>>shift, 0xff)
+			}
+			p.dst[i] = uint8(v)
+		}
+	}
+	return out
+}
+
+// downscale returns img scaled down, keeping its aspect ratio, so that its
+// longer side is size pixels, rounded to even dimensions. Pixels are area
+// averaged.
+func downscale(img *image.YCbCr, size int) *image.YCbCr {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	tw, th := size, size
+	if w > h {
+		th = h * size / w
+	} else {
+		tw = w * size / h
+	}
+	tw, th = max(tw&^1, 2), max(th&^1, 2)
+
+	out := image.NewYCbCr(image.Rect(0, 0, tw, th), image.YCbCrSubsampleRatio420)
+	y0, c0 := img.YOffset(img.Rect.Min.X, img.Rect.Min.Y), img.COffset(img.Rect.Min.X, img.Rect.Min.Y)
+	cw, ch := (w+1)/2, (h+1)/2
+	resizePlane(out.Y, tw, th, out.YStride, img.Y[y0:], w, h, img.YStride)
+	resizePlane(out.Cb, tw/2, th/2, out.CStride, img.Cb[c0:], cw, ch, img.CStride)
+	resizePlane(out.Cr, tw/2, th/2, out.CStride, img.Cr[c0:], cw, ch, img.CStride)
+	return out
+}
+
+// resizePlane scales a plane of samples down by averaging the source
+// samples covered by each destination sample.
+func resizePlane(dst []byte, dw, dh, dstride int, src []byte, sw, sh, sstride int) {
+	for y := 0; y < dh; y++ {
+		sy0, sy1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			sx0, sx1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+			sum := 0
+			for sy := sy0; sy < sy1; sy++ {
+				for _, v := range src[sy*sstride+sx0 : sy*sstride+sx1] {
+					sum += int(v)
+				}
+			}
+			n := (sy1 - sy0) * (sx1 - sx0)
+			dst[y*dstride+x] = uint8((sum + n/2) / n)
+		}
+	}
+}
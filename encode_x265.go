@@ -0,0 +1,31 @@
+//go:build x265
+
+package goheif
+
+import "github.com/jdeng/goheif/x265"
+
+func init() {
+	NewHEVCEncoder = func(cfg HEVCEncoderConfig) (HEVCEncoder, error) {
+		opts := []x265.Option{
+			x265.WithQuality(cfg.Quality),
+			x265.WithCRF(cfg.CRF),
+			x265.WithSpeed(cfg.Speed),
+		}
+		if c := cfg.Color; c != nil {
+			opts = append(opts, x265.WithColor(int(c.Primaries), int(c.Transfer), int(c.Matrix), c.FullRange))
+		}
+		if cl := cfg.ContentLight; cl != nil {
+			opts = append(opts, x265.WithContentLight(int(cl.MaxCLL), int(cl.MaxFALL)))
+		}
+		if md := cfg.MasteringDisplay; md != nil {
+			opts = append(opts, x265.WithMasteringDisplay(md.Primaries, md.WhitePoint, md.MaxLuminance, md.MinLuminance))
+		}
+		return x265Encoder{x265.NewEncoder(opts...)}, nil
+	}
+}
+
+type x265Encoder struct {
+	*x265.Encoder
+}
+
+func (x265Encoder) Free() {}
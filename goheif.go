@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"image/jpeg"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/jdeng/goheif/heif"
 	"github.com/jdeng/goheif/libde265"
@@ -14,8 +17,149 @@ import (
 
 // SafeEncoding uses more memory but seems to make
 // the library safer to use in containers.
+//
+// Deprecated: SafeEncoding is read by every Decode call, so changing it
+// while images are decoded is a data race. Use a Decoder created with
+// WithSafeEncoding instead. SafeEncoding remains the default for Decode
+// and NewDecoder.
 var SafeEncoding bool
 
+// Decoder decodes HEIF images with a fixed set of options. It holds no
+// other state and is safe for concurrent use: each Decode call gets its
+// own HEVC decoder, from the pool if SetDecoderPoolSize enabled one.
+type Decoder struct {
+	safeEncoding bool
+	threads      int
+	metrics      func(DecodeMetrics)
+	transforms   bool
+}
+
+// Option configures a Decoder.
+type Option func(*Decoder)
+
+// WithSafeEncoding makes the decoder copy pixels out of libde265 instead
+// of aliasing its memory; see SafeEncoding.
+func WithSafeEncoding(b bool) Option {
+	return func(d *Decoder) {
+		d.safeEncoding = b
+	}
+}
+
+// NewDecoder returns a Decoder with opts applied to the defaults: AutoThreads
+// and the current value of SafeEncoding.
+func NewDecoder(opts ...Option) *Decoder {
+	d := &Decoder{safeEncoding: SafeEncoding, threads: AutoThreads}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// hevcConfig returns the configuration for decoding a width x height image
+// while concurrency images are decoded at once.
+func (d *Decoder) hevcConfig(width, height, concurrency int) HEVCConfig {
+	threads := d.threads
+	if threads == AutoThreads {
+		threads = autoThreads(width, height, concurrency)
+	}
+	return HEVCConfig{SafeEncoding: d.safeEncoding, Threads: threads}
+}
+
+// HEVCDecoder decodes HEVC coded images for Decode. The libde265 Decoder
+// implements it; other backends can be used by replacing NewHEVCDecoder.
+//
+// Push takes length-prefixed NAL units, as found in hvcC boxes and item
+// data. If the decoder also has a PushReader(io.Reader) error method, item
+// data is streamed to it instead. Items sharing parameter sets are pushed
+// and decoded one after another without a Reset in between, so each
+// DecodeImage call must return the picture pushed since the previous one.
+// Images returned by DecodeImage that implement io.Closer are closed once
+// they are no longer needed.
+type HEVCDecoder interface {
+	Reset()
+	Push(data []byte) error
+	DecodeImage(data []byte) (image.Image, error)
+	Free()
+}
+
+var _ HEVCDecoder = (*libde265.Decoder)(nil)
+
+// HEVCConfig holds the settings a Decoder passes to NewHEVCDecoder.
+type HEVCConfig struct {
+	SafeEncoding bool
+	Threads      int // worker threads; zero decodes on the calling thread
+}
+
+// NewHEVCDecoder creates the decoder used by Decode for HEVC items.
+var NewHEVCDecoder = func(cfg HEVCConfig) (HEVCDecoder, error) {
+	initCodec()
+	if p := decoderPool(cfg); p != nil {
+		dec, err := p.Get()
+		if err != nil {
+			return nil, err
+		}
+		return &pooledDecoder{Decoder: dec, pool: p}, nil
+	}
+
+	dec, err := libde265.NewDecoder(cfg.options()...)
+	if err != nil {
+		return nil, err
+	}
+	return dec, nil
+}
+
+func (cfg HEVCConfig) options() []libde265.Option {
+	return []libde265.Option{libde265.WithSafeEncoding(cfg.SafeEncoding), libde265.WithThreads(cfg.Threads)}
+}
+
+var pools struct {
+	sync.Mutex
+	size int
+	m    map[HEVCConfig]*libde265.Pool
+}
+
+// SetDecoderPoolSize makes Decode keep up to n idle decoders for reuse by
+// later calls, which saves creating a decoder context per image in
+// services decoding many images. Zero, the default, disables pooling and
+// frees the idle decoders. Decoders are pooled per configuration.
+func SetDecoderPoolSize(n int) {
+	pools.Lock()
+	defer pools.Unlock()
+
+	for _, p := range pools.m {
+		p.Close()
+	}
+	pools.m = nil
+	pools.size = n
+}
+
+func decoderPool(cfg HEVCConfig) *libde265.Pool {
+	pools.Lock()
+	defer pools.Unlock()
+	if pools.size <= 0 {
+		return nil
+	}
+	p, ok := pools.m[cfg]
+	if !ok {
+		if pools.m == nil {
+			pools.m = make(map[HEVCConfig]*libde265.Pool)
+		}
+		p = libde265.NewPool(pools.size, cfg.options()...)
+		pools.m[cfg] = p
+	}
+	return p
+}
+
+// pooledDecoder returns its decoder to the pool when freed.
+type pooledDecoder struct {
+	*libde265.Decoder
+	pool *libde265.Pool
+}
+
+func (d *pooledDecoder) Free() {
+	d.pool.Put(d.Decoder)
+}
+
 type gridBox struct {
 	columns, rows int
 	width, height int
@@ -46,8 +190,196 @@ func newGridBox(data []byte) (*gridBox, error) {
 	return &gridBox{columns: columns, rows: rows, width: width, height: height}, nil
 }
 
-func decodeHevcItem(dec *libde265.Decoder, hf *heif.File, item *heif.Item) (*image.YCbCr, error) {
-	if item.Info.ItemType != "hvc1" {
+// newGridCanvas allocates a width x height image of the same kind as tile.
+func newGridCanvas(tile image.Image, width, height int) (image.Image, error) {
+	r := image.Rect(0, 0, width, height)
+	switch t := tile.(type) {
+	case *image.YCbCr:
+		return image.NewYCbCr(r, t.SubsampleRatio), nil
+	case *libde265.YCbCr16:
+		return libde265.NewYCbCr16(r, t.SubsampleRatio, t.BitDepth), nil
+	case *image.Gray:
+		return image.NewGray(r), nil
+	case *image.Gray16:
+		return image.NewGray16(r), nil
+	}
+	return nil, fmt.Errorf("unsupported tile image %T", tile)
+}
+
+// pasteTile copies tile into out at grid cell (x, y).
+func pasteTile(out, tile image.Image, x, y, tileHeight int) error {
+	switch out := out.(type) {
+	case *image.YCbCr:
+		ycc, ok := tile.(*image.YCbCr)
+		if !ok || ycc.SubsampleRatio != out.SubsampleRatio {
+			return errors.New("inconsistent tile formats")
+		}
+
+		// copy y rows; the stride may be wider than the tile
+		w := ycc.Rect.Dx()
+		copyRows(out.Y, (y*tileHeight)*out.YStride+x*w, out.YStride, ycc.Y, ycc.YStride, w, ycc.Rect.Dy())
+
+		// height of c strides
+		cHeight := len(ycc.Cb) / ycc.CStride
+
+		// copy c rows
+		cw := chromaWidth(w, ycc.SubsampleRatio)
+		cOff := (y*cHeight)*out.CStride + x*cw
+		copyRows(out.Cb, cOff, out.CStride, ycc.Cb, ycc.CStride, cw, cHeight)
+		copyRows(out.Cr, cOff, out.CStride, ycc.Cr, ycc.CStride, cw, cHeight)
+	case *libde265.YCbCr16:
+		ycc, ok := tile.(*libde265.YCbCr16)
+		if !ok || ycc.SubsampleRatio != out.SubsampleRatio || ycc.BitDepth != out.BitDepth {
+			return errors.New("inconsistent tile formats")
+		}
+
+		w := ycc.Rect.Dx()
+		copyRows(out.Y, (y*tileHeight)*out.YStride+x*w, out.YStride, ycc.Y, ycc.YStride, w, ycc.Rect.Dy())
+
+		cHeight := len(ycc.Cb) / ycc.CStride
+		cw := chromaWidth(w, ycc.SubsampleRatio)
+		cOff := (y*cHeight)*out.CStride + x*cw
+		copyRows(out.Cb, cOff, out.CStride, ycc.Cb, ycc.CStride, cw, cHeight)
+		copyRows(out.Cr, cOff, out.CStride, ycc.Cr, ycc.CStride, cw, cHeight)
+	case *image.Gray:
+		g, ok := tile.(*image.Gray)
+		if !ok {
+			return errors.New("inconsistent tile formats")
+		}
+		w := g.Rect.Dx()
+		copyRows(out.Pix, (y*tileHeight)*out.Stride+x*w, out.Stride, g.Pix, g.Stride, w, g.Rect.Dy())
+	case *image.Gray16:
+		g, ok := tile.(*image.Gray16)
+		if !ok {
+			return errors.New("inconsistent tile formats")
+		}
+		w := 2 * g.Rect.Dx()
+		copyRows(out.Pix, (y*tileHeight)*out.Stride+x*w, out.Stride, g.Pix, g.Stride, w, g.Rect.Dy())
+	}
+	return nil
+}
+
+// chromaWidth returns the width of the chroma planes of an image w pixels
+// wide.
+func chromaWidth(w int, ratio image.YCbCrSubsampleRatio) int {
+	switch ratio {
+	case image.YCbCrSubsampleRatio422, image.YCbCrSubsampleRatio420:
+		return (w + 1) / 2
+	case image.YCbCrSubsampleRatio411, image.YCbCrSubsampleRatio410:
+		return (w + 3) / 4
+	}
+	return w
+}
+
+// chromaHeight returns the height of the chroma planes of an image h
+// pixels high.
+func chromaHeight(h int, ratio image.YCbCrSubsampleRatio) int {
+	switch ratio {
+	case image.YCbCrSubsampleRatio420, image.YCbCrSubsampleRatio440, image.YCbCrSubsampleRatio410:
+		return (h + 1) / 2
+	}
+	return h
+}
+
+// checkTileSize reports grids of tiles whose chroma samples would overlap
+// on the canvas: tiles of odd sizes in a direction the chroma planes are
+// subsampled in.
+func checkTileSize(tile image.Image, columns, rows int) error {
+	var ratio image.YCbCrSubsampleRatio
+	switch t := tile.(type) {
+	case *image.YCbCr:
+		ratio = t.SubsampleRatio
+	case *libde265.YCbCr16:
+		ratio = t.SubsampleRatio
+	default:
+		return nil
+	}
+	w, h := tile.Bounds().Dx(), tile.Bounds().Dy()
+	if chromaWidth(w, ratio)*columns != chromaWidth(w*columns, ratio) || chromaHeight(h, ratio)*rows != chromaHeight(h*rows, ratio) {
+		return fmt.Errorf("%dx%d tiles not aligned to chroma samples", w, h)
+	}
+	return nil
+}
+
+// copyRows copies rows rows of n elements from src to dst at dstOff. Tiles
+// spanning the whole width of the canvas are copied in one go.
+func copyRows[T byte | uint16](dst []T, dstOff, dstStride int, src []T, srcStride, n, rows int) {
+	if dstStride == n && srcStride == n {
+		copy(dst[dstOff:], src[:n*rows])
+		return
+	}
+	for j := 0; j < rows; j++ {
+		copy(dst[dstOff+j*dstStride:], src[j*srcStride:j*srcStride+n])
+	}
+}
+
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+// wholeBand passes a successfully decoded image to onBand, if set, as its
+// only band.
+func wholeBand(img image.Image, err error, onBand BandFunc) (image.Image, error) {
+	if err != nil || onBand == nil {
+		return img, err
+	}
+	if err := onBand(img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// cropAperture returns the part of img kept by the clean aperture r. The
+// result keeps the coordinates of img, so its bounds may not start at 0, 0.
+func cropAperture(img image.Image, r image.Rectangle) image.Image {
+	if img == nil || img.Bounds() == r {
+		return img
+	}
+	if z, ok := img.(*libde265.Image); ok {
+		// a sub-image would not keep the picture's memory alive, so the
+		// image is cropped in place
+		r = r.Intersect(z.Bounds())
+		switch m := z.Image.(type) {
+		case *image.YCbCr:
+			*m = *m.SubImage(r).(*image.YCbCr)
+		case *image.Gray:
+			*m = *m.SubImage(r).(*image.Gray)
+		}
+		return z
+	}
+	if s, ok := img.(subImager); ok {
+		return s.SubImage(r.Intersect(img.Bounds()))
+	}
+	return img
+}
+
+// cropCanvas limits out to the given size, if tiles cover it.
+func cropCanvas(out image.Image, width, height int) {
+	r := image.Rect(0, 0, width, height).Intersect(out.Bounds())
+	switch out := out.(type) {
+	case *image.YCbCr:
+		out.Rect = r
+	case *libde265.YCbCr16:
+		out.Rect = r
+	case *image.Gray:
+		out.Rect = r
+	case *image.Gray16:
+		out.Rect = r
+	}
+}
+
+// hevcStream decodes HEVC items one after another on a decoder. Items
+// sharing parameter sets, such as the tiles of a grid, are decoded back to
+// back without resetting the decoder and pushing the hvcC header again.
+type hevcStream struct {
+	dec    HEVCDecoder
+	newDec func() (HEVCDecoder, error) // makes dec on first use if nil
+	hdr    []byte                      // parameter sets pushed since the last Reset
+	m      *DecodeMetrics              // must not be nil
+}
+
+func (s *hevcStream) decode(hf *heif.File, item *heif.Item) (image.Image, error) {
+	if item.Info.ItemType != heif.ItemTypeHEVC {
 		return nil, fmt.Errorf("unsupported item type: %s", item.Info.ItemType)
 	}
 
@@ -56,25 +388,98 @@ func decodeHevcItem(dec *libde265.Decoder, hf *heif.File, item *heif.Item) (*ima
 		return nil, errors.New("no hvcC")
 	}
 
+	if s.dec == nil {
+		dec, err := s.newDec()
+		if err != nil {
+			return nil, err
+		}
+		s.dec = dec
+	}
+
 	hdr := hvcc.AsHeader()
+	if s.hdr == nil || !bytes.Equal(hdr, s.hdr) {
+		s.dec.Reset()
+		s.hdr = nil
+		if err := s.dec.Push(hdr); err != nil {
+			return nil, err
+		}
+		s.hdr = hdr
+	}
+
+	img, err := s.decodeData(hf, item)
+	if err != nil {
+		// start from a clean state next time
+		s.hdr = nil
+	}
+	return img, err
+}
+
+func (s *hevcStream) decodeData(hf *heif.File, item *heif.Item) (image.Image, error) {
+	s.m.Tiles++
+	start := time.Now()
+
+	// mapped item data is pushed in place, without a copy
+	if rp, ok := s.dec.(interface{ PushReader(io.Reader) error }); ok && !hf.Mapped() {
+		r, err := hf.ItemDataReader(item)
+		if err != nil {
+			return nil, err
+		}
+		if err := rp.PushReader(r); err != nil {
+			return nil, err
+		}
+		s.m.add(&s.m.ItemRead, start)
+
+		start = time.Now()
+		defer s.m.add(&s.m.TileDecode, start)
+		return s.dec.DecodeImage(nil)
+	}
+
 	data, err := hf.GetItemData(item)
 	if err != nil {
 		return nil, err
 	}
+	s.m.add(&s.m.ItemRead, start)
 
-	dec.Reset()
-	dec.Push(hdr)
-	tile, err := dec.DecodeImage(data)
+	start = time.Now()
+	defer s.m.add(&s.m.TileDecode, start)
+	return s.dec.DecodeImage(data)
+}
+
+func decodeJpegItem(hf *heif.File, item *heif.Item) (image.Image, error) {
+	data, err := hf.GetItemData(item)
 	if err != nil {
 		return nil, err
 	}
 
-	ycc, ok := tile.(*image.YCbCr)
-	if !ok {
-		return nil, errors.New("tile is not YCbCr")
+	if jpgc, ok := item.JpegConfig(); ok {
+		data = append(append([]byte(nil), jpgc.Prefix...), data...)
 	}
 
-	return ycc, nil
+	return jpeg.Decode(bytes.NewReader(data))
+}
+
+// unwrapImage returns the image held by a zero-copy libde265 picture.
+func unwrapImage(m image.Image) image.Image {
+	if img, ok := m.(*libde265.Image); ok {
+		return img.Image
+	}
+	return m
+}
+
+// decodeTile decodes a grid tile.
+func decodeTile(s *hevcStream, ds *itemDecoders, hf *heif.File, item *heif.Item) (image.Image, error) {
+	if item.Info == nil {
+		return nil, errors.New("no item info")
+	}
+	if img, ok, err := ds.decode(hf, item, s.m); ok {
+		return img, err
+	}
+	if item.Info.ItemType == heif.ItemTypeJPEG {
+		s.m.Tiles++
+		defer s.m.add(&s.m.TileDecode, time.Now())
+		return decodeJpegItem(hf, item)
+	}
+	return s.decode(hf, item)
 }
 
 func ExtractExif(ra io.ReaderAt) ([]byte, error) {
@@ -82,39 +487,200 @@ func ExtractExif(ra io.ReaderAt) ([]byte, error) {
 	return hf.EXIF()
 }
 
+// ErrNoICC is returned by ExtractICC when the primary image has no ICC
+// profile.
+var ErrNoICC = errors.New("goheif: no ICC profile")
+
+// ExtractICC returns the ICC profile of the primary image.
+func ExtractICC(ra io.ReaderAt) ([]byte, error) {
+	it, err := heif.Open(ra).PrimaryItem()
+	if err != nil {
+		return nil, err
+	}
+	icc, ok := it.ICCProfile()
+	if !ok {
+		return nil, ErrNoICC
+	}
+	return icc, nil
+}
+
+// ErrNoThumbnail is returned by DecodeThumbnail when the primary image has
+// no thumbnail.
+var ErrNoThumbnail = errors.New("goheif: no thumbnail")
+
+// DecodeThumbnail decodes the first thumbnail of the primary image of a
+// HEIF file, as Decode decodes the image. It is much cheaper than Decode
+// for files that have one, such as those of phones.
+func (d *Decoder) DecodeThumbnail(r io.Reader) (image.Image, error) {
+	ra, err := asReaderAt(r)
+	if err != nil {
+		return nil, err
+	}
+	img, it, err := d.decodeThumbnail(heif.Open(ra, pixelsOnly))
+	if err != nil || !d.transforms {
+		return img, err
+	}
+	return transform(img, it), nil
+}
+
+// decodeThumbnail decodes the first thumbnail of the primary image of hf,
+// without transforms, and returns it with its item.
+func (d *Decoder) decodeThumbnail(hf *heif.File) (image.Image, *heif.Item, error) {
+	it, err := hf.PrimaryItem()
+	if err != nil {
+		return nil, nil, err
+	}
+	thumbs, err := hf.Thumbnails(it)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(thumbs) == 0 {
+		return nil, nil, ErrNoThumbnail
+	}
+
+	var dec HEVCDecoder
+	defer func() {
+		if dec != nil {
+			dec.Free()
+		}
+	}()
+	img, err := decodeItem(hf, thumbs[0], func(width, height int) (HEVCDecoder, error) {
+		var err error
+		dec, err = NewHEVCDecoder(d.hevcConfig(width, height, 1))
+		return dec, err
+	}, nil, &DecodeMetrics{})
+	return img, thumbs[0], err
+}
+
+// Decode decodes the primary image of a HEIF file, using SafeEncoding.
+// It is safe to call from many goroutines, as long as SafeEncoding and
+// NewHEVCDecoder are not changed meanwhile.
 func Decode(r io.Reader) (image.Image, error) {
+	return NewDecoder().Decode(r)
+}
+
+// Decode decodes the primary image of a HEIF file. An image with a clean
+// aperture (clap) property is cropped to it, so its bounds may not start
+// at 0, 0. Rotations and mirroring are not applied unless WithTransforms
+// is set.
+func (d *Decoder) Decode(r io.Reader) (image.Image, error) {
+	return d.decode(r, nil)
+}
+
+// BandFunc receives a horizontal band of the image being decoded. The band
+// shares its pixels with the image finally returned; the rows it covers are
+// complete and no longer change. Returning an error stops the decoding.
+type BandFunc func(band image.Image) error
+
+// DecodeBands is like Decode, but calls fn with each band of rows as soon
+// as it is decoded, top to bottom, so the output can be encoded and sent
+// progressively. Grid images are delivered one row of tiles at a time;
+// other images in a single band.
+func (d *Decoder) DecodeBands(r io.Reader, fn BandFunc) (image.Image, error) {
+	return d.decode(r, fn)
+}
+
+func (d *Decoder) decode(r io.Reader, onBand BandFunc) (img image.Image, err error) {
+	m := &DecodeMetrics{}
+	if d.metrics != nil {
+		defer func() {
+			m.Err = err
+			d.metrics(*m)
+		}()
+	}
+
+	start := time.Now()
 	ra, err := asReaderAt(r)
 	if err != nil {
 		return nil, err
 	}
+	m.add(&m.ItemRead, start)
 
-	hf := heif.Open(ra)
+	var dec HEVCDecoder
+	defer func() {
+		if dec != nil {
+			dec.Free()
+		}
+	}()
+	hf := heif.Open(ra, pixelsOnly)
+	img, err = decodePrimary(hf, func(width, height int) (HEVCDecoder, error) {
+		var err error
+		dec, err = NewHEVCDecoder(d.hevcConfig(width, height, 1))
+		return dec, err
+	}, onBand, m)
+	return d.finish(hf, img, err)
+}
 
+// finish applies the transforms of the primary item of hf to img, decoded
+// with err, if the decoder is set to.
+func (d *Decoder) finish(hf *heif.File, img image.Image, err error) (image.Image, error) {
+	if err != nil || !d.transforms {
+		return img, err
+	}
 	it, err := hf.PrimaryItem()
 	if err != nil {
 		return nil, err
 	}
+	return transform(img, it), nil
+}
+
+// decodePrimary decodes the primary image of hf, calling getDecoder with
+// its size for the decoder if one is needed. The caller owns the decoder. Metrics are
+// added to m.
+func decodePrimary(hf *heif.File, getDecoder func(width, height int) (HEVCDecoder, error), onBand BandFunc, m *DecodeMetrics) (image.Image, error) {
+	start := time.Now()
+	it, err := hf.PrimaryItem()
+	m.add(&m.Parse, start)
+	if err != nil {
+		return nil, err
+	}
+	return decodeItem(hf, it, getDecoder, onBand, m)
+}
 
+// decodeItem decodes the image item it of hf, as decodePrimary.
+func decodeItem(hf *heif.File, it *heif.Item, getDecoder func(width, height int) (HEVCDecoder, error), onBand BandFunc, m *DecodeMetrics) (image.Image, error) {
 	width, height, ok := it.SpatialExtents()
 	if !ok {
 		return nil, errors.New("no dimension")
 	}
+	aperture := image.Rect(0, 0, width, height)
+	if r, ok := it.CleanAperture(); ok {
+		aperture = r
+	}
 
 	if it.Info == nil {
 		return nil, errors.New("no item info")
 	}
 
-	dec, err := libde265.NewDecoder(libde265.WithSafeEncoding(SafeEncoding))
-	if err != nil {
-		return nil, err
+	// registered codecs come before the built-in ones
+	ds := &itemDecoders{}
+	defer ds.free()
+	if img, ok, err := ds.decode(hf, it, m); ok {
+		m.holding(imageBytes(img))
+		return wholeBand(cropAperture(img, aperture), err, onBand)
 	}
-	defer dec.Free()
-	if it.Info.ItemType == "hvc1" {
-		return decodeHevcItem(dec, hf, it)
+
+	if it.Info.ItemType == heif.ItemTypeJPEG {
+		m.Tiles++
+		start := time.Now()
+		img, err := decodeJpegItem(hf, it)
+		m.add(&m.TileDecode, start)
+		m.holding(imageBytes(img))
+		return wholeBand(cropAperture(img, aperture), err, onBand)
+	}
+
+	// the HEVC decoder is made only for HEVC items
+	s := &hevcStream{newDec: func() (HEVCDecoder, error) { return getDecoder(width, height) }, m: m}
+	if it.Info.ItemType == heif.ItemTypeHEVC {
+		// a zero-copy picture stays valid while its unwrapped image is
+		// reachable, whatever happens to the decoder
+		img, err := s.decode(hf, it)
+		m.holding(imageBytes(img))
+		return wholeBand(unwrapImage(cropAperture(img, aperture)), err, onBand)
 	}
 
-	if it.Info.ItemType != "grid" {
-		return nil, errors.New("no grid")
+	if it.Info.ItemType != heif.ItemTypeGrid {
+		return nil, fmt.Errorf("unsupported item type: %s", it.Info.ItemType)
 	}
 
 	data, err := hf.GetItemData(it)
@@ -127,7 +693,7 @@ func Decode(r io.Reader) (image.Image, error) {
 		return nil, err
 	}
 
-	dimg := it.Reference("dimg")
+	dimg := it.Reference(heif.RefDerivedImage)
 	if dimg == nil {
 		return nil, errors.New("no dimg")
 	}
@@ -136,7 +702,7 @@ func Decode(r io.Reader) (image.Image, error) {
 		return nil, fmt.Errorf("tiles number not matched: %d != %d", len(dimg.ToItemIDs), grid.columns*grid.rows)
 	}
 
-	var out *image.YCbCr
+	var out image.Image
 	var tileWidth, tileHeight int
 	for i, y := 0, 0; y < grid.rows; y++ {
 		for x := 0; x < grid.columns; x++ {
@@ -146,55 +712,68 @@ func Decode(r io.Reader) (image.Image, error) {
 				return nil, err
 			}
 
-			ycc, err := decodeHevcItem(dec, hf, item)
+			pic, err := decodeTile(s, ds, hf, item)
 			if err != nil {
 				return nil, err
 			}
+			tile := unwrapImage(pic)
 
-			rect := ycc.Bounds()
+			start := time.Now()
+			rect := tile.Bounds()
 			if tileWidth == 0 {
 				tileWidth, tileHeight = rect.Dx(), rect.Dy()
+				if err := checkTileSize(tile, grid.columns, grid.rows); err != nil {
+					return nil, err
+				}
 				xwidth, xheight := tileWidth*grid.columns, tileHeight*grid.rows
-				out = image.NewYCbCr(image.Rectangle{image.Pt(0, 0), image.Pt(xwidth, xheight)}, ycc.SubsampleRatio)
+				if out, err = newGridCanvas(tile, xwidth, xheight); err != nil {
+					return nil, err
+				}
 			}
 
 			if tileWidth != rect.Dx() || tileHeight != rect.Dy() {
 				return nil, errors.New("inconsistent tile dimensions")
 			}
 
-			// copy y stride data
-			for j := 0; j < rect.Dy(); j += 1 {
-				copy(out.Y[(y*tileHeight+j)*out.YStride+x*ycc.YStride:], ycc.Y[j*ycc.YStride:(j+1)*ycc.YStride])
+			if err := pasteTile(out, tile, x, y, tileHeight); err != nil {
+				return nil, err
 			}
-
-			// height of c strides
-			cHeight := len(ycc.Cb) / ycc.CStride
-
-			// copy c stride data
-			for j := 0; j < cHeight; j += 1 {
-				copy(out.Cb[(y*cHeight+j)*out.CStride+x*ycc.CStride:], ycc.Cb[j*ycc.CStride:(j+1)*ycc.CStride])
-				copy(out.Cr[(y*cHeight+j)*out.CStride+x*ycc.CStride:], ycc.Cr[j*ycc.CStride:(j+1)*ycc.CStride])
+			m.holding(imageBytes(out) + imageBytes(tile))
+			m.add(&m.Assembly, start)
+			if c, ok := pic.(io.Closer); ok {
+				c.Close()
 			}
 
 			i++
 		}
+
+		band := image.Rect(0, y*tileHeight, width, (y+1)*tileHeight).Intersect(aperture)
+		if onBand != nil && !band.Empty() {
+			if err := onBand(out.(subImager).SubImage(band)); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	//crop to actual size when applicable
-	out.Rect = image.Rectangle{image.Pt(0, 0), image.Pt(width, height)}
-	return out, nil
+	cropCanvas(out, width, height)
+	return cropAperture(out, aperture), nil
 }
 
 func DecodeConfig(r io.Reader) (image.Config, error) {
 	var config image.Config
 
-	ra, err := asReaderAt(r)
-	if err != nil {
-		return config, err
+	// only the meta box is needed: don't buffer a stream that can't seek
+	var hf *heif.File
+	if ra, ok := r.(io.ReaderAt); ok {
+		hf = heif.Open(ra, pixelsOnly)
+	} else {
+		var err error
+		if hf, err = heif.OpenMeta(r, pixelsOnly); err != nil {
+			return config, err
+		}
 	}
 
-	hf := heif.Open(ra)
-
 	it, err := hf.PrimaryItem()
 	if err != nil {
 		return config, err
@@ -204,15 +783,54 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 	if !ok {
 		return config, errors.New("no dimension")
 	}
+	if r, ok := it.CleanAperture(); ok {
+		width, height = r.Dx(), r.Dy()
+	}
 
 	config = image.Config{
-		ColorModel: color.YCbCrModel,
+		ColorModel: colorModel(hf, it),
 		Width:      width,
 		Height:     height,
 	}
 	return config, nil
 }
 
+// colorModel returns the color model of the image Decode returns for it,
+// from its pixi property or the hvcC of the item or its first tile.
+func colorModel(hf *heif.File, it *heif.Item) color.Model {
+	channels, depth := 3, 8
+	coded := it
+	if it.Info.ItemType == heif.ItemTypeGrid {
+		if dimg := it.Reference(heif.RefDerivedImage); dimg != nil && len(dimg.ToItemIDs) > 0 {
+			if tile, err := hf.ItemByID(dimg.ToItemIDs[0]); err == nil {
+				coded = tile
+			}
+		}
+	}
+	if hvcc, ok := coded.HevcConfig(); ok {
+		if hvcc.ChromaFormat() == 0 {
+			channels = 1
+		}
+		depth, _ = hvcc.BitDepth()
+	}
+	if pixi, ok := it.PixelInformation(); ok && len(pixi.BitsPerChannel) > 0 {
+		channels, depth = len(pixi.BitsPerChannel), int(pixi.BitsPerChannel[0])
+	}
+
+	switch {
+	case channels == 1 && depth > 8:
+		return color.Gray16Model
+	case channels == 1:
+		return color.GrayModel
+	case depth > 8:
+		return new(libde265.YCbCr16).ColorModel()
+	}
+	return color.YCbCrModel
+}
+
+// pixelsOnly opens files to decode the image only, without the metadata.
+var pixelsOnly = heif.WithSkipMetadata(true)
+
 func asReaderAt(r io.Reader) (io.ReaderAt, error) {
 	if ra, ok := r.(io.ReaderAt); ok {
 		return ra, nil
@@ -226,9 +844,22 @@ func asReaderAt(r io.Reader) (io.ReaderAt, error) {
 	return bytes.NewReader(b), nil
 }
 
-func init() {
-	libde265.Init()
-	// they check for "ftyp" at the 5th bytes, let's do the same...
-	// https://github.com/strukturag/libheif/blob/master/libheif/heif.cc#L94
-	image.RegisterFormat("heic", "????ftyp", Decode, DecodeConfig)
+var codecOnce, registerOnce sync.Once
+
+// initCodec initializes libde265 on first use, so that programs only
+// reading metadata don't pay for it.
+func initCodec() {
+	codecOnce.Do(libde265.Init)
+}
+
+// RegisterFormats registers HEIC with the image package, so image.Decode
+// and image.DecodeConfig recognize it. This happens on import unless the
+// package is built with the goheif_noregister tag. Calling it more than
+// once has no effect.
+func RegisterFormats() {
+	registerOnce.Do(func() {
+		// they check for "ftyp" at the 5th bytes, let's do the same...
+		// https://github.com/strukturag/libheif/blob/master/libheif/heif.cc#L94
+		image.RegisterFormat("heic", "????ftyp", Decode, DecodeConfig)
+	})
 }
@@ -2,13 +2,29 @@ package goheif
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"image"
+	"image/color"
 	"io"
+	"math"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/jdeng/goheif/heif"
+	"github.com/jdeng/goheif/internal/heiftest"
+	"github.com/jdeng/goheif/libde265"
 )
 
 func TestFormatRegistered(t *testing.T) {
+	RegisterFormats() // no-op unless built with goheif_noregister
+
 	b, err := os.ReadFile("testdata/camel.heic")
 	if err != nil {
 		t.Fatal(err)
@@ -39,11 +55,7 @@ func BenchmarkRegularEncoding(b *testing.B) {
 func benchEncoding(b *testing.B, safe bool) {
 	b.Helper()
 
-	currentSetting := SafeEncoding
-	defer func() {
-		SafeEncoding = currentSetting
-	}()
-	SafeEncoding = safe
+	dec := NewDecoder(WithSafeEncoding(safe))
 
 	f, err := os.ReadFile("testdata/camel.heic")
 	if err != nil {
@@ -54,7 +66,1604 @@ func benchEncoding(b *testing.B, safe bool) {
 	b.ResetTimer()
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		Decode(r)
+		dec.Decode(r)
 		r.Seek(0, io.SeekStart)
 	}
 }
+
+// countingDecoder is an HEVCDecoder without PushReader that records its use.
+type countingDecoder struct {
+	HEVCDecoder
+	decodes int
+}
+
+func (d *countingDecoder) DecodeImage(data []byte) (image.Image, error) {
+	d.decodes++
+	return d.HEVCDecoder.DecodeImage(data)
+}
+
+func TestHEVCDecoderBackend(t *testing.T) {
+	var backend *countingDecoder
+	orig := NewHEVCDecoder
+	defer func() { NewHEVCDecoder = orig }()
+	NewHEVCDecoder = func(cfg HEVCConfig) (HEVCDecoder, error) {
+		dec, err := orig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		backend = &countingDecoder{HEVCDecoder: dec}
+		return backend, nil
+	}
+
+	f, err := os.Open("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img, err := Decode(f)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if backend == nil || backend.decodes != 1 {
+		t.Fatalf("custom backend not used")
+	}
+	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 1596 || h != 1064 {
+		t.Errorf("unexpected decoded image size: got %dx%d, want 1596x1064", w, h)
+	}
+}
+
+func TestDecoderPool(t *testing.T) {
+	SetDecoderPoolSize(1)
+	defer SetDecoderPoolSize(0)
+
+	d1, err := NewHEVCDecoder(HEVCConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pd, ok := d1.(*pooledDecoder)
+	if !ok {
+		t.Fatalf("NewHEVCDecoder returned %T; want a pooled decoder", d1)
+	}
+	d1.Free()
+
+	d2, err := NewHEVCDecoder(HEVCConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d2.(*pooledDecoder).Decoder != pd.Decoder {
+		t.Errorf("idle decoder not reused")
+	}
+	d2.Free()
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := Decode(bytes.NewReader(b)); err != nil {
+			t.Fatalf("Decode #%d: %v", i, err)
+		}
+	}
+}
+
+func BenchmarkPooledDecode(b *testing.B) {
+	SetDecoderPoolSize(1)
+	defer SetDecoderPoolSize(0)
+	benchEncoding(b, false)
+}
+
+func TestRangeReader(t *testing.T) {
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches int
+	fetch := RangeFetcherFunc(func(p []byte, off int64) (int, error) {
+		fetches++
+		return bytes.NewReader(b).ReadAt(p, off)
+	})
+
+	r := NewRangeReader(fetch, int64(len(b)), 4096, 4)
+	if _, err := DecodeConfig(r); err != nil {
+		t.Fatalf("DecodeConfig: %v", err)
+	}
+	if fetches > 4 {
+		t.Errorf("reading the metadata took %d fetches", fetches)
+	}
+
+	img, err := Decode(r)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 1596 || h != 1064 {
+		t.Errorf("unexpected decoded image size: got %dx%d, want 1596x1064", w, h)
+	}
+
+	sr, err := NewSeekerRangeReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(sr)
+	if err != nil || !bytes.Equal(got, b) {
+		t.Errorf("ReadAll = %d bytes, %v; want %d bytes", len(got), err, len(b))
+	}
+}
+
+// onlyReader hides all methods but Read.
+type onlyReader struct {
+	io.Reader
+	n int
+}
+
+func (r *onlyReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += n
+	return n, err
+}
+
+func TestDecodeConfigStream(t *testing.T) {
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &onlyReader{Reader: bytes.NewReader(b)}
+	config, err := DecodeConfig(r)
+	if err != nil {
+		t.Fatalf("DecodeConfig: %v", err)
+	}
+	if config.Width != 1596 || config.Height != 1064 {
+		t.Errorf("unexpected size: got %dx%d, want 1596x1064", config.Width, config.Height)
+	}
+	if r.n > len(b)/2 {
+		t.Errorf("read %d of %d bytes; want only the metadata", r.n, len(b))
+	}
+}
+
+func TestDecodeConfigColorModel(t *testing.T) {
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	off, size, err := heiftest.FindBox(b, "meta", "iprp", "ipco", "hvcC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hvcC returns a copy of the camel's hvcC with the given chroma format
+	// and bit depth.
+	hvcC := func(chroma, depth byte) []byte {
+		c := append([]byte(nil), b[off:off+size]...)
+		c[24] = 0xfc | chroma
+		c[25], c[26] = 0xf8|(depth-8), 0xf8|(depth-8)
+		return c
+	}
+	pixi := func(depths ...int) []byte { return heif.PixiProperty(depths...).Box }
+
+	tests := []struct {
+		name  string
+		props [][]byte
+		want  color.Model
+	}{
+		{"8-bit", [][]byte{hvcC(1, 8)}, color.YCbCrModel},
+		{"10-bit", [][]byte{hvcC(1, 10)}, new(libde265.YCbCr16).ColorModel()},
+		{"monochrome", [][]byte{hvcC(0, 8)}, color.GrayModel},
+		{"monochrome 10-bit", [][]byte{hvcC(0, 10)}, color.Gray16Model},
+		{"pixi", [][]byte{hvcC(1, 8), pixi(12)}, color.Gray16Model},
+	}
+	for _, tt := range tests {
+		f := &heiftest.File{Brand: "heic"}
+		f.AddItem("hvc1", nil, append(tt.props, heiftest.Ispe(64, 64))...)
+		config, err := DecodeConfig(bytes.NewReader(f.Bytes()))
+		if err != nil {
+			t.Errorf("%s: DecodeConfig: %v", tt.name, err)
+			continue
+		}
+		if config.ColorModel != tt.want {
+			t.Errorf("%s: color model %v; want %v", tt.name, config.ColorModel, tt.want)
+		}
+	}
+
+	grid := heiftest.HEVCGrid(1, 2, 128, 64, hvcC(0, 8), nil, 64, 64)
+	if config, err := DecodeConfig(bytes.NewReader(grid.Bytes())); err != nil || config.ColorModel != color.GrayModel {
+		t.Errorf("grid of monochrome tiles: color model %v, %v; want GrayModel", config.ColorModel, err)
+	}
+}
+
+func TestDecodeBatch(t *testing.T) {
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := make([]io.Reader, 4)
+	for i := range inputs {
+		inputs[i] = bytes.NewReader(b)
+	}
+	inputs[2] = bytes.NewReader(b[:100])
+
+	// a budget below one image decodes them one at a time
+	res := DecodeBatch(context.Background(), inputs, BatchOptions{Concurrency: 2, MemoryBudget: 1})
+	for i, r := range res {
+		if i == 2 {
+			if r.Err == nil {
+				t.Errorf("input %d: truncated file decoded", i)
+			}
+			continue
+		}
+		if r.Err != nil {
+			t.Fatalf("input %d: %v", i, r.Err)
+		}
+		if w, h := r.Image.Bounds().Dx(), r.Image.Bounds().Dy(); w != 1596 || h != 1064 {
+			t.Errorf("input %d: got %dx%d, want 1596x1064", i, w, h)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i, r := range DecodeBatch(ctx, inputs, BatchOptions{}) {
+		if r.Err != context.Canceled {
+			t.Errorf("input %d: err = %v; want context.Canceled", i, r.Err)
+		}
+	}
+}
+
+func TestDecoderSafeEncoding(t *testing.T) {
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// decoders with different settings can be used at the same time
+	var wg sync.WaitGroup
+	imgs := make([]image.Image, 2)
+	for i, safe := range []bool{true, false} {
+		wg.Add(1)
+		go func(i int, dec *Decoder) {
+			defer wg.Done()
+			img, err := dec.Decode(bytes.NewReader(b))
+			if err != nil {
+				t.Errorf("Decode: %v", err)
+			}
+			imgs[i] = img
+		}(i, NewDecoder(WithSafeEncoding(safe)))
+	}
+	wg.Wait()
+
+	if imgs[0] == nil || imgs[1] == nil {
+		t.FailNow()
+	}
+	if !bytes.Equal(imgs[0].(*image.YCbCr).Y, imgs[1].(*image.YCbCr).Y) {
+		t.Errorf("safe and regular decodes differ")
+	}
+}
+
+func TestNewDecoderDefaults(t *testing.T) {
+	defer func(safe bool) { SafeEncoding = safe }(SafeEncoding)
+	SafeEncoding = true
+	d := NewDecoder()
+	SafeEncoding = false
+	if !d.safeEncoding || d.threads != AutoThreads {
+		t.Errorf("NewDecoder() = safe %v, threads %d; want true, AutoThreads", d.safeEncoding, d.threads)
+	}
+	if !NewDecoder(WithSafeEncoding(true)).safeEncoding {
+		t.Errorf("WithSafeEncoding(true) not applied")
+	}
+}
+
+func BenchmarkPasteTiles(b *testing.B) {
+	for _, grid := range []struct{ cols, rows int }{{8, 6}, {1, 48}} {
+		b.Run(fmt.Sprintf("%dx%d", grid.cols, grid.rows), func(b *testing.B) {
+			const size = 512
+			tile := image.NewYCbCr(image.Rect(0, 0, size, size), image.YCbCrSubsampleRatio420)
+			out, err := newGridCanvas(tile, grid.cols*size, grid.rows*size)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.SetBytes(int64(grid.cols * grid.rows * (len(tile.Y) + len(tile.Cb) + len(tile.Cr))))
+			for i := 0; i < b.N; i++ {
+				for y := 0; y < grid.rows; y++ {
+					for x := 0; x < grid.cols; x++ {
+						pasteTile(out, tile, x, y, size)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPasteTile(t *testing.T) {
+	tiles := make([]*image.YCbCr, 2)
+	for i := range tiles {
+		tiles[i] = image.NewYCbCr(image.Rect(0, 0, 4, 4), image.YCbCrSubsampleRatio420)
+		for j := range tiles[i].Y {
+			tiles[i].Y[j] = byte(10*i + j)
+		}
+		for j := range tiles[i].Cb {
+			tiles[i].Cb[j] = byte(100 + 10*i + j)
+		}
+	}
+
+	for _, grid := range []struct{ cols, rows int }{{2, 1}, {1, 2}} {
+		out, err := newGridCanvas(tiles[0], 4*grid.cols, 4*grid.rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, tile := range tiles {
+			if err := pasteTile(out, tile, i%grid.cols, i/grid.cols, 4); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i, tile := range tiles {
+			x0, y0 := 4*(i%grid.cols), 4*(i/grid.cols)
+			for y := 0; y < 4; y++ {
+				for x := 0; x < 4; x++ {
+					if got, want := out.At(x0+x, y0+y), tile.At(x, y); got != want {
+						t.Fatalf("%dx%d grid: pixel (%d, %d) = %v; want %v", grid.cols, grid.rows, x0+x, y0+y, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+// resetCounter counts the Reset calls of an HEVCDecoder, and fails Push
+// with pushErr if set.
+type resetCounter struct {
+	HEVCDecoder
+	resets  int
+	pushErr error
+}
+
+func (d *resetCounter) Reset() {
+	d.resets++
+	d.HEVCDecoder.Reset()
+}
+
+func (d *resetCounter) Push(data []byte) error {
+	if d.pushErr != nil {
+		return d.pushErr
+	}
+	return d.HEVCDecoder.Push(data)
+}
+
+func TestHevcStreamReusesParameterSets(t *testing.T) {
+	f, err := os.Open("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	hf := heif.Open(f)
+	it, err := hf.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := NewHEVCDecoder(HEVCConfig{SafeEncoding: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+
+	rc := &resetCounter{HEVCDecoder: dec}
+	s := &hevcStream{dec: rc, m: &DecodeMetrics{}}
+	for i := 0; i < 3; i++ {
+		img, err := s.decode(hf, it)
+		if err != nil {
+			t.Fatalf("decode #%d: %v", i, err)
+		}
+		if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 1596 || h != 1064 {
+			t.Errorf("decode #%d: got %dx%d, want 1596x1064", i, w, h)
+		}
+	}
+	if rc.resets != 1 {
+		t.Errorf("decoder reset %d times; want once", rc.resets)
+	}
+
+	// parameter sets that failed to push are pushed again
+	s.hdr = nil
+	rc.pushErr = errors.New("bad hvcC")
+	if _, err := s.decode(hf, it); err != rc.pushErr {
+		t.Errorf("decode with a failed push: %v; want %v", err, rc.pushErr)
+	}
+	rc.pushErr = nil
+	if _, err := s.decode(hf, it); err != nil {
+		t.Errorf("decode after a failed push: %v", err)
+	}
+	if rc.resets != 3 {
+		t.Errorf("decoder reset %d times; want 3", rc.resets)
+	}
+}
+
+func TestDecodeMappedFile(t *testing.T) {
+	m, err := heif.MapFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	hf := heif.Open(m)
+	if !hf.Mapped() {
+		t.Fatalf("file opened on a MappedFile is not mapped")
+	}
+	it, err := hf.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := hf.GetItemData(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 || cap(data) != len(data) {
+		t.Errorf("item data: len %d, cap %d; want a capped slice of the mapping", len(data), cap(data))
+	}
+	if _, err := m.Slice(1, math.MaxInt64); err == nil {
+		t.Errorf("Slice past the end of the mapping succeeded")
+	}
+
+	img, err := Decode(m)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 1596 || h != 1064 {
+		t.Errorf("unexpected decoded image size: got %dx%d, want 1596x1064", w, h)
+	}
+}
+
+func TestDecodeConcurrent(t *testing.T) {
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := Decode(bytes.NewReader(b)); err != nil {
+				t.Errorf("Decode: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSniff(t *testing.T) {
+	ftyp := func(major string, compatible ...string) []byte {
+		b := []byte{0, 0, 0, byte(16 + 4*len(compatible)), 'f', 't', 'y', 'p'}
+		b = append(b, major...)
+		b = append(b, 0, 0, 0, 0)
+		for _, c := range compatible {
+			b = append(b, c...)
+		}
+		return append(b, "\x00\x00\x00\x08free"...)
+	}
+
+	camel, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		prefix []byte
+		want   string
+	}{
+		{"camel", camel[:32], FormatHEIC},
+		{"avif", ftyp("avif", "mif1", "miaf"), FormatAVIF},
+		{"avis", ftyp("avis", "msf1", "miaf"), FormatAVIFSequence},
+		{"heic sequence", ftyp("msf1", "hevc"), FormatHEICSequence},
+		{"generic", ftyp("mif1"), FormatHEIF},
+		// the brand after the box is not a compatible brand
+		{"box end", append(ftyp("mif1")[:16:16], "\x00\x00\x00\x08avif"...), FormatHEIF},
+		{"mp4", ftyp("isom", "mp41"), ""},
+		{"short", camel[:12], ""},
+		{"jpeg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00\x01\x01\x00\x00\x01"), ""},
+	} {
+		got, ok := Sniff(tt.prefix)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("%s: Sniff = %q, %v; want %q", tt.name, got, ok, tt.want)
+		}
+	}
+}
+
+func TestDecodeBands(t *testing.T) {
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bands []image.Rectangle
+	img, err := NewDecoder().DecodeBands(bytes.NewReader(b), func(band image.Image) error {
+		bands = append(bands, band.Bounds())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DecodeBands: %v", err)
+	}
+	if len(bands) != 1 || bands[0] != img.Bounds() {
+		t.Errorf("bands = %v; want the whole image %v", bands, img.Bounds())
+	}
+
+	stop := errors.New("stop")
+	_, err = NewDecoder().DecodeBands(bytes.NewReader(b), func(image.Image) error { return stop })
+	if err != stop {
+		t.Errorf("DecodeBands = %v; want the callback's error", err)
+	}
+}
+
+func TestDecodeMetrics(t *testing.T) {
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []DecodeMetrics
+	dec := NewDecoder(WithMetrics(func(m DecodeMetrics) { got = append(got, m) }))
+	if _, err := dec.Decode(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dec.Decode(bytes.NewReader(b[:100])); err == nil {
+		t.Fatal("truncated file decoded")
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("metrics reported %d times; want 2", len(got))
+	}
+	m := got[0]
+	if m.Err != nil || m.Tiles != 1 || m.Parse <= 0 || m.TileDecode <= 0 {
+		t.Errorf("metrics = %+v", m)
+	}
+	if want := int64(1596*1064 + 2*798*532); m.PeakMemory < want {
+		t.Errorf("PeakMemory = %d; want at least %d", m.PeakMemory, want)
+	}
+	if got[1].Err == nil {
+		t.Errorf("failed decode reported no error")
+	}
+}
+
+func TestThreads(t *testing.T) {
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got HEVCConfig
+	orig := NewHEVCDecoder
+	defer func() { NewHEVCDecoder = orig }()
+	NewHEVCDecoder = func(cfg HEVCConfig) (HEVCDecoder, error) {
+		got = cfg
+		return orig(cfg)
+	}
+
+	for _, tt := range []struct {
+		opts []Option
+		want int
+	}{
+		{nil, autoThreads(1596, 1064, 1)},
+		{[]Option{WithThreads(3)}, 3},
+		{[]Option{WithThreads(0)}, 0},
+	} {
+		if _, err := NewDecoder(tt.opts...).Decode(bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+		if got.Threads != tt.want {
+			t.Errorf("Threads = %d; want %d", got.Threads, tt.want)
+		}
+	}
+
+	if n := autoThreads(512, 512, 1); n != 0 {
+		t.Errorf("autoThreads for a small image = %d; want 0", n)
+	}
+	if n := autoThreads(8000, 6000, 1<<20); n != 0 {
+		t.Errorf("autoThreads with all procs busy = %d; want 0", n)
+	}
+}
+
+// camelGrid returns a width x height grid of rows x columns camel images.
+func camelGrid(t *testing.T, rows, columns, width, height int) *heiftest.File {
+	t.Helper()
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	off, size, err := heiftest.FindBox(b, "meta", "iprp", "ipco", "hvcC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hf := heif.Open(bytes.NewReader(b))
+	it, err := hf.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := hf.GetItemData(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return heiftest.HEVCGrid(rows, columns, width, height, b[off:off+size], data, 1596, 1064)
+}
+
+func TestDecodeGrid(t *testing.T) {
+	file := camelGrid(t, 2, 2, 3000, 2000).Bytes()
+
+	var bands []image.Rectangle
+	img, err := NewDecoder().DecodeBands(bytes.NewReader(file), func(band image.Image) error {
+		bands = append(bands, band.Bounds())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DecodeBands: %v", err)
+	}
+	if got, want := img.Bounds(), image.Rect(0, 0, 3000, 2000); got != want {
+		t.Errorf("bounds = %v; want %v", got, want)
+	}
+	want := []image.Rectangle{image.Rect(0, 0, 3000, 1064), image.Rect(0, 1064, 3000, 2000)}
+	if fmt.Sprint(bands) != fmt.Sprint(want) {
+		t.Errorf("bands = %v; want %v", bands, want)
+	}
+	// the tiles are the same image
+	if a, b := img.At(100, 100), img.At(1596+100, 1064+100); a != b {
+		t.Errorf("tile pixels differ: %v, %v", a, b)
+	}
+
+	// a tile whose extent runs past the end of the file
+	g := camelGrid(t, 2, 2, 3000, 2000)
+	g.Items[len(g.Items)-1].DeclaredLength = 1 << 20
+	if _, err := Decode(bytes.NewReader(g.Bytes())); err == nil {
+		t.Errorf("grid with a truncated tile decoded")
+	}
+
+	// a tile with no extent: coded items need data
+	g = camelGrid(t, 2, 2, 3000, 2000)
+	g.Items[len(g.Items)-1].NoExtent = true
+	if _, err := Decode(bytes.NewReader(g.Bytes())); err == nil || !strings.Contains(err.Error(), "no data") {
+		t.Errorf("grid with a tile without data: err = %v; want no data", err)
+	}
+}
+
+func TestMuxerRoundTrip(t *testing.T) {
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	off, size, err := heiftest.FindBox(b, "meta", "iprp", "ipco", "hvcC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hf := heif.Open(bytes.NewReader(b))
+	it, err := hf.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := hf.GetItemData(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := heif.NewMuxer()
+	if _, err := m.AddItem(heif.MuxItem{Type: heif.ItemTypeHEVC, Data: data, Config: b[off+8 : off+size], Width: 1596, Height: 1064}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if format, ok := Sniff(buf.Bytes()); !ok || format != FormatHEIC {
+		t.Errorf("Sniff = %q, %v; want %q", format, ok, FormatHEIC)
+	}
+
+	want, err := Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Decode muxed file: %v", err)
+	}
+	if got.Bounds() != want.Bounds() {
+		t.Fatalf("bounds = %v; want %v", got.Bounds(), want.Bounds())
+	}
+	for _, p := range []image.Point{{0, 0}, {800, 500}, {1595, 1063}} {
+		if got.At(p.X, p.Y) != want.At(p.X, p.Y) {
+			t.Errorf("pixel at %v = %v; want %v", p, got.At(p.X, p.Y), want.At(p.X, p.Y))
+		}
+	}
+}
+
+// annexBEncoder returns a fixed HEVC stream, whatever the image.
+type annexBEncoder struct {
+	stream []byte
+	got    []*image.YCbCr
+}
+
+func (e *annexBEncoder) Encode(img *image.YCbCr) ([]byte, error) {
+	e.got = append(e.got, img)
+	return e.stream, nil
+}
+
+func (e *annexBEncoder) Free() {}
+
+type annexBEncoder16 struct {
+	*annexBEncoder
+	got []*libde265.YCbCr16
+}
+
+func (e *annexBEncoder16) Encode16(img *libde265.YCbCr16) ([]byte, error) {
+	e.got = append(e.got, img)
+	return e.stream, nil
+}
+
+// tileBackend returns the same coded picture for every tile.
+type tileBackend struct {
+	data, config []byte
+	got          []image.Image
+}
+
+func (b *tileBackend) EncodeTile(img image.Image) ([]byte, []byte, error) {
+	b.got = append(b.got, img)
+	return b.data, b.config, nil
+}
+
+func TestEncode(t *testing.T) {
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hf := heif.Open(bytes.NewReader(b))
+	it, err := hf.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream bytes.Buffer
+	if err := hf.ExtractBitstream(&stream, it); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(f func(HEVCEncoderConfig) (HEVCEncoder, error)) { NewHEVCEncoder = f }(NewHEVCEncoder)
+	NewHEVCEncoder = nil
+	src := image.NewGray(image.Rect(0, 0, 1595, 1063))
+	if err := Encode(io.Discard, src, nil); err != ErrNoEncoder {
+		t.Errorf("Encode without an encoder = %v; want ErrNoEncoder", err)
+	}
+
+	// backends work without NewHEVCEncoder and see each tile
+	config, data, err := heif.HEVCItemFromAnnexB(stream.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &tileBackend{data: data, config: config}
+	var tiled bytes.Buffer
+	if err := Encode(&tiled, src, &EncodeOptions{Backend: backend, TileSize: 1024}); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.got) != 4 || backend.got[0].Bounds() != image.Rect(0, 0, 1024, 1024) {
+		t.Errorf("backend coded %d tiles; want 4 of 1024x1024", len(backend.got))
+	}
+	if c, err := DecodeConfig(bytes.NewReader(tiled.Bytes())); err != nil || c.Width != 1595 || c.Height != 1063 {
+		t.Errorf("DecodeConfig = %dx%d, %v; want 1595x1063", c.Width, c.Height, err)
+	}
+
+	enc := &annexBEncoder{stream: stream.Bytes()}
+	var cfg HEVCEncoderConfig
+	NewHEVCEncoder = func(c HEVCEncoderConfig) (HEVCEncoder, error) {
+		cfg = c
+		return enc, nil
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, src, &EncodeOptions{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Quality != 90 || cfg.CRF != 0 || cfg.Speed != 5 {
+		t.Errorf("config = %+v; want quality 90 at speed 5", cfg)
+	}
+	if err := Encode(io.Discard, src, &EncodeOptions{CRF: 60, Preset: PresetFastest}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CRF != 51 || cfg.Speed != 10 {
+		t.Errorf("config = %+v; want CRF 51 at speed 10", cfg)
+	}
+	if err := Encode(io.Discard, src, &EncodeOptions{Preset: PresetBest, Speed: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Speed != 7 {
+		t.Errorf("speed = %d; want 7", cfg.Speed)
+	}
+	enc.got = enc.got[:1]
+	// odd sizes are padded and cropped again with clap
+	if got, want := enc.got[0].Rect, image.Rect(0, 0, 1596, 1064); got != want {
+		t.Errorf("encoded %v; want %v", got, want)
+	}
+	if _, _, err := heiftest.FindBox(buf.Bytes(), "meta", "iprp", "ipco", "clap"); err != nil {
+		t.Errorf("no clap property: %v", err)
+	}
+
+	want, err := Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Decode encoded file: %v", err)
+	}
+	if got.At(800, 500) != want.At(800, 500) {
+		t.Errorf("pixels differ from the stream's")
+	}
+	if got, want := got.Bounds(), image.Rect(0, 0, 1595, 1063); got != want {
+		t.Errorf("bounds = %v; want %v", got, want)
+	}
+	if c, err := DecodeConfig(bytes.NewReader(buf.Bytes())); err != nil || c.Width != 1595 || c.Height != 1063 {
+		t.Errorf("DecodeConfig = %dx%d, %v; want 1595x1063", c.Width, c.Height, err)
+	}
+
+	enc.got = nil
+	buf.Reset()
+	if err := Encode(&buf, src, &EncodeOptions{Thumbnail: 320}); err != nil {
+		t.Fatal(err)
+	}
+	if len(enc.got) != 2 || enc.got[1].Rect != image.Rect(0, 0, 320, 212) {
+		t.Fatalf("encoded %d images; want the image and a 320x212 thumbnail", len(enc.got))
+	}
+	hf = heif.Open(bytes.NewReader(buf.Bytes()))
+	thumb, err := hf.ItemByID(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref := thumb.Reference(heif.RefThumbnail); ref == nil || fmt.Sprint(ref.ToItemIDs) != "[1]" {
+		t.Errorf("thumbnail reference = %v; want to item 1", ref)
+	}
+	if w, h, _ := thumb.SpatialExtents(); w != 320 || h != 212 {
+		t.Errorf("thumbnail size = %dx%d; want 320x212", w, h)
+	}
+	if it, err := hf.PrimaryItem(); err != nil || it.ID != 1 {
+		t.Errorf("primary item = %v, %v; want item 1", it, err)
+	}
+
+	buf.Reset()
+	exif := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x00")
+	opts := &EncodeOptions{Thumbnail: 320, Exif: exif, XMP: []byte("<x:xmpmeta/>"), ICC: []byte("icc profile")}
+	if err := Encode(&buf, src, opts); err != nil {
+		t.Fatal(err)
+	}
+	hf = heif.Open(bytes.NewReader(buf.Bytes()))
+	if got, err := hf.EXIF(); err != nil || string(got) != "Exif\x00\x00"+string(exif) {
+		t.Errorf("EXIF = %q, %v", got, err)
+	}
+	xmp, err := hf.ItemByID(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref := xmp.Reference(heif.RefDescribes); xmp.Info.ContentType != "application/rdf+xml" || ref == nil || fmt.Sprint(ref.ToItemIDs) != "[1]" {
+		t.Errorf("XMP item = %+v, reference %v", xmp.Info, ref)
+	}
+	// the image and its thumbnail share the profile
+	off, size, err := heiftest.FindBox(buf.Bytes(), "meta", "iprp", "ipco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(buf.Bytes()[off:off+size], []byte("colrproficc profile")); n != 1 {
+		t.Errorf("%d ICC profiles written; want 1", n)
+	}
+	if icc, err := ExtractICC(bytes.NewReader(buf.Bytes())); err != nil || string(icc) != "icc profile" {
+		t.Errorf("ExtractICC = %q, %v", icc, err)
+	}
+
+	// the alpha channel goes to a hidden auxiliary image
+	enc.got = nil
+	buf.Reset()
+	translucent := image.NewNRGBA(src.Rect)
+	translucent.Pix[3] = 0xff
+	if err := Encode(&buf, translucent, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(enc.got) != 2 || enc.got[1].Y[0] != 0xff || enc.got[1].Y[1] != 0 {
+		t.Fatalf("encoded %d images; want the image and its alpha plane", len(enc.got))
+	}
+	hf = heif.Open(bytes.NewReader(buf.Bytes()))
+	aux, err := hf.ItemByID(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref := aux.Reference(heif.RefAuxiliary); aux.Info.Flags&1 == 0 || ref == nil || fmt.Sprint(ref.ToItemIDs) != "[1]" {
+		t.Errorf("alpha item flags %d, reference %v; want hidden, auxl to item 1", aux.Info.Flags, ref)
+	}
+	if _, _, err := heiftest.FindBox(buf.Bytes(), "meta", "iprp", "ipco", "auxC"); err != nil {
+		t.Errorf("no auxC property: %v", err)
+	}
+	if got, err := Decode(bytes.NewReader(buf.Bytes())); err != nil || got.Bounds() != image.Rect(0, 0, 1595, 1063) {
+		t.Errorf("Decode = %v, %v", got.Bounds(), err)
+	}
+
+	// depth maps too, with their representation SEI in the hvcC
+	enc.got = nil
+	buf.Reset()
+	info := heif.DepthInfo{Type: 2, ZNear: 0.5, ZFar: 4}
+	if err := Encode(&buf, src, &EncodeOptions{Depth: image.NewGray(image.Rect(0, 0, 319, 211)), DepthInfo: &info}); err != nil {
+		t.Fatal(err)
+	}
+	if len(enc.got) != 2 || enc.got[1].Rect != image.Rect(0, 0, 320, 212) {
+		t.Fatalf("encoded %d images; want the image and a 320x212 depth map", len(enc.got))
+	}
+	hf = heif.Open(bytes.NewReader(buf.Bytes()))
+	depth, err := hf.ItemByID(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref := depth.Reference(heif.RefAuxiliary); depth.Info.Flags&1 == 0 || ref == nil || fmt.Sprint(ref.ToItemIDs) != "[1]" {
+		t.Errorf("depth item flags %d, reference %v; want hidden, auxl to item 1", depth.Info.Flags, ref)
+	}
+	if r, ok := depth.CleanAperture(); !ok || r != image.Rect(0, 0, 319, 211) {
+		t.Errorf("depth aperture = %v, %v; want 319x211", r, ok)
+	}
+	off, size, err = heiftest.FindBox(buf.Bytes(), "meta", "iprp", "ipco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipco := buf.Bytes()[off : off+size]
+	if !bytes.Contains(ipco, []byte(heif.AuxTypeDepth)) {
+		t.Errorf("no depth auxC property")
+	}
+	if !bytes.Contains(ipco, heif.DepthRepresentationSEI(info)) {
+		t.Errorf("no depth representation SEI")
+	}
+
+	// collections describe all their images and may be alternatives
+	enc.got = nil
+	buf.Reset()
+	err = EncodeAll(&buf, []image.Image{src, translucent, src}, &EncodeOptions{Exif: exif, Depth: src, Alternatives: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enc.got) != 5 {
+		t.Errorf("encoded %d images; want 3, an alpha plane and a depth map", len(enc.got))
+	}
+	hf = heif.Open(bytes.NewReader(buf.Bytes()))
+	if it, err := hf.PrimaryItem(); err != nil || it.ID != 1 {
+		t.Errorf("primary item = %v, %v; want item 1", it, err)
+	}
+	meta, err := hf.ItemByID(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref := meta.Reference(heif.RefDescribes); meta.Info.ItemType != heif.ItemTypeExif || ref == nil || fmt.Sprint(ref.ToItemIDs) != "[1 3 5]" {
+		t.Errorf("Exif item %q describes %v; want [1 3 5]", meta.Info.ItemType, ref)
+	}
+	off, size, err = heiftest.FindBox(buf.Bytes(), "meta", "grpl", "altr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// group 7 of items 1, 3 and 5
+	if got, want := buf.Bytes()[off+12:off+size], []byte{0, 0, 0, 7, 0, 0, 0, 3, 0, 0, 0, 1, 0, 0, 0, 3, 0, 0, 0, 5}; !bytes.Equal(got, want) {
+		t.Errorf("altr group = % x; want % x", got, want)
+	}
+	if err := EncodeAll(io.Discard, nil, nil); err == nil {
+		t.Errorf("EncodeAll without images succeeded")
+	}
+
+	// 10-bit HDR
+	white := image.NewNRGBA64(image.Rect(0, 0, 64, 32))
+	for i := range white.Pix {
+		white.Pix[i] = 0xff
+	}
+	hdr := &EncodeOptions{
+		BitDepth:     10,
+		Thumbnail:    16,
+		Color:        &heif.NCLX{Primaries: heif.PrimariesBT2020, Transfer: heif.TransferPQ, Matrix: heif.MatrixBT2020},
+		ContentLight: &heif.ContentLight{MaxCLL: 1000, MaxFALL: 400},
+		MasteringDisplay: &heif.MasteringDisplay{
+			Primaries:    [3][2]uint16{{8500, 39850}, {6550, 2300}, {35400, 14600}},
+			WhitePoint:   [2]uint16{15635, 16450},
+			MaxLuminance: 10000000,
+			MinLuminance: 50,
+		},
+	}
+	if err := Encode(io.Discard, white, hdr); err == nil {
+		t.Errorf("10-bit image encoded by an 8-bit encoder")
+	}
+	enc16 := &annexBEncoder16{annexBEncoder: enc}
+	NewHEVCEncoder = func(c HEVCEncoderConfig) (HEVCEncoder, error) {
+		cfg = c
+		return enc16, nil
+	}
+	enc.got = nil
+	buf.Reset()
+	if err := Encode(&buf, white, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BitDepth != 10 || cfg.Color != hdr.Color || cfg.ContentLight != hdr.ContentLight {
+		t.Errorf("config = %+v", cfg)
+	}
+	// limited range white, and an 8-bit thumbnail
+	if len(enc16.got) != 1 || enc16.got[0].Y[0] != 940 || enc16.got[0].Cb[0] != 512 || enc16.got[0].Cr[0] != 512 {
+		t.Errorf("10-bit images = %v", enc16.got)
+	} else if len(enc.got) != 1 || enc.got[0].Y[0] != 235 || enc.got[0].Rect.Dx() != 16 {
+		t.Errorf("thumbnails = %v", enc.got)
+	}
+	off, size, err = heiftest.FindBox(buf.Bytes(), "meta", "iprp", "ipco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipco = buf.Bytes()[off : off+size]
+	for _, box := range [][]byte{
+		[]byte("colrnclx\x00\x09\x00\x10\x00\x09\x00"),
+		[]byte("clli\x03\xe8\x01\x90"),
+		[]byte("mdcv\x21\x34"),
+	} {
+		if !bytes.Contains(ipco, box) {
+			t.Errorf("no %q property", box[:4])
+		}
+	}
+	if err := Encode(io.Discard, white, &EncodeOptions{BitDepth: 9}); err == nil {
+		t.Errorf("9-bit image encoded")
+	}
+
+	// files for Apple devices: a grid of 512 pixel tiles and a thumbnail
+	NewHEVCEncoder = func(c HEVCEncoderConfig) (HEVCEncoder, error) { return enc, nil }
+	enc.got = nil
+	buf.Reset()
+	if err := Encode(&buf, src, &EncodeOptions{Profile: ProfileApple}); err != nil {
+		t.Fatal(err)
+	}
+	if len(enc.got) != 4*3+1 || enc.got[0].Rect != image.Rect(0, 0, 512, 512) {
+		t.Fatalf("encoded %d images; want 12 tiles and a thumbnail", len(enc.got))
+	}
+	file := buf.Bytes()
+	if got, want := string(file[16:36]), "mif1MiHEmiafMiHBheic"; got != want {
+		t.Errorf("compatible brands = %q; want %q", got, want)
+	}
+	var order []string
+	off, size, err = heiftest.FindBox(file, "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for b := file[off+12 : off+size]; len(b) >= 8; b = b[binary.BigEndian.Uint32(b):] {
+		order = append(order, string(b[4:8]))
+	}
+	if got, want := strings.Join(order, " "), "hdlr dinf pitm iloc iinf iref iprp"; got != want {
+		t.Errorf("meta boxes = %q; want %q", got, want)
+	}
+	hf = heif.Open(bytes.NewReader(file))
+	grid, err := hf.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h, _ := grid.SpatialExtents(); grid.Info.ItemType != heif.ItemTypeGrid || w != 1595 || h != 1063 {
+		t.Errorf("primary item = %q of %dx%d; want a 1595x1063 grid", grid.Info.ItemType, w, h)
+	}
+	if ref := grid.Reference(heif.RefDerivedImage); ref == nil || len(ref.ToItemIDs) != 12 {
+		t.Errorf("grid tiles = %v; want 12", ref)
+	}
+	if c, err := DecodeConfig(bytes.NewReader(file)); err != nil || c.Width != 1595 || c.Height != 1063 {
+		t.Errorf("DecodeConfig = %dx%d, %v; want 1595x1063", c.Width, c.Height, err)
+	}
+	if n := bytes.Count(file, []byte("pixi")); n != 1 {
+		t.Errorf("%d pixi properties written; want 1", n)
+	}
+
+	// streamed, the meta box follows the data
+	var streamBuf bytes.Buffer
+	if err := Encode(&streamBuf, src, &EncodeOptions{Profile: ProfileApple, Streaming: true}); err != nil {
+		t.Fatal(err)
+	}
+	streamed := streamBuf.Bytes()
+	metaOff, _, err := heiftest.FindBox(streamed, "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mdat, _, err := heiftest.FindBox(streamed, "mdat"); err != nil || mdat > metaOff {
+		t.Errorf("mdat at %d, %v; want before meta at %d", mdat, err, metaOff)
+	}
+	got, err = Decode(bytes.NewReader(streamed))
+	if err != nil {
+		t.Fatalf("Decode streamed file: %v", err)
+	}
+	want, err = Decode(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bounds() != want.Bounds() || got.At(800, 500) != want.At(800, 500) {
+		t.Errorf("streamed file decodes differently")
+	}
+}
+
+type av1Encoder struct {
+	got []*image.YCbCr
+}
+
+func (e *av1Encoder) Encode(frames []*image.YCbCr) ([]byte, []AV1Frame, error) {
+	e.got = frames
+	var units []AV1Frame
+	for i := range frames {
+		units = append(units, AV1Frame{Data: []byte{0x32, 0x01, byte(i)}, Key: i == 0})
+	}
+	return []byte{0x81, 0, 0, 0}, units, nil
+}
+
+func (e *av1Encoder) Free() {}
+
+func TestEncodeAnimation(t *testing.T) {
+	defer func(f func(AV1EncoderConfig) (AV1Encoder, error)) { NewAV1Encoder = f }(NewAV1Encoder)
+	a := &Animation{
+		Frames:    []image.Image{image.NewGray(image.Rect(0, 0, 63, 32)), image.NewGray(image.Rect(0, 0, 63, 32))},
+		Durations: []time.Duration{100 * time.Millisecond, 40 * time.Millisecond},
+	}
+	NewAV1Encoder = nil
+	if err := EncodeAnimation(io.Discard, a, nil); err != ErrNoAV1Encoder {
+		t.Errorf("EncodeAnimation without an encoder = %v; want ErrNoAV1Encoder", err)
+	}
+
+	enc := &av1Encoder{}
+	NewAV1Encoder = func(AV1EncoderConfig) (AV1Encoder, error) { return enc, nil }
+	var buf bytes.Buffer
+	if err := EncodeAnimation(&buf, a, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(enc.got) != 2 || enc.got[0].Rect != image.Rect(0, 0, 64, 32) {
+		t.Fatalf("encoded %d frames; want 2 of 64x32", len(enc.got))
+	}
+	if brand := string(buf.Bytes()[8:12]); brand != "avis" {
+		t.Errorf("brand = %q; want avis", brand)
+	}
+	hf := heif.Open(bytes.NewReader(buf.Bytes()))
+	it, err := hf.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := hf.GetItemData(it); err != nil || !bytes.Equal(data, []byte{0x32, 0x01, 0}) {
+		t.Errorf("primary item data = % x, %v; want the first frame", data, err)
+	}
+	if r, ok := it.CleanAperture(); !ok || r != image.Rect(0, 0, 63, 32) {
+		t.Errorf("aperture = %v, %v; want 63x32", r, ok)
+	}
+	off, size, err := heiftest.FindBox(buf.Bytes(), "moov", "trak", "mdia", "minf", "stbl", "stts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.Bytes()[off+12:off+size], []byte{0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 100, 0, 0, 0, 1, 0, 0, 0, 40}; !bytes.Equal(got, want) {
+		t.Errorf("stts = % x; want % x", got, want)
+	}
+
+	if err := EncodeAnimation(io.Discard, a, &EncodeOptions{BitDepth: 10}); err == nil {
+		t.Errorf("10-bit frames encoded by an 8-bit encoder")
+	}
+
+	a.Frames[1] = image.NewGray(image.Rect(0, 0, 8, 8))
+	if err := EncodeAnimation(io.Discard, a, nil); err == nil {
+		t.Errorf("frames of different sizes encoded")
+	}
+}
+
+func TestDecodeThumbnail(t *testing.T) {
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := NewDecoder().DecodeThumbnail(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := img.Bounds(), image.Rect(0, 0, 320, 240); got != want {
+		t.Errorf("bounds = %v; want %v", got, want)
+	}
+	if _, err := ExtractICC(bytes.NewReader(b)); err != ErrNoICC {
+		t.Errorf("ExtractICC = %v; want ErrNoICC", err)
+	}
+
+	// a file without thumbnails, rotated
+	var buf bytes.Buffer
+	if err := heif.RewriteTransform(bytes.NewReader(camelGrid(t, 1, 1, 1596, 1064).Bytes()), &buf, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDecoder().DecodeThumbnail(bytes.NewReader(buf.Bytes())); err != ErrNoThumbnail {
+		t.Errorf("DecodeThumbnail = %v; want ErrNoThumbnail", err)
+	}
+	want, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = NewDecoder(WithTransforms(true)).Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := img.Bounds(), image.Rect(0, 0, 1064, 1596); got != want {
+		t.Errorf("rotated bounds = %v; want %v", got, want)
+	}
+	// a quarter turn counter-clockwise brings the top right corner to the top left
+	if got, want := img.At(10, 20), want.At(1595-20, 10); got != want {
+		t.Errorf("rotated pixel = %v; want %v", got, want)
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDecoder().Thumbnail(bytes.NewReader(b), 0); err == nil {
+		t.Errorf("thumbnail of size 0 decoded")
+	}
+	for _, tt := range []struct {
+		size int
+		want image.Rectangle
+	}{{1000, image.Rect(0, 0, 320, 240)}, {160, image.Rect(0, 0, 160, 120)}} {
+		img, err := NewDecoder().Thumbnail(bytes.NewReader(b), tt.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.Bounds(); got != tt.want {
+			t.Errorf("size %d: bounds = %v; want %v", tt.size, got, tt.want)
+		}
+	}
+
+	// without an embedded thumbnail, rotated
+	var buf bytes.Buffer
+	if err := heif.RewriteTransform(bytes.NewReader(camelGrid(t, 1, 1, 1596, 1064).Bytes()), &buf, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	img, err := NewDecoder(WithTransforms(true)).Thumbnail(bytes.NewReader(buf.Bytes()), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := img.Bounds(), image.Rect(0, 0, 132, 200); got != want {
+		t.Errorf("scaled bounds = %v; want %v", got, want)
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, 4, 2))
+	copy(gray.Pix, []byte{0, 100, 200, 200, 100, 0, 200, 200})
+	if got, want := Shrink(gray, 2).At(0, 0), (color.RGBA64{0x3232, 0x3232, 0x3232, 0xffff}); got != want {
+		t.Errorf("shrunk pixel = %v; want %v", got, want)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	src := image.NewRGBA(image.Rect(10, 10, 13, 12)) // 3x2, not at the origin
+	for i := range src.Pix {
+		src.Pix[i] = byte(i / 4)
+	}
+	at := func(img image.Image, x, y int) byte {
+		r, _, _, _ := img.At(x, y).RGBA()
+		return byte(r >> 8)
+	}
+	// 0 1 2
+	// 3 4 5
+	for _, tt := range []struct {
+		img  image.Image
+		want [][]byte
+	}{
+		{rotate(src, 1), [][]byte{{2, 5}, {1, 4}, {0, 3}}},
+		{rotate(src, 2), [][]byte{{5, 4, 3}, {2, 1, 0}}},
+		{rotate(src, 3), [][]byte{{3, 0}, {4, 1}, {5, 2}}},
+		{mirror(src, 0), [][]byte{{2, 1, 0}, {5, 4, 3}}},
+		{mirror(src, 1), [][]byte{{3, 4, 5}, {0, 1, 2}}},
+	} {
+		var got [][]byte
+		for y := 0; y < tt.img.Bounds().Dy(); y++ {
+			var row []byte
+			for x := 0; x < tt.img.Bounds().Dx(); x++ {
+				row = append(row, at(tt.img, x, y))
+			}
+			got = append(got, row)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("got %v; want %v", got, tt.want)
+		}
+	}
+
+	yuv := image.NewYCbCr(image.Rect(0, 0, 4, 2), image.YCbCrSubsampleRatio422)
+	if r := rotate(yuv, 1).(*image.YCbCr); r.Rect != image.Rect(0, 0, 2, 4) || r.SubsampleRatio != image.YCbCrSubsampleRatio440 {
+		t.Errorf("rotated 4:2:2 image = %v %v; want 2x4 4:4:0", r.Rect, r.SubsampleRatio)
+	}
+}
+
+func TestTile(t *testing.T) {
+	img := image.NewYCbCr(image.Rect(0, 0, 6, 4), image.YCbCrSubsampleRatio420)
+	for i := range img.Y {
+		img.Y[i] = uint8(i)
+	}
+	for i := range img.Cb {
+		img.Cb[i] = uint8(100 + i)
+	}
+	tl := tile(img, image.Rect(4, 2, 8, 6)).(*image.YCbCr)
+	// the last column and row are repeated
+	if got, want := tl.Y, []byte{16, 17, 17, 17, 22, 23, 23, 23, 22, 23, 23, 23, 22, 23, 23, 23}; !bytes.Equal(got, want) {
+		t.Errorf("Y = %v; want %v", got, want)
+	}
+	if got, want := tl.Cb, []byte{105, 105, 105, 105}; !bytes.Equal(got, want) {
+		t.Errorf("Cb = %v; want %v", got, want)
+	}
+}
+
+func TestDownscale(t *testing.T) {
+	img := image.NewYCbCr(image.Rect(0, 0, 8, 4), image.YCbCrSubsampleRatio420)
+	for x := 0; x < 8; x++ {
+		for y := 0; y < 4; y++ {
+			img.Y[img.YOffset(x, y)] = uint8(x * 10)
+		}
+	}
+	out := downscale(img, 4)
+	if got, want := out.Rect, image.Rect(0, 0, 4, 2); got != want {
+		t.Fatalf("bounds = %v; want %v", got, want)
+	}
+	for x, want := range []uint8{5, 25, 45, 65} {
+		if got := out.Y[out.YOffset(x, 1)]; got != want {
+			t.Errorf("Y at %d = %d; want %d", x, got, want)
+		}
+	}
+}
+
+func TestToYCbCr420(t *testing.T) {
+	src := image.NewRGBA(image.Rect(10, 10, 13, 13))
+	src.Set(12, 12, color.RGBA{255, 255, 255, 255})
+	img, alpha := toYCbCr420(src)
+	if got, want := img.Rect, image.Rect(0, 0, 4, 4); got != want {
+		t.Fatalf("bounds = %v; want %v", got, want)
+	}
+	// the white corner is repeated into the padding
+	for _, p := range []image.Point{{2, 2}, {3, 2}, {2, 3}, {3, 3}} {
+		if y := img.YCbCrAt(p.X, p.Y).Y; y != 255 {
+			t.Errorf("Y at %v = %d; want 255", p, y)
+		}
+	}
+	if y := img.YCbCrAt(0, 0).Y; y != 0 {
+		t.Errorf("Y at 0, 0 = %d; want 0", y)
+	}
+	// only the white corner is opaque
+	if alpha == nil {
+		t.Fatalf("no alpha plane")
+	}
+	if a, b := alpha.YCbCrAt(3, 3), alpha.YCbCrAt(0, 0); a != (color.YCbCr{255, 128, 128}) || b.Y != 0 {
+		t.Errorf("alpha = %v, %v; want 255 in the corner, 0 elsewhere", a, b)
+	}
+
+	// colors are not premultiplied
+	translucent := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	for i := 0; i < 4; i++ {
+		translucent.Set(i%2, i/2, color.NRGBA{255, 0, 0, 128})
+	}
+	img, alpha = toYCbCr420(translucent)
+	if wantY, _, _ := color.RGBToYCbCr(255, 0, 0); img.Y[0] != wantY || alpha.Y[0] != 128 {
+		t.Errorf("Y, alpha = %d, %d; want %d, 128", img.Y[0], alpha.Y[0], wantY)
+	}
+
+	if _, alpha := toYCbCr420(image.NewGray(image.Rect(0, 0, 3, 3))); alpha != nil {
+		t.Errorf("alpha plane for an opaque image")
+	}
+	even := image.NewYCbCr(image.Rect(0, 0, 4, 2), image.YCbCrSubsampleRatio420)
+	if img, alpha := toYCbCr420(even); img != even || alpha != nil {
+		t.Errorf("4:2:0 image converted")
+	}
+}
+
+func TestRewriteCrop(t *testing.T) {
+	src := camelGrid(t, 2, 2, 3000, 2000).Bytes()
+	var dst bytes.Buffer
+	if err := heif.RewriteCrop(bytes.NewReader(src), &dst, image.Rect(101, 700, 2500, 1500)); err != nil {
+		t.Fatal(err)
+	}
+
+	var bands []image.Rectangle
+	img, err := NewDecoder().DecodeBands(bytes.NewReader(dst.Bytes()), func(band image.Image) error {
+		bands = append(bands, band.Bounds())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := img.Bounds(), image.Rect(100, 700, 2500, 1500); got != want {
+		t.Errorf("bounds = %v; want %v", got, want)
+	}
+	want := []image.Rectangle{image.Rect(100, 700, 2500, 1064), image.Rect(100, 1064, 2500, 1500)}
+	if fmt.Sprint(bands) != fmt.Sprint(want) {
+		t.Errorf("bands = %v; want %v", bands, want)
+	}
+	full, err := Decode(bytes.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []image.Point{{100, 700}, {2000, 1200}, {2499, 1499}} {
+		if img.At(p.X, p.Y) != full.At(p.X, p.Y) {
+			t.Errorf("pixel at %v differs from the uncropped image", p)
+		}
+	}
+}
+
+func TestExtractBitstream(t *testing.T) {
+	f, err := os.Open("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	hf := heif.Open(f)
+	it, err := hf.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream bytes.Buffer
+	if err := hf.ExtractBitstream(&stream, it); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stream decodes on its own
+	dec, err := libde265.NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+	if err := dec.PushAnnexB(stream.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := dec.DecodeImage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bounds() != want.Bounds() || got.At(800, 500) != want.At(800, 500) {
+		t.Errorf("extracted stream decodes to %v, unlike the file", got.Bounds())
+	}
+}
+
+// grayCodec decodes items to gray images of their size, filled with the
+// first byte of their data.
+type grayCodec struct {
+	freed *int
+}
+
+func (c grayCodec) DecodeItem(hf *heif.File, it *heif.Item) (image.Image, error) {
+	data, err := hf.GetItemData(it)
+	if err != nil {
+		return nil, err
+	}
+	w, h, _ := it.SpatialExtents()
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = data[0]
+	}
+	return img, nil
+}
+
+func (c grayCodec) Free() { *c.freed++ }
+
+func TestRegisterCodec(t *testing.T) {
+	var made, freed int
+	RegisterCodec(heif.ItemTypeAV1, func() (ItemDecoder, error) {
+		made++
+		return grayCodec{&freed}, nil
+	})
+	defer RegisterCodec(heif.ItemTypeAV1, nil)
+	if got, want := Codecs(), []string{"av01", "hvc1", "jpeg"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Codecs() = %q; want %q", got, want)
+	}
+
+	m := heif.NewMuxer()
+	var tiles []uint32
+	for _, v := range []byte{10, 200} {
+		id, err := m.AddItem(heif.MuxItem{Type: heif.ItemTypeAV1, Data: []byte{v}, Config: []byte{0x81, 0, 0, 0}, Width: 16, Height: 8, Hidden: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tiles = append(tiles, id)
+	}
+	grid, err := m.AddDerivedItem(heif.GridItem(1, 2, 30, 8), tiles...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetPrimary(grid); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := img.Bounds(), image.Rect(0, 0, 30, 8); got != want {
+		t.Errorf("bounds = %v; want %v", got, want)
+	}
+	if got := img.At(0, 0); got != (color.Gray{10}) {
+		t.Errorf("left tile pixel = %v; want 10", got)
+	}
+	if got := img.At(29, 7); got != (color.Gray{200}) {
+		t.Errorf("right tile pixel = %v; want 200", got)
+	}
+	if made != 1 || freed != 1 {
+		t.Errorf("%d decoders made and %d freed; want 1 and 1", made, freed)
+	}
+
+	// without the codec, AV1 items are not decoded
+	RegisterCodec(heif.ItemTypeAV1, nil)
+	if _, err := Decode(bytes.NewReader(buf.Bytes())); err == nil || !strings.Contains(err.Error(), "av01") {
+		t.Errorf("Decode without codec: err = %v; want unsupported av01", err)
+	}
+}
+
+// stubCodec stands in for the HEVC and other decoders while fuzzing. It
+// makes a blank image whose size and format come from the first bytes of
+// the item data.
+type stubCodec struct {
+	pushed []byte // by PushReader
+}
+
+func (*stubCodec) Reset()                 {}
+func (*stubCodec) Push(data []byte) error { return nil }
+func (*stubCodec) Free()                  {}
+
+func (c *stubCodec) PushReader(r io.Reader) error {
+	var err error
+	c.pushed, err = io.ReadAll(r)
+	return err
+}
+
+func (c *stubCodec) DecodeImage(data []byte) (image.Image, error) {
+	if data == nil {
+		data, c.pushed = c.pushed, nil
+	}
+	return stubImage(data)
+}
+
+func (*stubCodec) DecodeItem(hf *heif.File, it *heif.Item) (image.Image, error) {
+	data, err := hf.GetItemData(it)
+	if err != nil {
+		return nil, err
+	}
+	return stubImage(data)
+}
+
+func stubImage(data []byte) (image.Image, error) {
+	if len(data) < 3 {
+		return nil, errors.New("stub: short item data")
+	}
+	r := image.Rect(0, 0, 1+int(data[0]%64), 1+int(data[1]%64))
+	switch data[2] % 3 {
+	case 0:
+		return image.NewYCbCr(r, image.YCbCrSubsampleRatio420), nil
+	case 1:
+		return libde265.NewYCbCr16(r, image.YCbCrSubsampleRatio420, 10), nil
+	}
+	return image.NewGray(r), nil
+}
+
+func FuzzDecode(f *testing.F) {
+	hvcC := heiftest.Property("hvcC", make([]byte, 23))
+	single := &heiftest.File{Brand: "heic"}
+	single.AddItem(heif.ItemTypeHEVC, []byte{16, 8, 0}, hvcC, heiftest.Ispe(16, 8), heiftest.Irot(90))
+	f.Add(single.Bytes())
+	f.Add(heiftest.HEVCGrid(2, 2, 30, 14, hvcC, []byte{16, 8, 1}, 16, 8).Bytes())
+	cropped := heiftest.HEVCGrid(1, 2, 32, 8, hvcC, []byte{16, 8, 2}, 16, 8)
+	cropped.Items[0].Props = append(cropped.Items[0].Props, heif.ClapProperty(image.Rect(2, 2, 20, 6), 32, 8).Box)
+	f.Add(cropped.Bytes())
+	jpegs := &heiftest.File{Brand: "mif1"}
+	jpegs.AddItem(heif.ItemTypeJPEG, []byte{8, 8, 0}, heiftest.Ispe(8, 8))
+	f.Add(jpegs.Bytes())
+
+	// only the container and the assembly of images are fuzzed
+	orig := NewHEVCDecoder
+	defer func() { NewHEVCDecoder = orig }()
+	NewHEVCDecoder = func(cfg HEVCConfig) (HEVCDecoder, error) { return &stubCodec{}, nil }
+	for _, typ := range []string{heif.ItemTypeJPEG, heif.ItemTypeAV1} {
+		RegisterCodec(typ, func() (ItemDecoder, error) { return &stubCodec{}, nil })
+		defer RegisterCodec(typ, nil)
+	}
+
+	dec := NewDecoder(WithTransforms(true))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		DecodeConfig(bytes.NewReader(data))
+		img, err := dec.Decode(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		// the pixels of the whole bounds are there
+		if r := img.Bounds(); !r.Empty() {
+			img.At(r.Min.X, r.Min.Y)
+			img.At(r.Max.X-1, r.Max.Y-1)
+		}
+	})
+}
@@ -1,14 +1,32 @@
 package main
 
 import (
+	"encoding/binary"
 	"flag"
 	"fmt"
+	"image"
 	"image/jpeg"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/jdeng/goheif"
+	"github.com/jdeng/goheif/heif"
+)
+
+var (
+	quality  = flag.Int("q", jpeg.DefaultQuality, "JPEG quality, from 1 to 100")
+	rotate   = flag.Bool("rotate", true, "apply the rotation and mirroring of the image")
+	keepExif = flag.Bool("exif", true, "copy the EXIF metadata; -exif=false strips it")
+	keepICC  = flag.Bool("icc", true, "copy the ICC color profile")
+	thumb    = flag.Bool("thumb", false, "convert the embedded thumbnail instead of the image")
+	outDir   = flag.String("o", "", "write the JPG files to this directory instead of next to the inputs")
+	jobs     = flag.Int("j", runtime.NumCPU(), "number of files converted at once")
 )
 
 // Skip Writer for exif writing
@@ -36,7 +54,10 @@ func (w *writerSkipper) Write(data []byte) (int, error) {
 	}
 }
 
-func newWriterExif(w io.Writer, exif []byte) (io.Writer, error) {
+// newWriterExif writes the start of a JPG file with the EXIF metadata and
+// the ICC profile, if any, and returns a writer for the output of
+// jpeg.Encode, whose start of image marker it skips.
+func newWriterExif(w io.Writer, exif, icc []byte) (io.Writer, error) {
 	writer := &writerSkipper{w, 2}
 	soi := []byte{0xff, 0xd8}
 	if _, err := w.Write(soi); err != nil {
@@ -56,44 +77,203 @@ func newWriterExif(w io.Writer, exif []byte) (io.Writer, error) {
 		}
 	}
 
+	// profiles are split into chunks numbered from 1
+	const iccChunk = 0xffff - 2 - 14
+	count := (len(icc) + iccChunk - 1) / iccChunk
+	for i := 0; i < count; i++ {
+		chunk := icc[i*iccChunk : min((i+1)*iccChunk, len(icc))]
+		marker := []byte{0xff, 0xe2, 0, 0}
+		binary.BigEndian.PutUint16(marker[2:], uint16(2+14+len(chunk)))
+		marker = append(marker, "ICC_PROFILE\x00"...)
+		marker = append(marker, byte(i+1), byte(count))
+		if _, err := w.Write(append(marker, chunk...)); err != nil {
+			return nil, err
+		}
+	}
+
 	return writer, nil
 }
 
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: heic2jpg [flags] <in-file> <out-file>\n")
+	fmt.Fprintf(os.Stderr, "       heic2jpg [flags] <in-file or pattern>...\n")
+	flag.PrintDefaults()
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
-	if flag.NArg() != 2 {
-		fmt.Fprintf(os.Stderr, "usage: heic2jpg <in-file> <out-file> \n")
+	if flag.NArg() == 0 || *quality < 1 || *quality > 100 {
+		usage()
+		os.Exit(1)
+	}
+
+	// heic2jpg in.heic out.jpg, or a batch of files written as name.jpg
+	if flag.NArg() == 2 && *outDir == "" && isJPEGName(flag.Arg(1)) && !hasMeta(flag.Arg(0)) {
+		fin, fout := flag.Arg(0), flag.Arg(1)
+		if err := convert(fin, fout); err != nil {
+			log.Fatalf("Failed to convert %s: %v\n", fin, err)
+		}
+		log.Printf("Convert %s to %s successfully\n", fin, fout)
+		return
+	}
+
+	var inputs []string
+	for _, arg := range flag.Args() {
+		// patterns are expanded for shells that don't
+		if !hasMeta(arg) {
+			inputs = append(inputs, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			log.Fatalf("Bad pattern %s: %v\n", arg, err)
+		}
+		if len(matches) == 0 {
+			log.Printf("Warning: no files match %s\n", arg)
+		}
+		inputs = append(inputs, matches...)
+	}
+	if *outDir != "" {
+		if err := os.MkdirAll(*outDir, 0755); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var failed atomic.Bool
+	next := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < max(*jobs, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fin := range next {
+				fout := outputName(fin)
+				if err := convert(fin, fout); err != nil {
+					log.Printf("Failed to convert %s: %v\n", fin, err)
+					failed.Store(true)
+					continue
+				}
+				log.Printf("Convert %s to %s successfully\n", fin, fout)
+			}
+		}()
+	}
+	for _, fin := range inputs {
+		next <- fin
+	}
+	close(next)
+	wg.Wait()
+	if failed.Load() {
 		os.Exit(1)
 	}
+}
 
-	fin, fout := flag.Arg(0), flag.Arg(1)
+// convert converts the HEIF file fin to the JPG file fout.
+func convert(fin, fout string) error {
 	fi, err := os.Open(fin)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer fi.Close()
 
-	exif, err := goheif.ExtractExif(fi)
+	dec := goheif.NewDecoder(goheif.WithSafeEncoding(goheif.SafeEncoding), goheif.WithTransforms(*rotate))
+	var img image.Image
+	if *thumb {
+		img, err = dec.DecodeThumbnail(fi)
+	} else {
+		img, err = dec.Decode(fi)
+	}
 	if err != nil {
-		log.Printf("Warning: no EXIF from %s: %v\n", fin, err)
+		return err
 	}
 
-	img, err := goheif.Decode(fi)
-	if err != nil {
-		log.Fatalf("Failed to parse %s: %v\n", fin, err)
+	var exif, icc []byte
+	if *keepExif {
+		exif, err = goheif.ExtractExif(fi)
+		switch {
+		case err == heif.ErrNoEXIF:
+		case err != nil:
+			log.Printf("Warning: no EXIF from %s: %v\n", fin, err)
+		case len(exif) > 0xffff-2:
+			log.Printf("Warning: EXIF of %s too large for JPG, dropped\n", fin)
+			exif = nil
+		case *rotate:
+			// the pixels are upright now
+			exif = resetOrientation(exif)
+		}
+	}
+	if *keepICC {
+		icc, err = goheif.ExtractICC(fi)
+		if err != nil && err != goheif.ErrNoICC {
+			log.Printf("Warning: no ICC profile from %s: %v\n", fin, err)
+		}
 	}
 
-	fo, err := os.OpenFile(fout, os.O_RDWR|os.O_CREATE, 0644)
+	fo, err := os.Create(fout)
 	if err != nil {
-		log.Fatalf("Failed to create output file %s: %v\n", fout, err)
+		return err
+	}
+	w, err := newWriterExif(fo, exif, icc)
+	if err == nil {
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: *quality})
+	}
+	if cerr := fo.Close(); err == nil {
+		err = cerr
 	}
-	defer fo.Close()
+	return err
+}
 
-	w, _ := newWriterExif(fo, exif)
-	err = jpeg.Encode(w, img, nil)
-	if err != nil {
-		log.Fatalf("Failed to encode %s: %v\n", fout, err)
+// outputName returns the name of the JPG file converted from fin.
+func outputName(fin string) string {
+	name := strings.TrimSuffix(fin, filepath.Ext(fin)) + ".jpg"
+	if *outDir != "" {
+		name = filepath.Join(*outDir, filepath.Base(name))
 	}
+	return name
+}
 
-	log.Printf("Convert %s to %s successfully\n", fin, fout)
+func isJPEGName(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".jpg" || ext == ".jpeg"
+}
+
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[`)
+}
+
+// resetOrientation returns a copy of exif, an Exif block with its "Exif"
+// header, with the orientation tag set to 1 (upright), if it has one.
+func resetOrientation(exif []byte) []byte {
+	exif = append([]byte(nil), exif...)
+	tiff := exif
+	if i := 6; len(tiff) >= i && string(tiff[:4]) == "Exif" {
+		tiff = tiff[i:]
+	}
+	if len(tiff) < 8 {
+		return exif
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return exif
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 0 || ifd+2 > len(tiff) {
+		return exif
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		e := ifd + 2 + 12*i
+		if e+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[e:]) == 0x0112 && order.Uint16(tiff[e+2:]) == 3 { // SHORT
+			order.PutUint16(tiff[e+8:], 1)
+		}
+	}
+	return exif
 }
@@ -36,20 +36,65 @@ import (
 	"strings"
 )
 
-func NewReader(r io.Reader) *Reader {
-	br, ok := r.(*bufio.Reader)
+func NewReader(r io.Reader, opts ...Option) *Reader {
+	var rs io.ReadSeeker
+	br, ok := r.(peekReader)
 	if !ok {
+		rs, _ = r.(io.ReadSeeker)
 		br = bufio.NewReader(r)
 	}
-	return &Reader{br: bufReader{Reader: br}}
+	rd := &Reader{br: bufReader{peekReader: br}, rs: rs}
+	for _, opt := range opts {
+		opt(rd)
+	}
+	rd.br.mode = rd.mode
+	rd.br.skipMeta = rd.skipMeta
+	return rd
 }
 
 type Reader struct {
 	br          bufReader
+	rs          io.ReadSeeker // if non-nil, the seekable source of br, a *bufio.Reader
+	mode        Mode
+	skipMeta    bool // see WithSkipMetadata
 	lastBox     Box  // or nil
 	noMoreBoxes bool // a box with size 0 (the final box) was seen
 }
 
+// Mode selects how spec violations are handled while reading and
+// parsing boxes.
+type Mode int
+
+const (
+	// ModeLenient skips or recovers from violations where it is safe
+	// to do so. It is the default and suits decoding consumer files.
+	ModeLenient Mode = iota
+
+	// ModeStrict reports any detected violation as an error. It suits
+	// validators and tools that must not silently accept bad files.
+	ModeStrict
+)
+
+// Option configures a Reader.
+type Option func(*Reader)
+
+// WithMode sets the parsing mode of the Reader and of every box read
+// through it, including nested boxes.
+func WithMode(m Mode) Option {
+	return func(r *Reader) {
+		r.mode = m
+	}
+}
+
+// WithSkipMetadata makes the parsers skip what only describes metadata
+// items: the names and content types of Exif, mime and uri item info
+// entries, and "cdsc" item references. Item IDs and types are kept.
+func WithSkipMetadata(skip bool) Option {
+	return func(r *Reader) {
+		r.skipMeta = skip
+	}
+}
+
 type BoxType [4]byte
 
 // Common box types.
@@ -57,15 +102,95 @@ var (
 	TypeFtyp = BoxType{'f', 't', 'y', 'p'}
 	TypeMeta = BoxType{'m', 'e', 't', 'a'}
 	TypeMdat = BoxType{'m', 'd', 'a', 't'}
+	TypeFree = BoxType{'f', 'r', 'e', 'e'}
+	TypeSkip = BoxType{'s', 'k', 'i', 'p'}
 )
 
-func (t BoxType) String() string { return string(t[:]) }
+// BoxTypeFromString returns the BoxType for the four character code s.
+func BoxTypeFromString(s string) (BoxType, error) {
+	if len(s) != 4 {
+		return BoxType{}, fmt.Errorf("bmff: invalid box type %q: must be 4 bytes", s)
+	}
+	return BoxType{s[0], s[1], s[2], s[3]}, nil
+}
+
+func (t BoxType) String() string { return fourCC(t[:]) }
+
+// fourCC returns b as a string, without allocating for the codes common in
+// HEIF files. Files have one item type per item, often hundreds.
+func fourCC(b []byte) string {
+	switch string(b) { // does not allocate
+	case "hvc1":
+		return "hvc1"
+	case "hvt1":
+		return "hvt1"
+	case "grid":
+		return "grid"
+	case "iden":
+		return "iden"
+	case "iovl":
+		return "iovl"
+	case "Exif":
+		return "Exif"
+	case "mime":
+		return "mime"
+	case "jpeg":
+		return "jpeg"
+	case "av01":
+		return "av01"
+	case "vvc1":
+		return "vvc1"
+	case "pict":
+		return "pict"
+	case "mif1":
+		return "mif1"
+	case "msf1":
+		return "msf1"
+	case "heic":
+		return "heic"
+	case "heix":
+		return "heix"
+	case "avif":
+		return "avif"
+	case "miaf":
+		return "miaf"
+	}
+	return string(b)
+}
 
 func (t BoxType) EqualString(s string) bool {
 	// Could be cleaner, but see ohttps://github.com/golang/go/issues/24765
 	return len(s) == 4 && s[0] == t[0] && s[1] == t[1] && s[2] == t[2] && s[3] == t[3]
 }
 
+// Is reports whether t is the box type named by s, such as "ftyp".
+func (t BoxType) Is(s string) bool { return t.EqualString(s) }
+
+// IsAny reports whether t is one of the box types named by types.
+func (t BoxType) IsAny(types ...string) bool {
+	for _, s := range types {
+		if t.EqualString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t BoxType) MarshalText() ([]byte, error) {
+	return append([]byte(nil), t[:]...), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (t *BoxType) UnmarshalText(text []byte) error {
+	v, err := BoxTypeFromString(string(text))
+	if err != nil {
+		return err
+	}
+	*t = v
+	return nil
+}
+
 type parseFunc func(b box, br *bufio.Reader) (Box, error)
 
 // Box represents a BMFF box.
@@ -73,6 +198,10 @@ type Box interface {
 	Size() int64 // 0 means unknown (will read to end of file)
 	Type() BoxType
 
+	// LargeSize reports whether the box header used the 64-bit
+	// largesize encoding (size == 1), regardless of the actual size.
+	LargeSize() bool
+
 	// Parses parses the box, populating the fields
 	// in the returned concrete type.
 	//
@@ -115,24 +244,33 @@ var parsers = map[BoxType]parserFunc{
 	boxType("iprp"): parseItemPropertiesBox,
 	boxType("irot"): parseImageRotation,
 	boxType("imir"): parseImageMirror,
+	boxType("clap"): parseCleanAperture,
 	boxType("ispe"): parseImageSpatialExtentsProperty,
+	boxType("pixi"): parsePixelInformationProperty,
 	boxType("meta"): parseMetaBox,
 	boxType("pitm"): parsePrimaryItemBox,
 	boxType("idat"): parseItemDataBox,
 	boxType("iref"): parseItemReferenceBox,
 	boxType("hvcC"): parseItemHevcConfigBox,
+	boxType("vvcC"): parseItemVvcConfigBox,
+	boxType("jpgC"): parseItemJpegConfigBox,
 }
 
 type box struct {
-	size    int64 // 0 means unknown, will read to end of file (box container)
-	boxType BoxType
-	body    io.Reader
-	parsed  Box    // if non-nil, the Parsed result
-	slurp   []byte // if non-nil, the contents slurped to memory
+	size      int64 // 0 means unknown, will read to end of file (box container)
+	boxType   BoxType
+	largeSize bool // size was encoded as a 64-bit largesize
+	mode      Mode
+	skipMeta  bool
+	body      io.Reader
+	lr        io.LimitedReader // body of sized boxes
+	parsed    Box              // if non-nil, the Parsed result
+	slurp     []byte           // if non-nil, the contents slurped to memory
 }
 
-func (b *box) Size() int64   { return b.size }
-func (b *box) Type() BoxType { return b.boxType }
+func (b *box) Size() int64     { return b.size }
+func (b *box) Type() BoxType   { return b.boxType }
+func (b *box) LargeSize() bool { return b.largeSize }
 
 func (b *box) Body() io.Reader {
 	if b.slurp != nil {
@@ -149,7 +287,7 @@ func (b *box) Parse() (Box, error) {
 	if !ok {
 		return nil, ErrUnknownBox
 	}
-	v, err := parser(b, &bufReader{Reader: bufio.NewReader(b.Body())})
+	v, err := parser(b, b.bodyReader())
 	if err != nil {
 		return nil, err
 	}
@@ -157,6 +295,15 @@ func (b *box) Parse() (Box, error) {
 	return v, nil
 }
 
+// bodyReader returns a new bufReader over the box body that inherits
+// the box's parsing mode.
+func (b *box) bodyReader() *bufReader {
+	if b.slurp != nil {
+		return &bufReader{peekReader: &sliceReader{b: b.slurp}, mode: b.mode, skipMeta: b.skipMeta}
+	}
+	return &bufReader{peekReader: bufio.NewReader(b.Body()), mode: b.mode, skipMeta: b.skipMeta}
+}
+
 type FullBox struct {
 	*box
 	Version uint8
@@ -174,35 +321,34 @@ func (r *Reader) ReadBox() (Box, error) {
 		return nil, io.EOF
 	}
 	if r.lastBox != nil {
-		if _, err := io.Copy(ioutil.Discard, r.lastBox.Body()); err != nil {
+		if err := r.skipLastBox(); err != nil {
 			return nil, err
 		}
 	}
-	var buf [8]byte
-
-	_, err := io.ReadFull(r.br, buf[:4])
+	buf, err := r.peekHeader(8)
 	if err != nil {
 		return nil, err
 	}
 	box := &box{
-		size: int64(binary.BigEndian.Uint32(buf[:4])),
-	}
-
-	_, err = io.ReadFull(r.br, box.boxType[:]) // 4 more bytes
-	if err != nil {
-		return nil, err
+		size:     int64(binary.BigEndian.Uint32(buf[:4])),
+		mode:     r.mode,
+		skipMeta: r.skipMeta,
 	}
+	copy(box.boxType[:], buf[4:8])
+	r.br.Discard(8)
 
 	// Special cases for size:
 	var remain int64
 	switch box.size {
 	case 1:
 		// 1 means it's actually a 64-bit size, after the type.
-		_, err = io.ReadFull(r.br, buf[:8])
+		buf, err = r.peekHeader(8)
 		if err != nil {
 			return nil, err
 		}
 		box.size = int64(binary.BigEndian.Uint64(buf[:8]))
+		r.br.Discard(8)
+		box.largeSize = true
 		if box.size < 0 {
 			// Go uses int64 for sizes typically, but BMFF uses uint64.
 			// We assume for now that nobody actually uses boxes larger
@@ -220,7 +366,8 @@ func (r *Reader) ReadBox() (Box, error) {
 		return nil, fmt.Errorf("Box header for %q has size %d, suggesting %d (negative) bytes remain", box.boxType, box.size, remain)
 	}
 	if box.size > 0 {
-		box.body = io.LimitReader(r.br, remain)
+		box.lr = io.LimitedReader{R: r.br, N: remain}
+		box.body = &box.lr
 	} else {
 		box.body = r.br
 	}
@@ -228,6 +375,42 @@ func (r *Reader) ReadBox() (Box, error) {
 	return box, nil
 }
 
+// peekHeader returns the next n bytes of a box header without consuming
+// them. Unlike Peek, it reports a partial header as io.ErrUnexpectedEOF.
+func (r *Reader) peekHeader(n int) ([]byte, error) {
+	buf, err := r.br.Peek(n)
+	if err == io.EOF && len(buf) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf, err
+}
+
+// skipLastBox consumes whatever is left of the previously read box.
+// If the source is seekable and more than the buffered data remains
+// (typically a large mdat), it seeks past the body instead of copying it.
+func (r *Reader) skipLastBox() error {
+	body := r.lastBox.(*box).body
+	lr, ok := body.(*io.LimitedReader)
+	if sr, isSlice := r.br.peekReader.(*sliceReader); ok && isSlice {
+		sr.take(lr.N)
+		lr.N = 0
+		return nil
+	}
+	if !ok || r.rs == nil || lr.N <= int64(r.br.Buffered()) {
+		_, err := io.Copy(ioutil.Discard, body)
+		return err
+	}
+
+	n := lr.N - int64(r.br.Buffered())
+	r.br.Discard(r.br.Buffered())
+	if _, err := r.rs.Seek(n, io.SeekCurrent); err != nil {
+		return err
+	}
+	r.br.peekReader.(*bufio.Reader).Reset(r.rs)
+	lr.N = 0
+	return nil
+}
+
 // ReadAndParseBox wraps the ReadBox method, ensuring that the read box is of type typ
 // and parses successfully. It returns the parsed box.
 func (r *Reader) ReadAndParseBox(typ BoxType) (Box, error) {
@@ -273,19 +456,22 @@ func parseFileTypeBox(outer *box, br *bufReader) (Box, error) {
 	}
 	ft := &FileTypeBox{
 		box:          outer,
-		MajorBrand:   string(buf[:4]),
+		MajorBrand:   fourCC(buf[:4]),
 		MinorVersion: string(buf[4:8]),
 	}
 	br.Discard(8)
 	for {
 		buf, err := br.Peek(4)
 		if err == io.EOF {
+			if len(buf) > 0 && br.strict() {
+				return nil, fmt.Errorf("ftyp: %d trailing bytes after compatible brands", len(buf))
+			}
 			return ft, nil
 		}
 		if err != nil {
 			return nil, err
 		}
-		ft.Compatible = append(ft.Compatible, string(buf[:4]))
+		ft.Compatible = append(ft.Compatible, fourCC(buf[:4]))
 		br.Discard(4)
 	}
 }
@@ -308,7 +494,19 @@ func (br *bufReader) parseAppendBoxes(dst *[]Box) error {
 	if br.err != nil {
 		return br.err
 	}
-	boxr := NewReader(br.Reader)
+	// Read the rest of the body into memory once, unless it already is,
+	// and let the children refer to their part of it.
+	sr, ok := br.peekReader.(*sliceReader)
+	if !ok {
+		rest, err := ioutil.ReadAll(br.peekReader)
+		if err != nil {
+			br.err = err
+			return err
+		}
+		sr = &sliceReader{b: rest}
+	}
+
+	boxr := NewReader(sr, WithMode(br.mode), WithSkipMetadata(br.skipMeta))
 	for {
 		inner, err := boxr.ReadBox()
 		if err == io.EOF {
@@ -318,12 +516,17 @@ func (br *bufReader) parseAppendBoxes(dst *[]Box) error {
 			br.err = err
 			return err
 		}
-		slurp, err := ioutil.ReadAll(inner.Body())
-		if err != nil {
-			br.err = err
-			return err
+		b := inner.(*box)
+		if lr, ok := b.body.(*io.LimitedReader); ok {
+			b.slurp = sr.take(lr.N)
+			lr.N -= int64(len(b.slurp))
+			if lr.N > 0 && br.strict() {
+				br.err = fmt.Errorf("box %q truncated by %d bytes", inner.Type(), lr.N)
+				return br.err
+			}
+		} else {
+			b.slurp = sr.take(int64(sr.Buffered()))
 		}
-		inner.(*box).slurp = slurp
 		*dst = append(*dst, inner)
 	}
 }
@@ -367,7 +570,14 @@ func parseItemInfoEntry(outer *box, br *bufReader) (Box, error) {
 	if err != nil {
 		return nil, err
 	}
-	ie.ItemType = string(buf[:4])
+	ie.ItemType = fourCC(buf[:4])
+	br.Discard(4)
+	if br.skipMeta {
+		switch ie.ItemType {
+		case "Exif", "mime", "uri ":
+			return ie, nil
+		}
+	}
 	ie.Name, _ = br.readString()
 
 	switch ie.ItemType {
@@ -412,12 +622,18 @@ func parseItemInfoBox(outer *box, br *bufReader) (Box, error) {
 		for _, box := range itemInfos {
 			pb, err := box.Parse()
 			if err != nil {
+				if !br.strict() {
+					continue // e.g. an unsupported infe version
+				}
 				return nil, fmt.Errorf("error parsing ItemInfoEntry in ItemInfoBox: %v", err)
 			}
 			if iie, ok := pb.(*ItemInfoEntry); ok {
 				ib.ItemInfos = append(ib.ItemInfos, iie)
 			}
 		}
+		if br.strict() && uint32(len(itemInfos)) != ib.Count {
+			return nil, fmt.Errorf("iinf: declared %d entries, found %d", ib.Count, len(itemInfos))
+		}
 	}
 	if !br.ok() {
 		return FullBox{}, br.err
@@ -450,7 +666,10 @@ func parseItemReferenceBox(outer *box, br *bufReader) (Box, error) {
 
 	if br.ok() {
 		for _, b := range itemRefs {
-			pb, err := parseItemReferenceEntry(b.(*box), &bufReader{Reader: bufio.NewReader(b.Body())}, ib.Version)
+			if br.skipMeta && b.Type().Is("cdsc") {
+				continue
+			}
+			pb, err := parseItemReferenceEntry(b.(*box), b.(*box).bodyReader(), ib.Version)
 			if err != nil {
 				return nil, fmt.Errorf("error parsing ItemReferenceEntry in ItemReferenceBox: %v", err)
 			}
@@ -488,15 +707,96 @@ func parseItemReferenceEntry(outer *box, br *bufReader, version uint8) (Box, err
 	return ie, nil
 }
 
-// bufReader adds some HEIF/BMFF-specific methods around a *bufio.Reader.
+// peekReader is the part of *bufio.Reader used for parsing. It is also
+// implemented by *sliceReader, for data that is already in memory.
+type peekReader interface {
+	io.Reader
+	io.ByteReader
+	Peek(n int) ([]byte, error)
+	Discard(n int) (int, error)
+	ReadString(delim byte) (string, error)
+	Buffered() int
+}
+
+// sliceReader is a peekReader over a byte slice that, unlike a
+// *bufio.Reader, does not copy the data.
+type sliceReader struct {
+	b   []byte
+	off int
+}
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if r.off >= len(r.b) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b[r.off:])
+	r.off += n
+	return n, nil
+}
+
+func (r *sliceReader) ReadByte() (byte, error) {
+	if r.off >= len(r.b) {
+		return 0, io.EOF
+	}
+	r.off++
+	return r.b[r.off-1], nil
+}
+
+func (r *sliceReader) Peek(n int) ([]byte, error) {
+	if rem := len(r.b) - r.off; n > rem {
+		return r.b[r.off:], io.EOF
+	}
+	return r.b[r.off : r.off+n], nil
+}
+
+func (r *sliceReader) Discard(n int) (int, error) {
+	if rem := len(r.b) - r.off; n > rem {
+		r.off = len(r.b)
+		return rem, io.EOF
+	}
+	r.off += n
+	return n, nil
+}
+
+func (r *sliceReader) ReadString(delim byte) (string, error) {
+	rest := r.b[r.off:]
+	if i := bytes.IndexByte(rest, delim); i >= 0 {
+		r.off += i + 1
+		return string(rest[:i+1]), nil
+	}
+	r.off = len(r.b)
+	return string(rest), io.EOF
+}
+
+func (r *sliceReader) Buffered() int {
+	return len(r.b) - r.off
+}
+
+// take returns the next n bytes, or as many as remain, without copying.
+func (r *sliceReader) take(n int64) []byte {
+	if rem := int64(len(r.b) - r.off); n > rem {
+		n = rem
+	}
+	b := r.b[r.off : r.off+int(n) : r.off+int(n)]
+	r.off += int(n)
+	return b
+}
+
+// bufReader adds some HEIF/BMFF-specific methods around a *bufio.Reader
+// or a *sliceReader.
 type bufReader struct {
-	*bufio.Reader
-	err error // sticky error
+	peekReader
+	err      error // sticky error
+	mode     Mode
+	skipMeta bool
 }
 
 // ok reports whether all previous reads have been error-free.
 func (br *bufReader) ok() bool { return br.err == nil }
 
+// strict reports whether spec violations should be reported as errors.
+func (br *bufReader) strict() bool { return br.mode == ModeStrict }
+
 func (br *bufReader) anyRemain() bool {
 	if br.err != nil {
 		return false
@@ -620,8 +920,8 @@ func parseItemPropertiesBox(outer *box, br *bufReader) (Box, error) {
 	if err != nil {
 		return nil, err
 	}
-	if len(boxes) < 2 {
-		return nil, fmt.Errorf("expect at least 2 boxes in children; got 0")
+	if len(boxes) == 0 || (len(boxes) < 2 && br.strict()) {
+		return nil, fmt.Errorf("expect at least 2 boxes in children; got %d", len(boxes))
 	}
 
 	cb, err := boxes[0].Parse()
@@ -646,11 +946,78 @@ func parseItemPropertiesBox(outer *box, br *bufReader) (Box, error) {
 		if !ok {
 			return nil, fmt.Errorf("unexpected box %q instead of ItemPropertyAssociation", boxp.Type())
 		}
+		if br.strict() {
+			if err := ipa.checkIndexes(len(ip.PropertyContainer.Properties)); err != nil {
+				return nil, err
+			}
+		}
 		ip.Associations = append(ip.Associations, ipa)
 	}
 	return ip, nil
 }
 
+// AssociatedProperty is a property associated with an item,
+// as resolved by ItemPropertiesBox.PropertiesFor. (not a box)
+type AssociatedProperty struct {
+	Box       Box    // the parsed property, or the raw box if it has no parser
+	Essential bool   // the item can't be processed without understanding it
+	Index     uint16 // 1-based index into the property container
+}
+
+// PropertiesFor returns the properties associated with itemID, in the order
+// they are listed in the association box.
+//
+// Index 0 (no property) is skipped. Out of range indexes, properties that
+// fail to parse and items listed in more than one association box are
+// errors in strict mode; in lenient mode out of range indexes are skipped,
+// unparsable properties are returned raw and the first association wins.
+func (ip *ItemPropertiesBox) PropertiesFor(itemID uint32) ([]AssociatedProperty, error) {
+	strict := ip.box.mode == ModeStrict
+	allProps := ip.PropertyContainer.Properties
+
+	var props []AssociatedProperty
+	found := false
+	for _, ipa := range ip.Associations {
+		for _, ipai := range ipa.Entries {
+			if ipai.ItemID != itemID {
+				continue
+			}
+			if found {
+				if strict {
+					return nil, fmt.Errorf("ipma: item %d associated more than once", itemID)
+				}
+				continue
+			}
+			found = true
+
+			for _, ass := range ipai.Associations {
+				if ass.Index == 0 {
+					continue
+				}
+				if int(ass.Index) > len(allProps) {
+					if strict {
+						return nil, fmt.Errorf("ipma: item %d refers to property %d of %d", itemID, ass.Index, len(allProps))
+					}
+					continue
+				}
+				box := allProps[ass.Index-1]
+				boxp, err := box.Parse()
+				if err == nil {
+					box = boxp
+				} else if err != ErrUnknownBox && strict {
+					return nil, fmt.Errorf("property %q of item %d: %v", box.Type(), itemID, err)
+				}
+				props = append(props, AssociatedProperty{
+					Box:       box,
+					Essential: ass.Essential,
+					Index:     ass.Index,
+				})
+			}
+		}
+	}
+	return props, nil
+}
+
 type ItemPropertyAssociation struct {
 	FullBox
 	EntryCount uint32
@@ -670,6 +1037,19 @@ type ItemPropertyAssociationItem struct {
 	Associations      []ItemProperty // as parsed
 }
 
+// checkIndexes reports an error if any association refers to a property
+// outside of a container holding n properties.
+func (ipa *ItemPropertyAssociation) checkIndexes(n int) error {
+	for _, e := range ipa.Entries {
+		for _, ass := range e.Associations {
+			if int(ass.Index) > n {
+				return fmt.Errorf("ipma: item %d refers to property %d of %d", e.ItemID, ass.Index, n)
+			}
+		}
+	}
+	return nil
+}
+
 func parseItemPropertyAssociation(outer *box, br *bufReader) (Box, error) {
 	fb, err := readFullBox(outer, br)
 	if err != nil {
@@ -743,6 +1123,31 @@ func parseImageSpatialExtentsProperty(outer *box, br *bufReader) (Box, error) {
 	}, nil
 }
 
+// PixelInformationProperty is a HEIF "pixi" property giving the bit depth
+// of each channel of an image.
+type PixelInformationProperty struct {
+	FullBox
+	BitsPerChannel []uint8
+}
+
+func parsePixelInformationProperty(outer *box, br *bufReader) (Box, error) {
+	fb, err := readFullBox(outer, br)
+	if err != nil {
+		return nil, err
+	}
+	n, err := br.readUint8()
+	if err != nil {
+		return nil, err
+	}
+	bits := make([]uint8, n)
+	for i := range bits {
+		if bits[i], err = br.readUint8(); err != nil {
+			return nil, err
+		}
+	}
+	return &PixelInformationProperty{FullBox: fb, BitsPerChannel: bits}, nil
+}
+
 type OffsetLength struct {
 	Offset, Length uint64
 }
@@ -846,7 +1251,7 @@ func parseHandlerBox(gen *box, br *bufReader) (Box, error) {
 	if err != nil {
 		return nil, err
 	}
-	hb.HandlerType = string(buf[4:8])
+	hb.HandlerType = fourCC(buf[4:8])
 	br.Discard(20)
 
 	hb.Name, _ = br.readString()
@@ -911,9 +1316,12 @@ func parseItemDataBox(gen *box, br *bufReader) (Box, error) {
 		return nil, err
 	}
 
-	data, err := ioutil.ReadAll(fb.Body())
-	if err != nil {
-		return nil, err
+	data := gen.slurp
+	if data == nil {
+		data, err = ioutil.ReadAll(fb.Body())
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if !br.ok() {
@@ -957,6 +1365,32 @@ func parseImageMirror(gen *box, br *bufReader) (Box, error) {
 	return &ImageMirror{box: gen, Mirror: v & 1}, nil
 }
 
+// CleanAperture is a HEIF "clap" crop property. Each value is a fraction;
+// the offsets are those of the aperture center from the image center.
+type CleanAperture struct {
+	*box
+	WidthN, WidthD       uint32
+	HeightN, HeightD     uint32
+	HorizOffN, HorizOffD int32
+	VertOffN, VertOffD   int32
+}
+
+func parseCleanAperture(gen *box, br *bufReader) (Box, error) {
+	var v [8]uint32
+	for i := range v {
+		var err error
+		if v[i], err = br.readUint32(); err != nil {
+			return nil, err
+		}
+	}
+	return &CleanAperture{box: gen,
+		WidthN: v[0], WidthD: v[1],
+		HeightN: v[2], HeightD: v[3],
+		HorizOffN: int32(v[4]), HorizOffD: int32(v[5]),
+		VertOffN: int32(v[6]), VertOffD: int32(v[7]),
+	}, nil
+}
+
 // ItemHevcConfigBox is a HEIF "hvcC" property
 type hevcConfig struct {
 	version                          uint8
@@ -977,6 +1411,7 @@ type hevcConfig struct {
 	constantFrameRate uint8
 	numTemporalLayers uint8
 	temporalIdNested  uint8
+	lengthSize        uint8 // of the NAL unit lengths in the item data
 }
 
 type hevcNalArray struct {
@@ -989,21 +1424,51 @@ type ItemHevcConfigBox struct {
 	*box
 	config   hevcConfig
 	nalArray []*hevcNalArray
+	header   []byte // AsHeader, built once at parse time
 }
 
+// AsHeader returns the parameter set NAL units, each prefixed with a 4 byte
+// big endian length. The slice is shared by all callers and must not be
+// modified.
 func (ib *ItemHevcConfigBox) AsHeader() []byte {
-	var out []byte
+	if ib.header == nil {
+		return ib.buildHeader()
+	}
+	return ib.header
+}
+
+// NALLengthSize returns the size in bytes, 1, 2 or 4, of the lengths
+// prefixing the NAL units in the item data.
+func (ib *ItemHevcConfigBox) NALLengthSize() int {
+	return int(ib.config.lengthSize)
+}
+
+// BitDepth returns the bit depths of the luma and chroma samples.
+func (ib *ItemHevcConfigBox) BitDepth() (luma, chroma int) {
+	return int(ib.config.bitDepthLuma&7) + 8, int(ib.config.bitDepthChroma&7) + 8
+}
+
+// ChromaFormat returns the chroma_format_idc of the stream: 0 for
+// monochrome, then 1, 2 and 3 for 4:2:0, 4:2:2 and 4:4:4.
+func (ib *ItemHevcConfigBox) ChromaFormat() int {
+	return int(ib.config.chromaFormat & 3)
+}
+
+func (ib *ItemHevcConfigBox) buildHeader() []byte {
+	size := 0
 	for _, na := range ib.nalArray {
 		for _, unit := range na.units {
-			n := len(unit)
-			out = append(out, byte((n>>24)&0xff))
-			out = append(out, byte((n>>16)&0xff))
-			out = append(out, byte((n>>8)&0xff))
-			out = append(out, byte((n>>0)&0xff))
-			out = append(out, unit...)
+			size += 4 + len(unit)
 		}
 	}
 
+	out := make([]byte, 0, size)
+	for _, na := range ib.nalArray {
+		for _, unit := range na.units {
+			out = binary.BigEndian.AppendUint32(out, uint32(len(unit)))
+			out = append(out, unit...)
+		}
+	}
 	return out
 }
 
@@ -1037,6 +1502,7 @@ func parseItemHevcConfigBox(gen *box, br *bufReader) (Box, error) {
 	c.constantFrameRate = uint8((ch >> 6) & 0x03)
 	c.numTemporalLayers = uint8((ch >> 3) & 0x07)
 	c.temporalIdNested = uint8((ch >> 2) & 1)
+	c.lengthSize = ch&3 + 1
 
 	numArrays, err := br.readUint8()
 	if err != nil {
@@ -1051,9 +1517,12 @@ func parseItemHevcConfigBox(gen *box, br *bufReader) (Box, error) {
 		na.unitType = uint8(ch & 0x3F)
 
 		numUnits, _ := br.readUint16()
-		for j := 0; j < int(numUnits); j += 1 {
+		for j := 0; j < int(numUnits) && br.ok(); j += 1 {
 			size, _ := br.readUint16()
 			if size == 0 { // ignore empty NAL units
+				if br.strict() {
+					return nil, fmt.Errorf("hvcC: empty NAL unit in array %d", i)
+				}
 				continue
 			}
 
@@ -1071,5 +1540,160 @@ func parseItemHevcConfigBox(gen *box, br *bufReader) (Box, error) {
 		return nil, br.err
 	}
 
+	ib.header = ib.buildHeader()
 	return ib, nil
 }
+
+// VVC NAL unit types that appear in a "vvcC" array without a count.
+const (
+	vvcNalOPI = 12
+	vvcNalDCI = 13
+)
+
+// VvcNalArray is an array of NAL units of one type in a "vvcC" box.
+// (not a box)
+type VvcNalArray struct {
+	Completeness bool
+	UnitType     uint8
+	Units        [][]byte
+}
+
+// ItemVvcConfigBox is a HEIF "vvcC" property, holding the VVC (H.266)
+// decoder configuration record of a vvc1 item.
+type ItemVvcConfigBox struct {
+	FullBox
+
+	LengthSize int  // size in bytes of the NAL unit length fields in the item data
+	PTLPresent bool // the fields below up to NalArrays are only set if true
+
+	OlsIdx            uint16
+	NumSublayers      uint8
+	ConstantFrameRate uint8
+	ChromaFormatIdc   uint8
+	BitDepth          uint8
+	GeneralProfileIdc uint8
+	GeneralTierFlag   uint8
+	GeneralLevelIdc   uint8
+	MaxPictureWidth   uint16
+	MaxPictureHeight  uint16
+	AvgFrameRate      uint16
+
+	NalArrays []VvcNalArray
+}
+
+// AsHeader returns the parameter set NAL units, each prefixed with a 4 byte
+// big endian length, in the same layout as ItemHevcConfigBox.AsHeader.
+func (vb *ItemVvcConfigBox) AsHeader() []byte {
+	var out []byte
+	for _, na := range vb.NalArrays {
+		for _, unit := range na.Units {
+			out = binary.BigEndian.AppendUint32(out, uint32(len(unit)))
+			out = append(out, unit...)
+		}
+	}
+	return out
+}
+
+func parseItemVvcConfigBox(gen *box, br *bufReader) (Box, error) {
+	fb, err := readFullBox(gen, br)
+	if err != nil {
+		return nil, err
+	}
+	vb := &ItemVvcConfigBox{FullBox: fb}
+
+	ch, _ := br.readUint8()
+	vb.LengthSize = int((ch>>1)&3) + 1
+	vb.PTLPresent = ch&1 != 0
+
+	if vb.PTLPresent {
+		v, _ := br.readUint16()
+		vb.OlsIdx = v >> 7
+		vb.NumSublayers = uint8((v >> 4) & 7)
+		vb.ConstantFrameRate = uint8((v >> 2) & 3)
+		vb.ChromaFormatIdc = uint8(v & 3)
+		ch, _ = br.readUint8()
+		vb.BitDepth = (ch >> 5) + 8
+
+		// VvcPTLRecord
+		ch, _ = br.readUint8()
+		numBytesConstraintInfo := int(ch & 0x3f)
+		ch, _ = br.readUint8()
+		vb.GeneralProfileIdc = ch >> 1
+		vb.GeneralTierFlag = ch & 1
+		vb.GeneralLevelIdc, _ = br.readUint8()
+		if br.ok() {
+			if _, err := br.Discard(numBytesConstraintInfo); err != nil {
+				return nil, err
+			}
+		}
+		if vb.NumSublayers > 1 {
+			flags, _ := br.readUint8()
+			for i := int(vb.NumSublayers) - 2; i >= 0; i-- {
+				if flags&(0x80>>uint(int(vb.NumSublayers)-2-i)) != 0 {
+					br.readUint8() // sublayer_level_idc[i]
+				}
+			}
+		}
+		numSubProfiles, _ := br.readUint8()
+		for i := 0; i < int(numSubProfiles); i++ {
+			br.readUint32() // general_sub_profile_idc[i]
+		}
+
+		vb.MaxPictureWidth, _ = br.readUint16()
+		vb.MaxPictureHeight, _ = br.readUint16()
+		vb.AvgFrameRate, _ = br.readUint16()
+	}
+
+	numArrays, err := br.readUint8()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(numArrays) && br.ok(); i++ {
+		ch, _ := br.readUint8()
+		na := VvcNalArray{
+			Completeness: ch&0x80 != 0,
+			UnitType:     ch & 0x1f,
+		}
+
+		numUnits := uint16(1)
+		if na.UnitType != vvcNalDCI && na.UnitType != vvcNalOPI {
+			numUnits, _ = br.readUint16()
+		}
+		for j := 0; j < int(numUnits) && br.ok(); j++ {
+			size, _ := br.readUint16()
+			if size == 0 {
+				if br.strict() {
+					return nil, fmt.Errorf("vvcC: empty NAL unit in array %d", i)
+				}
+				continue
+			}
+			unit := make([]byte, size)
+			if _, err := io.ReadFull(br, unit); err != nil {
+				return nil, err
+			}
+			na.Units = append(na.Units, unit)
+		}
+		vb.NalArrays = append(vb.NalArrays, na)
+	}
+
+	if !br.ok() {
+		return nil, br.err
+	}
+	return vb, nil
+}
+
+// ItemJpegConfigBox is a HEIF "jpgC" property. Its prefix, typically the
+// JPEG headers and tables shared by several items, must be prepended to the
+// item data to form a complete JPEG stream.
+type ItemJpegConfigBox struct {
+	*box
+	Prefix []byte
+}
+
+func parseItemJpegConfigBox(gen *box, br *bufReader) (Box, error) {
+	prefix, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	return &ItemJpegConfigBox{box: gen, Prefix: prefix}, nil
+}
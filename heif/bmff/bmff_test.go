@@ -0,0 +1,244 @@
+package bmff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+)
+
+func appendBox(dst []byte, typ string, body []byte) []byte {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(8+len(body)))
+	copy(hdr[4:], typ)
+	return append(append(dst, hdr[:]...), body...)
+}
+
+// countingReader records how many bytes were read through it.
+type countingReader struct {
+	io.ReadSeeker
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	r.n += n
+	return n, err
+}
+
+func TestReadBoxSeeksOverMdat(t *testing.T) {
+	var file []byte
+	file = appendBox(file, "ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	file = appendBox(file, "mdat", make([]byte, 4<<20))
+	file = appendBox(file, "free", nil)
+
+	cr := &countingReader{ReadSeeker: bytes.NewReader(file)}
+	r := NewReader(cr)
+
+	var types []string
+	for {
+		box, err := r.ReadBox()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadBox: %v", err)
+		}
+		types = append(types, box.Type().String())
+	}
+	if got, want := len(types), 3; got != want {
+		t.Fatalf("read %d boxes (%q); want %d", got, types, want)
+	}
+	if types[2] != "free" {
+		t.Errorf("last box = %q; want %q", types[2], "free")
+	}
+	if cr.n > 1<<20 {
+		t.Errorf("read %d bytes; expected mdat body to be skipped", cr.n)
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	// An ftyp with a dangling partial brand.
+	ftyp := appendBox(nil, "ftyp", []byte("heic\x00\x00\x00\x00mif1he"))
+
+	for _, tt := range []struct {
+		mode    Mode
+		wantErr bool
+	}{
+		{ModeLenient, false},
+		{ModeStrict, true},
+	} {
+		r := NewReader(bytes.NewReader(ftyp), WithMode(tt.mode))
+		_, err := r.ReadAndParseBox(TypeFtyp)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("mode %d: err = %v; want error %v", tt.mode, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBoxTypeText(t *testing.T) {
+	bt, err := BoxTypeFromString("hvcC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bt.Is("hvcC") || bt.Is("hvcc") || !bt.IsAny("av1C", "hvcC") {
+		t.Errorf("Is/IsAny mismatch for %q", bt)
+	}
+	if _, err := BoxTypeFromString("abc"); err == nil {
+		t.Errorf("BoxTypeFromString(%q) succeeded; want error", "abc")
+	}
+
+	b, err := json.Marshal(map[string]BoxType{"type": bt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"type":"hvcC"}`; got != want {
+		t.Errorf("json = %s; want %s", got, want)
+	}
+	var out map[string]BoxType
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["type"] != bt {
+		t.Errorf("round trip = %q; want %q", out["type"], bt)
+	}
+}
+
+func TestLargeSizeRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		bodySize int64
+		large    bool
+	}{
+		{16, false},
+		{16, true},
+		{5 << 30, false}, // beyond 32 bits, so largesize is required
+	} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		if err := w.WriteBoxHeader(TypeMdat, tt.bodySize, tt.large); err != nil {
+			t.Fatal(err)
+		}
+		if tt.bodySize < 1<<20 {
+			w.Write(make([]byte, tt.bodySize))
+		}
+
+		box, err := NewReader(&buf).ReadBox()
+		if err != nil {
+			t.Fatalf("ReadBox: %v", err)
+		}
+		wantLarge := tt.large || tt.bodySize > 1<<32
+		if box.LargeSize() != wantLarge {
+			t.Errorf("body %d: LargeSize = %v; want %v", tt.bodySize, box.LargeSize(), wantLarge)
+		}
+		if got, want := box.Size(), tt.bodySize+HeaderSize(tt.bodySize, tt.large); got != want {
+			t.Errorf("body %d: Size = %d; want %d", tt.bodySize, got, want)
+		}
+	}
+}
+
+func TestParseVvcConfig(t *testing.T) {
+	body := []byte{
+		0, 0, 0, 0, // version, flags
+		0xff,       // LengthSizeMinusOne = 3, ptl_present_flag
+		0x00, 0x11, // ols_idx 0, num_sublayers 1, chroma_format_idc 1
+		0x5f,             // bit_depth_minus8 = 2
+		0x01, 0x02, 0x33, // 1 constraint byte, profile 1, level 0x33
+		0x00,       // general_constraint_info
+		0x00,       // ptl_num_sub_profiles
+		0x01, 0x00, // max_picture_width
+		0x00, 0x80, // max_picture_height
+		0x00, 0x00, // avg_frame_rate
+		2,                                              // num_of_arrays
+		0x8f, 0x00, 0x01, 0x00, 0x03, 0xaa, 0xbb, 0xcc, // complete SPS array
+		0x0d, 0x00, 0x02, 0x01, 0x02, // DCI, no count
+	}
+	box, err := NewReader(bytes.NewReader(appendBox(nil, "vvcC", body))).ReadBox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb, err := box.Parse()
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	vb, ok := pb.(*ItemVvcConfigBox)
+	if !ok {
+		t.Fatalf("parsed %T; want *ItemVvcConfigBox", pb)
+	}
+	if vb.LengthSize != 4 || vb.BitDepth != 10 || vb.ChromaFormatIdc != 1 || vb.GeneralLevelIdc != 0x33 {
+		t.Errorf("unexpected config: %+v", vb)
+	}
+	if vb.MaxPictureWidth != 256 || vb.MaxPictureHeight != 128 {
+		t.Errorf("max picture = %dx%d; want 256x128", vb.MaxPictureWidth, vb.MaxPictureHeight)
+	}
+	want := []byte{0, 0, 0, 3, 0xaa, 0xbb, 0xcc, 0, 0, 0, 2, 1, 2}
+	if got := vb.AsHeader(); !bytes.Equal(got, want) {
+		t.Errorf("AsHeader = %x; want %x", got, want)
+	}
+}
+
+func TestParseHevcConfigHeader(t *testing.T) {
+	body := make([]byte, 22) // configuration fields up to lengthSizeMinusOne
+	body = append(body,
+		2,                                  // numOfArrays
+		0xa1, 0x00, 0x01, 0x00, 0x02, 1, 2, // SPS array
+		0x22, 0x00, 0x01, 0x00, 0x01, 3, // PPS array
+	)
+	box, err := NewReader(bytes.NewReader(appendBox(nil, "hvcC", body))).ReadBox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb, err := box.Parse()
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	ib, ok := pb.(*ItemHevcConfigBox)
+	if !ok {
+		t.Fatalf("parsed %T; want *ItemHevcConfigBox", pb)
+	}
+
+	want := []byte{0, 0, 0, 2, 1, 2, 0, 0, 0, 1, 3}
+	got := ib.AsHeader()
+	if !bytes.Equal(got, want) || cap(got) != len(want) {
+		t.Errorf("AsHeader = %x (cap %d); want %x", got, cap(got), want)
+	}
+	if &ib.AsHeader()[0] != &got[0] {
+		t.Errorf("AsHeader rebuilt the header")
+	}
+}
+
+func TestFourCCAllocs(t *testing.T) {
+	b := []byte("hvc1")
+	var s string
+	if n := testing.AllocsPerRun(100, func() { s = fourCC(b) }); n != 0 {
+		t.Errorf("fourCC(%q) allocates %v times", b, n)
+	}
+	if s != "hvc1" || fourCC([]byte("abcd")) != "abcd" {
+		t.Errorf("fourCC returned the wrong string")
+	}
+}
+
+func FuzzReadBox(f *testing.F) {
+	f.Add(appendBox(nil, "ftyp", []byte("heic\x00\x00\x00\x00mif1heic")))
+	f.Add(appendBox(appendBox(nil, "meta", make([]byte, 4)), "mdat", []byte{1, 2, 3}))
+	if b, err := os.ReadFile("../../testdata/camel.heic"); err == nil {
+		f.Add(b[:min(len(b), 4096)])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, mode := range []Mode{ModeLenient, ModeStrict} {
+			r := NewReader(bytes.NewReader(data), WithMode(mode))
+			for {
+				b, err := r.ReadBox()
+				if err != nil {
+					break
+				}
+				// sizes may run past truncated files, but never inside the header
+				if b.Size() != 0 && b.Size() < 8 {
+					t.Fatalf("%v box of size %d", b.Type(), b.Size())
+				}
+				b.Parse()
+			}
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package bmff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// HeaderSize returns the size of a box header for a body of bodySize bytes.
+// If large is set, or the box would not fit in 32 bits, the header uses the
+// 64-bit largesize encoding.
+func HeaderSize(bodySize int64, large bool) int64 {
+	if large || bodySize > math.MaxUint32-8 {
+		return 16
+	}
+	return 8
+}
+
+// AppendBoxHeader appends the header of a box of type typ with a body of
+// bodySize bytes to dst. See HeaderSize for when largesize is used.
+func AppendBoxHeader(dst []byte, typ BoxType, bodySize int64, large bool) []byte {
+	if HeaderSize(bodySize, large) == 16 {
+		dst = binary.BigEndian.AppendUint32(dst, 1)
+		dst = append(dst, typ[:]...)
+		return binary.BigEndian.AppendUint64(dst, uint64(bodySize+16))
+	}
+	dst = binary.BigEndian.AppendUint32(dst, uint32(bodySize+8))
+	return append(dst, typ[:]...)
+}
+
+// AppendBox appends a complete box of type typ with the given body to dst.
+func AppendBox(dst []byte, typ BoxType, body []byte) []byte {
+	dst = AppendBoxHeader(dst, typ, int64(len(body)), false)
+	return append(dst, body...)
+}
+
+// AppendFullBox appends a complete "Full Box" of type typ, prefixing body
+// with the version and 24-bit flags.
+func AppendFullBox(dst []byte, typ BoxType, version uint8, flags uint32, body []byte) []byte {
+	dst = AppendBoxHeader(dst, typ, int64(len(body))+4, false)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(version)<<24|flags&0xffffff)
+	return append(dst, body...)
+}
+
+// Writer writes BMFF boxes to an underlying io.Writer.
+//
+// Errors are sticky: once a write fails, all later writes return the
+// same error.
+type Writer struct {
+	w   io.Writer
+	n   int64 // bytes written so far
+	err error
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Offset returns the number of bytes written so far.
+func (w *Writer) Offset() int64 { return w.n }
+
+// Err returns the first error of the writes so far, if any.
+func (w *Writer) Err() error { return w.err }
+
+// Write writes raw bytes, such as a box body following WriteBoxHeader.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
+
+// WriteBoxHeader writes the header of a box of type typ whose body of
+// bodySize bytes the caller writes next. If large is set, or the box
+// would not fit in 32 bits, the 64-bit largesize encoding is used.
+func (w *Writer) WriteBoxHeader(typ BoxType, bodySize int64, large bool) error {
+	if bodySize < 0 {
+		return fmt.Errorf("bmff: negative body size %d for %q box", bodySize, typ)
+	}
+	var buf [16]byte
+	_, err := w.Write(AppendBoxHeader(buf[:0], typ, bodySize, large))
+	return err
+}
+
+// WriteBox writes a complete box of type typ with the given body.
+func (w *Writer) WriteBox(typ BoxType, body []byte) error {
+	if err := w.WriteBoxHeader(typ, int64(len(body)), false); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
@@ -0,0 +1,107 @@
+package heif
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"math"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// CleanAperture returns the rectangle of the image kept by its clap
+// property, in the coordinates of the image before any rotation or
+// mirroring. ok is false if the item has no valid clap property.
+func (it *Item) CleanAperture() (r image.Rectangle, ok bool) {
+	width, height, ok := it.SpatialExtents()
+	if !ok {
+		return r, false
+	}
+	for _, p := range it.Properties {
+		if p, ok := p.(*bmff.CleanAperture); ok {
+			return clapRect(p, width, height)
+		}
+	}
+	return r, false
+}
+
+func clapRect(p *bmff.CleanAperture, width, height int) (image.Rectangle, bool) {
+	if p.WidthD == 0 || p.HeightD == 0 || p.HorizOffD == 0 || p.VertOffD == 0 {
+		return image.Rectangle{}, false
+	}
+	w := float64(p.WidthN) / float64(p.WidthD)
+	h := float64(p.HeightN) / float64(p.HeightD)
+	cx := float64(width)/2 + float64(p.HorizOffN)/float64(p.HorizOffD)
+	cy := float64(height)/2 + float64(p.VertOffN)/float64(p.VertOffD)
+	x, y := int(math.Round(cx-w/2)), int(math.Round(cy-h/2))
+	r := image.Rect(x, y, x+int(math.Round(w)), y+int(math.Round(h)))
+	r = r.Intersect(image.Rect(0, 0, width, height))
+	return r, !r.Empty()
+}
+
+// ClapProperty returns a clap property keeping r of a width x height
+// image, for a MuxItem.
+func ClapProperty(r image.Rectangle, width, height int) Property {
+	var body []byte
+	for _, v := range []int{
+		r.Dx(), 1,
+		r.Dy(), 1,
+		// offsets of the aperture center from the image center
+		r.Min.X + r.Max.X - width, 2,
+		r.Min.Y + r.Max.Y - height, 2,
+	} {
+		body = binary.BigEndian.AppendUint32(body, uint32(int32(v)))
+	}
+	return Property{Box: bmff.AppendBox(nil, boxType("clap"), body), Essential: true}
+}
+
+// RewriteCrop copies the HEIF file src to dst with the primary image
+// cropped to r by its clap property, without touching the coded data. r is
+// in the coordinates of the image before any rotation or mirroring, as
+// returned by CleanAperture, and replaces any previous crop: cropping to
+// the whole image removes it. The left and top edges are moved to even
+// coordinates so that they fall on chroma samples of subsampled images.
+//
+// As with RewriteTransform, files with image sequences are not supported.
+func RewriteCrop(src io.ReaderAt, dst io.Writer, r image.Rectangle) error {
+	return rewritePrimary(src, dst, func(props []rawBox, assocs []uint16, add func([]byte) uint16) ([]uint16, error) {
+		var width, height int
+		for _, a := range assocs {
+			if p, ok := property(props, a); ok && p.typ == "ispe" && len(p.body) >= 12 {
+				width, height = int(binary.BigEndian.Uint32(p.body[4:])), int(binary.BigEndian.Uint32(p.body[8:]))
+			}
+		}
+		if width == 0 || height == 0 {
+			return nil, errors.New("heif: primary item has no ispe property")
+		}
+		crop := r
+		crop.Min.X &^= 1
+		crop.Min.Y &^= 1
+		crop = crop.Intersect(image.Rect(0, 0, width, height))
+		if crop.Empty() {
+			return nil, errors.New("heif: crop outside of the image")
+		}
+
+		var clap uint16
+		if crop != image.Rect(0, 0, width, height) {
+			clap = add(ClapProperty(crop, width, height).Box)
+		}
+		var kept []uint16
+		for _, a := range assocs {
+			p, ok := property(props, a)
+			if ok && p.typ == "clap" {
+				continue
+			}
+			// the crop applies before the transforms
+			if ok && clap != 0 && (p.typ == "irot" || p.typ == "imir") {
+				kept, clap = append(kept, clap), 0
+			}
+			kept = append(kept, a)
+		}
+		if clap != 0 {
+			kept = append(kept, clap)
+		}
+		return kept, nil
+	})
+}
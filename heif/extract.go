@@ -0,0 +1,132 @@
+package heif
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// annexBStartCode precedes each NAL unit of an Annex-B stream.
+var annexBStartCode = []byte{0, 0, 0, 1}
+
+// ExtractBitstream writes the coded data of an image item to w as a
+// standalone stream for other decoders: an Annex-B byte stream (.h265) for
+// HEVC items and an IVF file for AV1 items. The tiles of a grid item are
+// written one after another, as the pictures or frames of the stream.
+func (f *File) ExtractBitstream(w io.Writer, it *Item) error {
+	items := []*Item{it}
+	if it.Info != nil && it.Info.ItemType == ItemTypeGrid {
+		dimg := it.Reference(RefDerivedImage)
+		if dimg == nil || len(dimg.ToItemIDs) == 0 {
+			return errors.New("heif: grid has no tiles")
+		}
+		items = items[:0]
+		for _, id := range dimg.ToItemIDs {
+			tile, err := f.ItemByID(id)
+			if err != nil {
+				return err
+			}
+			items = append(items, tile)
+		}
+	}
+	if items[0].Info == nil {
+		return errors.New("heif: no item info")
+	}
+	typ := items[0].Info.ItemType
+	for _, it := range items {
+		if it.Info == nil || it.Info.ItemType != typ {
+			return errors.New("heif: grid tiles of mixed types")
+		}
+	}
+
+	switch typ {
+	case ItemTypeHEVC:
+		return f.writeAnnexB(w, items)
+	case ItemTypeAV1:
+		return f.writeIVF(w, items)
+	}
+	return fmt.Errorf("heif: cannot extract a bitstream from %q items", typ)
+}
+
+func (f *File) writeAnnexB(w io.Writer, items []*Item) error {
+	bw := bmff.NewWriter(w)
+	var hdr []byte
+	for _, it := range items {
+		hvcc, ok := it.HevcConfig()
+		if !ok {
+			return fmt.Errorf("heif: item %d has no hvcC", it.ID)
+		}
+		// write the parameter sets again only when they change
+		if h := hvcc.AsHeader(); hdr == nil || string(h) != string(hdr) {
+			if err := writeNALs(bw, h, 4); err != nil {
+				return err
+			}
+			hdr = h
+		}
+		data, err := f.GetItemData(it)
+		if err != nil {
+			return err
+		}
+		if err := writeNALs(bw, data, hvcc.NALLengthSize()); err != nil {
+			return err
+		}
+	}
+	return bw.Err()
+}
+
+// writeNALs writes length-prefixed NAL units as an Annex-B stream.
+func writeNALs(w *bmff.Writer, data []byte, lengthSize int) error {
+	for len(data) > 0 {
+		if len(data) < lengthSize {
+			return errors.New("heif: truncated NAL unit length")
+		}
+		var n int
+		for _, b := range data[:lengthSize] {
+			n = n<<8 | int(b)
+		}
+		data = data[lengthSize:]
+		if n > len(data) {
+			return errors.New("heif: truncated NAL unit")
+		}
+		w.Write(annexBStartCode)
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	return nil
+}
+
+// temporalDelimiter is the OBU starting each AV1 temporal unit, left out
+// of HEIF items but expected in IVF frames.
+var temporalDelimiter = []byte{0x12, 0}
+
+func (f *File) writeIVF(w io.Writer, items []*Item) error {
+	width, height, _ := items[0].SpatialExtents()
+	hdr := []byte("DKIF")
+	hdr = binary.LittleEndian.AppendUint16(hdr, 0)  // version
+	hdr = binary.LittleEndian.AppendUint16(hdr, 32) // header size
+	hdr = append(hdr, "AV01"...)
+	hdr = binary.LittleEndian.AppendUint16(hdr, uint16(width))
+	hdr = binary.LittleEndian.AppendUint16(hdr, uint16(height))
+	hdr = binary.LittleEndian.AppendUint32(hdr, 1) // frame rate
+	hdr = binary.LittleEndian.AppendUint32(hdr, 1) // time scale
+	hdr = binary.LittleEndian.AppendUint32(hdr, uint32(len(items)))
+	hdr = append(hdr, 0, 0, 0, 0) // unused
+
+	bw := bmff.NewWriter(w)
+	bw.Write(hdr)
+	for i, it := range items {
+		data, err := f.GetItemData(it)
+		if err != nil {
+			return err
+		}
+		frame := binary.LittleEndian.AppendUint32(nil, uint32(len(temporalDelimiter)+len(data)))
+		frame = binary.LittleEndian.AppendUint64(frame, uint64(i)) // timestamp
+		bw.Write(frame)
+		bw.Write(temporalDelimiter)
+		bw.Write(data)
+	}
+	return bw.Err()
+}
@@ -22,10 +22,12 @@ limitations under the License.
 package heif
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"strings"
 
 	"github.com/jdeng/goheif/heif/bmff"
 )
@@ -34,12 +36,16 @@ import (
 //
 // Methods on File should not be called concurrently.
 type File struct {
-	ra      io.ReaderAt
-	primary *Item
+	ra       io.ReaderAt
+	primary  *Item
+	mode     bmff.Mode
+	skipMeta bool
 
 	// Populated lazily, by getMeta:
 	metaErr error
 	meta    *BoxMeta
+
+	items map[uint32]*Item // by ItemByID
 }
 
 // BoxMeta contains the low-level BMFF metadata boxes.
@@ -54,13 +60,36 @@ type BoxMeta struct {
 	ItemReference *bmff.ItemReferenceBox
 }
 
+// Item types, as found in ItemInfoEntry.ItemType.
+const (
+	ItemTypeHEVC     = "hvc1"
+	ItemTypeAV1      = "av01"
+	ItemTypeGrid     = "grid"
+	ItemTypeIdentity = "iden"
+	ItemTypeOverlay  = "iovl"
+	ItemTypeJPEG     = "jpeg"
+	ItemTypeExif     = "Exif"
+	ItemTypeMIME     = "mime"
+)
+
+// ContentTypeXMP is the content type of mime items holding XMP.
+const ContentTypeXMP = "application/rdf+xml"
+
+// Item reference types, for Item.Reference.
+const (
+	RefDerivedImage = "dimg"
+	RefThumbnail    = "thmb"
+	RefDescribes    = "cdsc"
+	RefAuxiliary    = "auxl"
+)
+
 // EXIFItemID returns the item ID of the EXIF part, or 0 if not found.
 func (m *BoxMeta) EXIFItemID() uint32 {
 	if m.ItemInfo == nil {
 		return 0
 	}
 	for _, ife := range m.ItemInfo.ItemInfos {
-		if ife.ItemType == "Exif" {
+		if ife.ItemType == ItemTypeExif {
 			return uint32(ife.ItemID)
 		}
 	}
@@ -78,9 +107,22 @@ type Item struct {
 	References []*bmff.ItemReferenceEntry
 }
 
+// derived reports whether the item is a derived image, such as a grid,
+// which may have no data of its own.
+func (item *Item) derived() bool {
+	if item.Info == nil {
+		return false
+	}
+	switch item.Info.ItemType {
+	case ItemTypeGrid, ItemTypeIdentity, ItemTypeOverlay:
+		return true
+	}
+	return false
+}
+
 func (item *Item) Reference(name string) *bmff.ItemReferenceEntry {
 	for _, r := range item.References {
-		if name == r.Type().String() {
+		if r.Type().Is(name) {
 			return r
 		}
 	}
@@ -108,6 +150,36 @@ func (it *Item) HevcConfig() (b *bmff.ItemHevcConfigBox, ok bool) {
 	return
 }
 
+// VvcConfig returns the vvcC box
+func (it *Item) VvcConfig() (b *bmff.ItemVvcConfigBox, ok bool) {
+	for _, p := range it.Properties {
+		if p, ok := p.(*bmff.ItemVvcConfigBox); ok {
+			return p, true
+		}
+	}
+	return
+}
+
+// JpegConfig returns the jpgC box
+func (it *Item) JpegConfig() (b *bmff.ItemJpegConfigBox, ok bool) {
+	for _, p := range it.Properties {
+		if p, ok := p.(*bmff.ItemJpegConfigBox); ok {
+			return p, true
+		}
+	}
+	return
+}
+
+// PixelInformation returns the pixi property
+func (it *Item) PixelInformation() (b *bmff.PixelInformationProperty, ok bool) {
+	for _, p := range it.Properties {
+		if p, ok := p.(*bmff.PixelInformationProperty); ok {
+			return p, true
+		}
+	}
+	return
+}
+
 // Rotations returns the number of 90 degree rotations counter-clockwise that this
 // image should be rendered at, in the range [0,3].
 func (it *Item) Rotations() int {
@@ -129,6 +201,41 @@ func (it *Item) Mirror() int {
 	return 0
 }
 
+// ICCProfile returns the ICC profile of the item's colr property, if it
+// has one.
+func (it *Item) ICCProfile() (icc []byte, ok bool) {
+	for _, p := range it.Properties {
+		if !p.Type().Is("colr") {
+			continue
+		}
+		b, err := io.ReadAll(p.Body())
+		if err != nil || len(b) < 4 {
+			continue
+		}
+		if t := string(b[:4]); t == "prof" || t == "rICC" {
+			return b[4:], true
+		}
+	}
+	return nil, false
+}
+
+// AuxType returns the type of auxiliary image given by the item's auxC
+// property, such as AuxTypeAlpha.
+func (it *Item) AuxType() (typ string, ok bool) {
+	for _, p := range it.Properties {
+		if !p.Type().Is("auxC") {
+			continue
+		}
+		b, err := io.ReadAll(p.Body())
+		if err != nil || len(b) < 4 {
+			continue
+		}
+		typ, _, _ = strings.Cut(string(b[4:]), "\x00")
+		return typ, true
+	}
+	return "", false
+}
+
 // VisualDimensions returns the item's width and height after correcting
 // for any rotations.
 func (it *Item) VisualDimensions() (width, height int, ok bool) {
@@ -140,13 +247,42 @@ func (it *Item) VisualDimensions() (width, height int, ok bool) {
 }
 
 // Open returns a handle to access a HEIF file.
-func Open(f io.ReaderAt) *File {
-	return &File{ra: f}
+func Open(f io.ReaderAt, opts ...Option) *File {
+	hf := &File{ra: f}
+	for _, opt := range opts {
+		opt(hf)
+	}
+	return hf
+}
+
+// Option configures a File.
+type Option func(*File)
+
+// WithMode sets the parsing mode used for the file's boxes. In
+// bmff.ModeStrict, properties that fail to parse are reported by
+// ItemByID instead of being returned unparsed; see
+// bmff.ItemPropertiesBox.PropertiesFor.
+func WithMode(m bmff.Mode) Option {
+	return func(f *File) {
+		f.mode = m
+	}
+}
+
+// WithSkipMetadata makes the file skip the descriptions of metadata items
+// when parsing, for callers that only want the image. EXIF still works,
+// but mime items have no content type and cdsc references are dropped.
+func WithSkipMetadata(skip bool) Option {
+	return func(f *File) {
+		f.skipMeta = skip
+	}
 }
 
 // ErrNoEXIF is returned by File.EXIF when a file does not contain an EXIF item.
 var ErrNoEXIF = errors.New("heif: no EXIF found")
 
+// ErrNoXMP is returned by File.XMP when a file does not contain an XMP item.
+var ErrNoXMP = errors.New("heif: no XMP found")
+
 // ErrUnknownItem is returned by File.ItemByID for unknown items.
 var ErrUnknownItem = errors.New("heif: unknown item")
 
@@ -177,12 +313,42 @@ func (f *File) EXIF() ([]byte, error) {
 	return data[4:], nil // TODO: why 4? did I miss something?
 }
 
+// XMP returns the XMP packet of the file, from its first mime item of
+// content type ContentTypeXMP.
+// The error is ErrNoXMP if the file did not contain XMP.
+func (f *File) XMP() ([]byte, error) {
+	meta, err := f.getMeta()
+	if err != nil {
+		return nil, err
+	}
+	if meta.ItemInfo == nil {
+		return nil, ErrNoXMP
+	}
+	for _, ife := range meta.ItemInfo.ItemInfos {
+		if ife.ItemType != ItemTypeMIME || ife.ContentType != ContentTypeXMP {
+			continue
+		}
+		it, err := f.ItemByID(uint32(ife.ItemID))
+		if err != nil {
+			return nil, err
+		}
+		return f.GetItemData(it)
+	}
+	return nil, ErrNoXMP
+}
+
 // GetItemData returns data specified by item's location
 func (f *File) GetItemData(it *Item) ([]byte, error) {
 	loc := it.Location
 	if loc == nil {
 		return nil, errors.New("heif: item has no location")
 	}
+	if len(loc.Extents) == 0 {
+		if !it.derived() {
+			return nil, errors.New("heif: item has no data")
+		}
+		return nil, nil // such as identity items
+	}
 	if n := len(loc.Extents); n != 1 {
 		return nil, fmt.Errorf("heif: expected 1 section, saw %d", n)
 	}
@@ -192,16 +358,28 @@ func (f *File) GetItemData(it *Item) ([]byte, error) {
 		if f.meta.ItemData == nil {
 			return nil, fmt.Errorf("heif: no idat for item")
 		}
-		if offLen.Offset+offLen.Length > uint64(len(f.meta.ItemData.Data)) {
+		n := uint64(len(f.meta.ItemData.Data))
+		if offLen.Offset > n || offLen.Length > n-offLen.Offset {
 			return nil, fmt.Errorf("heif: idat out of bound")
 		}
 		return f.meta.ItemData.Data[offLen.Offset : offLen.Offset+offLen.Length], nil
 	}
 
+	if f.ra == nil {
+		return nil, errors.New("heif: item data not available")
+	}
+	if m, ok := f.ra.(slicer); ok {
+		return m.Slice(int64(offLen.Offset+loc.BaseOffset), int64(offLen.Length))
+	}
+
 	const maxSize = 200 << 20 // 200MB cap it for sanity
 	if offLen.Length > maxSize {
 		return nil, fmt.Errorf("heif: declared size %d exceeds threshold of %d bytes", offLen.Length, maxSize)
 	}
+	// don't allocate for data past the end of readers of known size
+	if s, ok := f.ra.(interface{ Size() int64 }); ok && offLen.Offset+loc.BaseOffset+offLen.Length > uint64(s.Size()) {
+		return nil, fmt.Errorf("heif: item data past the end of the file")
+	}
 	buf := make([]byte, offLen.Length)
 	n, err := f.ra.ReadAt(buf, int64(offLen.Offset+loc.BaseOffset))
 	if err != nil {
@@ -211,6 +389,62 @@ func (f *File) GetItemData(it *Item) ([]byte, error) {
 	return buf, nil
 }
 
+// Mapped reports whether the file was opened on a MappedFile, so that
+// GetItemData returns item data without copying it.
+func (f *File) Mapped() bool {
+	_, ok := f.ra.(slicer)
+	return ok
+}
+
+// ItemDataReader is like GetItemData, but returns a reader over the
+// item's data instead of reading it all into memory.
+func (f *File) ItemDataReader(it *Item) (io.Reader, error) {
+	loc := it.Location
+	if loc == nil {
+		return nil, errors.New("heif: item has no location")
+	}
+	if len(loc.Extents) == 0 {
+		if !it.derived() {
+			return nil, errors.New("heif: item has no data")
+		}
+		return nil, nil // such as identity items
+	}
+	if n := len(loc.Extents); n != 1 {
+		return nil, fmt.Errorf("heif: expected 1 section, saw %d", n)
+	}
+	if loc.ConstructionMethod == 1 {
+		data, err := f.GetItemData(it)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+	if f.ra == nil {
+		return nil, errors.New("heif: item data not available")
+	}
+	offLen := loc.Extents[0]
+	return &extentReader{
+		r:    io.NewSectionReader(f.ra, int64(offLen.Offset+loc.BaseOffset), int64(offLen.Length)),
+		left: int64(offLen.Length),
+	}, nil
+}
+
+// extentReader reads an extent, reporting io.ErrUnexpectedEOF if the file
+// ends before it does.
+type extentReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (r *extentReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.left -= int64(n)
+	if err == io.EOF && r.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
 func (f *File) setMetaErr(err error) error {
 	if f.metaErr != nil {
 		f.metaErr = err
@@ -227,13 +461,38 @@ func (f *File) getMeta() (*BoxMeta, error) {
 	}
 	const assumedMaxSize = 5 << 40 // arbitrary
 	sr := io.NewSectionReader(f.ra, 0, assumedMaxSize)
-	bmr := bmff.NewReader(sr)
+	meta, err := f.readMeta(sr)
+	if err != nil {
+		return nil, f.setMetaErr(err)
+	}
+	f.meta = meta
+	return f.meta, nil
+}
+
+// OpenMeta reads a HEIF file from r up to and including its meta box, and
+// no further. Boxes before the meta box, such as mdat, are skipped by
+// seeking if r is an io.Seeker or else discarded.
+//
+// The returned File reports the file's items and their properties, but
+// can only return the data of items stored in the meta box itself.
+func OpenMeta(r io.Reader, opts ...Option) (*File, error) {
+	f := Open(nil, opts...)
+	meta, err := f.readMeta(r)
+	if err != nil {
+		return nil, err
+	}
+	f.meta = meta
+	return f, nil
+}
+
+func (f *File) readMeta(r io.Reader) (*BoxMeta, error) {
+	bmr := bmff.NewReader(r, bmff.WithMode(f.mode), bmff.WithSkipMetadata(f.skipMeta))
 
 	meta := &BoxMeta{}
 
 	pbox, err := bmr.ReadAndParseBox(bmff.TypeFtyp)
 	if err != nil {
-		return nil, f.setMetaErr(err)
+		return nil, err
 	}
 	meta.FileType = pbox.(*bmff.FileTypeBox)
 
@@ -244,8 +503,9 @@ func (f *File) getMeta() (*BoxMeta, error) {
 			break
 		}
 
-		// skip mdat boxes if they are before meta
-		if box.Type() == bmff.TypeMdat {
+		// skip mdat and free space boxes if they are before meta
+		switch box.Type() {
+		case bmff.TypeMdat, bmff.TypeFree, bmff.TypeSkip:
 			continue
 		}
 
@@ -258,7 +518,7 @@ func (f *File) getMeta() (*BoxMeta, error) {
 	}
 
 	if err != nil {
-		return nil, f.setMetaErr(err)
+		return nil, err
 	}
 
 	metabox := pbox.(*bmff.MetaBox)
@@ -268,7 +528,7 @@ func (f *File) getMeta() (*BoxMeta, error) {
 			continue
 		}
 		if err != nil {
-			return nil, f.setMetaErr(err)
+			return nil, err
 		}
 		switch v := boxp.(type) {
 		case *bmff.HandlerBox:
@@ -288,8 +548,7 @@ func (f *File) getMeta() (*BoxMeta, error) {
 		}
 	}
 
-	f.meta = meta
-	return f.meta, nil
+	return meta, nil
 }
 
 // PrimaryItem returns the HEIF file's primary item.
@@ -304,9 +563,65 @@ func (f *File) PrimaryItem() (*Item, error) {
 	return f.ItemByID(uint32(meta.PrimaryItem.ItemID))
 }
 
+// Thumbnails returns the thumbnail items of it, in the order of their
+// references.
+func (f *File) Thumbnails(it *Item) ([]*Item, error) {
+	return f.referencing(RefThumbnail, it)
+}
+
+// AuxiliaryImages returns the auxiliary images of it, such as its alpha
+// channel or depth map (see Item.AuxType), in the order of their
+// references.
+func (f *File) AuxiliaryImages(it *Item) ([]*Item, error) {
+	return f.referencing(RefAuxiliary, it)
+}
+
+// referencing returns the items with a reference of type typ to it.
+func (f *File) referencing(typ string, it *Item) ([]*Item, error) {
+	meta, err := f.getMeta()
+	if err != nil || meta.ItemReference == nil {
+		return nil, err
+	}
+	var items []*Item
+	for _, r := range meta.ItemReference.ItemRefs {
+		if !r.Type().Is(typ) {
+			continue
+		}
+		for _, id := range r.ToItemIDs {
+			if id != it.ID {
+				continue
+			}
+			from, err := f.ItemByID(r.FromItemID)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, from)
+			break
+		}
+	}
+	return items, nil
+}
+
 // ItemByID by returns the file's Item of a given ID.
 // If the ID is known, the returned error is ErrUnknownItem.
+// Items are looked up once and shared by later calls, so the returned
+// Item must not be modified.
 func (f *File) ItemByID(id uint32) (*Item, error) {
+	if it, ok := f.items[id]; ok {
+		return it, nil
+	}
+	it, err := f.lookupItem(id)
+	if err != nil {
+		return nil, err
+	}
+	if f.items == nil {
+		f.items = make(map[uint32]*Item)
+	}
+	f.items[id] = it
+	return it, nil
+}
+
+func (f *File) lookupItem(id uint32) (*Item, error) {
 	meta, err := f.getMeta()
 	if err != nil {
 		return nil, err
@@ -343,34 +658,12 @@ func (f *File) ItemByID(id uint32) (*Item, error) {
 		return nil, ErrUnknownItem
 	}
 	if meta.Properties != nil {
-		allProps := meta.Properties.PropertyContainer.Properties
-		for _, ipa := range meta.Properties.Associations {
-			// TODO: I've never seen a file with more than
-			// top-level ItemPropertyAssociation box, but
-			// apparently they can exist with different
-			// versions/flags. For now we just merge them
-			// all together, but that's not really right.
-			// So for now, just bail once a previous loop
-			// found anything.
-			if len(it.Properties) > 0 {
-				break
-			}
-
-			for _, ipai := range ipa.Entries {
-				if ipai.ItemID != id {
-					continue
-				}
-				for _, ass := range ipai.Associations {
-					if ass.Index != 0 && int(ass.Index) <= len(allProps) {
-						box := allProps[ass.Index-1]
-						boxp, err := box.Parse()
-						if err == nil {
-							box = boxp
-						}
-						it.Properties = append(it.Properties, box)
-					}
-				}
-			}
+		props, err := meta.Properties.PropertiesFor(id)
+		if err != nil {
+			return nil, fmt.Errorf("heif: %v", err)
+		}
+		for _, p := range props {
+			it.Properties = append(it.Properties, p.Box)
 		}
 	}
 	return it, nil
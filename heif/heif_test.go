@@ -2,10 +2,18 @@ package heif
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/jdeng/goheif/heif/bmff"
+	"github.com/jdeng/goheif/internal/heiftest"
 	"github.com/rwcarlsen/goexif/exif"
 	"github.com/rwcarlsen/goexif/tiff"
 )
@@ -36,6 +44,8 @@ func TestAll(t *testing.T) {
 	}
 	if it.Info == nil {
 		t.Errorf("Item.Info is nil")
+	} else if it.Info.ItemType != ItemTypeGrid || strings.HasPrefix(it.Info.Name, it.Info.ItemType) {
+		t.Errorf("Item.Info type %q, name %q", it.Info.ItemType, it.Info.Name)
 	}
 	if len(it.Properties) == 0 {
 		t.Errorf("Item.Properties is empty")
@@ -106,8 +116,851 @@ func TestRotations(t *testing.T) {
 	}
 }
 
+func TestPropertiesFor(t *testing.T) {
+	f, err := os.Open("testdata/park.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	h := Open(f)
+	meta, err := h.getMeta()
+	if err != nil {
+		t.Fatalf("getMeta: %v", err)
+	}
+	it, err := h.PrimaryItem()
+	if err != nil {
+		t.Fatalf("PrimaryItem: %v", err)
+	}
+	props, err := meta.Properties.PropertiesFor(it.ID)
+	if err != nil {
+		t.Fatalf("PropertiesFor: %v", err)
+	}
+	if len(props) != len(it.Properties) {
+		t.Fatalf("PropertiesFor returned %d properties; Item has %d", len(props), len(it.Properties))
+	}
+	for i, p := range props {
+		if p.Index == 0 {
+			t.Errorf("property %d has index 0", i)
+		}
+		if p.Box != it.Properties[i] {
+			t.Errorf("property %d = %q; Item has %q", i, p.Box.Type(), it.Properties[i].Type())
+		}
+	}
+}
+
 type walkFunc func(exif.FieldName, *tiff.Tag) error
 
 func (f walkFunc) Walk(name exif.FieldName, tag *tiff.Tag) error {
 	return f(name, tag)
 }
+
+func BenchmarkParseMeta(b *testing.B) {
+	data, err := os.ReadFile("testdata/park.heic")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h := Open(bytes.NewReader(data))
+		if _, err := h.PrimaryItem(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkItemByID(b *testing.B) {
+	hvcC := heiftest.Property("hvcC", make([]byte, 23))
+	g := heiftest.HEVCGrid(6, 8, 4096, 3072, hvcC, []byte{0, 0, 0, 0}, 512, 512)
+	h := Open(bytes.NewReader(g.Bytes()))
+	if _, err := h.PrimaryItem(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, it := range g.Items[1:] {
+			if _, err := h.ItemByID(uint32(it.ID)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestItemByIDCached(t *testing.T) {
+	g := heiftest.HEVCGrid(1, 2, 1024, 512, heiftest.Property("hvcC", make([]byte, 23)), nil, 512, 512)
+	hf := Open(bytes.NewReader(g.Bytes()))
+
+	a, err := hf.ItemByID(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := hf.ItemByID(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Errorf("ItemByID looked the item up again")
+	}
+	if w, h, ok := a.SpatialExtents(); !ok || w != 512 || h != 512 {
+		t.Errorf("SpatialExtents = %d, %d, %v; want 512, 512", w, h, ok)
+	}
+	if _, err := hf.ItemByID(9); err != ErrUnknownItem {
+		t.Errorf("ItemByID(9) = %v; want ErrUnknownItem", err)
+	}
+}
+
+func TestSkipMetadata(t *testing.T) {
+	g := heiftest.HEVCGrid(1, 1, 512, 512, heiftest.Property("hvcC", make([]byte, 23)), nil, 512, 512)
+	exifItem := g.AddItem("Exif", []byte{0, 0, 0, 0, 'M', 'M'})
+	xmp := g.AddItem("mime", []byte("<x:xmpmeta/>"))
+	xmp.ContentType = "application/rdf+xml"
+	g.AddRef("cdsc", exifItem.ID, 1)
+	g.AddRef("cdsc", xmp.ID, 1)
+	file := g.Bytes()
+
+	for _, skip := range []bool{false, true} {
+		h := Open(bytes.NewReader(file), WithSkipMetadata(skip))
+		if _, err := h.PrimaryItem(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.EXIF(); err != nil {
+			t.Errorf("skip=%v: EXIF: %v", skip, err)
+		}
+
+		it, err := h.ItemByID(uint32(xmp.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantType, wantRef := "application/rdf+xml", true
+		if skip {
+			wantType, wantRef = "", false
+		}
+		if it.Info.ContentType != wantType {
+			t.Errorf("skip=%v: content type = %q; want %q", skip, it.Info.ContentType, wantType)
+		}
+		if got := it.Reference(RefDescribes) != nil; got != wantRef {
+			t.Errorf("skip=%v: cdsc reference found = %v; want %v", skip, got, wantRef)
+		}
+	}
+}
+
+// hvccNALs returns the NAL units of the arrays of an hvcC record.
+func hvccNALs(t *testing.T, rec []byte) [][]byte {
+	t.Helper()
+	var nals [][]byte
+	b := rec[23:]
+	for n := rec[22]; n > 0; n-- {
+		count := int(b[1])<<8 | int(b[2])
+		b = b[3:]
+		for ; count > 0; count-- {
+			size := int(b[0])<<8 | int(b[1])
+			nals = append(nals, b[2:2+size])
+			b = b[2+size:]
+		}
+	}
+	return nals
+}
+
+func TestHEVCConfigRecord(t *testing.T) {
+	file, err := os.ReadFile("testdata/park.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	off, size, err := heiftest.FindBox(file, "meta", "iprp", "ipco", "hvcC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := file[off+8 : off+size]
+	nals := hvccNALs(t, orig)
+
+	rec, err := HEVCConfigRecord(nals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// temporalIdNested, in the last header byte, is up to the encoder
+	if !bytes.Equal(rec[:21], orig[:21]) {
+		t.Errorf("record header = % x; want % x", rec[:21], orig[:21])
+	}
+	if got := hvccNALs(t, rec); fmt.Sprint(got) != fmt.Sprint(nals) {
+		t.Errorf("parameter sets differ")
+	}
+
+	var stream []byte
+	for _, nal := range append(nals, []byte{0x26, 0x01, 0xaf}) { // an IDR slice
+		stream = append(append(stream, 0, 0, 0, 1), nal...)
+	}
+	config, data, err := HEVCItemFromAnnexB(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(config, rec) {
+		t.Errorf("HEVCItemFromAnnexB config differs from HEVCConfigRecord")
+	}
+	if want := []byte{0, 0, 0, 3, 0x26, 0x01, 0xaf}; !bytes.Equal(data, want) {
+		t.Errorf("data = % x; want % x", data, want)
+	}
+
+	if _, err := HEVCConfigRecord(nals[:1]); err == nil {
+		t.Errorf("record without an SPS built")
+	}
+}
+
+func TestDepthRepresentationSEI(t *testing.T) {
+	sei := DepthRepresentationSEI(DepthInfo{Type: 2, ZNear: 0.25, ZFar: 10})
+	if nalType(sei) != nalPrefixSEI {
+		t.Fatalf("NAL type = %d; want %d", nalType(sei), nalPrefixSEI)
+	}
+	rbsp := unescapeRBSP(sei[2:])
+	if rbsp[0] != 177 || int(rbsp[1]) != len(rbsp)-3 || rbsp[len(rbsp)-1] != 0x80 {
+		t.Fatalf("SEI message = % x", rbsp)
+	}
+	br := &bitReader{b: rbsp[2:]}
+	if flags := br.bits(4); flags != 0xc {
+		t.Errorf("flags = %04b; want 1100", flags)
+	}
+	if typ := br.ue(); typ != 2 {
+		t.Errorf("type = %d; want 2", typ)
+	}
+	for _, want := range []float64{0.25, 10} {
+		sign, exponent := br.bits(1), int(br.bits(7))
+		n := int(br.bits(5)) + 1
+		mantissa := float64(br.bits(n)) / float64(uint(1)<<n)
+		if got := math.Ldexp(1+mantissa, exponent-31); sign != 0 || got != want {
+			t.Errorf("element = %v; want %v", got, want)
+		}
+	}
+
+	// 0x000000 in the payload is escaped
+	if b := escapeRBSP([]byte{0, 0, 0, 0, 1}); !bytes.Equal(b, []byte{0, 0, 3, 0, 0, 3, 1}) {
+		t.Errorf("escapeRBSP = % x", b)
+	}
+}
+
+func TestMuxer(t *testing.T) {
+	hvcC := make([]byte, 23)
+	irot := Property{Box: heiftest.Irot(90)}
+	m := NewMuxer()
+	grid, _ := m.AddItem(MuxItem{Type: ItemTypeGrid, Data: heiftest.Grid(1, 2, 1024, 512), Width: 1024, Height: 512, Properties: []Property{irot}})
+	var tiles []uint32
+	for i := 0; i < 2; i++ {
+		id, err := m.AddItem(MuxItem{Type: ItemTypeHEVC, Data: []byte{0, 0, 0, 1, byte(i)}, Config: hvcC, Width: 512, Height: 512, Hidden: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tiles = append(tiles, id)
+	}
+	xmp, _ := m.AddItem(MuxItem{Type: ItemTypeMIME, Data: []byte("<x:xmpmeta/>"), ContentType: "application/rdf+xml"})
+	if err := m.AddReference(RefDerivedImage, grid, tiles...); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddReference(RefDescribes, xmp, grid); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddReference(RefDescribes, xmp, 9); err == nil {
+		t.Errorf("reference to an unknown item added")
+	}
+
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo = %d; wrote %d bytes", n, buf.Len())
+	}
+
+	h := Open(bytes.NewReader(buf.Bytes()))
+	meta, err := h.getMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if brand := meta.FileType.MajorBrand; brand != "mif1" {
+		t.Errorf("brand = %q; want mif1", brand)
+	}
+	it, err := h.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.Info.ItemType != ItemTypeGrid || it.Rotations() != 1 {
+		t.Errorf("primary item = %q rotated %d; want grid rotated 1", it.Info.ItemType, it.Rotations())
+	}
+	if refs := it.Reference(RefDerivedImage); refs == nil || fmt.Sprint(refs.ToItemIDs) != "[2 3]" {
+		t.Errorf("dimg reference = %v; want [2 3]", refs)
+	}
+	for i, id := range tiles {
+		tile, err := h.ItemByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tile.Info.Flags&1 == 0 {
+			t.Errorf("tile %d is not hidden", id)
+		}
+		if w, h, ok := tile.SpatialExtents(); !ok || w != 512 || h != 512 {
+			t.Errorf("tile %d extents = %d, %d, %v", id, w, h, ok)
+		}
+		data, err := h.GetItemData(tile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []byte{0, 0, 0, 1, byte(i)}; !bytes.Equal(data, want) {
+			t.Errorf("tile %d data = % x; want % x", id, data, want)
+		}
+	}
+	it, err = h.ItemByID(xmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.Info.ContentType != "application/rdf+xml" || it.Reference(RefDescribes) == nil {
+		t.Errorf("xmp item = %+v", it.Info)
+	}
+
+	// the tiles share their hvcC and ispe properties
+	off, size, err := heiftest.FindBox(buf.Bytes(), "meta", "iprp", "ipco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bytes.Count(buf.Bytes()[off:off+size], []byte("hvcC")); got != 1 {
+		t.Errorf("%d hvcC properties written; want 1", got)
+	}
+}
+
+func TestMuxerDerivedItems(t *testing.T) {
+	hvcC := make([]byte, 23)
+	m := NewMuxer()
+	var images []uint32
+	for i := 0; i < 2; i++ {
+		id, err := m.AddItem(MuxItem{Type: ItemTypeHEVC, Data: []byte{0, 0, 0, 1, byte(i)}, Config: hvcC, Width: 512, Height: 256, Hidden: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, id)
+	}
+	if _, err := m.AddDerivedItem(GridItem(2, 2, 1024, 512), images...); err == nil {
+		t.Errorf("grid with missing tiles added")
+	}
+	if _, err := m.AddDerivedItem(IdentityItem(256, 512), 7); err == nil {
+		t.Errorf("identity of an unknown item added")
+	}
+	sheet, err := m.AddDerivedItem(GridItem(1, 2, 1024, 256), images...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := m.AddDerivedItem(IdentityItem(256, 512, Property{Box: heiftest.Irot(90), Essential: true}), images[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	layered, err := m.AddDerivedItem(OverlayItem(600, 300, color.White, image.Pt(0, 0), image.Pt(88, -44)), images...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetPrimary(layered); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	h := Open(bytes.NewReader(buf.Bytes()))
+	for _, tt := range []struct {
+		id  uint32
+		typ string
+		to  string
+	}{{sheet, ItemTypeGrid, "[1 2]"}, {rotated, ItemTypeIdentity, "[1]"}, {layered, ItemTypeOverlay, "[1 2]"}} {
+		it, err := h.ItemByID(tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if it.Info.ItemType != tt.typ {
+			t.Errorf("item %d type = %q; want %q", tt.id, it.Info.ItemType, tt.typ)
+		}
+		if ref := it.Reference(RefDerivedImage); ref == nil || fmt.Sprint(ref.ToItemIDs) != tt.to {
+			t.Errorf("item %d inputs = %v; want %s", tt.id, ref, tt.to)
+		}
+	}
+	it, _ := h.ItemByID(rotated)
+	if data, err := h.GetItemData(it); err != nil || len(data) != 0 {
+		t.Errorf("identity item data = % x, %v; want none", data, err)
+	}
+	if it.Rotations() != 1 {
+		t.Errorf("identity item rotations = %d; want 1", it.Rotations())
+	}
+	it, _ = h.PrimaryItem()
+	data, err := h.GetItemData(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0x58, 0x01, 0x2c, 0, 0, 0, 0, 0, 0x58, 0xff, 0xd4}
+	if !bytes.Equal(data, want) {
+		t.Errorf("overlay data = % x; want % x", data, want)
+	}
+}
+
+func TestAuxiliaryImages(t *testing.T) {
+	hvcC := make([]byte, 23)
+	hvcC[17], hvcC[18] = 0xfa, 0xfa
+	m := NewMuxer()
+	img, err := m.AddItem(MuxItem{Type: ItemTypeHEVC, Data: []byte{0, 0, 0, 1, 0}, Config: hvcC, Width: 64, Height: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alpha, err := m.AddItem(MuxItem{Type: ItemTypeHEVC, Data: []byte{0, 0, 0, 1, 1}, Config: hvcC, Width: 64, Height: 64, Hidden: true,
+		Properties: []Property{AuxProperty(AuxTypeAlpha)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddReference(RefAuxiliary, alpha, img); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	h := Open(bytes.NewReader(buf.Bytes()))
+	it, err := h.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := it.AuxType(); ok {
+		t.Errorf("primary item has an aux type")
+	}
+	aux, err := h.AuxiliaryImages(it)
+	if err != nil || len(aux) != 1 || aux[0].ID != alpha {
+		t.Fatalf("auxiliary images = %v, %v; want item %d", aux, err, alpha)
+	}
+	if typ, ok := aux[0].AuxType(); typ != AuxTypeAlpha || !ok {
+		t.Errorf("aux type = %q, %v; want %q", typ, ok, AuxTypeAlpha)
+	}
+	if c, ok := it.Properties[0].(*bmff.ItemHevcConfigBox); !ok {
+		t.Errorf("first property = %T; want hvcC", it.Properties[0])
+	} else if luma, chroma := c.BitDepth(); luma != 10 || chroma != 10 {
+		t.Errorf("bit depth = %d, %d; want 10, 10", luma, chroma)
+	}
+}
+
+func TestMuxerTrack(t *testing.T) {
+	m := NewMuxer()
+	if _, err := m.AddItem(MuxItem{Type: ItemTypeAV1, Data: []byte{1, 2}, Width: 64, Height: 64}); err != nil {
+		t.Fatal(err)
+	}
+	track := MuxTrack{Type: ItemTypeAV1, Width: 64, Height: 64, Timescale: 1000, LoopCount: 2}
+	for i, d := range []uint32{100, 100, 50} {
+		track.Samples = append(track.Samples, MuxSample{Data: []byte{byte(i), 0xaa}, Duration: d, Sync: i != 1})
+	}
+	if _, err := m.AddTrack(MuxTrack{Type: ItemTypeAV1, Width: 64, Height: 64}); err == nil {
+		t.Errorf("track without a timescale added")
+	}
+	if _, err := m.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+	if got, want := string(file[8:12]), "avis"; got != want {
+		t.Errorf("brand = %q; want %q", got, want)
+	}
+	if it, err := Open(bytes.NewReader(file)).PrimaryItem(); err != nil || it.Info.ItemType != ItemTypeAV1 {
+		t.Errorf("primary item = %v, %v", it, err)
+	}
+
+	box := func(path ...string) []byte {
+		t.Helper()
+		off, size, err := heiftest.FindBox(file, append([]string{"moov"}, path...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file[off+12 : off+size] // full box bodies
+	}
+	stbl := []string{"trak", "mdia", "minf", "stbl"}
+	off := binary.BigEndian.Uint32(box(append(stbl, "stco")...)[4:])
+	if got := file[off : off+6]; !bytes.Equal(got, []byte{0, 0xaa, 1, 0xaa, 2, 0xaa}) {
+		t.Errorf("samples = % x", got)
+	}
+	if got, want := box(append(stbl, "stts")...), []byte{0, 0, 0, 2, 0, 0, 0, 2, 0, 0, 0, 100, 0, 0, 0, 1, 0, 0, 0, 50}; !bytes.Equal(got, want) {
+		t.Errorf("stts = % x; want % x", got, want)
+	}
+	if got, want := box(append(stbl, "stss")...), []byte{0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 3}; !bytes.Equal(got, want) {
+		t.Errorf("stss = % x; want % x", got, want)
+	}
+	// three passes of 250ms
+	if got := binary.BigEndian.Uint64(box("trak", "tkhd")[24:]); got != 750 {
+		t.Errorf("track duration = %d; want 750", got)
+	}
+	if got := binary.BigEndian.Uint64(box("trak", "edts", "elst")[4:]); got != 250 {
+		t.Errorf("edit duration = %d; want 250", got)
+	}
+}
+
+func TestStreamMuxer(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewStreamMuxer(&buf)
+	if _, err := m.AddItem(MuxItem{Type: ItemTypeAV1, Data: []byte{1, 2}, Width: 64, Height: 64}); err != nil {
+		t.Fatal(err)
+	}
+	exifID, err := m.AddItem(ExifItem([]byte("II*\x00")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddReference(RefDescribes, exifID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AddItem(XMPItem([]byte("<x:xmpmeta/>"))); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() == 0 {
+		t.Errorf("nothing written before Close")
+	}
+	id, err := m.AddTrack(MuxTrack{Type: ItemTypeAV1, Width: 64, Height: 64, Timescale: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err == nil {
+		t.Errorf("track without samples closed")
+	}
+	for i := 0; i < 3; i++ {
+		if err := m.WriteSample(id, MuxSample{Data: []byte{byte(i), 0xaa}, Duration: 100, Sync: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	f := Open(bytes.NewReader(file))
+	it, err := f.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := f.GetItemData(it); err != nil || !bytes.Equal(data, []byte{1, 2}) {
+		t.Errorf("item data = % x, %v", data, err)
+	}
+	if exif, err := f.EXIF(); err != nil || string(exif) != "Exif\x00\x00II*\x00" {
+		t.Errorf("EXIF = %q, %v", exif, err)
+	}
+	if xmp, err := f.XMP(); err != nil || string(xmp) != "<x:xmpmeta/>" {
+		t.Errorf("XMP = %q, %v", xmp, err)
+	}
+
+	mdat, _, err := heiftest.FindBox(file, "mdat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, _, err := heiftest.FindBox(file, "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta < mdat {
+		t.Errorf("meta at %d before mdat at %d", meta, mdat)
+	}
+	// each sample is a chunk of its own mdat box
+	off, size, err := heiftest.FindBox(file, "moov", "trak", "mdia", "minf", "stbl", "stco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stco := file[off+12 : off+size]
+	if n := binary.BigEndian.Uint32(stco); n != 3 {
+		t.Fatalf("%d chunks; want 3", n)
+	}
+	for i := 0; i < 3; i++ {
+		off := binary.BigEndian.Uint32(stco[4+4*i:])
+		if got := file[off : off+2]; !bytes.Equal(got, []byte{byte(i), 0xaa}) {
+			t.Errorf("sample %d = % x", i, got)
+		}
+	}
+}
+
+// transformed applies the irot and imir properties of it, in order, to m.
+func transformed(it *Item, m [][]int) [][]int {
+	for _, p := range it.Properties {
+		switch p := p.(type) {
+		case *bmff.ImageRotation:
+			for i := 0; i < int(p.Angle); i++ {
+				m = rotateCCW(m)
+			}
+		case *bmff.ImageMirror:
+			m = flip(m, p.Mirror)
+		}
+	}
+	return m
+}
+
+func rotateCCW(m [][]int) [][]int {
+	out := make([][]int, len(m[0]))
+	for y := range out {
+		out[y] = make([]int, len(m))
+		for x := range out[y] {
+			out[y][x] = m[x][len(m[0])-1-y]
+		}
+	}
+	return out
+}
+
+// flip mirrors m about the vertical (0) or horizontal (1) axis.
+func flip(m [][]int, axis uint8) [][]int {
+	out := make([][]int, len(m))
+	for y := range m {
+		out[y] = make([]int, len(m[y]))
+		for x := range m[y] {
+			if axis == 0 {
+				out[y][x] = m[y][len(m[y])-1-x]
+			} else {
+				out[y][x] = m[len(m)-1-y][x]
+			}
+		}
+	}
+	return out
+}
+
+func TestRewriteTransform(t *testing.T) {
+	m := [][]int{{1, 2, 3}, {4, 5, 6}}
+	for _, tc := range []struct {
+		props    [][]byte // of the primary item
+		rotate90 int
+		mirror   bool
+	}{
+		{nil, 1, false},
+		{nil, 0, true},
+		{nil, -1, true},
+		{[][]byte{heiftest.Irot(270)}, 1, false},
+		{[][]byte{heiftest.Irot(90)}, 2, true},
+		{[][]byte{heiftest.Property("imir", []byte{1})}, 1, false},
+		{[][]byte{heiftest.Property("imir", []byte{0}), heiftest.Irot(90)}, 1, true},
+		{[][]byte{heiftest.Irot(180), heiftest.Property("imir", []byte{1})}, 3, true},
+	} {
+		g := heiftest.HEVCGrid(1, 2, 1024, 512, heiftest.Property("hvcC", make([]byte, 23)), []byte{0, 0, 0, 1, 0x26}, 512, 512)
+		g.Items[0].Props = append(g.Items[0].Props, tc.props...)
+		src := g.Bytes()
+		name := fmt.Sprintf("%d props, rotate %d, mirror %v", len(tc.props), tc.rotate90, tc.mirror)
+
+		var dst bytes.Buffer
+		if err := RewriteTransform(bytes.NewReader(src), &dst, tc.rotate90, tc.mirror); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		before, after := Open(bytes.NewReader(src)), Open(bytes.NewReader(dst.Bytes()))
+		old, err := before.PrimaryItem()
+		if err != nil {
+			t.Fatal(err)
+		}
+		it, err := after.PrimaryItem()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		want := transformed(old, m)
+		for i := 0; i < (tc.rotate90%4+4)%4; i++ {
+			want = rotateCCW(want)
+		}
+		if tc.mirror {
+			want = flip(want, 0)
+		}
+		if got := transformed(it, m); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: image = %v; want %v", name, got, want)
+		}
+		if w, h, _ := it.SpatialExtents(); w != 1024 || h != 512 {
+			t.Errorf("%s: ispe = %dx%d; want it unchanged", name, w, h)
+		}
+
+		// the tiles moved with the grown meta box
+		for id := uint32(2); id <= 3; id++ {
+			a, _ := before.ItemByID(id)
+			b, err := after.ItemByID(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			da, _ := before.GetItemData(a)
+			db, err := after.GetItemData(b)
+			if err != nil || !bytes.Equal(da, db) {
+				t.Errorf("%s: tile %d data = % x, %v; want % x", name, id, db, err, da)
+			}
+		}
+	}
+}
+
+func TestRewriteTransformFile(t *testing.T) {
+	src, err := os.ReadFile("testdata/rotate.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dst bytes.Buffer
+	if err := RewriteTransform(bytes.NewReader(src), &dst, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	before, after := Open(bytes.NewReader(src)), Open(bytes.NewReader(dst.Bytes()))
+	it, err := after.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := it.Rotations(); r != 0 {
+		t.Errorf("Rotations = %d; want 0", r)
+	}
+	old, err := before.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file is truncated after the meta box, so compare the locations
+	delta := int64(dst.Len() - len(src))
+	for _, ref := range old.Reference(RefDerivedImage).ToItemIDs {
+		a, _ := before.ItemByID(ref)
+		b, err := after.ItemByID(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := int64(b.Location.Extents[0].Offset), int64(a.Location.Extents[0].Offset)+delta; got != want {
+			t.Fatalf("tile %d offset = %d; want %d", ref, got, want)
+		}
+	}
+}
+
+func TestRewriteCrop(t *testing.T) {
+	g := heiftest.HEVCGrid(1, 2, 1024, 512, heiftest.Property("hvcC", make([]byte, 23)), []byte{0, 0, 0, 1, 0x26}, 512, 512)
+	g.Items[0].Props = append(g.Items[0].Props, heiftest.Irot(90))
+	src := g.Bytes()
+
+	var cropped bytes.Buffer
+	if err := RewriteCrop(bytes.NewReader(src), &cropped, image.Rect(101, 33, 900, 400)); err != nil {
+		t.Fatal(err)
+	}
+	it, err := Open(bytes.NewReader(cropped.Bytes())).PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := it.CleanAperture(); !ok || r != image.Rect(100, 32, 900, 400) {
+		t.Errorf("CleanAperture = %v, %v; want (100,32)-(900,400)", r, ok)
+	}
+	// the crop applies before the rotation
+	var types []string
+	for _, p := range it.Properties {
+		types = append(types, p.Type().String())
+	}
+	if got := strings.Join(types, " "); !strings.HasSuffix(got, "clap irot") {
+		t.Errorf("properties = %s; want clap before irot", got)
+	}
+	if it.Rotations() != 1 {
+		t.Errorf("Rotations = %d; want 1", it.Rotations())
+	}
+
+	// cropping to the whole image removes the crop
+	var uncropped bytes.Buffer
+	if err := RewriteCrop(bytes.NewReader(cropped.Bytes()), &uncropped, image.Rect(-10, -10, 2000, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	it, err = Open(bytes.NewReader(uncropped.Bytes())).PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := it.CleanAperture(); ok {
+		t.Errorf("CleanAperture = %v after uncropping", r)
+	}
+
+	if err := RewriteCrop(bytes.NewReader(src), io.Discard, image.Rect(2000, 0, 2100, 10)); err == nil {
+		t.Errorf("crop outside of the image succeeded")
+	}
+}
+
+func TestExtractBitstream(t *testing.T) {
+	// a zero hvcC record declares 1 byte NAL unit lengths
+	hvcC := make([]byte, 23)
+	hvcC[22] = 1 // one array
+	hvcC = append(hvcC, 0x20, 0, 1, 0, 2, 0x40, 0x01)
+	g := heiftest.HEVCGrid(1, 2, 1024, 512, heiftest.Property("hvcC", hvcC), []byte{2, 0x26, 0x01}, 512, 512)
+	h := Open(bytes.NewReader(g.Bytes()))
+	it, err := h.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := h.ExtractBitstream(&buf, it); err != nil {
+		t.Fatal(err)
+	}
+	// the parameter sets are written once, then each tile
+	want := []byte{0, 0, 0, 1, 0x40, 0x01, 0, 0, 0, 1, 0x26, 0x01, 0, 0, 0, 1, 0x26, 0x01}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("Annex-B stream = % x; want % x", buf.Bytes(), want)
+	}
+
+	av1 := &heiftest.File{Brand: "avif"}
+	av1.AddItem("av01", []byte{0x0a, 0x01, 0xff}, heiftest.Ispe(64, 48))
+	h = Open(bytes.NewReader(av1.Bytes()))
+	if it, err = h.PrimaryItem(); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := h.ExtractBitstream(&buf, it); err != nil {
+		t.Fatal(err)
+	}
+	ivf := buf.Bytes()
+	if len(ivf) != 32+12+5 || string(ivf[:4]) != "DKIF" || string(ivf[8:12]) != "AV01" {
+		t.Fatalf("IVF file = % x", ivf)
+	}
+	if w, h := binary.LittleEndian.Uint16(ivf[12:]), binary.LittleEndian.Uint16(ivf[14:]); w != 64 || h != 48 {
+		t.Errorf("IVF size = %dx%d; want 64x48", w, h)
+	}
+	if frame := ivf[32:]; binary.LittleEndian.Uint32(frame) != 5 || !bytes.Equal(frame[12:], []byte{0x12, 0, 0x0a, 0x01, 0xff}) {
+		t.Errorf("IVF frame = % x", frame)
+	}
+
+	exif := &heiftest.File{}
+	exif.AddItem("Exif", []byte{0, 0, 0, 0})
+	h = Open(bytes.NewReader(exif.Bytes()))
+	if it, err = h.PrimaryItem(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ExtractBitstream(io.Discard, it); err == nil {
+		t.Errorf("extracted a bitstream from an Exif item")
+	}
+}
+
+func FuzzOpen(f *testing.F) {
+	for _, name := range []string{"testdata/park.heic", "testdata/rotate.heic", "../testdata/camel.heic"} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		// the meta box is at the start; the rest is mostly mdat
+		f.Add(b[:min(len(b), 16<<10)])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h := Open(bytes.NewReader(data))
+		meta, err := h.getMeta()
+		if err != nil {
+			return
+		}
+		h.EXIF()
+		h.XMP()
+		if it, err := h.PrimaryItem(); err == nil {
+			h.Thumbnails(it)
+			h.AuxiliaryImages(it)
+			h.ExtractBitstream(io.Discard, it)
+		}
+		if meta.ItemInfo == nil {
+			return
+		}
+		for _, ife := range meta.ItemInfo.ItemInfos {
+			it, err := h.ItemByID(uint32(ife.ItemID))
+			if err != nil {
+				continue
+			}
+			it.SpatialExtents()
+			it.VisualDimensions()
+			it.CleanAperture()
+			it.Rotations()
+			it.Mirror()
+			it.ICCProfile()
+			it.AuxType()
+			if hvcc, ok := it.HevcConfig(); ok {
+				hvcc.AsHeader()
+			}
+			if b, err := h.GetItemData(it); err == nil && len(b) > len(data) {
+				t.Fatalf("item %d has %d bytes of data in a %d byte file", it.ID, len(b), len(data))
+			}
+			if r, err := h.ItemDataReader(it); err == nil && r != nil {
+				io.Copy(io.Discard, r)
+			}
+		}
+	})
+}
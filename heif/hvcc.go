@@ -0,0 +1,429 @@
+package heif
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// HEVC NAL unit types of the parameter sets and SEI messages.
+const (
+	nalVPS       = 32
+	nalSPS       = 33
+	nalPPS       = 34
+	nalPrefixSEI = 39
+)
+
+// HEVCItemFromAnnexB splits an Annex-B HEVC stream holding one coded
+// picture, as written by encoders, into the hvcC record and item data of
+// a MuxItem: the parameter sets go to the record and the other NAL units,
+// length-prefixed, to the data. configNALs, such as the SEI message of
+// DepthRepresentationSEI, are added to the record.
+func HEVCItemFromAnnexB(stream []byte, configNALs ...[]byte) (config, data []byte, err error) {
+	params := configNALs[:len(configNALs):len(configNALs)]
+	for _, nal := range splitAnnexB(stream) {
+		switch nalType(nal) {
+		case nalVPS, nalSPS, nalPPS:
+			params = append(params, nal)
+		default:
+			data = binary.BigEndian.AppendUint32(data, uint32(len(nal)))
+			data = append(data, nal...)
+		}
+	}
+	if len(data) == 0 {
+		return nil, nil, errors.New("heif: no picture in HEVC stream")
+	}
+	config, err = HEVCConfigRecord(params)
+	return config, data, err
+}
+
+// HEVCConfigRecord returns the body of an hvcC property holding the given
+// VPS, SPS, PPS and prefix SEI NAL units. The profile, level, chroma
+// format and bit depths are taken from the first SPS.
+func HEVCConfigRecord(nals [][]byte) ([]byte, error) {
+	var sps []byte
+	for _, nal := range nals {
+		if nalType(nal) == nalSPS {
+			sps = nal
+			break
+		}
+	}
+	if sps == nil {
+		return nil, errors.New("heif: no SPS")
+	}
+	info, err := parseSPS(sps)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := []byte{1} // configurationVersion
+	rec = append(rec, info.ptl[:]...)
+	rec = append(rec,
+		0xf0, 0x00, // min_spatial_segmentation_idc
+		0xfc, // parallelismType
+		0xfc|info.chromaFormat,
+		0xf8|(info.bitDepthLuma-8),
+		0xf8|(info.bitDepthChroma-8),
+		0, 0, // avgFrameRate
+		info.maxSubLayers<<3|info.temporalIDNesting<<2|3, // 4 byte NAL lengths
+	)
+
+	var arrays [][]byte
+	for _, typ := range []int{nalVPS, nalSPS, nalPPS, nalPrefixSEI} {
+		array := []byte{byte(typ), 0, 0}
+		if typ != nalPrefixSEI {
+			array[0] |= 0x80 // complete
+		}
+		n := 0
+		for _, nal := range nals {
+			if nalType(nal) == typ {
+				array = binary.BigEndian.AppendUint16(array, uint16(len(nal)))
+				array = append(array, nal...)
+				n++
+			}
+		}
+		if n > 0 {
+			binary.BigEndian.PutUint16(array[1:], uint16(n))
+			arrays = append(arrays, array)
+		}
+	}
+	rec = append(rec, byte(len(arrays)))
+	for _, a := range arrays {
+		rec = append(rec, a...)
+	}
+	return rec, nil
+}
+
+// AppendHEVCConfigNALs returns the hvcC record config with nals, such as
+// the SEI message of DepthRepresentationSEI, added to its NAL unit arrays.
+// config is not modified.
+func AppendHEVCConfigNALs(config []byte, nals ...[]byte) ([]byte, error) {
+	const headerSize = 22
+	if len(config) <= headerSize {
+		return nil, errors.New("heif: hvcC record too short")
+	}
+	type array struct {
+		head  byte // completeness and NAL unit type
+		units [][]byte
+	}
+	var arrays []*array
+	b := config[headerSize+1:]
+	for i := 0; i < int(config[headerSize]); i++ {
+		if len(b) < 3 {
+			return nil, errors.New("heif: truncated hvcC record")
+		}
+		a := &array{head: b[0]}
+		n := int(binary.BigEndian.Uint16(b[1:]))
+		b = b[3:]
+		for j := 0; j < n; j++ {
+			size := -1
+			if len(b) >= 2 {
+				size = int(binary.BigEndian.Uint16(b))
+			}
+			if size < 0 || len(b) < 2+size {
+				return nil, errors.New("heif: truncated hvcC record")
+			}
+			a.units = append(a.units, b[2:2+size])
+			b = b[2+size:]
+		}
+		arrays = append(arrays, a)
+	}
+
+next:
+	for _, nal := range nals {
+		for _, a := range arrays {
+			if int(a.head&0x3f) == nalType(nal) {
+				a.units = append(a.units, nal)
+				continue next
+			}
+		}
+		arrays = append(arrays, &array{head: byte(nalType(nal)), units: [][]byte{nal}})
+	}
+	if len(arrays) > 255 {
+		return nil, errors.New("heif: too many NAL unit arrays")
+	}
+
+	rec := append(config[:headerSize:headerSize], byte(len(arrays)))
+	for _, a := range arrays {
+		rec = append(rec, a.head)
+		rec = binary.BigEndian.AppendUint16(rec, uint16(len(a.units)))
+		for _, u := range a.units {
+			rec = binary.BigEndian.AppendUint16(rec, uint16(len(u)))
+			rec = append(rec, u...)
+		}
+	}
+	return rec, nil
+}
+
+type spsInfo struct {
+	ptl               [12]byte // general profile, tier and level
+	maxSubLayers      byte
+	temporalIDNesting byte
+	chromaFormat      byte
+	bitDepthLuma      byte
+	bitDepthChroma    byte
+}
+
+// parseSPS reads the fields of an SPS NAL unit needed by the hvcC record.
+func parseSPS(nal []byte) (*spsInfo, error) {
+	rbsp := unescapeRBSP(nal)
+	if len(rbsp) < 15 {
+		return nil, errors.New("heif: SPS too short")
+	}
+	info := &spsInfo{
+		maxSubLayers:      (rbsp[2]>>1)&7 + 1,
+		temporalIDNesting: rbsp[2] & 1,
+	}
+	copy(info.ptl[:], rbsp[3:15])
+
+	br := &bitReader{b: rbsp[15:]}
+	if n := int(info.maxSubLayers) - 1; n > 0 {
+		var present []uint
+		for i := 0; i < n; i++ {
+			present = append(present, br.bits(2))
+		}
+		br.bits(2 * (8 - n)) // reserved
+		for _, p := range present {
+			if p&2 != 0 {
+				br.bits(88) // sub-layer profile
+			}
+			if p&1 != 0 {
+				br.bits(8) // sub-layer level
+			}
+		}
+	}
+	br.ue() // sps_seq_parameter_set_id
+	chroma := br.ue()
+	if chroma == 3 {
+		br.bits(1) // separate_colour_plane_flag
+	}
+	br.ue() // pic_width_in_luma_samples
+	br.ue() // pic_height_in_luma_samples
+
+	// conformance window offsets
+	if br.bits(1) != 0 {
+		br.ue()
+		br.ue()
+		br.ue()
+		br.ue()
+	}
+	luma, chr := br.ue(), br.ue()
+	if br.err != nil {
+		return nil, br.err
+	}
+	if chroma > 3 || luma > 8 || chr > 8 {
+		return nil, fmt.Errorf("heif: invalid SPS: chroma format %d, bit depths %d, %d", chroma, luma+8, chr+8)
+	}
+	info.chromaFormat = byte(chroma)
+	info.bitDepthLuma = byte(luma + 8)
+	info.bitDepthChroma = byte(chr + 8)
+	return info, nil
+}
+
+func nalType(nal []byte) int {
+	if len(nal) < 2 {
+		return -1
+	}
+	return int(nal[0]>>1) & 0x3f
+}
+
+// unescapeRBSP removes emulation prevention bytes (00 00 03).
+func unescapeRBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// splitAnnexB returns the NAL units of an Annex-B byte stream.
+func splitAnnexB(data []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			for end > start && data[end-1] == 0 {
+				end--
+			}
+			nals = append(nals, data[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nals = append(nals, data[start:])
+	}
+	return nals
+}
+
+// bitReader reads big endian bit fields and Exp-Golomb codes.
+type bitReader struct {
+	b   []byte
+	pos int // in bits
+	err error
+}
+
+func (r *bitReader) bits(n int) uint {
+	var v uint
+	for ; n > 0; n-- {
+		if r.pos >= 8*len(r.b) {
+			r.err = errors.New("heif: SPS truncated")
+			return 0
+		}
+		v = v<<1 | uint(r.b[r.pos/8]>>(7-r.pos%8))&1
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for r.bits(1) == 0 {
+		if r.err != nil || zeros == 31 {
+			r.err = errors.New("heif: invalid Exp-Golomb code in SPS")
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// DepthInfo describes the samples of a depth map, as in the depth
+// representation information SEI message of HEVC.
+type DepthInfo struct {
+	// Type is the depth representation type: 0 for samples uniformly
+	// quantizing 1/Z, 1 for uniform disparity, 2 for uniform Z.
+	Type int
+
+	// ZNear and ZFar are the distances of the nearest and farthest depth
+	// sample values; zero if unknown.
+	ZNear, ZFar float64
+}
+
+// DepthRepresentationSEI returns a prefix SEI NAL unit holding a depth
+// representation information message, for the hvcC record of a depth map
+// (see HEVCItemFromAnnexB).
+func DepthRepresentationSEI(info DepthInfo) []byte {
+	var bw bitWriter
+	bw.bit(info.ZNear != 0)
+	bw.bit(info.ZFar != 0)
+	bw.bit(false) // d_min_flag
+	bw.bit(false) // d_max_flag
+	bw.ue(uint(info.Type))
+	for _, z := range []float64{info.ZNear, info.ZFar} {
+		if z != 0 {
+			bw.depthElement(z)
+		}
+	}
+	if bw.n%8 != 0 {
+		// payload_bit_equal_to_one and alignment zeros
+		bw.bit(true)
+		for bw.n%8 != 0 {
+			bw.bit(false)
+		}
+	}
+	payload := bw.b
+
+	rbsp := []byte{177} // depth_representation_info
+	for n := len(payload); ; n -= 255 {
+		if n < 255 {
+			rbsp = append(rbsp, byte(n))
+			break
+		}
+		rbsp = append(rbsp, 255)
+	}
+	rbsp = append(rbsp, payload...)
+	rbsp = append(rbsp, 0x80) // rbsp_trailing_bits
+	return append([]byte{nalPrefixSEI << 1, 1}, escapeRBSP(rbsp)...)
+}
+
+// bitWriter writes big endian bit fields and Exp-Golomb codes.
+type bitWriter struct {
+	b []byte
+	n int // in bits
+}
+
+func (w *bitWriter) bits(v uint, n int) {
+	for n--; n >= 0; n-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>n&1) << (7 - w.n%8)
+		w.n++
+	}
+}
+
+func (w *bitWriter) bit(b bool) {
+	if b {
+		w.bits(1, 1)
+	} else {
+		w.bits(0, 1)
+	}
+}
+
+func (w *bitWriter) ue(v uint) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v, n+1)
+}
+
+// depthElement writes a depth_rep_info_element: a sign, a 7-bit exponent
+// and a mantissa, for x = (-1)^sign * 2^(exponent-31) * (1 + mantissa).
+func (w *bitWriter) depthElement(x float64) {
+	const mantissaBits = 16
+	frac, exp := math.Frexp(math.Abs(x)) // frac in [0.5, 1)
+	mantissa := uint(math.Round((2*frac - 1) * (1 << mantissaBits)))
+	if mantissa == 1<<mantissaBits {
+		mantissa, exp = 0, exp+1
+	}
+	exponent := exp - 1 + 31
+	if exponent <= 0 || exponent >= 127 {
+		// out of range: 0 or the largest value
+		exponent, mantissa = 0, 0
+		if exp > 0 {
+			exponent, mantissa = 126, 1<<mantissaBits-1
+		}
+	}
+	w.bit(x < 0)
+	w.bits(uint(exponent), 7)
+	w.bits(mantissaBits-1, 5)
+	w.bits(mantissa, mantissaBits)
+}
+
+// escapeRBSP inserts emulation prevention bytes.
+func escapeRBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b)+len(b)/64)
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
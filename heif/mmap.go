@@ -0,0 +1,59 @@
+package heif
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// MappedFile is a file mapped read-only into memory. A File opened on a
+// MappedFile returns item data from GetItemData without copying it.
+//
+// The slices returned by GetItemData alias the mapping: they must not be
+// modified, and must not be used after Close. Copy the data to keep it.
+//
+// On Unix the mapping is shared with the file, so the file must not be
+// truncated while it is mapped: reading pages past its new end raises
+// SIGBUS, which crashes the program.
+type MappedFile struct {
+	*bytes.Reader
+	data  []byte
+	unmap func() error
+}
+
+// MapFile maps the named file into memory. On systems without mmap the
+// file is read into memory instead.
+func MapFile(name string) (*MappedFile, error) {
+	data, unmap, err := mapFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &MappedFile{Reader: bytes.NewReader(data), data: data, unmap: unmap}, nil
+}
+
+// Slice returns n bytes at off without copying them.
+func (m *MappedFile) Slice(off, n int64) ([]byte, error) {
+	if m.data == nil {
+		return nil, errors.New("heif: mapped file is closed")
+	}
+	if off < 0 || n < 0 || n > int64(len(m.data))-off {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return m.data[off : off+n : off+n], nil
+}
+
+// Close unmaps the file.
+func (m *MappedFile) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	m.data = nil
+	m.Reader.Reset(nil)
+	return m.unmap()
+}
+
+// slicer is implemented by readers that can return their data without
+// copying, such as *MappedFile.
+type slicer interface {
+	Slice(off, n int64) ([]byte, error)
+}
@@ -0,0 +1,666 @@
+package heif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// Property is an item property box written by a Muxer.
+type Property struct {
+	Box       []byte // the complete box, header included
+	Essential bool   // readers must understand it to process the item
+}
+
+// MuxItem describes an item written by a Muxer.
+type MuxItem struct {
+	Type string // such as ItemTypeHEVC, ItemTypeAV1, ItemTypeGrid or ItemTypeExif
+	Data []byte // the item data: length-prefixed NAL units for HEVC items
+
+	// Config is the body of the codec configuration property: the hvcC
+	// record of HEVC items (see HEVCConfigRecord) or the av1C record of AV1
+	// items.
+	Config []byte
+
+	// Width and Height, if set, are written as an ispe property.
+	Width, Height int
+
+	Properties  []Property // further properties, such as irot or colr
+	Hidden      bool       // not meant to be displayed, such as grid tiles
+	ContentType string     // of mime items, such as XMP
+}
+
+// Muxer writes HEIF files from items that are already encoded, such as
+// HEVC or AV1 bitstreams, without an encoder.
+type Muxer struct {
+	// Brand is the major brand. If empty, it is chosen from the type of
+	// the first track or else of the primary item: "hevc" and "avis" for
+	// HEVC and AV1 sequences, "heic" and "avif" for HEVC and AV1 images,
+	// else "mif1".
+	Brand string
+	// Compatible lists the compatible brands. If empty, "mif1" and the
+	// brand are written, the image brand and "msf1" and "iso8" for
+	// sequences, and "miaf" for AV1.
+	Compatible []string
+
+	items   []*MuxItem
+	refs    []muxRef
+	groups  []muxRef
+	tracks  []*MuxTrack
+	primary uint16
+}
+
+type muxRef struct {
+	typ  string
+	from uint16
+	to   []uint16
+}
+
+// Entity group types.
+const (
+	GroupAlternatives = "altr" // alternatives of each other, such as burst shots
+)
+
+// NewMuxer returns an empty Muxer.
+func NewMuxer() *Muxer {
+	return &Muxer{}
+}
+
+// AddItem adds an item and returns its ID. The first item added is the
+// primary item unless SetPrimary is called.
+func (m *Muxer) AddItem(it MuxItem) (uint32, error) {
+	if len(m.items) == math.MaxUint16 {
+		return 0, errors.New("heif: too many items")
+	}
+	m.items = append(m.items, &it)
+	return uint32(len(m.items)), nil
+}
+
+// AddReference adds a reference of type typ, such as RefDerivedImage from
+// a grid to its tiles, from one item to others.
+func (m *Muxer) AddReference(typ string, from uint32, to ...uint32) error {
+	if len(typ) != 4 {
+		return fmt.Errorf("heif: invalid reference type %q", typ)
+	}
+	ref := muxRef{typ: typ, from: uint16(from)}
+	for _, id := range append(to, from) {
+		if id == 0 || id > uint32(len(m.items)) {
+			return fmt.Errorf("heif: reference to unknown item %d", id)
+		}
+	}
+	for _, id := range to {
+		ref.to = append(ref.to, uint16(id))
+	}
+	m.refs = append(m.refs, ref)
+	return nil
+}
+
+// AddGroup adds an entity group of type typ, such as GroupAlternatives,
+// holding the given items in order of preference. Groups are numbered
+// after the items when the file is written.
+func (m *Muxer) AddGroup(typ string, ids ...uint32) error {
+	if len(typ) != 4 {
+		return fmt.Errorf("heif: invalid group type %q", typ)
+	}
+	g := muxRef{typ: typ}
+	for _, id := range ids {
+		if id == 0 || id > uint32(len(m.items)) {
+			return fmt.Errorf("heif: group of unknown item %d", id)
+		}
+		g.to = append(g.to, uint16(id))
+	}
+	m.groups = append(m.groups, g)
+	return nil
+}
+
+// SetPrimary sets the primary item.
+func (m *Muxer) SetPrimary(id uint32) error {
+	if id == 0 || id > uint32(len(m.items)) {
+		return fmt.Errorf("heif: unknown item %d", id)
+	}
+	m.primary = uint16(id)
+	return nil
+}
+
+func (m *Muxer) primaryID() uint16 {
+	if m.primary == 0 && len(m.items) > 0 {
+		return 1
+	}
+	return m.primary
+}
+
+func (m *Muxer) brands() (string, []string) {
+	var typ, image string
+	if len(m.tracks) > 0 {
+		typ = m.tracks[0].Type
+	} else if id := m.primaryID(); id != 0 {
+		typ = m.items[id-1].Type
+	}
+	switch typ {
+	case ItemTypeHEVC:
+		image = "heic"
+	case ItemTypeAV1:
+		image = "avif"
+	default:
+		image = "mif1"
+	}
+	brand := image
+	if len(m.tracks) > 0 {
+		switch typ {
+		case ItemTypeHEVC:
+			brand = "hevc"
+		case ItemTypeAV1:
+			brand = "avis"
+		}
+	}
+	if m.Brand != "" {
+		brand = m.Brand
+	}
+	if len(m.Compatible) > 0 {
+		return brand, m.Compatible
+	}
+
+	compatible := []string{"mif1"}
+	if image != "mif1" {
+		compatible = append(compatible, image)
+	}
+	if len(m.tracks) > 0 {
+		compatible = append(compatible, brand, "msf1", "iso8")
+	} else if brand != image && brand != "mif1" {
+		compatible = append(compatible, brand)
+	}
+	if typ == ItemTypeAV1 {
+		compatible = append(compatible, "miaf")
+	}
+	return brand, compatible
+}
+
+// WriteTo writes the file: the ftyp, meta, moov and mdat boxes, in that
+// order. The meta box is left out if there are only tracks, and the moov
+// box if there are only items.
+func (m *Muxer) WriteTo(w io.Writer) (int64, error) {
+	if len(m.items) == 0 && len(m.tracks) == 0 {
+		return 0, errors.New("heif: no items")
+	}
+
+	ftypBox := m.ftyp()
+	var dataSize int64
+	for _, it := range m.items {
+		dataSize += int64(len(it.Data))
+	}
+	for _, t := range m.tracks {
+		for _, s := range t.Samples {
+			dataSize += int64(len(s.Data))
+		}
+	}
+	large := bmff.HeaderSize(dataSize, false) == 16
+
+	// offsets only change the size of the boxes with their width, which
+	// only grows with them
+	var head []byte
+	for dataStart := int64(0); ; {
+		// the data follows in order
+		off := dataStart
+		items := make([]extent, len(m.items))
+		for i, it := range m.items {
+			items[i] = extent{off, int64(len(it.Data))}
+			off += items[i].size
+		}
+		samples := make([][]extent, len(m.tracks))
+		for i, t := range m.tracks {
+			for _, s := range t.Samples {
+				samples[i] = append(samples[i], extent{off, int64(len(s.Data))})
+				off += int64(len(s.Data))
+			}
+		}
+
+		boxes, err := m.metaAndMoov(items, samples)
+		if err != nil {
+			return 0, err
+		}
+		head = append(ftypBox[:len(ftypBox):len(ftypBox)], boxes...)
+		start := int64(len(head)) + bmff.HeaderSize(dataSize, large)
+		if start == dataStart {
+			break
+		}
+		dataStart = start
+	}
+
+	// errors are sticky, so the last one tells
+	bw := bmff.NewWriter(w)
+	bw.Write(head)
+	err := bw.WriteBoxHeader(boxType("mdat"), dataSize, large)
+	for _, it := range m.items {
+		_, err = bw.Write(it.Data)
+	}
+	for _, t := range m.tracks {
+		for _, s := range t.Samples {
+			_, err = bw.Write(s.Data)
+		}
+	}
+	return bw.Offset(), err
+}
+
+// extent is the location of item data or of a sample in the file.
+type extent struct {
+	off, size int64
+}
+
+func (m *Muxer) ftyp() []byte {
+	brand, compatible := m.brands()
+	ftyp := append([]byte(brand), 0, 0, 0, 0)
+	for _, c := range compatible {
+		ftyp = append(ftyp, c...)
+	}
+	return bmff.AppendBox(nil, boxType("ftyp"), ftyp)
+}
+
+// metaAndMoov returns the meta box of the items and the moov box of the
+// tracks, if any, given the locations of their data.
+func (m *Muxer) metaAndMoov(items []extent, samples [][]extent) ([]byte, error) {
+	var b []byte
+	if len(m.items) > 0 {
+		meta, err := m.meta(items)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, meta...)
+	}
+	if len(m.tracks) > 0 {
+		b = append(b, m.moov(samples)...)
+	}
+	return b, nil
+}
+
+func (m *Muxer) meta(locs []extent) ([]byte, error) {
+	// the boxes are in the order of the files of Apple devices, which some
+	// of their readers expect
+	hdlr := append(make([]byte, 4), "pict"...)
+	hdlr = append(hdlr, make([]byte, 13)...) // reserved, empty name
+	body := bmff.AppendFullBox(nil, boxType("hdlr"), 0, 0, hdlr)
+	body = appendDinf(body)
+	body = bmff.AppendFullBox(body, boxType("pitm"), 0, 0, binary.BigEndian.AppendUint16(nil, m.primaryID()))
+
+	offsetSize := 4
+	for _, l := range locs {
+		if l.off+l.size > math.MaxUint32 {
+			offsetSize = 8
+		}
+	}
+	iloc := []byte{byte(offsetSize<<4 | offsetSize), 0}
+	iloc = binary.BigEndian.AppendUint16(iloc, uint16(len(m.items)))
+	for i, l := range locs {
+		iloc = binary.BigEndian.AppendUint16(iloc, uint16(i+1))
+		if l.size == 0 {
+			iloc = append(iloc, 0, 0, 0, 0) // no data, as of identity items
+			continue
+		}
+		iloc = append(iloc, 0, 0, 0, 1) // data reference index, one extent
+		iloc = appendUint(iloc, uint64(l.off), offsetSize)
+		iloc = appendUint(iloc, uint64(l.size), offsetSize)
+	}
+	body = bmff.AppendFullBox(body, boxType("iloc"), 0, 0, iloc)
+
+	iinf := binary.BigEndian.AppendUint16(nil, uint16(len(m.items)))
+	for i, it := range m.items {
+		if len(it.Type) != 4 {
+			return nil, fmt.Errorf("heif: invalid item type %q", it.Type)
+		}
+		infe := binary.BigEndian.AppendUint16(nil, uint16(i+1))
+		infe = append(infe, 0, 0) // protection index
+		infe = append(append(infe, it.Type...), 0)
+		if it.Type == ItemTypeMIME {
+			infe = append(append(infe, it.ContentType...), 0)
+		}
+		var flags uint32
+		if it.Hidden {
+			flags = 1
+		}
+		iinf = bmff.AppendFullBox(iinf, boxType("infe"), 2, flags, infe)
+	}
+	body = bmff.AppendFullBox(body, boxType("iinf"), 0, 0, iinf)
+
+	if len(m.refs) > 0 {
+		var iref []byte
+		for _, r := range m.refs {
+			ref := binary.BigEndian.AppendUint16(nil, r.from)
+			ref = binary.BigEndian.AppendUint16(ref, uint16(len(r.to)))
+			for _, to := range r.to {
+				ref = binary.BigEndian.AppendUint16(ref, to)
+			}
+			iref = bmff.AppendBox(iref, boxType(r.typ), ref)
+		}
+		body = bmff.AppendFullBox(body, boxType("iref"), 0, 0, iref)
+	}
+
+	if len(m.groups) > 0 {
+		var grpl []byte
+		for i, g := range m.groups {
+			group := binary.BigEndian.AppendUint32(nil, uint32(len(m.items)+i+1))
+			group = binary.BigEndian.AppendUint32(group, uint32(len(g.to)))
+			for _, id := range g.to {
+				group = binary.BigEndian.AppendUint32(group, uint32(id))
+			}
+			grpl = bmff.AppendFullBox(grpl, boxType(g.typ), 0, 0, group)
+		}
+		body = bmff.AppendBox(body, boxType("grpl"), grpl)
+	}
+
+	body = append(body, m.iprp()...)
+
+	return bmff.AppendFullBox(nil, boxType("meta"), 0, 0, body), nil
+}
+
+// iprp returns the item properties box, writing each distinct property
+// once.
+func (m *Muxer) iprp() []byte {
+	var ipco []byte
+	index := map[string]int{}
+	assocs := make([][]Property, len(m.items))
+	for i, it := range m.items {
+		var props []Property
+		switch it.Type {
+		case ItemTypeHEVC:
+			props = append(props, Property{Box: bmff.AppendBox(nil, boxType("hvcC"), it.Config), Essential: true})
+		case ItemTypeAV1:
+			props = append(props, Property{Box: bmff.AppendBox(nil, boxType("av1C"), it.Config), Essential: true})
+		}
+		if it.Width > 0 && it.Height > 0 {
+			ispe := binary.BigEndian.AppendUint32(nil, uint32(it.Width))
+			ispe = binary.BigEndian.AppendUint32(ispe, uint32(it.Height))
+			props = append(props, Property{Box: bmff.AppendFullBox(nil, boxType("ispe"), 0, 0, ispe)})
+		}
+		props = append(props, it.Properties...)
+		for _, p := range props {
+			if _, ok := index[string(p.Box)]; !ok {
+				index[string(p.Box)] = len(index) + 1
+				ipco = append(ipco, p.Box...)
+			}
+		}
+		assocs[i] = props
+	}
+
+	// indexes above 127 need 15 bits
+	var flags uint32
+	if len(index) > 127 {
+		flags = 1
+	}
+	ipma := binary.BigEndian.AppendUint32(nil, uint32(len(m.items)))
+	for i, props := range assocs {
+		ipma = binary.BigEndian.AppendUint16(ipma, uint16(i+1))
+		ipma = append(ipma, byte(len(props)))
+		for _, p := range props {
+			idx := index[string(p.Box)]
+			if flags&1 != 0 {
+				if p.Essential {
+					idx |= 0x8000
+				}
+				ipma = binary.BigEndian.AppendUint16(ipma, uint16(idx))
+			} else {
+				if p.Essential {
+					idx |= 0x80
+				}
+				ipma = append(ipma, byte(idx))
+			}
+		}
+	}
+
+	iprp := bmff.AppendBox(nil, boxType("ipco"), ipco)
+	iprp = bmff.AppendFullBox(iprp, boxType("ipma"), 0, flags, ipma)
+	return bmff.AppendBox(nil, boxType("iprp"), iprp)
+}
+
+// GridItem returns a grid item of rows x columns tiles, from 1 to 256 each,
+// cropped to width x height. Link it to its tiles, in row-major order, with
+// a RefDerivedImage reference.
+func GridItem(rows, columns, width, height int) MuxItem {
+	var flags byte
+	if width > math.MaxUint16 || height > math.MaxUint16 {
+		flags = 1 // 32-bit fields
+	}
+	data := []byte{0, flags, byte(rows - 1), byte(columns - 1)}
+	data = appendUint(data, uint64(width), 2<<flags)
+	data = appendUint(data, uint64(height), 2<<flags)
+	return MuxItem{Type: ItemTypeGrid, Data: data, Width: width, Height: height}
+}
+
+// IdentityItem returns a derived image item of width x height, the size
+// of its input after its transformative properties, such as irot, imir or
+// clap, which are added to the item. It has no data.
+func IdentityItem(width, height int, props ...Property) MuxItem {
+	return MuxItem{Type: ItemTypeIdentity, Width: width, Height: height, Properties: props}
+}
+
+// OverlayItem returns an overlay item of width x height, filled with fill,
+// or transparent black if nil, on which its inputs are drawn in order at
+// the given offsets, one for each input.
+func OverlayItem(width, height int, fill color.Color, offsets ...image.Point) MuxItem {
+	var flags byte
+	large := width > math.MaxUint16 || height > math.MaxUint16
+	for _, p := range offsets {
+		if p.X < math.MinInt16 || p.X > math.MaxInt16 || p.Y < math.MinInt16 || p.Y > math.MaxInt16 {
+			large = true
+		}
+	}
+	if large {
+		flags = 1 // 32-bit fields
+	}
+	data := []byte{0, flags}
+	var c color.NRGBA64
+	if fill != nil {
+		c = color.NRGBA64Model.Convert(fill).(color.NRGBA64)
+	}
+	for _, v := range []uint16{c.R, c.G, c.B, c.A} {
+		data = binary.BigEndian.AppendUint16(data, v)
+	}
+	data = appendUint(data, uint64(width), 2<<flags)
+	data = appendUint(data, uint64(height), 2<<flags)
+	for _, p := range offsets {
+		data = appendUint(data, uint64(p.X), 2<<flags)
+		data = appendUint(data, uint64(p.Y), 2<<flags)
+	}
+	return MuxItem{Type: ItemTypeOverlay, Data: data, Width: width, Height: height}
+}
+
+// AddDerivedItem adds a derived image item, such as one returned by
+// GridItem, IdentityItem or OverlayItem, and a RefDerivedImage reference
+// to its inputs, which must have been added before. The inputs are the
+// tiles of grids in row-major order, the one image of identity items and
+// the layers of overlays, bottom first.
+func (m *Muxer) AddDerivedItem(it MuxItem, inputs ...uint32) (uint32, error) {
+	if err := m.checkDerived(it, inputs); err != nil {
+		return 0, err
+	}
+	id, err := m.AddItem(it)
+	if err != nil {
+		return 0, err
+	}
+	return id, m.AddReference(RefDerivedImage, id, inputs...)
+}
+
+// checkDerived checks that the derived image item it has the right number
+// of inputs, all of them added.
+func (m *Muxer) checkDerived(it MuxItem, inputs []uint32) error {
+	want := -1
+	switch it.Type {
+	case ItemTypeGrid:
+		if len(it.Data) >= 4 {
+			want = (int(it.Data[2]) + 1) * (int(it.Data[3]) + 1)
+		}
+	case ItemTypeIdentity:
+		want = 1
+	case ItemTypeOverlay:
+		if len(it.Data) >= 2 {
+			size := 2 << (it.Data[1] & 1)
+			want = (len(it.Data) - 10 - 2*size) / (2 * size)
+		}
+	default:
+		return fmt.Errorf("heif: %q is not a derived image item type", it.Type)
+	}
+	if want <= 0 || len(inputs) != want {
+		return fmt.Errorf("heif: %q item with %d inputs", it.Type, len(inputs))
+	}
+	for _, id := range inputs {
+		if id == 0 || id > uint32(len(m.items)) {
+			return fmt.Errorf("heif: derived image of unknown item %d", id)
+		}
+	}
+	return nil
+}
+
+// PixiProperty returns a pixi property giving the bit depth of each
+// channel of an image, such as 8, 8, 8 for 8-bit 4:2:0 images.
+func PixiProperty(depths ...int) Property {
+	body := []byte{byte(len(depths))}
+	for _, d := range depths {
+		body = append(body, byte(d))
+	}
+	return Property{Box: bmff.AppendFullBox(nil, boxType("pixi"), 0, 0, body)}
+}
+
+// ExifItem returns an Exif metadata item holding exif, an Exif block with
+// or without its "Exif\x00\x00" header. Link it to the image it describes
+// with a RefDescribes reference.
+func ExifItem(exif []byte) MuxItem {
+	if !bytes.HasPrefix(exif, exifHeader) {
+		exif = append(exifHeader[:len(exifHeader):len(exifHeader)], exif...)
+	}
+	// the offset of the TIFF header, past the Exif header
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(exifHeader)))
+	return MuxItem{Type: ItemTypeExif, Data: append(data, exif...)}
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// XMPItem returns a metadata item holding an XMP packet. Link it to the
+// image it describes with a RefDescribes reference.
+func XMPItem(xmp []byte) MuxItem {
+	return MuxItem{Type: ItemTypeMIME, Data: xmp, ContentType: ContentTypeXMP}
+}
+
+// ICCProperty returns a colr property holding an ICC profile.
+func ICCProperty(icc []byte) Property {
+	return Property{Box: bmff.AppendBox(nil, boxType("colr"), append([]byte("prof"), icc...))}
+}
+
+// NCLX is a color description in the code points of ITU-T H.273, as
+// written in nclx colr properties and in the VUI of HEVC streams.
+type NCLX struct {
+	Primaries uint16 // colour_primaries, such as PrimariesBT2020
+	Transfer  uint16 // transfer_characteristics, such as TransferPQ
+	Matrix    uint16 // matrix_coefficients, such as MatrixBT2020
+	FullRange bool
+}
+
+// Code points of NCLX.
+const (
+	PrimariesBT709  = 1
+	PrimariesBT2020 = 9
+	PrimariesP3     = 12 // Display P3
+
+	TransferBT709 = 1
+	TransferSRGB  = 13
+	TransferPQ    = 16 // SMPTE ST 2084
+	TransferHLG   = 18 // ARIB STD-B67
+
+	MatrixBT709  = 1
+	MatrixBT601  = 6
+	MatrixBT2020 = 9 // non-constant luminance
+)
+
+// NCLXProperty returns a colr property holding c.
+func NCLXProperty(c NCLX) Property {
+	body := []byte("nclx")
+	for _, v := range []uint16{c.Primaries, c.Transfer, c.Matrix} {
+		body = binary.BigEndian.AppendUint16(body, v)
+	}
+	if c.FullRange {
+		body = append(body, 0x80)
+	} else {
+		body = append(body, 0)
+	}
+	return Property{Box: bmff.AppendBox(nil, boxType("colr"), body)}
+}
+
+// ContentLight is the content light level of HDR content, in cd/m2, as
+// written in clli properties and in HEVC SEI messages.
+type ContentLight struct {
+	MaxCLL  uint16 // maximum content light level
+	MaxFALL uint16 // maximum frame average light level
+}
+
+// MasteringDisplay is the colour volume of the display HDR content was
+// mastered on (SMPTE ST 2086), as written in mdcv properties and in HEVC
+// SEI messages.
+type MasteringDisplay struct {
+	Primaries    [3][2]uint16 // x, y in units of 0.00002, in G, B, R order
+	WhitePoint   [2]uint16    // x, y in units of 0.00002
+	MaxLuminance uint32       // in units of 0.0001 cd/m2
+	MinLuminance uint32       // in units of 0.0001 cd/m2
+}
+
+// ContentLightProperty returns a clli property holding c.
+func ContentLightProperty(c ContentLight) Property {
+	body := binary.BigEndian.AppendUint16(nil, c.MaxCLL)
+	body = binary.BigEndian.AppendUint16(body, c.MaxFALL)
+	return Property{Box: bmff.AppendBox(nil, boxType("clli"), body)}
+}
+
+// MasteringDisplayProperty returns an mdcv property holding md.
+func MasteringDisplayProperty(md MasteringDisplay) Property {
+	var body []byte
+	for _, p := range md.Primaries {
+		body = binary.BigEndian.AppendUint16(body, p[0])
+		body = binary.BigEndian.AppendUint16(body, p[1])
+	}
+	body = binary.BigEndian.AppendUint16(body, md.WhitePoint[0])
+	body = binary.BigEndian.AppendUint16(body, md.WhitePoint[1])
+	body = binary.BigEndian.AppendUint32(body, md.MaxLuminance)
+	body = binary.BigEndian.AppendUint32(body, md.MinLuminance)
+	return Property{Box: bmff.AppendBox(nil, boxType("mdcv"), body)}
+}
+
+// Auxiliary image types of auxC properties.
+const (
+	AuxTypeAlpha     = "urn:mpeg:hevc:2015:auxid:1"                  // HEVC alpha planes
+	AuxTypeAlphaAVIF = "urn:mpeg:mpegB:cicp:systems:auxiliary:alpha" // AV1 alpha planes
+	AuxTypeDepth     = "urn:mpeg:hevc:2015:auxid:2"                  // HEVC depth maps
+)
+
+// AuxProperty returns an auxC property marking an item as an auxiliary
+// image of type auxType, which is linked to its master image with a
+// RefAuxiliary reference.
+func AuxProperty(auxType string) Property {
+	body := append([]byte(auxType), 0)
+	return Property{Box: bmff.AppendFullBox(nil, boxType("auxC"), 0, 0, body), Essential: true}
+}
+
+// appendDinf appends a data information box stating that the data is in
+// this file.
+func appendDinf(b []byte) []byte {
+	dref := bmff.AppendFullBox(binary.BigEndian.AppendUint32(nil, 1), boxType("url "), 0, 1, nil)
+	return bmff.AppendBox(b, boxType("dinf"), bmff.AppendFullBox(nil, boxType("dref"), 0, 0, dref))
+}
+
+func appendUint(b []byte, v uint64, size int) []byte {
+	switch size {
+	case 2:
+		return binary.BigEndian.AppendUint16(b, uint16(v))
+	case 8:
+		return binary.BigEndian.AppendUint64(b, v)
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(v))
+}
+
+func boxType(s string) bmff.BoxType {
+	var t bmff.BoxType
+	copy(t[:], s)
+	return t
+}
@@ -0,0 +1,170 @@
+package heif
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// StreamMuxer writes HEIF files like a Muxer, but writes the data of each
+// item and track sample to w as soon as it is added, in an mdat box of its
+// own, and only keeps their metadata in memory. Close writes the meta and
+// moov boxes at the end of the file, once all the offsets are known, so w
+// need not be seekable.
+//
+// Readers must look for the meta box past the data. This package does,
+// but OpenMeta then reads all of a stream.
+type StreamMuxer struct {
+	// Brand and Compatible are the brands, as for Muxer. The ftyp box is
+	// written with the first item or track, from which they are chosen if
+	// empty.
+	Brand      string
+	Compatible []string
+
+	m       Muxer
+	bw      *bmff.Writer
+	started bool
+	closed  bool
+	items   []extent
+	samples [][]extent
+}
+
+// NewStreamMuxer returns a StreamMuxer writing to w.
+func NewStreamMuxer(w io.Writer) *StreamMuxer {
+	return &StreamMuxer{bw: bmff.NewWriter(w)}
+}
+
+// start writes the ftyp box before the first data.
+func (s *StreamMuxer) start() error {
+	if s.closed {
+		return errors.New("heif: StreamMuxer is closed")
+	}
+	if !s.started {
+		s.m.Brand, s.m.Compatible = s.Brand, s.Compatible
+		s.bw.Write(s.m.ftyp())
+		s.started = true
+	}
+	return s.bw.Err()
+}
+
+// writeData writes data in an mdat box and returns its location.
+func (s *StreamMuxer) writeData(data []byte) (extent, error) {
+	large := bmff.HeaderSize(int64(len(data)), false) == 16
+	s.bw.WriteBoxHeader(boxType("mdat"), int64(len(data)), large)
+	l := extent{s.bw.Offset(), int64(len(data))}
+	_, err := s.bw.Write(data)
+	return l, err
+}
+
+// AddItem writes the data of an item and returns its ID, as Muxer.AddItem.
+func (s *StreamMuxer) AddItem(it MuxItem) (uint32, error) {
+	id, err := s.m.AddItem(it)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.start(); err != nil {
+		return 0, err
+	}
+	var l extent
+	if len(it.Data) > 0 {
+		if l, err = s.writeData(it.Data); err != nil {
+			return 0, err
+		}
+	}
+	s.m.items[id-1].Data = nil
+	s.items = append(s.items, l)
+	return id, nil
+}
+
+// AddReference adds a reference, as Muxer.AddReference.
+func (s *StreamMuxer) AddReference(typ string, from uint32, to ...uint32) error {
+	return s.m.AddReference(typ, from, to...)
+}
+
+// AddGroup adds an entity group, as Muxer.AddGroup.
+func (s *StreamMuxer) AddGroup(typ string, ids ...uint32) error {
+	return s.m.AddGroup(typ, ids...)
+}
+
+// AddDerivedItem adds a derived image item, as Muxer.AddDerivedItem.
+func (s *StreamMuxer) AddDerivedItem(it MuxItem, inputs ...uint32) (uint32, error) {
+	if err := s.m.checkDerived(it, inputs); err != nil {
+		return 0, err
+	}
+	id, err := s.AddItem(it)
+	if err != nil {
+		return 0, err
+	}
+	return id, s.m.AddReference(RefDerivedImage, id, inputs...)
+}
+
+// SetPrimary sets the primary item. The brands are chosen from the first
+// item, which is written before it can be called.
+func (s *StreamMuxer) SetPrimary(id uint32) error {
+	return s.m.SetPrimary(id)
+}
+
+// AddTrack adds an image sequence track and returns its ID. Its samples,
+// if any, are written at once; more are added with WriteSample.
+func (s *StreamMuxer) AddTrack(t MuxTrack) (uint32, error) {
+	if err := t.check(); err != nil {
+		return 0, err
+	}
+	samples := t.Samples
+	t.Samples = nil
+	s.m.tracks = append(s.m.tracks, &t)
+	s.samples = append(s.samples, nil)
+	id := uint32(len(s.m.tracks))
+	if err := s.start(); err != nil {
+		return 0, err
+	}
+	for _, sample := range samples {
+		if err := s.WriteSample(id, sample); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// WriteSample writes the next sample of a track.
+func (s *StreamMuxer) WriteSample(track uint32, sample MuxSample) error {
+	if track == 0 || track > uint32(len(s.m.tracks)) {
+		return fmt.Errorf("heif: unknown track %d", track)
+	}
+	if err := s.start(); err != nil {
+		return err
+	}
+	l, err := s.writeData(sample.Data)
+	if err != nil {
+		return err
+	}
+	t := s.m.tracks[track-1]
+	t.Samples = append(t.Samples, MuxSample{Duration: sample.Duration, Sync: sample.Sync})
+	s.samples[track-1] = append(s.samples[track-1], l)
+	return nil
+}
+
+// Close writes the meta and moov boxes, ending the file. It does not close
+// the underlying writer.
+func (s *StreamMuxer) Close() error {
+	if s.closed {
+		return nil
+	}
+	if len(s.m.items) == 0 && len(s.m.tracks) == 0 {
+		return errors.New("heif: no items")
+	}
+	for _, t := range s.m.tracks {
+		if len(t.Samples) == 0 {
+			return errors.New("heif: track without samples")
+		}
+	}
+	s.closed = true
+	boxes, err := s.m.metaAndMoov(s.items, s.samples)
+	if err != nil {
+		return err
+	}
+	_, err = s.bw.Write(boxes)
+	return err
+}
@@ -0,0 +1,251 @@
+package heif
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// MuxTrack describes an image sequence track written by a Muxer, such as
+// the frames of an animated AVIF.
+type MuxTrack struct {
+	Type   string // the sample entry type: ItemTypeAV1 or ItemTypeHEVC
+	Config []byte // the av1C or hvcC record, as for MuxItem
+	Width  int
+	Height int
+
+	// Properties are further boxes of the sample entry, such as clap.
+	Properties []Property
+
+	Timescale uint32 // sample durations are in 1/Timescale seconds
+	Samples   []MuxSample
+
+	// LoopCount is the number of times the sequence is repeated after it
+	// is first shown, as in image/gif: 0 repeats forever, -1 shows it once.
+	LoopCount int
+}
+
+// MuxSample is a coded frame of a MuxTrack.
+type MuxSample struct {
+	Data     []byte // an AV1 temporal unit or length-prefixed HEVC NAL units
+	Duration uint32 // in units of the track timescale
+	Sync     bool   // a key frame, decodable without the ones before it
+}
+
+// AddTrack adds an image sequence track and returns its ID. Its samples
+// are written to the mdat box after the item data.
+func (m *Muxer) AddTrack(t MuxTrack) (uint32, error) {
+	if len(t.Samples) == 0 {
+		return 0, errors.New("heif: track without samples")
+	}
+	if err := t.check(); err != nil {
+		return 0, err
+	}
+	m.tracks = append(m.tracks, &t)
+	return uint32(len(m.tracks)), nil
+}
+
+// check validates the parameters of t other than its samples.
+func (t *MuxTrack) check() error {
+	switch {
+	case t.Type != ItemTypeAV1 && t.Type != ItemTypeHEVC:
+		return fmt.Errorf("heif: unsupported track type %q", t.Type)
+	case t.Width <= 0 || t.Width > math.MaxUint16 || t.Height <= 0 || t.Height > math.MaxUint16:
+		return fmt.Errorf("heif: invalid track size %dx%d", t.Width, t.Height)
+	case t.Timescale == 0:
+		return errors.New("heif: track without a timescale")
+	}
+	return nil
+}
+
+// duration returns the duration of one pass through the track.
+func (t *MuxTrack) duration() uint64 {
+	var d uint64
+	for _, s := range t.Samples {
+		d += uint64(s.Duration)
+	}
+	return d
+}
+
+// moov returns the movie box of the tracks, whose samples are at the given
+// locations. The movie uses the timescale of the first track.
+func (m *Muxer) moov(samples [][]extent) []byte {
+	timescale := m.tracks[0].Timescale
+	var movieDuration uint64
+	var traks []byte
+	for i, t := range m.tracks {
+		pass := t.duration() * uint64(timescale) / uint64(t.Timescale)
+		// with a repeated edit list, tkhd holds the time of all passes
+		total := pass
+		switch {
+		case t.LoopCount == 0:
+			total = math.MaxUint64
+		case t.LoopCount > 0:
+			total = pass * uint64(t.LoopCount+1)
+		}
+		movieDuration = max(movieDuration, total)
+		traks = append(traks, t.trak(uint32(i+1), pass, total, samples[i])...)
+	}
+
+	mvhd := make([]byte, 16) // creation and modification times
+	mvhd = binary.BigEndian.AppendUint32(mvhd, timescale)
+	mvhd = binary.BigEndian.AppendUint64(mvhd, movieDuration)
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 0x00010000) // rate
+	mvhd = binary.BigEndian.AppendUint16(mvhd, 0x0100)     // volume
+	mvhd = append(mvhd, make([]byte, 10)...)
+	mvhd = appendMatrix(mvhd)
+	mvhd = append(mvhd, make([]byte, 24)...)
+	mvhd = binary.BigEndian.AppendUint32(mvhd, uint32(len(m.tracks)+1)) // next track ID
+	moov := bmff.AppendFullBox(nil, boxType("mvhd"), 1, 0, mvhd)
+	return bmff.AppendBox(nil, boxType("moov"), append(moov, traks...))
+}
+
+// trak returns the track box of t. pass and total are the durations of one
+// pass and of the whole presentation, in the movie timescale.
+func (t *MuxTrack) trak(id uint32, pass, total uint64, samples []extent) []byte {
+	tkhd := make([]byte, 16)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, id)
+	tkhd = append(tkhd, 0, 0, 0, 0)
+	tkhd = binary.BigEndian.AppendUint64(tkhd, total)
+	tkhd = append(tkhd, make([]byte, 16)...) // reserved, layer, alternate group, volume
+	tkhd = appendMatrix(tkhd)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, uint32(t.Width)<<16)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, uint32(t.Height)<<16)
+	trak := bmff.AppendFullBox(nil, boxType("tkhd"), 1, 3, tkhd) // enabled, in movie
+
+	if t.LoopCount >= 0 {
+		// a single edit, repeated
+		elst := binary.BigEndian.AppendUint32(nil, 1)
+		elst = binary.BigEndian.AppendUint64(elst, pass)
+		elst = binary.BigEndian.AppendUint64(elst, 0) // media time
+		elst = binary.BigEndian.AppendUint32(elst, 0x00010000)
+		trak = bmff.AppendBox(trak, boxType("edts"), bmff.AppendFullBox(nil, boxType("elst"), 1, 1, elst))
+	}
+
+	mdhd := make([]byte, 16)
+	mdhd = binary.BigEndian.AppendUint32(mdhd, t.Timescale)
+	mdhd = binary.BigEndian.AppendUint64(mdhd, t.duration())
+	mdhd = append(mdhd, 0x55, 0xc4, 0, 0) // "und" language
+	mdia := bmff.AppendFullBox(nil, boxType("mdhd"), 1, 0, mdhd)
+	hdlr := append(make([]byte, 4), "pict"...)
+	hdlr = append(hdlr, make([]byte, 13)...) // reserved, empty name
+	mdia = bmff.AppendFullBox(mdia, boxType("hdlr"), 0, 0, hdlr)
+
+	minf := bmff.AppendFullBox(nil, boxType("vmhd"), 0, 1, make([]byte, 8))
+	minf = appendDinf(minf)
+	minf = bmff.AppendBox(minf, boxType("stbl"), t.stbl(samples))
+	mdia = bmff.AppendBox(mdia, boxType("minf"), minf)
+
+	trak = bmff.AppendBox(trak, boxType("mdia"), mdia)
+	return bmff.AppendBox(nil, boxType("trak"), trak)
+}
+
+// stbl returns the body of the sample table box of t, whose samples are
+// at the given locations. Adjacent samples are grouped into chunks.
+func (t *MuxTrack) stbl(samples []extent) []byte {
+	entry := make([]byte, 6)
+	entry = binary.BigEndian.AppendUint16(entry, 1) // data reference index
+	entry = append(entry, make([]byte, 16)...)
+	entry = binary.BigEndian.AppendUint16(entry, uint16(t.Width))
+	entry = binary.BigEndian.AppendUint16(entry, uint16(t.Height))
+	entry = binary.BigEndian.AppendUint32(entry, 0x00480000) // 72 dpi
+	entry = binary.BigEndian.AppendUint32(entry, 0x00480000)
+	entry = append(entry, 0, 0, 0, 0, 0, 1) // one frame per sample
+	entry = append(entry, make([]byte, 32)...)
+	entry = append(entry, 0, 0x18, 0xff, 0xff) // depth, pre_defined -1
+	switch t.Type {
+	case ItemTypeAV1:
+		entry = bmff.AppendBox(entry, boxType("av1C"), t.Config)
+		// codec constraints of AVIF sequences: intra prediction and up to 15
+		// reference frames
+		entry = bmff.AppendFullBox(entry, boxType("ccst"), 0, 0, []byte{0x7c, 0, 0, 0})
+	case ItemTypeHEVC:
+		entry = bmff.AppendBox(entry, boxType("hvcC"), t.Config)
+	}
+	for _, p := range t.Properties {
+		entry = append(entry, p.Box...)
+	}
+	stsd := bmff.AppendBox(binary.BigEndian.AppendUint32(nil, 1), boxType(t.Type), entry)
+	stbl := bmff.AppendFullBox(nil, boxType("stsd"), 0, 0, stsd)
+
+	// runs of equal durations
+	var stts []byte
+	runs := 0
+	for i, s := range t.Samples {
+		if i > 0 && s.Duration == t.Samples[i-1].Duration {
+			n := len(stts) - 8
+			binary.BigEndian.PutUint32(stts[n:], binary.BigEndian.Uint32(stts[n:])+1)
+			continue
+		}
+		stts = binary.BigEndian.AppendUint32(stts, 1)
+		stts = binary.BigEndian.AppendUint32(stts, s.Duration)
+		runs++
+	}
+	stbl = bmff.AppendFullBox(stbl, boxType("stts"), 0, 0, append(binary.BigEndian.AppendUint32(nil, uint32(runs)), stts...))
+
+	var sync []byte
+	for i, s := range t.Samples {
+		if s.Sync {
+			sync = binary.BigEndian.AppendUint32(sync, uint32(i+1))
+		}
+	}
+	// without stss, all samples are sync samples
+	if len(sync) != 4*len(t.Samples) {
+		stbl = bmff.AppendFullBox(stbl, boxType("stss"), 0, 0, append(binary.BigEndian.AppendUint32(nil, uint32(len(sync)/4)), sync...))
+	}
+
+	var chunks []extent // of samples, the size being their count
+	for i, l := range samples {
+		if i > 0 && l.off == samples[i-1].off+samples[i-1].size {
+			chunks[len(chunks)-1].size++
+			continue
+		}
+		chunks = append(chunks, extent{l.off, 1})
+	}
+	// runs of chunks with the same number of samples
+	var stsc []byte
+	runs = 0
+	for i, c := range chunks {
+		if i > 0 && c.size == chunks[i-1].size {
+			continue
+		}
+		stsc = binary.BigEndian.AppendUint32(stsc, uint32(i+1)) // first chunk
+		stsc = binary.BigEndian.AppendUint32(stsc, uint32(c.size))
+		stsc = binary.BigEndian.AppendUint32(stsc, 1) // sample description index
+		runs++
+	}
+	stbl = bmff.AppendFullBox(stbl, boxType("stsc"), 0, 0, append(binary.BigEndian.AppendUint32(nil, uint32(runs)), stsc...))
+
+	stsz := binary.BigEndian.AppendUint32(nil, 0)
+	stsz = binary.BigEndian.AppendUint32(stsz, uint32(len(samples)))
+	for _, l := range samples {
+		stsz = binary.BigEndian.AppendUint32(stsz, uint32(l.size))
+	}
+	stbl = bmff.AppendFullBox(stbl, boxType("stsz"), 0, 0, stsz)
+
+	last := samples[len(samples)-1]
+	co := binary.BigEndian.AppendUint32(nil, uint32(len(chunks)))
+	if last.off+last.size > math.MaxUint32 {
+		for _, c := range chunks {
+			co = binary.BigEndian.AppendUint64(co, uint64(c.off))
+		}
+		stbl = bmff.AppendFullBox(stbl, boxType("co64"), 0, 0, co)
+	} else {
+		for _, c := range chunks {
+			co = binary.BigEndian.AppendUint32(co, uint32(c.off))
+		}
+		stbl = bmff.AppendFullBox(stbl, boxType("stco"), 0, 0, co)
+	}
+	return stbl
+}
+
+// appendMatrix appends the identity transformation matrix of mvhd and tkhd.
+func appendMatrix(b []byte) []byte {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
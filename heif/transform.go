@@ -0,0 +1,526 @@
+package heif
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// RewriteTransform copies the HEIF file src to dst with the primary image
+// rotated by rotate90s quarter turns counter-clockwise and then, if mirror
+// is set, mirrored left to right. Only the irot and imir properties of the
+// primary item change, composed with the ones it already has; the coded
+// data is copied as is. The ispe property is kept, as it describes the
+// image before any transformation.
+//
+// Files with image sequences (a moov box) are not supported, as their
+// sample offsets are not adjusted.
+func RewriteTransform(src io.ReaderAt, dst io.Writer, rotate90s int, mirror bool) error {
+	return rewritePrimary(src, dst, func(props []rawBox, assocs []uint16, add func([]byte) uint16) ([]uint16, error) {
+		// the transform, as a rotation followed by an optional mirror, built
+		// by applying the transforms in association order
+		var rot int
+		var mir bool
+		rotate := func(n int) {
+			// a rotation after a mirror is the opposite rotation before it
+			if mir {
+				n = -n
+			}
+			rot = ((rot+n)%4 + 4) % 4
+		}
+		var kept []uint16
+		for _, a := range assocs {
+			p, ok := property(props, a)
+			switch {
+			case ok && p.typ == "irot" && len(p.body) > 0:
+				rotate(int(p.body[0] & 3))
+			case ok && p.typ == "imir" && len(p.body) > 0:
+				if p.body[0]&1 != 0 {
+					// a top to bottom flip is a left to right flip after a half turn
+					rotate(2)
+				}
+				mir = !mir
+			default:
+				kept = append(kept, a)
+			}
+		}
+		rotate(rotate90s)
+		mir = mir != mirror
+
+		if rot != 0 {
+			kept = append(kept, add(bmff.AppendBox(nil, boxType("irot"), []byte{byte(rot)})))
+		}
+		if mir {
+			kept = append(kept, add(bmff.AppendBox(nil, boxType("imir"), []byte{0})))
+		}
+		return kept, nil
+	})
+}
+
+// assocEditor returns the edited property associations of an item. props
+// are the properties in the ipco box; add adds a property unless it is
+// there already and returns its association, marked essential.
+type assocEditor func(props []rawBox, assocs []uint16, add func(box []byte) uint16) ([]uint16, error)
+
+// property returns the property an association refers to.
+func property(props []rawBox, assoc uint16) (rawBox, bool) {
+	idx := int(assoc & 0x7fff)
+	if idx == 0 || idx > len(props) {
+		return rawBox{}, false
+	}
+	return props[idx-1], true
+}
+
+// rewritePrimary copies src to dst with the property associations of the
+// primary item edited, changing only the meta box and the item offsets
+// that depend on its size.
+func rewritePrimary(src io.ReaderAt, dst io.Writer, edit assocEditor) error {
+	boxes, err := topLevelBoxes(src)
+	if err != nil {
+		return err
+	}
+	var meta *topBox
+	for i := range boxes {
+		if boxes[i].typ == "meta" {
+			meta = &boxes[i]
+		}
+		if boxes[i].typ == "moov" {
+			return errors.New("heif: cannot rewrite files with image sequences")
+		}
+	}
+	if meta == nil || meta.size < 0 || meta.size > math.MaxInt32 {
+		return errors.New("heif: no meta box")
+	}
+	old := make([]byte, meta.size)
+	if _, err := src.ReadAt(old, meta.off); err != nil {
+		return err
+	}
+	newMeta, err := editMeta(old, meta.off+meta.size, edit)
+	if err != nil {
+		return err
+	}
+
+	w := bmff.NewWriter(dst)
+	for _, b := range boxes {
+		if b.typ == "meta" {
+			w.Write(newMeta)
+			continue
+		}
+		n := b.size
+		if n < 0 {
+			n = math.MaxInt64 - b.off
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(src, b.off, n)); err != nil {
+			return err
+		}
+	}
+	return w.Err()
+}
+
+type topBox struct {
+	typ       string
+	off, size int64 // size is -1 for a box extending to the end of the file
+}
+
+func topLevelBoxes(r io.ReaderAt) ([]topBox, error) {
+	var boxes []topBox
+	var hdr [16]byte
+	for off := int64(0); ; {
+		n, err := r.ReadAt(hdr[:], off)
+		if n == 0 && err == io.EOF {
+			return boxes, nil
+		}
+		if n < 8 {
+			return nil, fmt.Errorf("heif: truncated box header at offset %d", off)
+		}
+		b := topBox{typ: string(hdr[4:8]), off: off, size: int64(binary.BigEndian.Uint32(hdr[:]))}
+		switch b.size {
+		case 0:
+			b.size = -1
+		case 1:
+			if n < 16 {
+				return nil, fmt.Errorf("heif: truncated box header at offset %d", off)
+			}
+			b.size = int64(binary.BigEndian.Uint64(hdr[8:]))
+		}
+		if b.size >= 0 && b.size < 8 {
+			return nil, fmt.Errorf("heif: invalid box size %d at offset %d", b.size, off)
+		}
+		boxes = append(boxes, b)
+		if b.size < 0 {
+			return boxes, nil
+		}
+		off += b.size
+	}
+}
+
+// rawBox is a box within a byte slice.
+type rawBox struct {
+	typ  string
+	body []byte
+	all  []byte // header included
+}
+
+func rawBoxes(b []byte) ([]rawBox, error) {
+	var boxes []rawBox
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return nil, errors.New("heif: truncated box")
+		}
+		size, hdr := uint64(binary.BigEndian.Uint32(b)), 8
+		switch size {
+		case 0:
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return nil, errors.New("heif: truncated box")
+			}
+			size, hdr = binary.BigEndian.Uint64(b[8:]), 16
+		}
+		if size < uint64(hdr) || size > uint64(len(b)) {
+			return nil, fmt.Errorf("heif: invalid %q box size %d", b[4:8], size)
+		}
+		boxes = append(boxes, rawBox{typ: string(b[4:8]), body: b[hdr:size], all: b[:size]})
+		b = b[size:]
+	}
+	return boxes, nil
+}
+
+// editMeta returns the meta box with the primary item's properties edited.
+// Item data at or after dataShift, the old end of the meta box, moves by
+// the change in size.
+func editMeta(meta []byte, dataShift int64, edit assocEditor) ([]byte, error) {
+	top, err := rawBoxes(meta)
+	if err != nil {
+		return nil, err
+	}
+	if len(top[0].body) < 4 {
+		return nil, errors.New("heif: truncated meta box")
+	}
+	children, err := rawBoxes(top[0].body[4:])
+	if err != nil {
+		return nil, err
+	}
+
+	var primary uint32
+	iprp, iloc := -1, -1
+	for i, c := range children {
+		switch c.typ {
+		case "pitm":
+			if len(c.body) >= 6 && c.body[0] == 0 {
+				primary = uint32(binary.BigEndian.Uint16(c.body[4:]))
+			} else if len(c.body) >= 8 {
+				primary = binary.BigEndian.Uint32(c.body[4:])
+			}
+		case "iprp":
+			iprp = i
+		case "iloc":
+			iloc = i
+		}
+	}
+	if primary == 0 || iprp < 0 || iloc < 0 {
+		return nil, errors.New("heif: no primary item properties")
+	}
+
+	newIprp, err := editIprp(children[iprp].body, primary, edit)
+	if err != nil {
+		return nil, err
+	}
+	delta := int64(len(newIprp) - len(children[iprp].all))
+	newIloc, err := shiftIloc(children[iloc].body, dataShift, delta)
+	if err != nil {
+		return nil, err
+	}
+
+	body := append([]byte(nil), top[0].body[:4]...) // version and flags
+	for i, c := range children {
+		switch i {
+		case iprp:
+			body = append(body, newIprp...)
+		case iloc:
+			body = bmff.AppendBox(body, boxType("iloc"), newIloc)
+		default:
+			body = append(body, c.all...)
+		}
+	}
+	out := bmff.AppendBox(nil, boxType("meta"), body)
+	if int64(len(out)) != int64(len(meta))+delta {
+		// a box header changed width
+		return nil, errors.New("heif: cannot resize meta box")
+	}
+	return out, nil
+}
+
+// editIprp returns the iprp box with the item's associations edited.
+func editIprp(body []byte, item uint32, edit assocEditor) ([]byte, error) {
+	children, err := rawBoxes(body)
+	if err != nil {
+		return nil, err
+	}
+	ipco, ipma := -1, -1
+	for i, c := range children {
+		switch c.typ {
+		case "ipco":
+			ipco = i
+		case "ipma":
+			if ipma < 0 {
+				ipma = i
+			}
+		}
+	}
+	if ipco < 0 || ipma < 0 {
+		return nil, errors.New("heif: no item properties")
+	}
+	props, err := rawBoxes(children[ipco].body)
+	if err != nil {
+		return nil, err
+	}
+	entries, version, flags, err := parseIpma(children[ipma].body)
+	if err != nil {
+		return nil, err
+	}
+
+	e := -1
+	for i := range entries {
+		if entries[i].item == item {
+			e = i
+		}
+	}
+	if e < 0 {
+		entries = append(entries, ipmaEntry{item: item})
+		e = len(entries) - 1
+		// entries are ordered by item ID
+		for ; e > 0 && entries[e-1].item > item; e-- {
+			entries[e], entries[e-1] = entries[e-1], entries[e]
+		}
+	}
+
+	ipcoBody := children[ipco].body
+	add := func(box []byte) uint16 {
+		for i, p := range props {
+			if string(p.all) == string(box) {
+				return uint16(i+1) | 0x8000
+			}
+		}
+		props = append(props, rawBox{all: box})
+		ipcoBody = append(ipcoBody[:len(ipcoBody):len(ipcoBody)], box...)
+		return uint16(len(props)) | 0x8000
+	}
+	if entries[e].assocs, err = edit(props, entries[e].assocs, add); err != nil {
+		return nil, err
+	}
+
+	if len(props) > 0x7fff {
+		return nil, errors.New("heif: too many properties")
+	}
+	if len(props) > 127 {
+		flags |= 1
+	}
+	var out []byte
+	for i, c := range children {
+		switch {
+		case i == ipco:
+			out = bmff.AppendBox(out, boxType("ipco"), ipcoBody)
+		case i == ipma:
+			out = bmff.AppendFullBox(out, boxType("ipma"), version, flags, appendIpma(nil, entries, version, flags))
+		default:
+			out = append(out, c.all...)
+		}
+	}
+	return bmff.AppendBox(nil, boxType("iprp"), out), nil
+}
+
+type ipmaEntry struct {
+	item   uint32
+	assocs []uint16 // essential bit in 0x8000, index in the low 15 bits
+}
+
+func parseIpma(b []byte) (entries []ipmaEntry, version uint8, flags uint32, err error) {
+	errShort := errors.New("heif: truncated ipma box")
+	if len(b) < 8 {
+		return nil, 0, 0, errShort
+	}
+	version, flags = b[0], binary.BigEndian.Uint32(b)&0xffffff
+	n := binary.BigEndian.Uint32(b[4:])
+	b = b[8:]
+	for ; n > 0; n-- {
+		var e ipmaEntry
+		if version < 1 {
+			if len(b) < 3 {
+				return nil, 0, 0, errShort
+			}
+			e.item, b = uint32(binary.BigEndian.Uint16(b)), b[2:]
+		} else {
+			if len(b) < 5 {
+				return nil, 0, 0, errShort
+			}
+			e.item, b = binary.BigEndian.Uint32(b), b[4:]
+		}
+		count := int(b[0])
+		b = b[1:]
+		for ; count > 0; count-- {
+			if flags&1 != 0 {
+				if len(b) < 2 {
+					return nil, 0, 0, errShort
+				}
+				e.assocs, b = append(e.assocs, binary.BigEndian.Uint16(b)), b[2:]
+			} else {
+				if len(b) < 1 {
+					return nil, 0, 0, errShort
+				}
+				a := uint16(b[0]&0x7f) | uint16(b[0]&0x80)<<8
+				e.assocs, b = append(e.assocs, a), b[1:]
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, version, flags, nil
+}
+
+func appendIpma(b []byte, entries []ipmaEntry, version uint8, flags uint32) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(entries)))
+	for _, e := range entries {
+		if version < 1 {
+			b = binary.BigEndian.AppendUint16(b, uint16(e.item))
+		} else {
+			b = binary.BigEndian.AppendUint32(b, e.item)
+		}
+		b = append(b, byte(len(e.assocs)))
+		for _, a := range e.assocs {
+			if flags&1 != 0 {
+				b = binary.BigEndian.AppendUint16(b, a)
+			} else {
+				b = append(b, byte(a&0x7f)|byte(a>>8)&0x80)
+			}
+		}
+	}
+	return b
+}
+
+// shiftIloc returns the body of an iloc box with the file offsets at or
+// after from moved by delta.
+func shiftIloc(body []byte, from, delta int64) ([]byte, error) {
+	b := append([]byte(nil), body...)
+	errShort := errors.New("heif: truncated iloc box")
+	if len(b) < 8 {
+		return nil, errShort
+	}
+	version := b[0]
+	offsetSize, lengthSize := int(b[4]>>4), int(b[4]&15)
+	baseSize, indexSize := int(b[5]>>4), int(b[5]&15)
+	if version == 0 {
+		indexSize = 0
+	}
+	for _, size := range []int{offsetSize, lengthSize, baseSize, indexSize} {
+		if size != 0 && size != 4 && size != 8 {
+			return nil, fmt.Errorf("heif: invalid iloc field size %d", size)
+		}
+	}
+	pos := 6
+	field := func(size int) (int, error) {
+		if pos+size > len(b) {
+			return 0, errShort
+		}
+		p := pos
+		pos += size
+		return p, nil
+	}
+	get := func(p, size int) int64 {
+		switch size {
+		case 4:
+			return int64(binary.BigEndian.Uint32(b[p:]))
+		case 8:
+			return int64(binary.BigEndian.Uint64(b[p:]))
+		}
+		return 0
+	}
+	shift := func(p, size int) error {
+		v := get(p, size) + delta
+		switch {
+		case size == 8:
+			binary.BigEndian.PutUint64(b[p:], uint64(v))
+		case size == 4 && v <= math.MaxUint32:
+			binary.BigEndian.PutUint32(b[p:], uint32(v))
+		default:
+			return errors.New("heif: item offset overflows iloc field")
+		}
+		return nil
+	}
+
+	countSize := 2
+	if version == 2 {
+		countSize = 4
+	}
+	p, err := field(countSize)
+	if err != nil {
+		return nil, err
+	}
+	count := int(get(p, countSize))
+	if version < 2 {
+		count = int(binary.BigEndian.Uint16(b[p:]))
+	}
+	for ; count > 0; count-- {
+		idSize := 2
+		if version == 2 {
+			idSize = 4
+		}
+		if _, err := field(idSize); err != nil {
+			return nil, err
+		}
+		method := 0
+		if version >= 1 {
+			p, err := field(2)
+			if err != nil {
+				return nil, err
+			}
+			method = int(b[p+1] & 15)
+		}
+		p, err := field(2) // data reference index
+		if err != nil {
+			return nil, err
+		}
+		inFile := method == 0 && binary.BigEndian.Uint16(b[p:]) == 0
+		basePos, err := field(baseSize)
+		if err != nil {
+			return nil, err
+		}
+		base := get(basePos, baseSize)
+		if inFile && delta != 0 && baseSize != 0 && base >= from {
+			if err := shift(basePos, baseSize); err != nil {
+				return nil, err
+			}
+			inFile = false // the extents moved with the base
+		}
+		p, err = field(2)
+		if err != nil {
+			return nil, err
+		}
+		for extents := int(binary.BigEndian.Uint16(b[p:])); extents > 0; extents-- {
+			if indexSize != 0 {
+				if _, err := field(indexSize); err != nil {
+					return nil, err
+				}
+			}
+			offPos, err := field(offsetSize)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := field(lengthSize); err != nil {
+				return nil, err
+			}
+			if inFile && delta != 0 && base+get(offPos, offsetSize) >= from {
+				if offsetSize == 0 {
+					return nil, errors.New("heif: item offset overflows iloc field")
+				}
+				if err := shift(offPos, offsetSize); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return b, nil
+}
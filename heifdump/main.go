@@ -0,0 +1,372 @@
+// Command heifdump prints the box tree of HEIF files, with the offsets,
+// sizes and main fields of the boxes, and the table of their items.
+//
+//	heifdump [-json] file...
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jdeng/goheif/heif"
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+var jsonOutput = flag.Bool("json", false, "print JSON instead of text")
+
+// Box is a box of the tree.
+type Box struct {
+	Type     string         `json:"type"`
+	Offset   int64          `json:"offset"`
+	Size     int64          `json:"size"`
+	Fields   map[string]any `json:"fields,omitempty"`
+	Children []*Box         `json:"children,omitempty"`
+	Err      string         `json:"error,omitempty"`
+}
+
+// Item is an entry of the item table.
+type Item struct {
+	ID         uint32              `json:"id"`
+	Type       string              `json:"type"`
+	Name       string              `json:"name,omitempty"`
+	Primary    bool                `json:"primary,omitempty"`
+	Hidden     bool                `json:"hidden,omitempty"`
+	Width      int                 `json:"width,omitempty"`
+	Height     int                 `json:"height,omitempty"`
+	Method     uint8               `json:"construction_method,omitempty"`
+	Extents    []bmff.OffsetLength `json:"extents"`
+	Properties []string            `json:"properties,omitempty"`
+	References map[string][]uint32 `json:"references,omitempty"`
+}
+
+// File is the dump of a file.
+type File struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Boxes []*Box `json:"boxes"`
+	Items []Item `json:"items,omitempty"`
+	Err   string `json:"error,omitempty"`
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("heifdump: ")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: heifdump [-json] file...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	var files []*File
+	for _, name := range flag.Args() {
+		f, err := dump(name)
+		if err != nil {
+			log.Printf("%s: %v", name, err)
+			failed = true
+			if f == nil {
+				continue
+			}
+			f.Err = err.Error()
+		}
+		if *jsonOutput {
+			files = append(files, f)
+			continue
+		}
+		if flag.NArg() > 1 {
+			fmt.Printf("%s:\n", name)
+		}
+		printFile(os.Stdout, f)
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(files); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// dump reads the boxes and items of a file. With an error, the File holds
+// what could be read.
+func dump(name string) (*File, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{Name: name, Size: int64(len(data))}
+	var ids []uint32
+	f.Boxes, err = walk(data, 0, "", &ids)
+	if err != nil {
+		return f, err
+	}
+	f.Items, err = items(data, ids)
+	return f, err
+}
+
+// containers maps the types of the boxes holding other boxes to the size of
+// the fields before them.
+var containers = map[string]int{
+	"moov": 0, "trak": 0, "mdia": 0, "minf": 0, "stbl": 0, "edts": 0, "udta": 0,
+	"dinf": 0, "iprp": 0, "ipco": 0, "grpl": 0,
+	"meta": 4, "iref": 4, "dref": 8, "stsd": 8,
+}
+
+// walk returns the boxes of b, which starts at offset off of the file.
+// parent is the type of the box holding them. The IDs of the items found
+// in iinf boxes are added to ids.
+func walk(b []byte, off int64, parent string, ids *[]uint32) ([]*Box, error) {
+	r := bmff.NewReader(bytes.NewReader(b))
+	var boxes []*Box
+	for pos := int64(0); pos < int64(len(b)); {
+		box, err := r.ReadBox()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return boxes, fmt.Errorf("box at offset %d: %v", off+pos, err)
+		}
+		typ := box.Type().String()
+		size := box.Size()
+		if size == 0 || pos+size > int64(len(b)) {
+			size = int64(len(b)) - pos // to the end of the file
+		}
+		header := int64(8)
+		if box.LargeSize() {
+			header += 8
+		}
+		if typ == "uuid" {
+			header += 16
+		}
+		n := &Box{Type: typ, Offset: off + pos, Size: size}
+		boxes = append(boxes, n)
+		body := b[min(pos+header, pos+size) : pos+size]
+
+		if parent == "iref" {
+			n.Fields = reference(body)
+		} else if p, err := box.Parse(); err == nil {
+			n.Fields = fields(p, ids)
+		} else if err != bmff.ErrUnknownBox {
+			n.Err = err.Error()
+		}
+
+		skip, ok := containers[typ]
+		switch {
+		case typ == "iinf":
+			skip, ok = 6, true
+			if len(body) > 0 && body[0] > 0 {
+				skip = 8 // 32-bit entry count
+			}
+		case parent == "stsd":
+			skip, ok = 78, true // the fields of visual sample entries
+		}
+		if ok && int64(skip) <= int64(len(body)) {
+			n.Children, err = walk(body[skip:], n.Offset+header+int64(skip), typ, ids)
+			if err != nil {
+				return boxes, err
+			}
+		}
+		pos += size
+	}
+	return boxes, nil
+}
+
+// fields returns the main fields of a parsed box.
+func fields(p bmff.Box, ids *[]uint32) map[string]any {
+	switch p := p.(type) {
+	case *bmff.FileTypeBox:
+		f := map[string]any{"major": p.MajorBrand, "compatible": p.Compatible}
+		if len(p.MinorVersion) == 4 {
+			f["minor"] = binary.BigEndian.Uint32([]byte(p.MinorVersion))
+		}
+		return f
+	case *bmff.HandlerBox:
+		return map[string]any{"handler": p.HandlerType, "name": p.Name}
+	case *bmff.PrimaryItemBox:
+		return map[string]any{"item": p.ItemID}
+	case *bmff.ItemInfoBox:
+		for _, e := range p.ItemInfos {
+			*ids = append(*ids, uint32(e.ItemID))
+		}
+		return map[string]any{"entries": p.Count}
+	case *bmff.ItemInfoEntry:
+		f := map[string]any{"item": p.ItemID, "item_type": p.ItemType}
+		if p.Name != "" {
+			f["name"] = p.Name
+		}
+		if p.ContentType != "" {
+			f["content_type"] = p.ContentType
+		}
+		if p.Flags&1 != 0 {
+			f["hidden"] = true
+		}
+		return f
+	case *bmff.ItemLocationBox:
+		return map[string]any{"version": p.Version, "items": p.ItemCount}
+	case *bmff.ItemPropertyAssociation:
+		return map[string]any{"version": p.Version, "entries": p.EntryCount}
+	case *bmff.ImageSpatialExtentsProperty:
+		return map[string]any{"width": p.ImageWidth, "height": p.ImageHeight}
+	case *bmff.ImageRotation:
+		return map[string]any{"degrees": 90 * int(p.Angle)}
+	case *bmff.ImageMirror:
+		axis := "vertical"
+		if p.Mirror == bmff.MirrorHorizontal {
+			axis = "horizontal"
+		}
+		return map[string]any{"axis": axis}
+	case *bmff.CleanAperture:
+		return map[string]any{
+			"width":  fmt.Sprintf("%d/%d", p.WidthN, p.WidthD),
+			"height": fmt.Sprintf("%d/%d", p.HeightN, p.HeightD),
+			"h_off":  fmt.Sprintf("%d/%d", p.HorizOffN, p.HorizOffD),
+			"v_off":  fmt.Sprintf("%d/%d", p.VertOffN, p.VertOffD),
+		}
+	case *bmff.ItemHevcConfigBox:
+		return map[string]any{"nal_length_size": p.NALLengthSize()}
+	case *bmff.ItemDataBox:
+		return map[string]any{"data_size": len(p.Data)}
+	}
+	return nil
+}
+
+// reference returns the fields of the body of a box of iref. Item IDs are
+// 16-bit, as in the version 0 iref boxes of most files.
+func reference(b []byte) map[string]any {
+	if len(b) < 4 {
+		return nil
+	}
+	f := map[string]any{"from": binary.BigEndian.Uint16(b)}
+	var to []uint16
+	for b = b[4:]; len(b) >= 2; b = b[2:] {
+		to = append(to, binary.BigEndian.Uint16(b))
+	}
+	f["to"] = to
+	return f
+}
+
+// items returns the item table of a file.
+func items(data []byte, ids []uint32) ([]Item, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	hf := heif.Open(bytes.NewReader(data))
+	var primary uint32
+	if it, err := hf.PrimaryItem(); err == nil {
+		primary = it.ID
+	}
+	var table []Item
+	for _, id := range ids {
+		it, err := hf.ItemByID(id)
+		if err != nil {
+			return table, fmt.Errorf("item %d: %v", id, err)
+		}
+		e := Item{ID: id, Primary: id == primary}
+		if it.Info != nil {
+			e.Type, e.Name, e.Hidden = it.Info.ItemType, it.Info.Name, it.Info.Flags&1 != 0
+		}
+		e.Width, e.Height, _ = it.SpatialExtents()
+		if loc := it.Location; loc != nil {
+			e.Method = loc.ConstructionMethod
+			for _, x := range loc.Extents {
+				e.Extents = append(e.Extents, bmff.OffsetLength{Offset: x.Offset + loc.BaseOffset, Length: x.Length})
+			}
+		}
+		for _, p := range it.Properties {
+			e.Properties = append(e.Properties, p.Type().String())
+		}
+		for _, r := range it.References {
+			if e.References == nil {
+				e.References = map[string][]uint32{}
+			}
+			e.References[r.Type().String()] = append(e.References[r.Type().String()], r.ToItemIDs...)
+		}
+		table = append(table, e)
+	}
+	return table, nil
+}
+
+func printFile(w io.Writer, f *File) {
+	printBoxes(w, f.Boxes, 0)
+	if len(f.Items) == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTYPE\tSIZE\tFLAGS\tEXTENTS\tPROPERTIES\tREFERENCES")
+	for _, it := range f.Items {
+		var flags []string
+		if it.Primary {
+			flags = append(flags, "primary")
+		}
+		if it.Hidden {
+			flags = append(flags, "hidden")
+		}
+		if it.Method == 1 {
+			flags = append(flags, "idat")
+		}
+		size := "-"
+		if it.Width > 0 {
+			size = fmt.Sprintf("%dx%d", it.Width, it.Height)
+		}
+		var extents []string
+		for _, x := range it.Extents {
+			extents = append(extents, fmt.Sprintf("%d+%d", x.Offset, x.Length))
+		}
+		var refs []string
+		for typ, to := range it.References {
+			refs = append(refs, fmt.Sprintf("%s%v", typ, to))
+		}
+		sort.Strings(refs)
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", it.ID, it.Type, size,
+			dash(strings.Join(flags, ",")), dash(strings.Join(extents, " ")),
+			dash(strings.Join(it.Properties, " ")), dash(strings.Join(refs, " ")))
+	}
+	tw.Flush()
+}
+
+func printBoxes(w io.Writer, boxes []*Box, depth int) {
+	for _, b := range boxes {
+		fmt.Fprintf(w, "%s%s @%d size %d", strings.Repeat("  ", depth), b.Type, b.Offset, b.Size)
+		var keys []string
+		for k := range b.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := b.Fields[k]
+			if s, ok := v.(string); ok {
+				v = fmt.Sprintf("%q", s)
+			}
+			fmt.Fprintf(w, " %s=%v", k, v)
+		}
+		if b.Err != "" {
+			fmt.Fprintf(w, " error=%q", b.Err)
+		}
+		fmt.Fprintln(w)
+		printBoxes(w, b.Children, depth+1)
+	}
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
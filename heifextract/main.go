@@ -0,0 +1,134 @@
+// Command heifextract writes one part of a HEIF file: the raw bytes of an
+// item, the EXIF or XMP metadata, or the coded image as a bitstream for
+// other decoders (Annex-B for HEVC, IVF for AV1).
+//
+//	heifextract [-o out] -item id file
+//	heifextract [-o out] -exif file
+//	heifextract [-o out] -xmp file
+//	heifextract [-o out] -bitstream [-item id] file
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/jdeng/goheif/heif"
+)
+
+var (
+	itemID    = flag.Uint("item", 0, "write the raw bytes of the item with this ID")
+	exif      = flag.Bool("exif", false, "write the EXIF metadata, from its TIFF header")
+	xmp       = flag.Bool("xmp", false, "write the XMP packet")
+	bitstream = flag.Bool("bitstream", false, "write the primary image, or the -item image, as an Annex-B or IVF stream")
+	output    = flag.String("o", "", "write to this file instead of the standard output")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("heifextract: ")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: heifextract [-o out] {-item id | -exif | -xmp | -bitstream [-item id]} file\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	modes := 0
+	for _, b := range []bool{*exif, *xmp, *bitstream, *itemID != 0 && !*bitstream} {
+		if b {
+			modes++
+		}
+	}
+	if flag.NArg() != 1 || modes != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	var w io.Writer = os.Stdout
+	var out *os.File
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			log.Fatal(err)
+		}
+		w = out
+	}
+	bw := bufio.NewWriter(w)
+	err = extract(bw, heif.Open(f))
+	if err == nil {
+		err = bw.Flush()
+	}
+	if out != nil {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(*output)
+		}
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", flag.Arg(0), err)
+	}
+}
+
+// extract writes the part of hf selected by the flags to w.
+func extract(w io.Writer, hf *heif.File) error {
+	var data []byte
+	var err error
+	switch {
+	case *exif:
+		data, err = hf.EXIF()
+		if err == nil {
+			data, err = tiff(data)
+		}
+	case *xmp:
+		data, err = hf.XMP()
+	case *bitstream:
+		it, err := item(hf)
+		if err != nil {
+			return err
+		}
+		return hf.ExtractBitstream(w, it)
+	default:
+		it, err := item(hf)
+		if err != nil {
+			return err
+		}
+		data, err = hf.GetItemData(it)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// item returns the item given by -item, or the primary item.
+func item(hf *heif.File) (*heif.Item, error) {
+	if *itemID == 0 {
+		return hf.PrimaryItem()
+	}
+	it, err := hf.ItemByID(uint32(*itemID))
+	if err != nil {
+		return nil, fmt.Errorf("item %d: %v", *itemID, err)
+	}
+	return it, nil
+}
+
+// tiff returns the TIFF structure of raw EXIF data, which most files
+// precede with an "Exif\0\0" header.
+func tiff(exif []byte) ([]byte, error) {
+	for i := 0; i+4 <= len(exif) && i <= 16; i++ {
+		if s := string(exif[i : i+4]); s == "II*\x00" || s == "MM\x00*" {
+			return exif[i:], nil
+		}
+	}
+	return nil, fmt.Errorf("no TIFF header in the EXIF data")
+}
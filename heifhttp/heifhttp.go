@@ -0,0 +1,279 @@
+// Package heifhttp serves HEIF images converted on the fly to formats
+// browsers display, such as JPEG.
+//
+// A Handler converts the body of POST requests, or for GET requests the
+// image its Source returns, typically from a file system or object store:
+//
+//	h := &heifhttp.Handler{
+//		Source: func(r *http.Request) (io.Reader, error) {
+//			return http.Dir(dir).Open(r.URL.Path)
+//		},
+//	}
+//	http.Handle("/photos/", http.StripPrefix("/photos/", h))
+//
+// Query parameters select the size (the longer side, in pixels), quality
+// and format of the response, as in /photos/a.heic?size=1024&q=80&format=jpeg.
+// Without format, the first type of the Accept header with an encoder is
+// used, or JPEG.
+//
+// Any HEIF file is accepted, but only items goheif decodes are converted:
+// AVIF images get 422 Unprocessable Entity unless an AV1 decoder is
+// registered with goheif.RegisterCodec.
+package heifhttp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jdeng/goheif"
+)
+
+// EncodeFunc writes img to w in one image format. quality ranges from 1
+// to 100, for lossy formats.
+type EncodeFunc func(w io.Writer, img image.Image, quality int) error
+
+// Handler is an http.Handler converting HEIF images. Its fields must not
+// be changed once it serves requests.
+type Handler struct {
+	// Source returns the image for a GET or HEAD request. Readers that
+	// also implement io.ReaderAt, such as *os.File or a
+	// goheif.RangeReader, are read only where needed; readers that
+	// implement io.Closer are closed. Errors matching fs.ErrNotExist are
+	// reported as 404 Not Found. If Source is nil, only POST requests are
+	// served.
+	Source func(r *http.Request) (io.Reader, error)
+
+	// Decoder decodes the images. If nil, images are decoded with
+	// SafeEncoding and their rotations applied.
+	Decoder *goheif.Decoder
+
+	// Encoders maps the content types of the response formats, such as
+	// "image/webp", to their encoders. JPEG is always available.
+	Encoders map[string]EncodeFunc
+
+	MaxBodySize   int64 // largest POST body, in bytes; 64 MiB if 0
+	MaxPixels     int   // largest image decoded, in pixels; 100 million if 0
+	MaxSize       int   // largest size parameter; sizes are not limited if 0
+	Quality       int   // quality used without a q parameter; 85 if 0
+	MaxConcurrent int   // conversions at once, others wait; runtime.NumCPU() if 0
+
+	once sync.Once
+	sem  chan struct{}
+}
+
+// httpError is an error reported to the client with its status code.
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e *httpError) Error() string { return e.msg }
+
+func errorf(code int, format string, args ...any) error {
+	return &httpError{code, fmt.Sprintf(format, args...)}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.serve(w, r); err != nil {
+		code := http.StatusInternalServerError
+		var he *httpError
+		if errors.As(err, &he) {
+			code = he.code
+		}
+		http.Error(w, err.Error(), code)
+	}
+}
+
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) error {
+	h.once.Do(func() {
+		n := h.MaxConcurrent
+		if n <= 0 {
+			n = runtime.NumCPU()
+		}
+		h.sem = make(chan struct{}, n)
+	})
+
+	size, quality, err := h.params(r)
+	if err != nil {
+		return err
+	}
+	typ, enc := h.encoder(r)
+	if enc == nil {
+		return errorf(http.StatusNotAcceptable, "unsupported format %q", r.URL.Query().Get("format"))
+	}
+
+	src, err := h.open(r)
+	if err != nil {
+		return err
+	}
+	if c, ok := src.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	select {
+	case h.sem <- struct{}{}:
+		defer func() { <-h.sem }()
+	case <-r.Context().Done():
+		return errorf(http.StatusServiceUnavailable, "canceled while waiting: %v", r.Context().Err())
+	}
+
+	img, err := h.decode(src)
+	if err != nil {
+		return err
+	}
+	if size > 0 {
+		img = goheif.Shrink(img, size)
+	}
+
+	w.Header().Set("Content-Type", typ)
+	if r.URL.Query().Get("format") == "" {
+		w.Header().Add("Vary", "Accept")
+	}
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	// the status is sent with the first bytes, so encoding errors after
+	// that only cut the response short
+	return enc(w, img, quality)
+}
+
+// params returns the size and quality asked for by r.
+func (h *Handler) params(r *http.Request) (size, quality int, err error) {
+	q := r.URL.Query()
+	quality = h.Quality
+	if quality <= 0 {
+		quality = 85
+	}
+	if s := q.Get("q"); s != "" {
+		if quality, err = strconv.Atoi(s); err != nil || quality < 1 || quality > 100 {
+			return 0, 0, errorf(http.StatusBadRequest, "bad quality %q", s)
+		}
+	}
+	if s := q.Get("size"); s != "" {
+		if size, err = strconv.Atoi(s); err != nil || size < 1 {
+			return 0, 0, errorf(http.StatusBadRequest, "bad size %q", s)
+		}
+	}
+	if h.MaxSize > 0 && (size == 0 || size > h.MaxSize) {
+		size = h.MaxSize
+	}
+	return size, quality, nil
+}
+
+// encoder returns the content type and encoder of the response to r, or
+// a nil encoder if the format asked for is not available.
+func (h *Handler) encoder(r *http.Request) (string, EncodeFunc) {
+	lookup := func(typ string) EncodeFunc {
+		if enc, ok := h.Encoders[typ]; ok {
+			return enc
+		}
+		if typ == "image/jpeg" {
+			return encodeJPEG
+		}
+		return nil
+	}
+	if f := r.URL.Query().Get("format"); f != "" {
+		typ := "image/" + strings.ToLower(f)
+		if f == "jpg" {
+			typ = "image/jpeg"
+		}
+		return typ, lookup(typ)
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		typ, _, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		if enc := lookup(typ); enc != nil {
+			return typ, enc
+		}
+	}
+	return "image/jpeg", encodeJPEG
+}
+
+func encodeJPEG(w io.Writer, img image.Image, quality int) error {
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
+
+// open returns the image of r, from its body or Source.
+func (h *Handler) open(r *http.Request) (io.Reader, error) {
+	switch r.Method {
+	case http.MethodPost:
+		max := h.MaxBodySize
+		if max <= 0 {
+			max = 64 << 20
+		}
+		b, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "reading body: %v", err)
+		}
+		if int64(len(b)) > max {
+			return nil, errorf(http.StatusRequestEntityTooLarge, "body larger than %d bytes", max)
+		}
+		return bytes.NewReader(b), nil
+	case http.MethodGet, http.MethodHead:
+		if h.Source == nil {
+			break
+		}
+		src, err := h.Source(r)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errorf(http.StatusNotFound, "%v", err)
+		}
+		return src, err
+	}
+	return nil, errorf(http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+}
+
+// decode checks the format and size of the image of src, then decodes it.
+func (h *Handler) decode(src io.Reader) (image.Image, error) {
+	ra, ok := src.(io.ReaderAt)
+	if !ok {
+		b, err := io.ReadAll(src)
+		if err != nil {
+			return nil, err
+		}
+		ra = bytes.NewReader(b)
+	}
+	prefix := make([]byte, 64)
+	n, err := ra.ReadAt(prefix, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if _, ok := goheif.Sniff(prefix[:n]); !ok {
+		return nil, errorf(http.StatusUnsupportedMediaType, "not a HEIF image")
+	}
+
+	r := io.NewSectionReader(ra, 0, 1<<63-1)
+	cfg, err := goheif.DecodeConfig(r)
+	if err != nil {
+		return nil, errorf(http.StatusUnprocessableEntity, "%v", err)
+	}
+	max := h.MaxPixels
+	if max <= 0 {
+		max = 100e6
+	}
+	if cfg.Width*cfg.Height > max {
+		return nil, errorf(http.StatusRequestEntityTooLarge, "image of %dx%d pixels too large", cfg.Width, cfg.Height)
+	}
+
+	dec := h.Decoder
+	if dec == nil {
+		dec = goheif.NewDecoder(goheif.WithSafeEncoding(true), goheif.WithTransforms(true))
+	}
+	img, err := dec.Decode(r)
+	if err != nil {
+		return nil, errorf(http.StatusUnprocessableEntity, "%v", err)
+	}
+	return img, nil
+}
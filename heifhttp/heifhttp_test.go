@@ -0,0 +1,90 @@
+package heifhttp
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	camel, err := os.ReadFile("../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		Source: func(r *http.Request) (io.Reader, error) {
+			return http.Dir("../testdata").Open(r.URL.Path)
+		},
+		Encoders: map[string]EncodeFunc{
+			"image/png": func(w io.Writer, img image.Image, _ int) error { return png.Encode(w, img) },
+		},
+		MaxSize: 1000,
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		method, path, accept string
+		body                 []byte
+		code                 int
+		typ                  string
+		size                 image.Point
+	}{
+		{"GET", "/camel.heic", "", nil, 200, "image/jpeg", image.Pt(1000, 666)},
+		{"GET", "/camel.heic?size=320&q=50", "", nil, 200, "image/jpeg", image.Pt(320, 212)},
+		{"GET", "/camel.heic?size=320", "image/webp,image/png;q=0.9,*/*", nil, 200, "image/png", image.Pt(320, 212)},
+		{"POST", "/?size=100&format=jpg", "", camel, 200, "image/jpeg", image.Pt(100, 66)},
+		{"GET", "/missing.heic", "", nil, 404, "", image.Point{}},
+		{"GET", "/camel.heic?format=webp", "", nil, 406, "", image.Point{}},
+		{"GET", "/camel.heic?q=0", "", nil, 400, "", image.Point{}},
+		{"POST", "/", "", []byte("GIF89a"), 415, "", image.Point{}},
+		{"PUT", "/camel.heic", "", nil, 405, "", image.Point{}},
+	} {
+		req, err := http.NewRequest(tt.method, srv.URL+tt.path, bytes.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s %s: status %d; want %d (%s)", tt.method, tt.path, resp.StatusCode, tt.code, strings.TrimSpace(string(body)))
+			continue
+		}
+		if tt.code != 200 {
+			continue
+		}
+		if typ := resp.Header.Get("Content-Type"); typ != tt.typ {
+			t.Errorf("%s %s: content type %q; want %q", tt.method, tt.path, typ, tt.typ)
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.method, tt.path, err)
+		} else if got := image.Pt(cfg.Width, cfg.Height); got != tt.size {
+			t.Errorf("%s %s: size %v; want %v", tt.method, tt.path, got, tt.size)
+		}
+	}
+
+	for _, h := range []*Handler{{MaxBodySize: 1000}, {MaxPixels: 1000}} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader(camel)))
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("oversized image: status %d; want 413", rec.Code)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+// Command heifinfo prints what HEIF files hold: the size, codec, bit depth
+// and orientation of their primary image, their brands, a summary of their
+// EXIF metadata and ICC profile, and their auxiliary images and
+// thumbnails.
+//
+//	heifinfo [-json] file...
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf16"
+
+	"github.com/jdeng/goheif/heif"
+	"github.com/jdeng/goheif/heif/bmff"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+var jsonOutput = flag.Bool("json", false, "print JSON instead of text")
+
+// Info is what heifinfo prints for a file.
+type Info struct {
+	Name       string   `json:"name"`
+	Brand      string   `json:"brand,omitempty"`
+	Compatible []string `json:"compatible,omitempty"`
+	Image
+	Mirror     string  `json:"mirror,omitempty"`
+	Exif       *Exif   `json:"exif,omitempty"`
+	ICC        string  `json:"icc,omitempty"`
+	Auxiliary  []Image `json:"auxiliary,omitempty"`
+	Thumbnails []Image `json:"thumbnails,omitempty"`
+	Err        string  `json:"error,omitempty"`
+}
+
+// Image describes an image item. Width and Height are those of the image
+// as displayed, after cropping and rotation.
+type Image struct {
+	ID       uint32 `json:"id"`
+	Codec    string `json:"codec"`
+	Grid     string `json:"grid,omitempty"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	BitDepth int    `json:"bit_depth,omitempty"`
+	Rotation int    `json:"rotation,omitempty"`
+	AuxType  string `json:"aux_type,omitempty"`
+}
+
+// Exif is a summary of the EXIF metadata.
+type Exif struct {
+	Date      string   `json:"date,omitempty"`
+	Make      string   `json:"make,omitempty"`
+	Model     string   `json:"model,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("heifinfo: ")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: heifinfo [-json] file...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	var infos []*Info
+	for i, name := range flag.Args() {
+		info, err := inspect(name)
+		if err != nil {
+			log.Printf("%s: %v", name, err)
+			failed = true
+			info.Err = err.Error()
+		}
+		if *jsonOutput {
+			infos = append(infos, info)
+			continue
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		printInfo(os.Stdout, info)
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(infos); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// inspect returns the Info of a file. With an error, the Info holds what
+// could be read.
+func inspect(name string) (*Info, error) {
+	info := &Info{Name: name}
+	f, err := os.Open(name)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+
+	if b, err := bmff.NewReader(f).ReadBox(); err == nil {
+		if p, err := b.Parse(); err == nil {
+			if ftyp, ok := p.(*bmff.FileTypeBox); ok {
+				info.Brand, info.Compatible = ftyp.MajorBrand, ftyp.Compatible
+			}
+		}
+	}
+
+	hf := heif.Open(f)
+	it, err := hf.PrimaryItem()
+	if err != nil {
+		return info, err
+	}
+	if info.Image, err = describe(hf, it); err != nil {
+		return info, err
+	}
+	for _, p := range it.Properties {
+		if p, ok := p.(*bmff.ImageMirror); ok {
+			info.Mirror = "left-right"
+			if p.Mirror == bmff.MirrorHorizontal {
+				info.Mirror = "top-bottom"
+			}
+		}
+	}
+
+	if raw, err := hf.EXIF(); err == nil {
+		info.Exif = summarize(raw)
+	}
+	if icc, ok := it.ICCProfile(); ok {
+		info.ICC = iccDescription(icc)
+	}
+
+	aux, err := hf.AuxiliaryImages(it)
+	if err != nil {
+		return info, err
+	}
+	for _, a := range aux {
+		img, err := describe(hf, a)
+		if err != nil {
+			return info, err
+		}
+		img.AuxType, _ = a.AuxType()
+		info.Auxiliary = append(info.Auxiliary, img)
+	}
+	thumbs, err := hf.Thumbnails(it)
+	if err != nil {
+		return info, err
+	}
+	for _, t := range thumbs {
+		img, err := describe(hf, t)
+		if err != nil {
+			return info, err
+		}
+		info.Thumbnails = append(info.Thumbnails, img)
+	}
+	return info, nil
+}
+
+// codecs maps the types of coded image items to their codec.
+var codecs = map[string]string{
+	"hvc1": "hevc",
+	"av01": "av1",
+	"vvc1": "vvc",
+	"jpeg": "jpeg",
+}
+
+// describe returns the Image of an item. The codec and bit depth of grids
+// are those of their first tile.
+func describe(hf *heif.File, it *heif.Item) (Image, error) {
+	img := Image{ID: it.ID}
+	w, h, _ := it.VisualDimensions()
+	img.Width, img.Height = w, h
+	if it.Rotations()%2 == 1 {
+		img.Width, img.Height = h, w
+	}
+	img.Rotation = 90 * it.Rotations()
+
+	coded := it
+	if it.Info != nil && it.Info.ItemType == heif.ItemTypeGrid {
+		// version, flags, then the row and column counts minus one
+		if g, err := hf.GetItemData(it); err == nil && len(g) >= 4 {
+			img.Grid = fmt.Sprintf("%dx%d", int(g[3])+1, int(g[2])+1)
+		}
+		for _, r := range it.References {
+			if r.Type().Is(heif.RefDerivedImage) && len(r.ToItemIDs) > 0 {
+				tile, err := hf.ItemByID(r.ToItemIDs[0])
+				if err != nil {
+					return img, err
+				}
+				coded = tile
+				break
+			}
+		}
+	}
+	if coded.Info != nil {
+		img.Codec = coded.Info.ItemType
+		if c, ok := codecs[img.Codec]; ok {
+			img.Codec = c
+		}
+	}
+	img.BitDepth = bitDepth(coded)
+	return img, nil
+}
+
+// bitDepth returns the bit depth of the first channel of an item, from its
+// pixi property or else its decoder configuration, or 0 if unknown.
+func bitDepth(it *heif.Item) int {
+	depth := 0
+	for _, p := range it.Properties {
+		switch {
+		case p.Type().Is("pixi"):
+			// full box header, channel count, then one depth per channel
+			if b, err := io.ReadAll(p.Body()); err == nil && len(b) >= 6 && b[4] > 0 {
+				return int(b[5])
+			}
+		case p.Type().Is("av1C"):
+			if b, err := io.ReadAll(p.Body()); err == nil && len(b) >= 3 {
+				switch {
+				case b[2]&0x20 != 0: // twelve_bit, when high_bitdepth is set
+					depth = 12
+				case b[2]&0x40 != 0:
+					depth = 10
+				default:
+					depth = 8
+				}
+			}
+		}
+		if c, ok := p.(*bmff.ItemHevcConfigBox); ok {
+			depth, _ = c.BitDepth()
+		}
+	}
+	return depth
+}
+
+// summarize returns the date, camera and location of raw EXIF metadata.
+func summarize(raw []byte) *Exif {
+	x, err := exif.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	s := &Exif{}
+	if t, err := x.DateTime(); err == nil {
+		s.Date = t.Format("2006-01-02 15:04:05")
+	}
+	for _, f := range []struct {
+		name exif.FieldName
+		v    *string
+	}{{exif.Make, &s.Make}, {exif.Model, &s.Model}} {
+		if tag, err := x.Get(f.name); err == nil {
+			if v, err := tag.StringVal(); err == nil {
+				*f.v = strings.TrimSpace(v)
+			}
+		}
+	}
+	if lat, long, err := x.LatLong(); err == nil {
+		s.Latitude, s.Longitude = &lat, &long
+	}
+	return s
+}
+
+// iccDescription returns the profile description of an ICC profile, from
+// its desc tag, which is a textDescriptionType in version 2 profiles and a
+// multiLocalizedUnicodeType in version 4 ones.
+func iccDescription(icc []byte) string {
+	if len(icc) < 132 {
+		return ""
+	}
+	be := binary.BigEndian
+	n := int(be.Uint32(icc[128:]))
+	for i := 0; i < n && 132+12*(i+1) <= len(icc); i++ {
+		e := icc[132+12*i:]
+		if string(e[:4]) != "desc" {
+			continue
+		}
+		off, size := int(be.Uint32(e[4:])), int(be.Uint32(e[8:]))
+		if off < 0 || size < 12 || off+size > len(icc) {
+			return ""
+		}
+		tag := icc[off : off+size]
+		switch string(tag[:4]) {
+		case "desc":
+			count := int(be.Uint32(tag[8:]))
+			if 12+count > len(tag) {
+				return ""
+			}
+			return strings.TrimRight(string(tag[12:12+count]), "\x00")
+		case "mluc":
+			// the first record: language, country, length and offset
+			if len(tag) < 28 || be.Uint32(tag[8:]) == 0 {
+				return ""
+			}
+			length, start := int(be.Uint32(tag[20:])), int(be.Uint32(tag[24:]))
+			if start+length > len(tag) {
+				return ""
+			}
+			u := make([]uint16, length/2)
+			for j := range u {
+				u[j] = be.Uint16(tag[start+2*j:])
+			}
+			return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+		}
+		return ""
+	}
+	return ""
+}
+
+func printInfo(w io.Writer, info *Info) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintf(tw, "file:\t%s\n", info.Name)
+	if info.Brand != "" {
+		fmt.Fprintf(tw, "brands:\t%s (%s)\n", info.Brand, strings.Join(info.Compatible, " "))
+	}
+	if info.Codec == "" {
+		return
+	}
+	fmt.Fprintf(tw, "image:\t%s\n", image(info.Image))
+	if info.Rotation != 0 {
+		fmt.Fprintf(tw, "rotation:\t%d°\n", info.Rotation)
+	}
+	if info.Mirror != "" {
+		fmt.Fprintf(tw, "mirror:\t%s\n", info.Mirror)
+	}
+	if x := info.Exif; x != nil {
+		if x.Date != "" {
+			fmt.Fprintf(tw, "date:\t%s\n", x.Date)
+		}
+		if camera := strings.TrimSpace(x.Make + " " + x.Model); camera != "" {
+			fmt.Fprintf(tw, "camera:\t%s\n", camera)
+		}
+		if x.Latitude != nil {
+			fmt.Fprintf(tw, "gps:\t%.6f, %.6f\n", *x.Latitude, *x.Longitude)
+		}
+	}
+	if info.ICC != "" {
+		fmt.Fprintf(tw, "icc:\t%s\n", info.ICC)
+	}
+	for _, a := range info.Auxiliary {
+		fmt.Fprintf(tw, "auxiliary:\t%s, %s\n", image(a), dash(a.AuxType))
+	}
+	for _, t := range info.Thumbnails {
+		fmt.Fprintf(tw, "thumbnail:\t%s\n", image(t))
+	}
+}
+
+// image formats the codec, size and bit depth of img.
+func image(img Image) string {
+	s := fmt.Sprintf("%dx%d %s", img.Width, img.Height, dash(img.Codec))
+	if img.Grid != "" {
+		s += fmt.Sprintf(" (%s grid)", img.Grid)
+	}
+	if img.BitDepth > 0 {
+		s += fmt.Sprintf(", %d-bit", img.BitDepth)
+	}
+	return s
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
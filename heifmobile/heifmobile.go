@@ -0,0 +1,46 @@
+// Package heifmobile is a small API over goheif for iOS and Android apps,
+// made of types gomobile can bind:
+//
+//	gomobile bind -target ios github.com/jdeng/goheif/heifmobile
+//	gomobile bind -target android github.com/jdeng/goheif/heifmobile
+//
+// Images are passed as encoded bytes and come out upright, with their
+// rotation and mirroring applied.
+package heifmobile
+
+import (
+	"bytes"
+	"image/jpeg"
+
+	"github.com/jdeng/goheif"
+)
+
+var decoder = goheif.NewDecoder(goheif.WithSafeEncoding(true), goheif.WithTransforms(true))
+
+// DecodeToJPEGBytes converts the primary image of a HEIF file to a JPEG
+// file of the given quality, from 1 to 100.
+func DecodeToJPEGBytes(data []byte, quality int) ([]byte, error) {
+	img, err := decoder.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ThumbnailToJPEGBytes returns a JPEG thumbnail of a HEIF file whose
+// longer side is at most size pixels, as Decoder.Thumbnail makes it.
+func ThumbnailToJPEGBytes(data []byte, size, quality int) ([]byte, error) {
+	img, err := decoder.Thumbnail(bytes.NewReader(data), size)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,39 @@
+package heifmobile
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"os"
+	"testing"
+)
+
+func TestDecodeToJPEGBytes(t *testing.T) {
+	data, err := os.ReadFile("../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		conv func() ([]byte, error)
+		want image.Point
+	}{
+		{"image", func() ([]byte, error) { return DecodeToJPEGBytes(data, 80) }, image.Pt(1596, 1064)},
+		{"thumbnail", func() ([]byte, error) { return ThumbnailToJPEGBytes(data, 160, 80) }, image.Pt(160, 120)},
+	} {
+		b, err := tt.conv()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := image.Pt(cfg.Width, cfg.Height); got != tt.want {
+			t.Errorf("%s: size %v; want %v", tt.name, got, tt.want)
+		}
+	}
+	if _, err := DecodeToJPEGBytes([]byte("not heif"), 80); err == nil {
+		t.Errorf("garbage decoded")
+	}
+}
@@ -0,0 +1,144 @@
+// Command heifthumb writes small JPEG or PNG previews of HEIF files, for
+// indexing photo libraries. The thumbnails embedded in the files are used
+// when present, so most files cost a decode of a few kilobytes; others are
+// decoded and scaled down.
+//
+//	heifthumb [-s size] [-f jpeg|png] [-o dir] file or pattern...
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jdeng/goheif"
+)
+
+var (
+	size    = flag.Int("s", 256, "longer side of the thumbnails, in pixels")
+	format  = flag.String("f", "jpeg", "thumbnail format: jpeg or png")
+	quality = flag.Int("q", 80, "JPEG quality, from 1 to 100")
+	rotate  = flag.Bool("rotate", true, "apply the rotation and mirroring of the image")
+	outDir  = flag.String("o", "", "write the thumbnails to this directory instead of next to the inputs")
+	jobs    = flag.Int("j", runtime.NumCPU(), "number of files processed at once")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("heifthumb: ")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: heifthumb [flags] <file or pattern>...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || *size < 1 || *quality < 1 || *quality > 100 || (*format != "jpeg" && *format != "png") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var inputs []string
+	for _, arg := range flag.Args() {
+		// patterns are expanded for shells that don't
+		if !strings.ContainsAny(arg, `*?[`) {
+			inputs = append(inputs, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			log.Fatalf("bad pattern %s: %v", arg, err)
+		}
+		inputs = append(inputs, matches...)
+	}
+	if *outDir != "" {
+		if err := os.MkdirAll(*outDir, 0755); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// files are processed in parallel, so each decode uses one thread
+	dec := goheif.NewDecoder(goheif.WithSafeEncoding(true), goheif.WithThreads(1), goheif.WithTransforms(*rotate))
+	var failed atomic.Bool
+	next := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < max(*jobs, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fin := range next {
+				if err := thumbnail(dec, fin, outputName(fin)); err != nil {
+					log.Printf("%s: %v", fin, err)
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+	for _, fin := range inputs {
+		next <- fin
+	}
+	close(next)
+	wg.Wait()
+	if failed.Load() {
+		os.Exit(1)
+	}
+}
+
+// thumbnail writes the thumbnail of the HEIF file fin to fout.
+func thumbnail(dec *goheif.Decoder, fin, fout string) error {
+	fi, err := os.Open(fin)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	img, err := dec.Thumbnail(fi, *size)
+	if err != nil {
+		return err
+	}
+
+	fo, err := os.Create(fout)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fo)
+	err = encode(w, img)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := fo.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fout)
+	}
+	return err
+}
+
+func encode(w *bufio.Writer, img image.Image) error {
+	if *format == "png" {
+		enc := png.Encoder{CompressionLevel: png.BestSpeed}
+		return enc.Encode(w, img)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: *quality})
+}
+
+// outputName returns the name of the thumbnail of fin.
+func outputName(fin string) string {
+	ext := ".jpg"
+	if *format == "png" {
+		ext = ".png"
+	}
+	name := strings.TrimSuffix(fin, filepath.Ext(fin)) + ".thumb" + ext
+	if *outDir != "" {
+		name = filepath.Join(*outDir, filepath.Base(name))
+	}
+	return name
+}
@@ -0,0 +1,310 @@
+// Package conformance compares decoded images with reference outputs,
+// such as those of libheif, to catch regressions in grid assembly,
+// transforms and color handling.
+//
+// An image is described by a Summary: its size and sample format, and for
+// each plane a hash of its samples and the means of its samples over a
+// grid of blocks. Summaries with the same hashes match exactly; otherwise
+// the block means must agree within a tolerance, so that references from
+// other decoders, which may round differently, can be used.
+package conformance
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/jdeng/goheif/libde265"
+)
+
+// Blocks is the number of blocks across and down of the means of a plane.
+const Blocks = 8
+
+// Summary describes a decoded image.
+type Summary struct {
+	Width, Height int
+	Format        string // such as "ycbcr420p8", "ycbcr420p10", "gray8" or "rgba16"
+	Planes        []Plane
+}
+
+// Plane describes a plane of samples.
+type Plane struct {
+	Name   string    // Y, Cb, Cr, Gray, R, G, B or A
+	SHA256 string    // of the samples row by row, 16-bit ones big-endian
+	Means  []float64 // of the samples of Blocks x Blocks blocks, row by row
+}
+
+// plane is the samples of a plane, read through at.
+type plane struct {
+	name string
+	rect image.Rectangle
+	wide bool // 16-bit samples
+	at   func(x, y int) uint16
+}
+
+// Summarize returns the summary of img.
+func Summarize(img image.Image) Summary {
+	r := img.Bounds()
+	s := Summary{Width: r.Dx(), Height: r.Dy()}
+	var planes []plane
+	switch img := img.(type) {
+	case *image.YCbCr:
+		s.Format = "ycbcr" + ratioName(img.SubsampleRatio) + "p8"
+		cr, fx, fy := chromaRect(r, img.SubsampleRatio)
+		planes = []plane{
+			{"Y", r, false, func(x, y int) uint16 { return uint16(img.Y[img.YOffset(x, y)]) }},
+			{"Cb", cr, false, func(x, y int) uint16 { return uint16(img.Cb[img.COffset(x*fx, y*fy)]) }},
+			{"Cr", cr, false, func(x, y int) uint16 { return uint16(img.Cr[img.COffset(x*fx, y*fy)]) }},
+		}
+	case *libde265.YCbCr16:
+		s.Format = "ycbcr" + ratioName(img.SubsampleRatio) + "p" + strconv.Itoa(img.BitDepth)
+		cr, fx, fy := chromaRect(r, img.SubsampleRatio)
+		planes = []plane{
+			{"Y", r, true, func(x, y int) uint16 { return img.Y[img.YOffset(x, y)] }},
+			{"Cb", cr, true, func(x, y int) uint16 { return img.Cb[img.COffset(x*fx, y*fy)] }},
+			{"Cr", cr, true, func(x, y int) uint16 { return img.Cr[img.COffset(x*fx, y*fy)] }},
+		}
+	case *image.Gray:
+		s.Format = "gray8"
+		planes = []plane{{"Gray", r, false, func(x, y int) uint16 { return uint16(img.GrayAt(x, y).Y) }}}
+	case *image.Gray16:
+		s.Format = "gray16"
+		planes = []plane{{"Gray", r, true, func(x, y int) uint16 { return img.Gray16At(x, y).Y }}}
+	default:
+		s.Format = "rgba16"
+		at := func(x, y int) color.RGBA64 { return color.RGBA64Model.Convert(img.At(x, y)).(color.RGBA64) }
+		planes = []plane{
+			{"R", r, true, func(x, y int) uint16 { return at(x, y).R }},
+			{"G", r, true, func(x, y int) uint16 { return at(x, y).G }},
+			{"B", r, true, func(x, y int) uint16 { return at(x, y).B }},
+			{"A", r, true, func(x, y int) uint16 { return at(x, y).A }},
+		}
+	}
+	for _, p := range planes {
+		s.Planes = append(s.Planes, p.summarize())
+	}
+	return s
+}
+
+func (p plane) summarize() Plane {
+	h := sha256.New()
+	w := bufio.NewWriter(h)
+	bw, bh := max(p.rect.Dx(), 1), max(p.rect.Dy(), 1)
+	sums := make([]float64, Blocks*Blocks)
+	counts := make([]int, Blocks*Blocks)
+	for y := p.rect.Min.Y; y < p.rect.Max.Y; y++ {
+		by := (y - p.rect.Min.Y) * Blocks / bh
+		for x := p.rect.Min.X; x < p.rect.Max.X; x++ {
+			v := p.at(x, y)
+			if p.wide {
+				w.WriteByte(byte(v >> 8))
+			}
+			w.WriteByte(byte(v))
+			i := by*Blocks + (x-p.rect.Min.X)*Blocks/bw
+			sums[i] += float64(v)
+			counts[i]++
+		}
+	}
+	w.Flush()
+
+	var means []float64
+	for i, n := range counts {
+		if n > 0 {
+			// two decimals keep the golden files readable
+			means = append(means, math.Round(sums[i]/float64(n)*100)/100)
+		}
+	}
+	return Plane{Name: p.name, SHA256: hex.EncodeToString(h.Sum(nil)), Means: means}
+}
+
+// chromaRect returns the chroma samples of the luma samples r, and the
+// subsampling factors across and down.
+func chromaRect(r image.Rectangle, ratio image.YCbCrSubsampleRatio) (cr image.Rectangle, fx, fy int) {
+	fx, fy = 1, 1
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		fx = 2
+	case image.YCbCrSubsampleRatio420:
+		fx, fy = 2, 2
+	case image.YCbCrSubsampleRatio440:
+		fy = 2
+	case image.YCbCrSubsampleRatio411:
+		fx = 4
+	case image.YCbCrSubsampleRatio410:
+		fx, fy = 4, 2
+	}
+	cr = image.Rect(r.Min.X/fx, r.Min.Y/fy, (r.Max.X+fx-1)/fx, (r.Max.Y+fy-1)/fy)
+	return cr, fx, fy
+}
+
+func ratioName(ratio image.YCbCrSubsampleRatio) string {
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		return "422"
+	case image.YCbCrSubsampleRatio420:
+		return "420"
+	case image.YCbCrSubsampleRatio440:
+		return "440"
+	case image.YCbCrSubsampleRatio411:
+		return "411"
+	case image.YCbCrSubsampleRatio410:
+		return "410"
+	}
+	return "444"
+}
+
+// Compare reports how got differs from want: in size, format, or in the
+// block means of planes whose hashes differ by more than tolerance.
+func Compare(got, want Summary, tolerance float64) error {
+	if got.Width != want.Width || got.Height != want.Height {
+		return fmt.Errorf("size %dx%d, want %dx%d", got.Width, got.Height, want.Width, want.Height)
+	}
+	if got.Format != want.Format {
+		return fmt.Errorf("format %s, want %s", got.Format, want.Format)
+	}
+	if len(got.Planes) != len(want.Planes) {
+		return fmt.Errorf("%d planes, want %d", len(got.Planes), len(want.Planes))
+	}
+	var errs []error
+	for i, p := range got.Planes {
+		q := want.Planes[i]
+		if p.SHA256 == q.SHA256 {
+			continue
+		}
+		if len(p.Means) != len(q.Means) {
+			errs = append(errs, fmt.Errorf("plane %s: %d blocks, want %d", p.Name, len(p.Means), len(q.Means)))
+			continue
+		}
+		worst, at := 0.0, 0
+		for j := range p.Means {
+			if d := math.Abs(p.Means[j] - q.Means[j]); d > worst {
+				worst, at = d, j
+			}
+		}
+		if worst > tolerance {
+			errs = append(errs, fmt.Errorf("plane %s: block %d mean %.2f, want %.2f", p.Name, at, p.Means[at], q.Means[at]))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReadY4M reads the first frame of a YUV4MPEG2 stream, as written by
+// libheif's heif-convert, as an *image.YCbCr, a *libde265.YCbCr16 for
+// high bit depths, or an *image.Gray or *image.Gray16 for monochrome ones.
+func ReadY4M(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != "YUV4MPEG2" {
+		return nil, errors.New("conformance: not a YUV4MPEG2 stream")
+	}
+	var width, height int
+	colorspace := "420jpeg"
+	for _, f := range fields[1:] {
+		switch f[0] {
+		case 'W':
+			width, err = strconv.Atoi(f[1:])
+		case 'H':
+			height, err = strconv.Atoi(f[1:])
+		case 'C':
+			colorspace = f[1:]
+		}
+		if err != nil {
+			return nil, fmt.Errorf("conformance: bad y4m header field %s", f)
+		}
+	}
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("conformance: bad y4m size %dx%d", width, height)
+	}
+	if line, err = br.ReadString('\n'); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "FRAME") {
+		return nil, errors.New("conformance: no y4m frame")
+	}
+
+	// high bit depths follow the ratio, as in 420p10 and mono10
+	ratioName, depth := colorspace, 8
+	if name, bits, ok := strings.Cut(colorspace, "p"); ok {
+		if d, err := strconv.Atoi(bits); err == nil {
+			ratioName, depth = name, d
+		}
+	} else if bits, ok := strings.CutPrefix(colorspace, "mono"); ok && bits != "" {
+		ratioName = "mono"
+		if depth, err = strconv.Atoi(bits); err != nil {
+			return nil, fmt.Errorf("conformance: unsupported y4m colorspace %s", colorspace)
+		}
+	}
+	if depth < 8 || depth > 16 {
+		return nil, fmt.Errorf("conformance: unsupported y4m colorspace %s", colorspace)
+	}
+	rect := image.Rect(0, 0, width, height)
+	if ratioName == "mono" {
+		if depth > 8 {
+			img := image.NewGray16(rect)
+			samples, err := readSamples(br, width*height)
+			for i, v := range samples {
+				binary.BigEndian.PutUint16(img.Pix[2*i:], v<<(16-depth)|v>>(2*depth-16))
+			}
+			return img, err
+		}
+		img := image.NewGray(rect)
+		_, err := io.ReadFull(br, img.Pix)
+		return img, err
+	}
+
+	var ratio image.YCbCrSubsampleRatio
+	switch {
+	case strings.HasPrefix(ratioName, "420"):
+		ratio = image.YCbCrSubsampleRatio420
+	case ratioName == "422":
+		ratio = image.YCbCrSubsampleRatio422
+	case ratioName == "444":
+		ratio = image.YCbCrSubsampleRatio444
+	default:
+		return nil, fmt.Errorf("conformance: unsupported y4m colorspace %s", colorspace)
+	}
+	if depth > 8 {
+		img := libde265.NewYCbCr16(rect, ratio, depth)
+		for _, p := range [][]uint16{img.Y, img.Cb, img.Cr} {
+			samples, err := readSamples(br, len(p))
+			if err != nil {
+				return nil, err
+			}
+			copy(p, samples)
+		}
+		return img, nil
+	}
+	img := image.NewYCbCr(rect, ratio)
+	for _, p := range [][]byte{img.Y, img.Cb, img.Cr} {
+		if _, err := io.ReadFull(br, p); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// readSamples reads n samples of a y4m plane, 16-bit ones little-endian.
+func readSamples(r io.Reader, n int) ([]uint16, error) {
+	b := make([]byte, 2*n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	samples := make([]uint16, n)
+	for i := range samples {
+		samples[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return samples, nil
+}
@@ -0,0 +1,239 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jdeng/goheif"
+	"github.com/jdeng/goheif/heif"
+	"github.com/jdeng/goheif/internal/heiftest"
+)
+
+var (
+	update    = flag.Bool("update", false, "rewrite the golden summaries from the decoded images")
+	refDir    = flag.String("ref", "", "compare with the NAME.y4m outputs of another decoder in this directory, such as heif-convert's")
+	corpusDir = flag.String("corpus", "", "also decode the HEIF files of this directory, summarized in its golden.json")
+	tolerance = flag.Float64("tolerance", 1, "largest difference of block means, in sample values")
+)
+
+const goldenFile = "testdata/golden.json"
+
+// testFile is a file of the corpus, summarized in the golden file.
+type testFile struct {
+	name, golden string
+	data         []byte
+}
+
+// corpus returns the files compared with their golden summaries. Variants
+// of the camel image cover rotations, crops and grids.
+func corpus(t *testing.T) []testFile {
+	camel, err := os.ReadFile("../../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"camel": camel}
+	rewrite := func(name string, f func(*bytes.Buffer) error) {
+		var buf bytes.Buffer
+		if err := f(&buf); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		files[name] = buf.Bytes()
+	}
+	src := bytes.NewReader(camel)
+	rewrite("camel-rot90", func(w *bytes.Buffer) error { return heif.RewriteTransform(src, w, 1, false) })
+	rewrite("camel-rot270-mirror", func(w *bytes.Buffer) error { return heif.RewriteTransform(src, w, 3, true) })
+	rewrite("camel-crop", func(w *bytes.Buffer) error { return heif.RewriteCrop(src, w, image.Rect(101, 50, 1001, 651)) })
+
+	off, size, err := heiftest.FindBox(camel, "meta", "iprp", "ipco", "hvcC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hf := heif.Open(src)
+	it, err := hf.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := hf.GetItemData(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the output is smaller than the tiles, as in camera files
+	files["camel-grid"] = heiftest.HEVCGrid(2, 2, 3000, 2000, camel[off:off+size], data, 1596, 1064).Bytes()
+
+	var tfs []testFile
+	for name, data := range files {
+		tfs = append(tfs, testFile{name, goldenFile, data})
+	}
+	sort.Slice(tfs, func(i, j int) bool { return tfs[i].name < tfs[j].name })
+
+	if *corpusDir != "" {
+		names, err := filepath.Glob(filepath.Join(*corpusDir, "*.hei[cf]"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			b, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			base := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+			tfs = append(tfs, testFile{base, filepath.Join(*corpusDir, "golden.json"), b})
+		}
+	}
+	return tfs
+}
+
+func readGolden(t *testing.T, name string) map[string]Summary {
+	golden := map[string]Summary{}
+	b, err := os.ReadFile(name)
+	if os.IsNotExist(err) && *update {
+		return golden
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &golden); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return golden
+}
+
+func writeGolden(t *testing.T, name string, golden map[string]Summary) {
+	b, err := json.MarshalIndent(golden, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, append(b, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reference returns the summary of the output of another decoder for the
+// file name, if -ref is set and has one.
+func reference(t *testing.T, name string) (Summary, bool) {
+	if *refDir == "" {
+		return Summary{}, false
+	}
+	f, err := os.Open(filepath.Join(*refDir, name+".y4m"))
+	if os.IsNotExist(err) {
+		return Summary{}, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := ReadY4M(f)
+	if err != nil {
+		t.Fatalf("%s: %v", f.Name(), err)
+	}
+	return Summarize(img), true
+}
+
+func TestConformance(t *testing.T) {
+	goldens := map[string]map[string]Summary{}
+	dec := goheif.NewDecoder(goheif.WithTransforms(true))
+	for _, tf := range corpus(t) {
+		golden, ok := goldens[tf.golden]
+		if !ok {
+			golden = readGolden(t, tf.golden)
+			goldens[tf.golden] = golden
+		}
+		t.Run(tf.name, func(t *testing.T) {
+			img, err := dec.Decode(bytes.NewReader(tf.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := Summarize(img)
+			want, ok := reference(t, tf.name)
+			if *update {
+				// references, if any, become the golden summaries
+				if !ok {
+					want = got
+				}
+				golden[tf.name] = want
+				return
+			}
+			if !ok {
+				if want, ok = golden[tf.name]; !ok {
+					t.Fatalf("no golden summary in %s; run with -update", tf.golden)
+				}
+			}
+			if err := Compare(got, want, *tolerance); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	if *update {
+		for name, golden := range goldens {
+			writeGolden(t, name, golden)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	img := image.NewYCbCr(image.Rect(0, 0, 64, 32), image.YCbCrSubsampleRatio420)
+	for i := range img.Y {
+		img.Y[i] = byte(i / 64 * 8) // darker at the top
+	}
+	want := Summarize(img)
+	if err := Compare(Summarize(img), want, 0); err != nil {
+		t.Errorf("same image: %v", err)
+	}
+
+	// small changes pass within the tolerance only
+	img.Y[0]++
+	if err := Compare(Summarize(img), want, 0); err == nil {
+		t.Error("changed image matches with no tolerance")
+	}
+	if err := Compare(Summarize(img), want, 1); err != nil {
+		t.Errorf("changed image: %v", err)
+	}
+
+	// a flipped image has the same samples in other blocks
+	flipped := image.NewYCbCr(img.Rect, img.SubsampleRatio)
+	for y := 0; y < 32; y++ {
+		copy(flipped.Y[y*64:(y+1)*64], img.Y[(31-y)*64:(32-y)*64])
+	}
+	if err := Compare(Summarize(flipped), want, 1); err == nil || !strings.Contains(err.Error(), "plane Y") {
+		t.Errorf("flipped image: err = %v; want a Y plane difference", err)
+	}
+
+	if err := Compare(Summarize(img.SubImage(image.Rect(0, 0, 32, 32))), want, 1); err == nil {
+		t.Error("cropped image matches")
+	}
+}
+
+func TestReadY4M(t *testing.T) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "YUV4MPEG2 W3 H2 F25:1 Ip A1:1 C420jpeg\nFRAME\n")
+	buf.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+	img, err := ReadY4M(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ycc, ok := img.(*image.YCbCr)
+	if !ok || ycc.Rect != image.Rect(0, 0, 3, 2) || ycc.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		t.Fatalf("got %T %v", img, img.Bounds())
+	}
+	if !bytes.Equal(ycc.Y, []byte{1, 2, 3, 4, 5, 6}) || !bytes.Equal(ycc.Cb, []byte{7, 8}) || !bytes.Equal(ycc.Cr, []byte{9, 10}) {
+		t.Errorf("planes %v %v %v", ycc.Y, ycc.Cb, ycc.Cr)
+	}
+
+	buf.Reset()
+	fmt.Fprintf(&buf, "YUV4MPEG2 W2 H1 Cmono10\nFRAME\n\xff\x03\x00\x02")
+	img, err = ReadY4M(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, ok := img.(*image.Gray16); !ok || g.Gray16At(0, 0).Y != 0xffff || g.Gray16At(1, 0).Y != 0x8020 {
+		t.Errorf("got %T %v", img, img.At(1, 0))
+	}
+}
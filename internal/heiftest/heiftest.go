@@ -0,0 +1,245 @@
+// Package heiftest builds small HEIF files for tests, so that grids,
+// properties and broken files can be tested without binary fixtures.
+package heiftest
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// Item is an item of a File.
+type Item struct {
+	ID    uint16
+	Type  string   // item type, such as "hvc1" or "grid"
+	Data  []byte   // stored in the mdat box
+	Props [][]byte // complete property boxes, associated in order
+
+	ContentType string // of "mime" items
+
+	// DeclaredLength, if not zero, is written as the length of the item's
+	// extent instead of len(Data), to make truncated or overlong items.
+	DeclaredLength uint32
+
+	// NoExtent writes the item's location with no extents, as for items
+	// without data such as identity items. Data is still stored.
+	NoExtent bool
+}
+
+// File describes a HEIF file. The zero value is an empty "mif1" file.
+type File struct {
+	Brand      string   // major brand; "mif1" if empty
+	Compatible []string // compatible brands; Brand alone if empty
+	Primary    uint16   // primary item; the first item if zero
+	Items      []*Item
+	Refs       []Ref
+}
+
+// Ref is an item reference, such as a grid's "dimg" tiles.
+type Ref struct {
+	Type string
+	From uint16
+	To   []uint16
+}
+
+// AddItem adds an item with the next free ID and returns it.
+func (f *File) AddItem(typ string, data []byte, props ...[]byte) *Item {
+	it := &Item{ID: uint16(len(f.Items) + 1), Type: typ, Data: data, Props: props}
+	f.Items = append(f.Items, it)
+	return it
+}
+
+// AddRef adds a reference of type typ from one item to others.
+func (f *File) AddRef(typ string, from uint16, to ...uint16) {
+	f.Refs = append(f.Refs, Ref{Type: typ, From: from, To: to})
+}
+
+// Bytes encodes the file: ftyp, meta and mdat boxes, in that order.
+func (f *File) Bytes() []byte {
+	brand := f.Brand
+	if brand == "" {
+		brand = "mif1"
+	}
+	compatible := f.Compatible
+	if len(compatible) == 0 {
+		compatible = []string{brand}
+	}
+	ftyp := append([]byte(brand), 0, 0, 0, 0)
+	for _, c := range compatible {
+		ftyp = append(ftyp, c...)
+	}
+	out := bmff.AppendBox(nil, boxType("ftyp"), ftyp)
+
+	// the item offsets don't change the size of the meta box
+	mdatStart := len(out) + len(f.meta(0)) + 8
+	out = append(out, f.meta(uint32(mdatStart))...)
+
+	var mdat []byte
+	for _, it := range f.Items {
+		mdat = append(mdat, it.Data...)
+	}
+	return bmff.AppendBox(out, boxType("mdat"), mdat)
+}
+
+func (f *File) meta(mdatStart uint32) []byte {
+	primary := f.Primary
+	if primary == 0 && len(f.Items) > 0 {
+		primary = f.Items[0].ID
+	}
+
+	hdlr := append(make([]byte, 4), "pict"...)
+	hdlr = append(hdlr, make([]byte, 13)...) // reserved, empty name
+	body := bmff.AppendFullBox(nil, boxType("hdlr"), 0, 0, hdlr)
+	body = bmff.AppendFullBox(body, boxType("pitm"), 0, 0, be16(nil, primary))
+
+	iinf := be16(nil, uint16(len(f.Items)))
+	for _, it := range f.Items {
+		infe := be16(be16(nil, it.ID), 0)
+		infe = append(append(infe, it.Type...), 0)
+		if it.Type == "mime" {
+			infe = append(append(infe, it.ContentType...), 0)
+		}
+		iinf = bmff.AppendFullBox(iinf, boxType("infe"), 2, 0, infe)
+	}
+	body = bmff.AppendFullBox(body, boxType("iinf"), 0, 0, iinf)
+
+	if len(f.Refs) > 0 {
+		var iref []byte
+		for _, r := range f.Refs {
+			ref := be16(be16(nil, r.From), uint16(len(r.To)))
+			for _, to := range r.To {
+				ref = be16(ref, to)
+			}
+			iref = bmff.AppendBox(iref, boxType(r.Type), ref)
+		}
+		body = bmff.AppendFullBox(body, boxType("iref"), 0, 0, iref)
+	}
+
+	var ipco []byte
+	ipma := binary.BigEndian.AppendUint32(nil, uint32(len(f.Items)))
+	index := 0
+	for _, it := range f.Items {
+		ipma = append(be16(ipma, it.ID), byte(len(it.Props)))
+		for _, p := range it.Props {
+			ipco = append(ipco, p...)
+			index++
+			ipma = append(ipma, 0x80|byte(index)) // essential
+		}
+	}
+	iprp := bmff.AppendBox(nil, boxType("ipco"), ipco)
+	iprp = bmff.AppendFullBox(iprp, boxType("ipma"), 0, 0, ipma)
+	body = bmff.AppendBox(body, boxType("iprp"), iprp)
+
+	iloc := append([]byte{0x44, 0x00}, be16(nil, uint16(len(f.Items)))...)
+	off := mdatStart
+	for _, it := range f.Items {
+		length := uint32(len(it.Data))
+		if it.DeclaredLength != 0 {
+			length = it.DeclaredLength
+		}
+		if it.NoExtent {
+			iloc = be16(be16(be16(iloc, it.ID), 0), 0)
+		} else {
+			iloc = be16(be16(be16(iloc, it.ID), 0), 1)
+			iloc = binary.BigEndian.AppendUint32(iloc, off)
+			iloc = binary.BigEndian.AppendUint32(iloc, length)
+		}
+		off += uint32(len(it.Data))
+	}
+	body = bmff.AppendFullBox(body, boxType("iloc"), 0, 0, iloc)
+
+	return bmff.AppendFullBox(nil, boxType("meta"), 0, 0, body)
+}
+
+// Ispe returns an image spatial extents property.
+func Ispe(width, height int) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(width))
+	b = binary.BigEndian.AppendUint32(b, uint32(height))
+	return bmff.AppendFullBox(nil, boxType("ispe"), 0, 0, b)
+}
+
+// Irot returns an image rotation property, turning the image anti-clockwise
+// by angle degrees, a multiple of 90.
+func Irot(angle int) []byte {
+	return bmff.AppendBox(nil, boxType("irot"), []byte{byte((angle / 90) & 3)})
+}
+
+// Property returns a property box of type typ with the given body.
+func Property(typ string, body []byte) []byte {
+	return bmff.AppendBox(nil, boxType(typ), body)
+}
+
+// Grid returns the data of a grid item of rows x columns tiles making a
+// width x height image.
+func Grid(rows, columns, width, height int) []byte {
+	if width > 0xffff || height > 0xffff {
+		b := []byte{0, 1, byte(rows - 1), byte(columns - 1)}
+		b = binary.BigEndian.AppendUint32(b, uint32(width))
+		return binary.BigEndian.AppendUint32(b, uint32(height))
+	}
+	b := []byte{0, 0, byte(rows - 1), byte(columns - 1)}
+	return be16(be16(b, uint16(width)), uint16(height))
+}
+
+// HEVCGrid returns a file whose primary item is a width x height grid of
+// rows x columns copies of one HEVC coded image, given as its hvcC
+// property box and item data.
+func HEVCGrid(rows, columns, width, height int, hvcC, data []byte, tileWidth, tileHeight int) *File {
+	f := &File{Brand: "heic", Compatible: []string{"mif1", "heic"}}
+	grid := f.AddItem("grid", Grid(rows, columns, width, height), Ispe(width, height))
+
+	tiles := make([]uint16, rows*columns)
+	for i := range tiles {
+		tiles[i] = f.AddItem("hvc1", data, hvcC, Ispe(tileWidth, tileHeight)).ID
+	}
+	f.AddRef("dimg", grid.ID, tiles...)
+	return f
+}
+
+// FindBox returns the offset and size of the first box found by following
+// the path of box types from the top level, as in "meta", "iprp", "ipco".
+func FindBox(file []byte, path ...string) (off, size int, err error) {
+	b := file
+	base := 0
+	for depth, typ := range path {
+		found := false
+		for pos := 0; pos+8 <= len(b); {
+			n := int(binary.BigEndian.Uint32(b[pos:]))
+			if n < 8 || pos+n > len(b) {
+				return 0, 0, errors.New("heiftest: malformed box")
+			}
+			if string(b[pos+4:pos+8]) == typ {
+				if depth == len(path)-1 {
+					return base + pos, n, nil
+				}
+				hdr := 8
+				if typ == "meta" || typ == "iref" || typ == "iinf" {
+					hdr = 12 // full boxes holding boxes
+				}
+				if typ == "iinf" {
+					hdr += 2 // entry count
+				}
+				base += pos + hdr
+				b = b[pos+hdr : pos+n]
+				found = true
+				break
+			}
+			pos += n
+		}
+		if !found {
+			return 0, 0, errors.New("heiftest: box " + typ + " not found")
+		}
+	}
+	return 0, 0, errors.New("heiftest: empty path")
+}
+
+func be16(b []byte, v uint16) []byte {
+	return binary.BigEndian.AppendUint16(b, v)
+}
+
+func boxType(s string) bmff.BoxType {
+	var t bmff.BoxType
+	copy(t[:], s)
+	return t
+}
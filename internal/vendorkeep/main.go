@@ -0,0 +1,206 @@
+// Command vendorkeep writes the stubs that keep C sources in vendored
+// copies of the module.
+//
+// go mod vendor copies the directories of Go packages only, so the
+// directories holding only C, C++ or assembly sources would be left out.
+// vendorkeep makes each of them a package with a vendorkeep.go file built
+// only with the vendorkeep tag, and writes include_cgo.go in the closest
+// enclosing Go package to import them all under the same tag.
+//
+// It runs from go generate in libde265. With -check, it only reports the
+// files that are out of date.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var check = flag.Bool("check", false, "report out of date files instead of writing them")
+
+// sourceExts are the extensions of the files cgo compiles or includes.
+var sourceExts = map[string]bool{
+	".c": true, ".cc": true, ".cpp": true, ".cxx": true, ".h": true, ".hh": true, ".hpp": true,
+	".inl": true, ".S": true, ".s": true, ".asm": true,
+}
+
+const stub = `//go:build vendorkeep
+// +build vendorkeep
+
+package cgowrapper
+`
+
+const includeHeader = `// Code generated by internal/vendorkeep; DO NOT EDIT.
+
+//go:build vendorkeep
+// +build vendorkeep
+
+package %s
+
+// https://github.com/golang/go/issues/26366
+
+// This file exists purely to prevent the golang toolchain from stripping
+// away the c source directories and files when ` + "`go mod vendor`" + ` is used
+// to populate a ` + "`vendor/`" + ` directory of a project depending on ` + "`goheif`" + `.
+//
+// How it works:
+//  - every directory which only includes c/c++ source files receives a
+//    vendorkeep.go file.
+//  - every directory we want to preserve is included here as a _ import.
+//  - every dummy go file is given a build tag to exclude it from the regular
+//    build.
+
+import (
+	// Prevent go tooling from stripping out the c source files.
+`
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("vendorkeep: ")
+	flag.Parse()
+
+	root, module, err := findModule()
+	if err != nil {
+		log.Fatal(err)
+	}
+	files, err := generate(root, module)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stale := false
+	for _, name := range names {
+		old, err := os.ReadFile(name)
+		if err == nil && bytes.Equal(old, files[name]) {
+			continue
+		}
+		rel, _ := filepath.Rel(root, name)
+		if *check {
+			log.Printf("%s is out of date; run go generate ./libde265", rel)
+			stale = true
+			continue
+		}
+		if err := os.WriteFile(name, files[name], 0644); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("wrote %s", rel)
+	}
+	if stale {
+		os.Exit(1)
+	}
+}
+
+// findModule returns the directory and path of the module holding the
+// working directory.
+func findModule() (dir, module string, err error) {
+	dir, err = os.Getwd()
+	if err != nil {
+		return "", "", err
+	}
+	for {
+		b, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			for _, line := range strings.Split(string(b), "\n") {
+				if f := strings.Fields(line); len(f) == 2 && f[0] == "module" {
+					return dir, strings.Trim(f[1], `"`), nil
+				}
+			}
+			return "", "", fmt.Errorf("no module path in %s", filepath.Join(dir, "go.mod"))
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", fmt.Errorf("no go.mod found")
+		}
+		dir = parent
+	}
+}
+
+// generate returns the contents of the vendorkeep.go and include_cgo.go
+// files of the module in root, by file name.
+func generate(root, module string) (map[string][]byte, error) {
+	type dirInfo struct {
+		sources bool   // has C sources
+		pkg     string // name of the package of its Go files, if any
+	}
+	dirs := map[string]*dirInfo{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if p != root && (name == "testdata" || name == "vendor" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(p, "go.mod")); p != root && err == nil {
+				return filepath.SkipDir // another module
+			}
+			dirs[p] = &dirInfo{}
+			return nil
+		}
+		info := dirs[filepath.Dir(p)]
+		switch {
+		case sourceExts[filepath.Ext(name)]:
+			info.sources = true
+		case strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go") && name != "vendorkeep.go" && info.pkg == "":
+			f, err := parser.ParseFile(token.NewFileSet(), p, nil, parser.PackageClauseOnly)
+			if err != nil {
+				return err
+			}
+			info.pkg = f.Name.Name
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{}
+	imports := map[string][]string{} // by the directory of the importing package
+	for dir, info := range dirs {
+		if !info.sources || info.pkg != "" {
+			continue
+		}
+		files[filepath.Join(dir, "vendorkeep.go")] = []byte(stub)
+
+		// the closest enclosing package imports the stub
+		parent := filepath.Dir(dir)
+		for parent != root && (dirs[parent] == nil || dirs[parent].pkg == "") {
+			parent = filepath.Dir(parent)
+		}
+		if dirs[parent].pkg == "" {
+			return nil, fmt.Errorf("no Go package encloses %s", dir)
+		}
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return nil, err
+		}
+		imports[parent] = append(imports[parent], path.Join(module, filepath.ToSlash(rel)))
+	}
+	for dir, paths := range imports {
+		sort.Strings(paths)
+		var b bytes.Buffer
+		fmt.Fprintf(&b, includeHeader, dirs[dir].pkg)
+		for _, p := range paths {
+			fmt.Fprintf(&b, "\t_ %q\n", p)
+		}
+		b.WriteString(")\n")
+		files[filepath.Join(dir, "include_cgo.go")] = b.Bytes()
+	}
+	return files, nil
+}
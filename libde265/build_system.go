@@ -0,0 +1,10 @@
+//go:build system_libde265
+
+package libde265
+
+// Build with -tags system_libde265 to link the libde265 installed on the
+// system, located with pkg-config, instead of compiling the vendored sources.
+
+//#cgo CFLAGS: -DGOHEIF_SYSTEM_LIBDE265
+//#cgo pkg-config: libde265
+import "C"
@@ -0,0 +1,32 @@
+//go:build !system_libde265
+
+package libde265
+
+//go:generate go run ../internal/vendorkeep
+
+// The vendored libde265 sources are compiled through libde265.cc.
+//
+// libde265 has hand-written SSE4.1 code only; there are no AVX2 kernels,
+// and its NEON assembly is for 32-bit ARM, which cgo cannot build. Wider
+// SIMD therefore comes from the compiler vectorizing the C++ code: when
+// building with GOAMD64=v3 the binary requires AVX2 anyway, so we let the
+// compiler use it, and NEON is always available on arm64.
+//
+// On Windows, the sources build with the mingw-w64 gcc (amd64) or
+// llvm-mingw clang (arm64) that cgo uses. The C++ runtime is linked
+// statically so that programs run without the toolchain's DLLs.
+//
+// For gomobile, iOS builds (GOOS=ios) take the darwin flags, and Android
+// builds also cover 32-bit arm and 386, which get the portable C++ code.
+// The NDK's clang++ links the shared libc++ by default, which apps built
+// by gomobile do not ship, so it is linked statically.
+
+//#cgo CFLAGS: -I.
+//#cgo CXXFLAGS: -Ilibde265 -I. -std=c++11
+//#cgo amd64 CXXFLAGS: -DHAVE_SSE4_1 -msse4.1
+//#cgo amd64.v3 CXXFLAGS: -march=x86-64-v3 -O3
+//#cgo arm64 CXXFLAGS: -DHAVE_ARM -O3
+//#cgo darwin,amd64 CXXFLAGS: -Wno-constant-conversion
+//#cgo windows LDFLAGS: -static-libgcc -static-libstdc++
+//#cgo android LDFLAGS: -static-libstdc++
+import "C"
@@ -0,0 +1,70 @@
+package libde265
+
+// #include "glue.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error categories, for use with errors.Is on errors returned by Decoder.
+var (
+	// ErrBitstream reports a malformed or corrupt bitstream.
+	ErrBitstream = errors.New("libde265: bitstream error")
+
+	// ErrUnsupported reports a stream using a feature libde265 does not implement.
+	ErrUnsupported = errors.New("libde265: unsupported feature")
+
+	// ErrOutOfMemory reports a failed allocation in the decoder.
+	ErrOutOfMemory = errors.New("libde265: out of memory")
+
+	// ErrInternal reports a decoder setup or state problem, such as a
+	// failure to start worker threads.
+	ErrInternal = errors.New("libde265: internal error")
+
+	// ErrMemoryLimit is returned by DecodeImage when a picture does not fit
+	// in the limit set with WithMemoryLimit. It matches ErrOutOfMemory.
+	ErrMemoryLimit = fmt.Errorf("%w: memory limit exceeded", ErrOutOfMemory)
+
+	// ErrNoPicture is returned by DecodeImage when the input yields no picture.
+	ErrNoPicture = errors.New("libde265: no picture")
+)
+
+// Error is a de265_error code returned by libde265.
+// It matches one of the category errors above with errors.Is.
+type Error int
+
+func (e Error) Error() string {
+	return "libde265: " + C.GoString(C.de265_get_error_text(C.de265_error(e)))
+}
+
+// Is reports whether e belongs to the category target.
+func (e Error) Is(target error) bool {
+	return target == e.category()
+}
+
+// IsWarning reports whether e is a warning rather than an error.
+func (e Error) IsWarning() bool {
+	return e >= C.DE265_WARNING_NO_WPP_CANNOT_USE_MULTITHREADING
+}
+
+func (e Error) category() error {
+	switch e {
+	case C.DE265_ERROR_OUT_OF_MEMORY, C.DE265_WARNING_CANNOT_APPLY_SAO_OUT_OF_MEMORY:
+		return ErrOutOfMemory
+	case C.DE265_ERROR_NOT_IMPLEMENTED_YET:
+		return ErrUnsupported
+	case C.DE265_ERROR_NO_SUCH_FILE,
+		C.DE265_ERROR_IMAGE_BUFFER_FULL,
+		C.DE265_ERROR_CANNOT_START_THREADPOOL,
+		C.DE265_ERROR_LIBRARY_INITIALIZATION_FAILED,
+		C.DE265_ERROR_LIBRARY_NOT_INITIALIZED,
+		C.DE265_ERROR_WAITING_FOR_INPUT_DATA,
+		C.DE265_WARNING_NO_WPP_CANNOT_USE_MULTITHREADING,
+		C.DE265_WARNING_WARNING_BUFFER_FULL,
+		C.DE265_WARNING_NUMBER_OF_THREADS_LIMITED_TO_MAXIMUM:
+		return ErrInternal
+	}
+	return ErrBitstream
+}
@@ -0,0 +1,19 @@
+//go:build !system_libde265
+
+#include "glue.h"
+#include "libde265/image.h"
+
+void goheif_get_conformance_window(const struct de265_image* img,
+                                   int* coded_width, int* coded_height,
+                                   int* left, int* top)
+{
+  *coded_width = img->get_width(0);
+  *coded_height = img->get_height(0);
+  *left = *top = 0;
+
+  if (img->has_sps()) {
+    const seq_parameter_set& sps = img->get_sps();
+    *left = sps.conf_win_left_offset * sps.SubWidthC;
+    *top = sps.conf_win_top_offset * sps.SubHeightC;
+  }
+}
@@ -0,0 +1,79 @@
+#ifndef GOHEIF_GLUE_H
+#define GOHEIF_GLUE_H
+
+#include <stdint.h>
+
+#ifdef GOHEIF_SYSTEM_LIBDE265
+// set by build_system.go; the quoted form would find the bundled header
+// next to this file first
+#include <libde265/de265.h>
+#else
+#if defined(__has_include)
+#if !__has_include("libde265/de265.h")
+#error "goheif: the bundled libde265 sources are missing from a vendored copy (see libde265/include_cgo.go)"
+#endif
+#endif
+#include "libde265/de265.h"
+#endif
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+// Helpers exposing decoder internals that the public libde265 API lacks.
+
+// goheif_get_conformance_window returns the coded size of img and the
+// offset, in luma samples, of its conformance window within it.
+void goheif_get_conformance_window(const struct de265_image* img,
+                                   int* coded_width, int* coded_height,
+                                   int* left, int* top);
+
+// goheif_alloc_limit tracks the memory used for the picture buffers of a
+// decoder and refuses allocations beyond limit bytes. It is shared by the
+// decoder and the planes it allocated, and freed once all have let go.
+struct goheif_alloc_limit {
+  int64_t limit;
+  int64_t used;
+  int64_t peak;
+  int32_t refused;
+  int32_t refs;
+};
+
+// goheif_new_alloc_limit returns a limit without a maximum, referenced by
+// the caller.
+struct goheif_alloc_limit* goheif_new_alloc_limit(void);
+
+// goheif_release_alloc_limit drops the caller's reference to lim.
+void goheif_release_alloc_limit(struct goheif_alloc_limit* lim);
+
+// goheif_set_alloc_limit installs allocation functions on ctx that account
+// to lim, which must outlive the decoder.
+void goheif_set_alloc_limit(de265_decoder_context* ctx,
+                            struct goheif_alloc_limit* lim);
+
+// goheif_pin_planes takes a reference to the planes of img, which were
+// allocated by the functions of goheif_set_alloc_limit, and stores them in
+// planes. The planes stay allocated after libde265 releases img, until
+// goheif_unpin_planes drops the reference. It returns 0 and pins nothing
+// if any plane was allocated by libde265 itself.
+int goheif_pin_planes(const struct de265_image* img, void* planes[3]);
+void goheif_unpin_planes(void* planes[3]);
+
+int64_t goheif_alloc_used(struct goheif_alloc_limit* lim);
+int64_t goheif_alloc_peak(struct goheif_alloc_limit* lim);
+
+// goheif_alloc_take_refused returns the number of refused allocations and
+// resets it.
+int32_t goheif_alloc_take_refused(struct goheif_alloc_limit* lim);
+
+// goheif_push_nals pushes the len bytes of 4 byte length-prefixed NAL
+// units at data, skipping empty ones, so that a whole item takes a single
+// cgo call. The caller has checked the lengths.
+de265_error goheif_push_nals(de265_decoder_context* ctx,
+                             const uint8_t* data, int len);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif
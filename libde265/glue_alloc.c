@@ -0,0 +1,208 @@
+#include <stdlib.h>
+#include "glue.h"
+
+// Output pictures are allocated here rather than by the default libde265
+// functions so that each plane can remember its size, and can outlive the
+// picture while Go images use it. Only the public API is used, so this
+// works with both the vendored and the system library.
+
+enum {
+  PLANE_ALIGNMENT = 64,
+  PLANE_PADDING = 64, // SIMD code reads past the end of a plane
+};
+
+struct plane_header {
+  struct goheif_alloc_limit* lim;
+  int64_t size;
+  int32_t refs; // libde265's and, while pinned, a Go image's
+};
+
+static void unref_limit(struct goheif_alloc_limit* lim)
+{
+  if (__atomic_sub_fetch(&lim->refs, 1, __ATOMIC_SEQ_CST) == 0) {
+    free(lim);
+  }
+}
+
+static uint8_t* alloc_plane(struct goheif_alloc_limit* lim, int64_t size,
+                            void** userdata)
+{
+  int64_t total = sizeof(struct plane_header) + PLANE_ALIGNMENT + size + PLANE_PADDING;
+
+  int64_t used = __atomic_add_fetch(&lim->used, total, __ATOMIC_SEQ_CST);
+  if (lim->limit > 0 && used > lim->limit) {
+    __atomic_sub_fetch(&lim->used, total, __ATOMIC_SEQ_CST);
+    __atomic_add_fetch(&lim->refused, 1, __ATOMIC_SEQ_CST);
+    return NULL;
+  }
+
+  struct plane_header* h = malloc(total);
+  if (h == NULL) {
+    __atomic_sub_fetch(&lim->used, total, __ATOMIC_SEQ_CST);
+    return NULL;
+  }
+  h->lim = lim;
+  h->size = total;
+  h->refs = 1;
+  __atomic_add_fetch(&lim->refs, 1, __ATOMIC_SEQ_CST);
+
+  int64_t peak = __atomic_load_n(&lim->peak, __ATOMIC_SEQ_CST);
+  while (used > peak &&
+         !__atomic_compare_exchange_n(&lim->peak, &peak, used, 0,
+                                      __ATOMIC_SEQ_CST, __ATOMIC_SEQ_CST)) {
+  }
+
+  uintptr_t p = (uintptr_t)(h + 1);
+  p = (p + PLANE_ALIGNMENT - 1) & ~(uintptr_t)(PLANE_ALIGNMENT - 1);
+  *userdata = h;
+  return (uint8_t*)p;
+}
+
+static void unref_plane(void* userdata)
+{
+  struct plane_header* h = userdata;
+  if (__atomic_sub_fetch(&h->refs, 1, __ATOMIC_SEQ_CST) > 0) {
+    return;
+  }
+  struct goheif_alloc_limit* lim = h->lim;
+  __atomic_sub_fetch(&lim->used, h->size, __ATOMIC_SEQ_CST);
+  free(h);
+  unref_limit(lim);
+}
+
+static int limited_get_buffer(de265_decoder_context* ctx,
+                              struct de265_image_spec* spec,
+                              struct de265_image* img, void* userdata)
+{
+  struct goheif_alloc_limit* lim = userdata;
+
+  int width[3], height[3];
+  width[0] = spec->width;
+  height[0] = spec->height;
+
+  int planes = 3;
+  switch (de265_get_chroma_format(img)) {
+  case de265_chroma_mono:
+    planes = 1;
+    break;
+  case de265_chroma_420:
+    width[1] = spec->width / 2;
+    height[1] = spec->height / 2;
+    break;
+  case de265_chroma_422:
+    width[1] = spec->width / 2;
+    height[1] = spec->height;
+    break;
+  case de265_chroma_444:
+    width[1] = spec->width;
+    height[1] = spec->height;
+    break;
+  }
+  width[2] = width[1];
+  height[2] = height[1];
+
+  uint8_t* mem[3] = { NULL, NULL, NULL };
+  void* ud[3] = { NULL, NULL, NULL };
+  int stride[3] = { 0, 0, 0 }; /* in samples */
+  int bytes[3] = { 1, 1, 1 };
+
+  for (int c = 0; c < planes; c++) {
+    int align = spec->alignment;
+    bytes[c] = (de265_get_bits_per_pixel(img, c) + 7) / 8;
+    stride[c] = (width[c] + align - 1) / align * align;
+
+    mem[c] = alloc_plane(lim, (int64_t)stride[c] * bytes[c] * height[c], &ud[c]);
+    if (mem[c] == NULL) {
+      for (int i = 0; i < c; i++) {
+        unref_plane(ud[i]);
+      }
+      return 0;
+    }
+  }
+
+  /* de265_set_image_plane takes the stride in bytes and divides it by the
+     sample size, unlike de265_image::set_image_plane */
+  for (int c = 0; c < 3; c++) {
+    de265_set_image_plane(img, c, mem[c], stride[c] * bytes[c], ud[c]);
+  }
+  return 1;
+}
+
+static void limited_release_buffer(de265_decoder_context* ctx,
+                                   struct de265_image* img, void* userdata)
+{
+  for (int c = 0; c < 3; c++) {
+    void* ud = de265_get_image_plane_user_data(img, c);
+    if (ud != NULL) {
+      unref_plane(ud);
+    }
+  }
+}
+
+struct goheif_alloc_limit* goheif_new_alloc_limit(void)
+{
+  struct goheif_alloc_limit* lim = calloc(1, sizeof(*lim));
+  if (lim != NULL) {
+    lim->refs = 1;
+  }
+  return lim;
+}
+
+void goheif_release_alloc_limit(struct goheif_alloc_limit* lim)
+{
+  unref_limit(lim);
+}
+
+void goheif_set_alloc_limit(de265_decoder_context* ctx,
+                            struct goheif_alloc_limit* lim)
+{
+  static struct de265_image_allocation funcs = {
+    limited_get_buffer,
+    limited_release_buffer,
+  };
+  de265_set_image_allocation_functions(ctx, &funcs, lim);
+}
+
+int64_t goheif_alloc_used(struct goheif_alloc_limit* lim)
+{
+  return __atomic_load_n(&lim->used, __ATOMIC_SEQ_CST);
+}
+
+int64_t goheif_alloc_peak(struct goheif_alloc_limit* lim)
+{
+  return __atomic_load_n(&lim->peak, __ATOMIC_SEQ_CST);
+}
+
+int32_t goheif_alloc_take_refused(struct goheif_alloc_limit* lim)
+{
+  return __atomic_exchange_n(&lim->refused, 0, __ATOMIC_SEQ_CST);
+}
+
+int goheif_pin_planes(const struct de265_image* img, void* planes[3])
+{
+  for (int c = 0; c < 3; c++) {
+    planes[c] = NULL;
+    if (de265_get_image_plane(img, c, NULL) == NULL) {
+      continue;
+    }
+    struct plane_header* h = de265_get_image_plane_user_data(img, c);
+    if (h == NULL) {
+      // libde265 allocates pictures it filters in place itself
+      goheif_unpin_planes(planes);
+      return 0;
+    }
+    __atomic_add_fetch(&h->refs, 1, __ATOMIC_SEQ_CST);
+    planes[c] = h;
+  }
+  return 1;
+}
+
+void goheif_unpin_planes(void* planes[3])
+{
+  for (int c = 0; c < 3; c++) {
+    if (planes[c] != NULL) {
+      unref_plane(planes[c]);
+      planes[c] = NULL;
+    }
+  }
+}
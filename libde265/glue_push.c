@@ -0,0 +1,24 @@
+#include <stddef.h>
+#include "glue.h"
+
+de265_error goheif_push_nals(de265_decoder_context* ctx,
+                             const uint8_t* data, int len)
+{
+  int pos = 0;
+  while (pos + 4 <= len) {
+    uint32_t size = (uint32_t)data[pos] << 24 | (uint32_t)data[pos+1] << 16 |
+                    (uint32_t)data[pos+2] << 8 | (uint32_t)data[pos+3];
+    pos += 4;
+    if (size > (uint32_t)(len - pos)) {
+      return DE265_ERROR_PREMATURE_END_OF_SLICE;
+    }
+    if (size > 0) {
+      de265_error err = de265_push_NAL(ctx, data + pos, (int)size, 0, NULL);
+      if (err != DE265_OK) {
+        return err;
+      }
+    }
+    pos += (int)size;
+  }
+  return DE265_OK;
+}
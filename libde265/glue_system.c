@@ -0,0 +1,14 @@
+//go:build system_libde265
+
+#include "glue.h"
+
+// The decoder internals are not available when linking the system
+// library, so report the visible area as the whole coded picture.
+void goheif_get_conformance_window(const struct de265_image* img,
+                                   int* coded_width, int* coded_height,
+                                   int* left, int* top)
+{
+  *coded_width = de265_get_image_width(img, 0);
+  *coded_height = de265_get_image_height(img, 0);
+  *left = *top = 0;
+}
@@ -0,0 +1,161 @@
+package libde265
+
+import (
+	"image"
+	"image/color"
+	"runtime"
+)
+
+// Image is a decoded picture whose pixels alias memory allocated by the
+// decoder, as returned by DecodeImage when safe encoding is off. The
+// embedded image is an *image.YCbCr or, for monochrome streams, an
+// *image.Gray. Pictures that libde265 filters in place, as it does without
+// worker threads, are copied instead.
+//
+// The memory stays allocated, without being copied, until Close is called
+// or the embedded image is garbage collected, whatever the decoder does
+// in between: Reset, Free and later decodes leave it alone. Images derived
+// from the embedded one, such as its sub-images, do not keep it alive, so
+// it must stay reachable while they are used.
+type Image struct {
+	image.Image
+	pin *pin
+}
+
+// Close frees the memory of the picture. The image must not be used after
+// Close; its planes are cleared to make such use fail loudly rather than
+// read freed memory.
+func (img *Image) Close() error {
+	runtime.SetFinalizer(img.Image, nil)
+	img.pin.unpin()
+	switch m := img.Image.(type) {
+	case *image.YCbCr:
+		m.Y, m.Cb, m.Cr = nil, nil, nil
+	case *image.Gray:
+		m.Pix = nil
+	}
+	return nil
+}
+
+// YCbCr16 is an in-memory image of high bit depth Y'CbCr colors, as decoded
+// from 10 and 12-bit HEVC streams. It mirrors image.YCbCr, with each sample
+// stored in the low BitDepth bits of a uint16 and strides counted in samples.
+//
+// Colors are converted to RGB with the same full range BT.601 equations as
+// image.YCbCr, at 16-bit precision.
+type YCbCr16 struct {
+	Y, Cb, Cr      []uint16
+	YStride        int
+	CStride        int
+	SubsampleRatio image.YCbCrSubsampleRatio
+	BitDepth       int
+	Rect           image.Rectangle
+}
+
+// NewYCbCr16 returns a new YCbCr16 image with the given bounds, subsample
+// ratio and bit depth.
+func NewYCbCr16(r image.Rectangle, subsampleRatio image.YCbCrSubsampleRatio, bitDepth int) *YCbCr16 {
+	w, h := r.Dx(), r.Dy()
+	cw, ch := w, h
+	switch subsampleRatio {
+	case image.YCbCrSubsampleRatio422:
+		cw = (r.Max.X+1)/2 - r.Min.X/2
+	case image.YCbCrSubsampleRatio420:
+		cw = (r.Max.X+1)/2 - r.Min.X/2
+		ch = (r.Max.Y+1)/2 - r.Min.Y/2
+	}
+	return &YCbCr16{
+		Y:              make([]uint16, w*h),
+		Cb:             make([]uint16, cw*ch),
+		Cr:             make([]uint16, cw*ch),
+		YStride:        w,
+		CStride:        cw,
+		SubsampleRatio: subsampleRatio,
+		BitDepth:       bitDepth,
+		Rect:           r,
+	}
+}
+
+func (p *YCbCr16) ColorModel() color.Model { return color.RGBA64Model }
+
+func (p *YCbCr16) Bounds() image.Rectangle { return p.Rect }
+
+func (p *YCbCr16) Opaque() bool { return true }
+
+func (p *YCbCr16) At(x, y int) color.Color {
+	return p.RGBA64At(x, y)
+}
+
+// RGBA64At returns the color of the pixel at (x, y) converted to RGB.
+func (p *YCbCr16) RGBA64At(x, y int) color.RGBA64 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return color.RGBA64{}
+	}
+	yi, ci := p.YOffset(x, y), p.COffset(x, y)
+	return ycbcrToRGBA64(p.scale(p.Y[yi]), p.scale(p.Cb[ci]), p.scale(p.Cr[ci]))
+}
+
+// YOffset returns the index of the first element of Y that corresponds to
+// the pixel at (x, y).
+func (p *YCbCr16) YOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.YStride + (x - p.Rect.Min.X)
+}
+
+// COffset returns the index of the first element of Cb or Cr that
+// corresponds to the pixel at (x, y).
+func (p *YCbCr16) COffset(x, y int) int {
+	switch p.SubsampleRatio {
+	case image.YCbCrSubsampleRatio422:
+		return (y-p.Rect.Min.Y)*p.CStride + (x/2 - p.Rect.Min.X/2)
+	case image.YCbCrSubsampleRatio420:
+		return (y/2-p.Rect.Min.Y/2)*p.CStride + (x/2 - p.Rect.Min.X/2)
+	}
+	// Default to 4:4:4 subsampling.
+	return (y-p.Rect.Min.Y)*p.CStride + (x - p.Rect.Min.X)
+}
+
+// SubImage returns an image representing the portion of the image p visible
+// through r. The returned value shares pixels with the original image.
+func (p *YCbCr16) SubImage(r image.Rectangle) image.Image {
+	r = r.Intersect(p.Rect)
+	if r.Empty() {
+		return &YCbCr16{SubsampleRatio: p.SubsampleRatio, BitDepth: p.BitDepth}
+	}
+	yi, ci := p.YOffset(r.Min.X, r.Min.Y), p.COffset(r.Min.X, r.Min.Y)
+	return &YCbCr16{
+		Y:              p.Y[yi:],
+		Cb:             p.Cb[ci:],
+		Cr:             p.Cr[ci:],
+		YStride:        p.YStride,
+		CStride:        p.CStride,
+		SubsampleRatio: p.SubsampleRatio,
+		BitDepth:       p.BitDepth,
+		Rect:           r,
+	}
+}
+
+// scale expands a BitDepth sample to 16 bits by bit replication.
+func (p *YCbCr16) scale(v uint16) int32 {
+	shift := 16 - p.BitDepth
+	return int32(v<<shift | v>>(p.BitDepth-shift))
+}
+
+func ycbcrToRGBA64(y, cb, cr int32) color.RGBA64 {
+	// Same constants as color.YCbCrToRGB, with 16-bit samples.
+	cb -= 0x8000
+	cr -= 0x8000
+	r := int64(y) + (91881*int64(cr))>>16
+	g := int64(y) - (22554*int64(cb)+46802*int64(cr))>>16
+	b := int64(y) + (116130*int64(cb))>>16
+	return color.RGBA64{clamp16(r), clamp16(g), clamp16(b), 0xffff}
+}
+
+func clamp16(v int64) uint16 {
+	if v < 0 {
+		return 0
+	}
+	if v > 0xffff {
+		return 0xffff
+	}
+	return uint16(v)
+}
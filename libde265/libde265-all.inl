@@ -1,6 +1,10 @@
 #if _WIN32
+// windows.h must not define min and max, which break std::min and std::max
+#define NOMINMAX 1
+#define WIN32_LEAN_AND_MEAN 1
 #include "extra/win32cond.c"
 #define HAVE___MINGW_ALIGNED_MALLOC 1
+#define HAVE_MALLOC_H 1 // for __mingw_aligned_malloc
 #else
 #define HAVE_POSIX_MEMALIGN 1
 #endif
@@ -1,4 +1,16 @@
+//go:build !system_libde265
+
 #include <stdint.h>
+
+// go mod vendor keeps the C directories only through include_cgo.go;
+// without them, say so instead of failing on the first missing file.
+#if defined(__has_include)
+#if !__has_include("libde265/de265.cc") || !__has_include("libde265/x86/sse.cc") || \
+    !__has_include("libde265/arm/arm.cc") || !__has_include("extra/win32cond.c")
+#error "goheif: the bundled libde265 sources are missing; vendored copies need the directories listed in libde265/include_cgo.go"
+#endif
+#endif
+
 #include "libde265-all.inl"
 
 
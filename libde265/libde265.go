@@ -1,26 +1,55 @@
 package libde265
 
-//#cgo CFLAGS: -I.
-//#cgo amd64 CXXFLAGS: -Ilibde265 -I. -std=c++11 -DHAVE_SSE4_1 -msse4.1
-//#cgo arm64 CXXFLAGS: -Ilibde265 -I. -std=c++11 -DHAVE_ARM
-//#cgo darwin,amd64 CXXFLAGS: -Ilibde265 -I. -std=c++11 -DHAVE_SSE4_1 -msse4.1 -Wno-constant-conversion
-//#cgo darwin,amd64 CXXFLAGS: -Ilibde265 -I. -std=c++11 -DHAVE_ARM
 // #include <stdint.h>
 // #include <stdlib.h>
-// #include "libde265/de265.h"
+// #include "glue.h"
 import "C"
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"image"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
+// maxThreads is the worker thread limit of libde265 (MAX_THREADS).
+const maxThreads = 32
+
+// Decoder wraps a libde265 decoder context. A Decoder must not be used by
+// several goroutines at once: its methods panic when they detect this.
+// Use a Pool to share decoders.
 type Decoder struct {
 	ctx        unsafe.Pointer
-	hasImage   bool
+	busy       atomic.Bool
 	safeEncode bool
+	threads    int
+	warn       func(msg string)
+	warnings   []Warning                    // collected during the last DecodeImage
+	sei        *SEI                         // collected since the last Reset
+	pushed     Stats                        // NAL units pushed since the last DecodeImage
+	stats      Stats                        // of the last DecodeImage
+	mem        *C.struct_goheif_alloc_limit // C memory; nil if pictures are copied and not limited
+	window     ConformanceWindow
+}
+
+// ConformanceWindow describes where the picture returned by DecodeImage
+// lies within the coded picture. libde265 applies the window itself, so
+// the returned image always has the size of Rect.
+type ConformanceWindow struct {
+	CodedWidth, CodedHeight int
+	Rect                    image.Rectangle // visible area, in luma samples
+}
+
+// Cropped reports whether the coded picture was larger than the visible area.
+func (w ConformanceWindow) Cropped() bool {
+	return w.Rect.Dx() != w.CodedWidth || w.Rect.Dy() != w.CodedHeight
 }
 
 func Init() {
@@ -37,14 +66,35 @@ func NewDecoder(opts ...Option) (*Decoder, error) {
 		return nil, errors.New("unable to create decoder")
 	}
 
-	dec := &Decoder{ctx: p, hasImage: false}
+	dec := &Decoder{ctx: p, threads: DefaultThreads()}
 	for _, opt := range opts {
 		opt(dec)
 	}
+	if !dec.safeEncode {
+		// zero-copy images pin their planes, which needs the goheif allocator
+		dec.trackMemory()
+	}
+
+	if dec.threads > 0 {
+		if ret := C.de265_start_worker_threads(p, C.int(dec.threads)); ret != C.DE265_OK {
+			C.de265_free_decoder(p)
+			return nil, fmt.Errorf("unable to start %d worker threads: %w", dec.threads, Error(ret))
+		}
+	}
 
 	return dec, nil
 }
 
+// DefaultThreads returns the number of worker threads used when WithThreads
+// is not given: GOMAXPROCS, capped at the libde265 limit of 32.
+func DefaultThreads() int {
+	n := runtime.GOMAXPROCS(0)
+	if n > maxThreads {
+		n = maxThreads
+	}
+	return n
+}
+
 type Option func(*Decoder)
 
 func WithSafeEncoding(b bool) Option {
@@ -53,61 +103,421 @@ func WithSafeEncoding(b bool) Option {
 	}
 }
 
+// WithThreads sets the number of decoder worker threads. Zero decodes on
+// the calling goroutine's thread only. Values above 32 are capped.
+// Only streams using tiles or wavefront parallel processing benefit.
+func WithThreads(n int) Option {
+	return func(dec *Decoder) {
+		if n < 0 {
+			n = 0
+		}
+		if n > maxThreads {
+			n = maxThreads
+		}
+		dec.threads = n
+	}
+}
+
+// WithWarningHandler sets a function called with each warning reported by
+// the decoder. By default warnings are only collected; see Warnings.
+func WithWarningHandler(fn func(msg string)) Option {
+	return func(dec *Decoder) {
+		dec.warn = fn
+	}
+}
+
+// WithDisableDeblocking turns off the deblocking filter. Decoding gets
+// faster at the cost of visible block edges, which is often acceptable
+// for small thumbnails.
+func WithDisableDeblocking(b bool) Option {
+	return boolParam(C.DE265_DECODER_PARAM_DISABLE_DEBLOCKING, b)
+}
+
+// WithDisableSAO turns off the sample adaptive offset filter, trading a
+// little quality for speed.
+func WithDisableSAO(b bool) Option {
+	return boolParam(C.DE265_DECODER_PARAM_DISABLE_SAO, b)
+}
+
+// WithSEIHashCheck verifies decoded pictures against the hashes carried in
+// decoded picture hash SEI messages. Mismatches are reported as warnings.
+// It is off by default.
+func WithSEIHashCheck(b bool) Option {
+	return boolParam(C.DE265_DECODER_PARAM_BOOL_SEI_CHECK_HASH, b)
+}
+
+// WithSuppressFaultyPictures drops pictures that had decoding errors
+// instead of returning them.
+func WithSuppressFaultyPictures(b bool) Option {
+	return boolParam(C.DE265_DECODER_PARAM_SUPPRESS_FAULTY_PICTURES, b)
+}
+
+// Acceleration selects the SIMD code paths used by the decoder.
+type Acceleration int
+
+const (
+	AccelerationScalar Acceleration = C.de265_acceleration_SCALAR // portable C++ only
+	AccelerationMMX    Acceleration = C.de265_acceleration_MMX
+	AccelerationSSE    Acceleration = C.de265_acceleration_SSE
+	AccelerationSSE2   Acceleration = C.de265_acceleration_SSE2
+	AccelerationSSE4   Acceleration = C.de265_acceleration_SSE4
+	AccelerationARM    Acceleration = C.de265_acceleration_ARM
+	AccelerationNEON   Acceleration = C.de265_acceleration_NEON
+	AccelerationAuto   Acceleration = C.de265_acceleration_AUTO // best available; the default
+)
+
+// WithAcceleration limits the decoder to the given SIMD level, which takes
+// effect at runtime without rebuilding. AccelerationScalar is useful to
+// work around miscompiled SIMD code or to get output that is identical
+// across machines. Levels the build does not include fall back to lower
+// ones.
+func WithAcceleration(a Acceleration) Option {
+	return func(dec *Decoder) {
+		C.de265_set_parameter_int(dec.ctx, C.DE265_DECODER_PARAM_ACCELERATION_CODE, C.int(a))
+	}
+}
+
+func boolParam(param C.enum_de265_param, b bool) Option {
+	return func(dec *Decoder) {
+		var v C.int
+		if b {
+			v = 1
+		}
+		C.de265_set_parameter_bool(dec.ctx, param, v)
+	}
+}
+
+// WithMemoryLimit caps the memory used for the decoder's output pictures
+// at n bytes, including those of zero-copy images until they are closed.
+// Decoding a picture that does not fit fails with ErrMemoryLimit. Zero
+// only tracks usage; see MemoryUsage.
+//
+// libde265 allocates output pictures through hooks that goheif provides,
+// but pictures still being filtered are allocated internally and are not
+// counted. They have the same size, so peak usage is about twice the
+// limit.
+func WithMemoryLimit(n int64) Option {
+	return func(dec *Decoder) {
+		dec.trackMemory()
+		if n < 0 {
+			n = 0
+		}
+		dec.mem.limit = C.int64_t(n)
+	}
+}
+
+// trackMemory installs the allocation functions that account for the
+// memory of output pictures, if not done yet.
+func (dec *Decoder) trackMemory() {
+	if dec.mem == nil {
+		dec.mem = C.goheif_new_alloc_limit()
+		C.goheif_set_alloc_limit(dec.ctx, dec.mem)
+	}
+}
+
+// MemoryUsage returns the current and peak size of the output pictures
+// held by the decoder, and by its zero-copy images until they are closed.
+// Both are zero with safe encoding, unless WithMemoryLimit was given.
+func (dec *Decoder) MemoryUsage() (current, peak int64) {
+	if dec.mem == nil {
+		return 0, 0
+	}
+	return int64(C.goheif_alloc_used(dec.mem)), int64(C.goheif_alloc_peak(dec.mem))
+}
+
+// limitErr returns ErrMemoryLimit if allocations were refused since the
+// last call.
+func (dec *Decoder) limitErr() error {
+	if dec.mem == nil || C.goheif_alloc_take_refused(dec.mem) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w (%d bytes)", ErrMemoryLimit, int64(dec.mem.limit))
+}
+
+// ConformanceWindow returns the conformance window of the picture returned
+// by the last successful DecodeImage call.
+func (dec *Decoder) ConformanceWindow() ConformanceWindow {
+	return dec.window
+}
+
+// Warning is a soft error reported by the decoder. The picture is still
+// returned, but may contain artifacts.
+type Warning struct {
+	Code Error
+	Msg  string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s (%d)", w.Msg, int(w.Code))
+}
+
+// DecodeResult is the outcome of a successful Decode.
+type DecodeResult struct {
+	Image    image.Image
+	Warnings []Warning
+	SEI      *SEI // nil if the stream carried no SEI of interest
+	Stats    Stats
+}
+
+// Stats describes the work done by a DecodeImage call. NAL units and bytes
+// include everything pushed since the previous call.
+type Stats struct {
+	NALs        int
+	BytesPushed int64
+	Iterations  int // calls into the decoding loop
+	Elapsed     time.Duration
+}
+
+// Stats returns the statistics of the last DecodeImage call.
+func (dec *Decoder) Stats() Stats {
+	return dec.stats
+}
+
+// Warnings returns the warnings reported during the last DecodeImage call.
+func (dec *Decoder) Warnings() []Warning {
+	return dec.warnings
+}
+
+func (dec *Decoder) addWarning(code C.de265_error) {
+	w := Warning{Code: Error(code), Msg: C.GoString(C.de265_get_error_text(code))}
+	dec.warnings = append(dec.warnings, w)
+	if dec.warn != nil {
+		dec.warn(w.Msg)
+	}
+}
+
+// enter marks the decoder as in use until the returned function is called,
+// panicking if another goroutine is using it.
+func (dec *Decoder) enter() func() {
+	if !dec.busy.CompareAndSwap(false, true) {
+		panic("libde265: concurrent use of Decoder")
+	}
+	return func() { dec.busy.Store(false) }
+}
+
 func (dec *Decoder) Free() {
-	dec.Reset()
+	defer dec.enter()()
+	dec.reset()
 	C.de265_free_decoder(dec.ctx)
+	if dec.mem != nil {
+		// zero-copy images may still hold planes accounted to it
+		C.goheif_release_alloc_limit(dec.mem)
+		dec.mem = nil
+	}
 }
 
 func (dec *Decoder) Reset() {
-	if dec.ctx != nil && dec.hasImage {
-		C.de265_release_next_picture(dec.ctx)
-		dec.hasImage = false
-	}
+	defer dec.enter()()
+	dec.reset()
+}
 
+func (dec *Decoder) reset() {
+	dec.sei = nil
+	dec.pushed = Stats{}
 	C.de265_reset(dec.ctx)
 }
 
 func (dec *Decoder) Push(data []byte) error {
-	var pos int
-	totalSize := len(data)
-	for pos < totalSize {
-		if pos+4 > totalSize {
-			return errors.New("invalid NAL data")
+	defer dec.enter()()
+	return dec.push(data)
+}
+
+// push checks and scans the NAL units in Go, then hands the valid ones to
+// libde265 in one call, since each cgo call has a cost.
+func (dec *Decoder) push(data []byte) error {
+	it := NewNALIterator(data)
+	end := 0
+	for it.Next() {
+		dec.countNAL(it.NAL().Data)
+		end = it.pos
+	}
+	if err := dec.pushNALs(data[:end]); err != nil {
+		return err
+	}
+	return it.Err()
+}
+
+// PushReader is like Push, but reads the length-prefixed NAL units from r
+// in chunks of at most pushChunkSize bytes, so the item data is never held
+// in Go memory at once. Small units are batched into a chunk and pushed in
+// one call. Call DecodeImage with no data to decode what was pushed.
+func (dec *Decoder) PushReader(r io.Reader) error {
+	defer dec.enter()()
+
+	var hdr [4]byte
+	var batch, buf bytes.Buffer
+	flush := func() error {
+		defer batch.Reset()
+		return dec.pushNALs(batch.Bytes())
+	}
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return flush()
+			}
+			if err == io.ErrUnexpectedEOF {
+				return fmt.Errorf("%w: truncated NAL length", ErrBitstream)
+			}
+			return err
+		}
+
+		nalSize := int64(binary.BigEndian.Uint32(hdr[:]))
+		if nalSize > pushChunkSize {
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := dec.streamNAL(r, nalSize, &buf); err != nil {
+				return err
+			}
+			continue
+		}
+		if int64(batch.Len())+4+nalSize > pushChunkSize {
+			if err := flush(); err != nil {
+				return err
+			}
 		}
 
-		nalSize := uint32(data[pos])<<24 | uint32(data[pos+1])<<16 | uint32(data[pos+2])<<8 | uint32(data[pos+3])
-		pos += 4
+		// grow the batch as data arrives rather than trusting the size
+		start := batch.Len() + 4
+		batch.Write(hdr[:])
+		if _, err := io.CopyN(&batch, r, nalSize); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("%w: invalid NAL size: %d", ErrBitstream, nalSize)
+			}
+			return err
+		}
+		dec.countNAL(batch.Bytes()[start:])
+	}
+}
 
-		if pos+int(nalSize) > totalSize {
-			return fmt.Errorf("invalid NAL size: %d", nalSize)
+// pushChunkSize is the largest NAL unit PushReader pushes in one piece.
+const pushChunkSize = 64 << 10
+
+// streamNAL pushes a NAL unit of the given size read from r a chunk at a
+// time, as an Annex-B byte stream: a start code followed by the unit.
+// libde265 reassembles it, so only one chunk is held in buf. SEI units are
+// small enough never to be streamed, so none is missed by scanSEI.
+func (dec *Decoder) streamNAL(r io.Reader, size int64, buf *bytes.Buffer) error {
+	dec.pushed.NALs++
+	if err := dec.pushData([]byte{0, 0, 1}); err != nil {
+		return err
+	}
+	for size > 0 {
+		n := min(size, pushChunkSize)
+		buf.Reset()
+		if _, err := io.CopyN(buf, r, n); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("%w: invalid NAL size: %d", ErrBitstream, size)
+			}
+			return err
+		}
+		if err := dec.pushData(buf.Bytes()); err != nil {
+			return err
 		}
+		dec.pushed.BytesPushed += n
+		size -= n
+	}
+	// complete the unit now, ahead of any unit pushed with push_NAL
+	C.de265_push_end_of_NAL(dec.ctx)
+	return nil
+}
 
-		C.de265_push_NAL(dec.ctx, unsafe.Pointer(&data[pos]), C.int(nalSize), C.de265_PTS(0), nil)
-		pos += int(nalSize)
+func (dec *Decoder) pushData(data []byte) error {
+	if ret := C.de265_push_data(dec.ctx, unsafe.Pointer(&data[0]), C.int(len(data)), C.de265_PTS(0), nil); ret != C.DE265_OK {
+		return fmt.Errorf("push_data error: %w", Error(ret))
 	}
+	return nil
+}
 
+// pushNALs hands the length-prefixed NAL units in data, whose lengths have
+// been checked, to the decoder in one call. The decoder copies them.
+func (dec *Decoder) pushNALs(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if ret := C.goheif_push_nals(dec.ctx, (*C.uint8_t)(unsafe.Pointer(&data[0])), C.int(len(data))); ret != C.DE265_OK {
+		return fmt.Errorf("push_NAL error: %w", Error(ret))
+	}
 	return nil
 }
 
-func (dec *Decoder) DecodeImage(data []byte) (image.Image, error) {
-	if dec.hasImage {
-		fmt.Printf("previous image may leak")
+// countNAL records a NAL unit about to be pushed.
+func (dec *Decoder) countNAL(nal []byte) {
+	if len(nal) == 0 {
+		return
+	}
+	dec.scanSEI(nal)
+	dec.pushed.NALs++
+	dec.pushed.BytesPushed += int64(len(nal))
+}
+
+// PushAnnexB pushes an Annex-B byte stream, as found in raw .h265 files,
+// in which NAL units are delimited by start codes rather than prefixed
+// with their length. As with Push, emulation prevention bytes are removed
+// by the decoder. Call DecodeImage with no data to decode what was pushed.
+func (dec *Decoder) PushAnnexB(data []byte) error {
+	defer dec.enter()()
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	splitAnnexB(data, func(nal []byte) {
+		dec.scanSEI(nal)
+		dec.pushed.NALs++
+	})
+	dec.pushed.BytesPushed += int64(len(data))
+	return dec.pushData(data)
+}
+
+// Decode is like DecodeImage, but also returns the warnings reported while
+// decoding, for callers that record soft errors, and the SEI messages
+// pushed since the last Reset.
+func (dec *Decoder) Decode(data []byte) (*DecodeResult, error) {
+	defer dec.enter()()
+	img, err := dec.decodeImage(data)
+	if err != nil {
+		return nil, err
 	}
+	return &DecodeResult{Image: img, Warnings: dec.warnings, SEI: dec.sei, Stats: dec.stats}, nil
+}
+
+func (dec *Decoder) DecodeImage(data []byte) (image.Image, error) {
+	defer dec.enter()()
+	return dec.decodeImage(data)
+}
+
+func (dec *Decoder) decodeImage(data []byte) (image.Image, error) {
+	dec.warnings = nil
+	dec.limitErr() // drop refusals from earlier decodes
+
+	start := time.Now()
+	var iterations int
+	defer func() {
+		dec.stats = dec.pushed
+		dec.stats.Iterations = iterations
+		dec.stats.Elapsed = time.Since(start)
+		dec.pushed = Stats{}
+	}()
 
 	if len(data) > 0 {
-		if err := dec.Push(data); err != nil {
+		if err := dec.push(data); err != nil {
 			return nil, err
 		}
 	}
 
 	if ret := C.de265_flush_data(dec.ctx); ret != C.DE265_OK {
-		return nil, fmt.Errorf("flush_data error: %d", ret)
+		return nil, fmt.Errorf("flush_data error: %w", Error(ret))
 	}
 
 	var more C.int = 1
 	for more != 0 {
+		iterations++
 		if decerr := C.de265_decode(dec.ctx, &more); decerr != C.DE265_OK {
-			return nil, fmt.Errorf("decode error: %d", decerr)
+			if err := dec.limitErr(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("decode error: %w", Error(decerr))
 		}
 
 		for {
@@ -115,62 +525,174 @@ func (dec *Decoder) DecodeImage(data []byte) (image.Image, error) {
 			if warning == C.DE265_OK {
 				break
 			}
-			fmt.Printf("warning: %v\n", C.GoString(C.de265_get_error_text(warning)))
+			dec.addWarning(warning)
 		}
 
-		if img := C.de265_get_next_picture(dec.ctx); img != nil {
-			dec.hasImage = true // lazy release
+		if img := C.de265_peek_next_picture(dec.ctx); img != nil {
+			if err := dec.limitErr(); err != nil {
+				// decoded without the filters that needed more memory
+				C.de265_release_next_picture(dec.ctx)
+				return nil, err
+			}
+			// zero-copy images pin the planes they use
+			out, err := dec.convert(img)
+			C.de265_release_next_picture(dec.ctx)
+			return out, err
+		}
+	}
 
-			width := C.de265_get_image_width(img, 0)
-			height := C.de265_get_image_height(img, 0)
+	if err := dec.limitErr(); err != nil {
+		return nil, err
+	}
+	return nil, ErrNoPicture
+}
 
-			var ystride, cstride C.int
-			y := C.de265_get_image_plane(img, 0, &ystride)
-			cb := C.de265_get_image_plane(img, 1, &cstride)
-			cheight := C.de265_get_image_height(img, 1)
-			cr := C.de265_get_image_plane(img, 2, &cstride)
-			//			crh := C.de265_get_image_height(img, 2)
+// handOut wraps m, an image aliasing the planes pinned by p, keeping them
+// pinned until the image is closed or garbage collected.
+func handOut(m image.Image, p *pin) *Image {
+	runtime.SetFinalizer(m, func(image.Image) { p.unpin() })
+	return &Image{Image: m, pin: p}
+}
 
-			// sanity check
-			if int(height)*int(ystride) >= int(1<<30) {
-				return nil, fmt.Errorf("image too big")
-			}
+// pinPlanes pins the planes of img so an image can alias them, or returns
+// nil if they must be copied.
+func (dec *Decoder) pinPlanes(img *C.struct_de265_image) *pin {
+	if dec.safeEncode {
+		return nil
+	}
+	p := new(pin)
+	if C.goheif_pin_planes(img, &p.planes[0]) == 0 {
+		return nil
+	}
+	return p
+}
 
-			var r image.YCbCrSubsampleRatio
-			switch chroma := C.de265_get_chroma_format(img); chroma {
-			case C.de265_chroma_420:
-				r = image.YCbCrSubsampleRatio420
-			case C.de265_chroma_422:
-				r = image.YCbCrSubsampleRatio422
-			case C.de265_chroma_444:
-				r = image.YCbCrSubsampleRatio444
-			}
-			ycc := &image.YCbCr{
-				YStride:        int(ystride),
-				CStride:        int(cstride),
-				SubsampleRatio: r,
-				Rect:           image.Rectangle{Min: image.Point{0, 0}, Max: image.Point{int(width), int(height)}},
-			}
-			if dec.safeEncode {
-				ycc.Y = C.GoBytes(unsafe.Pointer(y), C.int(height*ystride))
-				ycc.Cb = C.GoBytes(unsafe.Pointer(cb), C.int(cheight*cstride))
-				ycc.Cr = C.GoBytes(unsafe.Pointer(cr), C.int(cheight*cstride))
-			} else {
-				// Calculate the exact sizes needed
-				ySize := int(height) * int(ystride)
-				cSize := int(cheight) * int(cstride)
-
-				// Create slices directly from pointers with exact sizes
-				ycc.Y = unsafe.Slice((*byte)(y), ySize)
-				ycc.Cb = unsafe.Slice((*byte)(cb), cSize)
-				ycc.Cr = unsafe.Slice((*byte)(cr), cSize)
-			}
+// pin holds references to the planes of a picture, taken by
+// goheif_pin_planes.
+type pin struct {
+	once   sync.Once
+	planes [3]unsafe.Pointer
+}
+
+func (p *pin) unpin() {
+	p.once.Do(func() { C.goheif_unpin_planes(&p.planes[0]) })
+}
+
+// convert wraps or copies the planes of a decoded picture into an image.
+func (dec *Decoder) convert(img *C.struct_de265_image) (image.Image, error) {
+	width := C.de265_get_image_width(img, 0)
+	height := C.de265_get_image_height(img, 0)
+
+	var codedWidth, codedHeight, left, top C.int
+	C.goheif_get_conformance_window(img, &codedWidth, &codedHeight, &left, &top)
+	dec.window = ConformanceWindow{
+		CodedWidth:  int(codedWidth),
+		CodedHeight: int(codedHeight),
+		Rect:        image.Rect(int(left), int(top), int(left+width), int(top+height)),
+	}
+
+	var ystride, cstride C.int
+	y := C.de265_get_image_plane(img, 0, &ystride)
+
+	if C.de265_get_chroma_format(img) == C.de265_chroma_mono {
+		return dec.convertGray(img, y, int(width), int(height), int(ystride))
+	}
+
+	cb := C.de265_get_image_plane(img, 1, &cstride)
+	cheight := C.de265_get_image_height(img, 1)
+	cr := C.de265_get_image_plane(img, 2, &cstride)
+	//			crh := C.de265_get_image_height(img, 2)
+
+	// sanity check
+	if int(height)*int(ystride) >= int(1<<30) {
+		return nil, fmt.Errorf("image too big")
+	}
+
+	var r image.YCbCrSubsampleRatio
+	switch chroma := C.de265_get_chroma_format(img); chroma {
+	case C.de265_chroma_420:
+		r = image.YCbCrSubsampleRatio420
+	case C.de265_chroma_422:
+		r = image.YCbCrSubsampleRatio422
+	case C.de265_chroma_444:
+		r = image.YCbCrSubsampleRatio444
+	}
+	rect := image.Rectangle{Min: image.Point{0, 0}, Max: image.Point{int(width), int(height)}}
+
+	if bpp := int(C.de265_get_bits_per_pixel(img, 0)); bpp > 8 {
+		if cbpp := int(C.de265_get_bits_per_pixel(img, 1)); cbpp != bpp {
+			return nil, fmt.Errorf("%w: luma bit depth %d with chroma bit depth %d", ErrUnsupported, bpp, cbpp)
+		}
+		// High bit depth planes hold native endian uint16 samples and are
+		// always copied, so the result never aliases decoder memory.
+		ySize := int(height) * int(ystride) / 2
+		cSize := int(cheight) * int(cstride) / 2
+		return &YCbCr16{
+			Y:              append([]uint16(nil), unsafe.Slice((*uint16)(unsafe.Pointer(y)), ySize)...),
+			Cb:             append([]uint16(nil), unsafe.Slice((*uint16)(unsafe.Pointer(cb)), cSize)...),
+			Cr:             append([]uint16(nil), unsafe.Slice((*uint16)(unsafe.Pointer(cr)), cSize)...),
+			YStride:        int(ystride) / 2,
+			CStride:        int(cstride) / 2,
+			SubsampleRatio: r,
+			BitDepth:       bpp,
+			Rect:           rect,
+		}, nil
+	}
+
+	ycc := &image.YCbCr{
+		YStride:        int(ystride),
+		CStride:        int(cstride),
+		SubsampleRatio: r,
+		Rect:           rect,
+	}
+	if p := dec.pinPlanes(img); p == nil {
+		ycc.Y = C.GoBytes(unsafe.Pointer(y), C.int(height*ystride))
+		ycc.Cb = C.GoBytes(unsafe.Pointer(cb), C.int(cheight*cstride))
+		ycc.Cr = C.GoBytes(unsafe.Pointer(cr), C.int(cheight*cstride))
+	} else {
+		// Calculate the exact sizes needed
+		ySize := int(height) * int(ystride)
+		cSize := int(cheight) * int(cstride)
+
+		// Create slices directly from pointers with exact sizes
+		ycc.Y = unsafe.Slice((*byte)(y), ySize)
+		ycc.Cb = unsafe.Slice((*byte)(cb), cSize)
+		ycc.Cr = unsafe.Slice((*byte)(cr), cSize)
+		return handOut(ycc, p), nil
+	}
 
-			//C.de265_release_next_picture(dec.ctx)
+	return ycc, nil
+}
 
-			return ycc, nil
+// convertGray returns a monochrome (4:0:0) picture as an *image.Gray, or an
+// *image.Gray16 with samples scaled to 16 bits for high bit depths.
+func (dec *Decoder) convertGray(img *C.struct_de265_image, y *C.uint8_t, width, height, stride int) (image.Image, error) {
+	if height*stride >= int(1<<30) {
+		return nil, fmt.Errorf("image too big")
+	}
+	rect := image.Rect(0, 0, width, height)
+
+	if bpp := int(C.de265_get_bits_per_pixel(img, 0)); bpp > 8 {
+		src := unsafe.Slice((*uint16)(unsafe.Pointer(y)), height*stride/2)
+		out := image.NewGray16(rect)
+		shift := uint(16 - bpp)
+		for j := 0; j < height; j++ {
+			row := src[j*stride/2:]
+			pix := out.Pix[j*out.Stride:]
+			for i := 0; i < width; i++ {
+				v := row[i]<<shift | row[i]>>(uint(bpp)-shift)
+				pix[2*i], pix[2*i+1] = uint8(v>>8), uint8(v)
+			}
 		}
+		return out, nil
 	}
 
-	return nil, errors.New("no picture")
+	out := &image.Gray{Stride: stride, Rect: rect}
+	p := dec.pinPlanes(img)
+	if p == nil {
+		out.Pix = C.GoBytes(unsafe.Pointer(y), C.int(height*stride))
+		return out, nil
+	}
+	out.Pix = unsafe.Slice((*byte)(y), height*stride)
+	return handOut(out, p), nil
 }
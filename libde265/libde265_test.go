@@ -0,0 +1,809 @@
+package libde265
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"os"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jdeng/goheif/heif"
+)
+
+func TestMain(m *testing.M) {
+	Init()
+	defer Fini()
+	m.Run()
+}
+
+func TestErrorCategories(t *testing.T) {
+	for _, tt := range []struct {
+		code Error
+		want error
+	}{
+		{5, ErrBitstream},     // DE265_ERROR_CHECKSUM_MISMATCH
+		{7, ErrOutOfMemory},   // DE265_ERROR_OUT_OF_MEMORY
+		{502, ErrUnsupported}, // DE265_ERROR_NOT_IMPLEMENTED_YET
+		{10, ErrInternal},     // DE265_ERROR_CANNOT_START_THREADPOOL
+	} {
+		if !errors.Is(tt.code, tt.want) {
+			t.Errorf("Error(%d) is not %v", int(tt.code), tt.want)
+		}
+		if tt.code.Error() == "" {
+			t.Errorf("Error(%d) has no text", int(tt.code))
+		}
+	}
+}
+
+func TestPushInvalidNAL(t *testing.T) {
+	dec, err := NewDecoder(WithThreads(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+
+	for _, data := range [][]byte{
+		{0, 0, 1},
+		{0, 0, 0, 9, 1, 2},
+	} {
+		if err := dec.Push(data); !errors.Is(err, ErrBitstream) {
+			t.Errorf("Push(%x) = %v; want ErrBitstream", data, err)
+		}
+	}
+}
+
+func TestYCbCr16At(t *testing.T) {
+	img := NewYCbCr16(image.Rect(0, 0, 4, 4), image.YCbCrSubsampleRatio420, 10)
+	for i := range img.Y {
+		img.Y[i] = 600
+	}
+	for i := range img.Cb {
+		img.Cb[i], img.Cr[i] = 300, 700
+	}
+
+	// The 10-bit samples are the 8-bit ones shifted by 2, so the result
+	// should be close to the 8-bit conversion.
+	r8, g8, b8 := color.YCbCrToRGB(150, 75, 175)
+	got := img.RGBA64At(1, 1)
+	for i, c := range [][2]int{{int(got.R >> 8), int(r8)}, {int(got.G >> 8), int(g8)}, {int(got.B >> 8), int(b8)}} {
+		if d := c[0] - c[1]; d < -1 || d > 1 {
+			t.Errorf("channel %d = %d; want about %d", i, c[0], c[1])
+		}
+	}
+}
+
+// readCamel returns the hvcC header and data of the camel test image,
+// both as 4 byte length-prefixed NAL units.
+func readCamel(t testing.TB) (hdr, data []byte) {
+	t.Helper()
+	f, err := os.Open("../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	hf := heif.Open(f)
+	it, err := hf.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hvcc, ok := it.HevcConfig()
+	if !ok {
+		t.Fatal("no hvcC")
+	}
+	data, err = hf.GetItemData(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hvcc.AsHeader(), data
+}
+
+// toAnnexB replaces 4 byte NAL lengths with start codes.
+func toAnnexB(data []byte) []byte {
+	var out []byte
+	for len(data) >= 4 {
+		n := int(binary.BigEndian.Uint32(data))
+		out = append(out, 0, 0, 0, 1)
+		out = append(out, data[4:4+n]...)
+		data = data[4+n:]
+	}
+	return out
+}
+
+func TestPushAnnexB(t *testing.T) {
+	hdr, data := readCamel(t)
+
+	dec, err := NewDecoder(WithSafeEncoding(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+
+	if err := dec.PushAnnexB(append(toAnnexB(hdr), toAnnexB(data)...)); err != nil {
+		t.Fatalf("PushAnnexB: %v", err)
+	}
+	img, err := dec.DecodeImage(nil)
+	if err != nil {
+		t.Fatalf("DecodeImage: %v", err)
+	}
+	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 1596 || h != 1064 {
+		t.Errorf("decoded %dx%d; want 1596x1064", w, h)
+	}
+}
+
+func TestImageLifetime(t *testing.T) {
+	hdr, data := readCamel(t)
+
+	dec, err := NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	freed := false
+	defer func() {
+		if !freed {
+			dec.Free()
+		}
+	}()
+
+	decode := func() (*Image, *image.YCbCr) {
+		t.Helper()
+		dec.Reset()
+		dec.Push(hdr)
+		m, err := dec.DecodeImage(data)
+		if err != nil {
+			t.Fatalf("DecodeImage: %v", err)
+		}
+		img, ok := m.(*Image)
+		if !ok {
+			t.Fatalf("DecodeImage returned %T; want *Image", m)
+		}
+		return img, img.Image.(*image.YCbCr)
+	}
+
+	// Images that are not closed keep their memory, uncopied, through
+	// later decodes, Reset and Free.
+	img1, ycc1 := decode()
+	y1 := &ycc1.Y[0]
+	want := append([]byte(nil), ycc1.Y...)
+	img2, ycc2 := decode()
+	if &ycc2.Y[0] == y1 {
+		t.Fatalf("second picture reuses the memory of the first")
+	}
+	used, _ := dec.MemoryUsage()
+	dec.Reset()
+	dec.Free()
+	freed = true
+	if &ycc1.Y[0] != y1 || !bytes.Equal(ycc1.Y, want) || !bytes.Equal(ycc2.Y, want) {
+		t.Errorf("Y planes changed after Reset and Free")
+	}
+
+	// A closed image frees its memory and must not be used.
+	img1.Close()
+	if ycc1.Y != nil {
+		t.Errorf("Y plane still set after Close")
+	}
+	if err := img1.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	img2.Close()
+	if used == 0 {
+		t.Errorf("zero-copy images not accounted")
+	}
+}
+
+// Without worker threads libde265 filters pictures in place in memory it
+// allocates itself, so they are copied rather than pinned.
+func TestImageCopiedWithoutThreads(t *testing.T) {
+	hdr, data := readCamel(t)
+
+	dec, err := NewDecoder(WithThreads(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+
+	var first []byte
+	for i := 0; i < 2; i++ {
+		dec.Reset()
+		dec.Push(hdr)
+		m, err := dec.DecodeImage(data)
+		if err != nil {
+			t.Fatalf("DecodeImage: %v", err)
+		}
+		ycc, ok := m.(*image.YCbCr)
+		if !ok {
+			t.Fatalf("DecodeImage returned %T; want *image.YCbCr", m)
+		}
+		if first == nil {
+			first = ycc.Y
+			continue
+		}
+		if &ycc.Y[0] == &first[0] || !bytes.Equal(ycc.Y, first) {
+			t.Errorf("second picture shares or changed the first")
+		}
+	}
+}
+
+func TestImageFinalizer(t *testing.T) {
+	hdr, data := readCamel(t)
+
+	dec, err := NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+
+	dec.Push(hdr)
+	if _, err := dec.DecodeImage(data); err != nil {
+		t.Fatal(err)
+	}
+	dec.Reset()
+	before, _ := dec.MemoryUsage()
+	if before == 0 {
+		t.Fatal("no memory used by the dropped image")
+	}
+	// the finalizer of the dropped image frees its planes
+	for i := 0; i < 50; i++ {
+		runtime.GC()
+		if used, _ := dec.MemoryUsage(); used < before {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("memory of a dropped image not freed")
+}
+
+func TestScalarAcceleration(t *testing.T) {
+	hdr, data := readCamel(t)
+
+	decode := func(a Acceleration) *image.YCbCr {
+		dec, err := NewDecoder(WithSafeEncoding(true), WithAcceleration(a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dec.Free()
+		dec.Push(hdr)
+		m, err := dec.DecodeImage(data)
+		if err != nil {
+			t.Fatalf("DecodeImage: %v", err)
+		}
+		return m.(*image.YCbCr)
+	}
+
+	// SIMD and scalar paths implement the same normative process.
+	scalar, auto := decode(AccelerationScalar), decode(AccelerationAuto)
+	if !bytes.Equal(scalar.Y, auto.Y) || !bytes.Equal(scalar.Cb, auto.Cb) {
+		t.Errorf("scalar and accelerated output differ")
+	}
+}
+
+func TestPool(t *testing.T) {
+	hdr, data := readCamel(t)
+
+	p := NewPool(1, WithSafeEncoding(true))
+	defer p.Close()
+
+	var first *Decoder
+	for i := 0; i < 3; i++ {
+		dec, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = dec
+		} else if dec != first {
+			t.Errorf("Get %d returned a new decoder; want the pooled one", i)
+		}
+
+		dec.Push(hdr)
+		if _, err := dec.DecodeImage(data); err != nil {
+			t.Fatalf("DecodeImage %d: %v", i, err)
+		}
+		p.Put(dec)
+	}
+}
+
+func TestDecodeWarnings(t *testing.T) {
+	hdr, data := readCamel(t)
+
+	var handled []string
+	dec, err := NewDecoder(WithWarningHandler(func(msg string) { handled = append(handled, msg) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+
+	// Without the parameter sets every slice refers to a missing PPS.
+	if _, err := dec.Decode(data); err == nil {
+		t.Fatalf("Decode without parameter sets succeeded")
+	}
+	ws := dec.Warnings()
+	if len(ws) == 0 {
+		t.Fatalf("no warnings reported")
+	}
+	if len(handled) != len(ws) {
+		t.Errorf("handler saw %d warnings; Warnings has %d", len(handled), len(ws))
+	}
+	for _, w := range ws {
+		if !w.Code.IsWarning() && !errors.Is(w.Code, ErrBitstream) {
+			t.Errorf("unexpected warning code %v", w)
+		}
+	}
+
+	dec.Reset()
+	dec.Push(hdr)
+	res, err := dec.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if res.Image == nil || len(res.Warnings) != 0 {
+		t.Errorf("Decode = %+v; want an image and no warnings", res)
+	}
+}
+
+func TestDecodeSEI(t *testing.T) {
+	hdr, data := readCamel(t)
+
+	// prefix SEI NAL with mastering display, content light level and
+	// user data unregistered messages; the first has emulation prevention.
+	md := []byte{
+		0x33, 0xc2, 0x86, 0xc4, 0x1d, 0x4c, 0x0b, 0xb8, 0x84, 0xd0, 0x3e, 0x80,
+		0x3d, 0x13, 0x40, 0x42, 0x00, 0x98, 0x96, 0x80, 0x00, 0x00, 0x00, 0x32,
+	}
+	uuid := append(bytes.Repeat([]byte{0xab}, 16), 'h', 'i')
+	rbsp := append([]byte{137, byte(len(md))}, md...)
+	rbsp = append(rbsp, 144, 4, 0x03, 0xe8, 0x01, 0x90)
+	rbsp = append(rbsp, 5, byte(len(uuid)))
+	rbsp = append(append(rbsp, uuid...), 0x80)
+
+	var nal []byte
+	zeros := 0
+	for _, c := range rbsp {
+		if zeros == 2 && c <= 3 {
+			nal = append(nal, 3)
+			zeros = 0
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		nal = append(nal, c)
+	}
+	nal = append([]byte{byte(NALPrefixSEI) << 1, 1}, nal...)
+	sei := binary.BigEndian.AppendUint32(nil, uint32(len(nal)))
+	sei = append(sei, nal...)
+
+	dec, err := NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+
+	dec.Push(hdr)
+	dec.Push(sei)
+	res, err := dec.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	s := res.SEI
+	if s == nil || s.MasteringDisplay == nil || s.ContentLight == nil {
+		t.Fatalf("SEI = %+v; want mastering display and content light level", s)
+	}
+	if got := s.MasteringDisplay; got.Primaries[0] != [2]uint16{13250, 34500} || got.WhitePoint != [2]uint16{15635, 16450} ||
+		got.MaxLuminance != 10000000 || got.MinLuminance != 50 {
+		t.Errorf("MasteringDisplay = %+v", got)
+	}
+	if got := *s.ContentLight; got != (ContentLightLevel{MaxCLL: 1000, MaxFALL: 400}) {
+		t.Errorf("ContentLight = %+v", got)
+	}
+	// camel.heic carries the x265 version and options as user data.
+	if len(s.UserDataUnregistered) != 2 || !bytes.Equal(s.UserDataUnregistered[0], uuid) ||
+		!bytes.Contains(s.UserDataUnregistered[1], []byte("x265")) {
+		t.Errorf("UserDataUnregistered = %q", s.UserDataUnregistered)
+	}
+
+	dec.Reset()
+	if dec.SEI() != nil {
+		t.Errorf("SEI not cleared by Reset")
+	}
+}
+
+func TestPushReader(t *testing.T) {
+	hdr, data := readCamel(t)
+
+	dec, err := NewDecoder(WithSafeEncoding(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+
+	dec.Push(hdr)
+	want, err := dec.DecodeImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantStats := dec.Stats()
+
+	dec.Reset()
+	stream := append(append([]byte(nil), hdr...), data...)
+	if err := dec.PushReader(bytes.NewReader(stream)); err != nil {
+		t.Fatalf("PushReader: %v", err)
+	}
+	got, err := dec.DecodeImage(nil)
+	if err != nil {
+		t.Fatalf("DecodeImage: %v", err)
+	}
+	if !bytes.Equal(got.(*image.YCbCr).Y, want.(*image.YCbCr).Y) {
+		t.Errorf("PushReader decode differs from Push")
+	}
+	// the slice data is larger than a chunk, so it was streamed
+	if st := dec.Stats(); st.NALs != wantStats.NALs || st.BytesPushed != wantStats.BytesPushed {
+		t.Errorf("PushReader stats = %+v; want %+v", st, wantStats)
+	}
+
+	// repeated parameter sets fill several batches
+	dec.Reset()
+	stream = append(bytes.Repeat(hdr, pushChunkSize/len(hdr)*3), data...)
+	if err := dec.PushReader(bytes.NewReader(stream)); err != nil {
+		t.Fatalf("PushReader: %v", err)
+	}
+	if got, err = dec.DecodeImage(nil); err != nil {
+		t.Fatalf("DecodeImage: %v", err)
+	}
+	if !bytes.Equal(got.(*image.YCbCr).Y, want.(*image.YCbCr).Y) {
+		t.Errorf("PushReader decode of batches differs from Push")
+	}
+
+	dec.Reset()
+	if err := dec.PushReader(bytes.NewReader(stream[:len(stream)-1])); !errors.Is(err, ErrBitstream) {
+		t.Errorf("PushReader(truncated) = %v; want ErrBitstream", err)
+	}
+}
+
+func TestNALIterator(t *testing.T) {
+	hdr, _ := readCamel(t)
+
+	var types []NALType
+	it := NewNALIterator(hdr)
+	for it.Next() {
+		types = append(types, it.NAL().Type)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	if len(types) != 3 || types[0] != NALVPS || types[1] != NALSPS || types[2] != NALPPS {
+		t.Errorf("types = %v; want VPS, SPS, PPS", types)
+	}
+
+	it = NewNALIterator(hdr[:len(hdr)-1])
+	for it.Next() {
+	}
+	if !errors.Is(it.Err(), ErrBitstream) {
+		t.Errorf("Err = %v; want ErrBitstream", it.Err())
+	}
+}
+
+func TestDecodeStats(t *testing.T) {
+	hdr, data := readCamel(t)
+
+	dec, err := NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+
+	dec.Push(hdr)
+	res, err := dec.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := res.Stats
+	if st.NALs < 4 || st.BytesPushed >= int64(len(hdr)+len(data)) || st.Iterations == 0 || st.Elapsed <= 0 {
+		t.Errorf("Stats = %+v", st)
+	}
+	if dec.Stats() != st {
+		t.Errorf("Decoder.Stats = %+v; want %+v", dec.Stats(), st)
+	}
+
+	// the counters restart with each decode
+	if _, err := dec.DecodeImage(nil); err == nil {
+		t.Fatalf("DecodeImage with nothing pushed succeeded")
+	}
+	if st := dec.Stats(); st.NALs != 0 || st.BytesPushed != 0 {
+		t.Errorf("Stats after empty decode = %+v", st)
+	}
+}
+
+// withBitDepth returns the parameter sets hdr with the bit depths of the
+// SPS changed to depth. The slices still decode, to different samples, so
+// this gives high bit depth pictures without a high bit depth stream.
+func withBitDepth(t *testing.T, hdr []byte, depth int) []byte {
+	t.Helper()
+	var out []byte
+	for len(hdr) >= 4 {
+		n := int(binary.BigEndian.Uint32(hdr))
+		nal := hdr[4 : 4+n]
+		hdr = hdr[4+n:]
+		if nal[0]>>1&0x3f == 33 {
+			nal = rewriteSPSBitDepth(t, nal, depth)
+		}
+		out = binary.BigEndian.AppendUint32(out, uint32(len(nal)))
+		out = append(out, nal...)
+	}
+	return out
+}
+
+func rewriteSPSBitDepth(t *testing.T, nal []byte, depth int) []byte {
+	// RBSP without emulation prevention bytes
+	var rbsp []byte
+	for _, b := range nal[2:] {
+		if b == 3 && len(rbsp) >= 2 && rbsp[len(rbsp)-1] == 0 && rbsp[len(rbsp)-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, b)
+	}
+	pos := 0
+	bit := func() int {
+		v := int(rbsp[pos/8]>>(7-pos%8)) & 1
+		pos++
+		return v
+	}
+	bits := func(n int) int {
+		v := 0
+		for ; n > 0; n-- {
+			v = v<<1 | bit()
+		}
+		return v
+	}
+	ue := func() int {
+		zeros := 0
+		for bit() == 0 {
+			zeros++
+		}
+		return 1<<zeros - 1 + bits(zeros)
+	}
+
+	var w []int // bits written
+	put := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			w = append(w, v>>i&1)
+		}
+	}
+	putUE := func(v int) {
+		n := 0
+		for (v+1)>>n > 1 {
+			n++
+		}
+		put(0, n)
+		put(v+1, n+1)
+	}
+
+	put(bits(4), 4) // sps_video_parameter_set_id
+	subLayers := bits(3)
+	if subLayers != 0 {
+		t.Fatalf("SPS with %d sub-layers", subLayers)
+	}
+	put(subLayers, 3)
+	put(bits(1+96), 1+96) // temporal_id_nesting and profile_tier_level
+	putUE(ue())           // sps_seq_parameter_set_id
+	chroma := ue()
+	putUE(chroma)
+	if chroma == 3 {
+		put(bit(), 1)
+	}
+	putUE(ue()) // width
+	putUE(ue()) // height
+	window := bit()
+	put(window, 1)
+	if window == 1 {
+		for i := 0; i < 4; i++ {
+			putUE(ue())
+		}
+	}
+	ue()
+	ue()
+	putUE(depth - 8)
+	putUE(depth - 8)
+
+	// the rest, up to the stop bit
+	last := len(rbsp)*8 - 1
+	for rbsp[last/8]>>(7-last%8)&1 == 0 {
+		last--
+	}
+	for pos < last {
+		put(bit(), 1)
+	}
+	put(1, 1)
+	for len(w)%8 != 0 {
+		put(0, 1)
+	}
+
+	out := append([]byte(nil), nal[:2]...)
+	zeros := 0
+	for i := 0; i < len(w); i += 8 {
+		b := byte(bits8(w[i : i+8]))
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+func bits8(b []int) int {
+	v := 0
+	for _, x := range b {
+		v = v<<1 | x
+	}
+	return v
+}
+
+func TestMemoryLimitHighBitDepth(t *testing.T) {
+	hdr, data := readCamel(t)
+	hdr = withBitDepth(t, hdr, 10)
+
+	decode := func(opts ...Option) (*YCbCr16, *Decoder) {
+		dec, err := NewDecoder(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(dec.Free)
+		dec.Push(hdr)
+		img, err := dec.DecodeImage(data)
+		if err != nil {
+			t.Fatalf("DecodeImage: %v", err)
+		}
+		ycc, ok := img.(*YCbCr16)
+		if !ok || ycc.BitDepth != 10 || ycc.Rect.Dx() != 1596 || ycc.Rect.Dy() != 1064 {
+			t.Fatalf("decoded %T %v", img, img.Bounds())
+		}
+		return ycc, dec
+	}
+	want, _ := decode()
+	got, dec := decode(WithMemoryLimit(0))
+
+	// the tracked planes must hold the same picture as libde265's own
+	for _, p := range [][2][]uint16{{got.Y, want.Y}, {got.Cb, want.Cb}, {got.Cr, want.Cr}} {
+		if !slices.Equal(p[0], p[1]) {
+			t.Fatal("pictures differ with the memory limit")
+		}
+	}
+	// 2 bytes a sample
+	if _, peak := dec.MemoryUsage(); peak < 2*int64(len(got.Y)+len(got.Cb)+len(got.Cr)) {
+		t.Errorf("peak usage %d smaller than the picture", peak)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	hdr, data := readCamel(t)
+
+	dec, err := NewDecoder(WithMemoryLimit(1 << 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+
+	dec.Push(hdr)
+	if _, err := dec.DecodeImage(data); !errors.Is(err, ErrMemoryLimit) || !errors.Is(err, ErrOutOfMemory) {
+		t.Fatalf("DecodeImage over the limit = %v; want ErrMemoryLimit", err)
+	}
+
+	dec, err = NewDecoder(WithMemoryLimit(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+
+	dec.Push(hdr)
+	img, err := dec.DecodeImage(data)
+	if err != nil {
+		t.Fatalf("DecodeImage: %v", err)
+	}
+	ycc := img.(*Image).Image.(*image.YCbCr)
+	if _, peak := dec.MemoryUsage(); peak < int64(len(ycc.Y)+len(ycc.Cb)+len(ycc.Cr)) {
+		t.Errorf("peak usage %d smaller than the picture", peak)
+	}
+}
+
+func TestDecodeWithoutReset(t *testing.T) {
+	hdr, data := readCamel(t)
+
+	dec, err := NewDecoder(WithSafeEncoding(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+
+	// intra pictures decode one after another once the parameter sets
+	// have been pushed
+	dec.Push(hdr)
+	for i := 0; i < 3; i++ {
+		img, err := dec.DecodeImage(data)
+		if err != nil {
+			t.Fatalf("DecodeImage #%d: %v", i, err)
+		}
+		if img.Bounds().Dx() != 1596 {
+			t.Errorf("DecodeImage #%d: width %d", i, img.Bounds().Dx())
+		}
+	}
+}
+
+func TestThreadedDecode(t *testing.T) {
+	hdr, data := readCamel(t)
+
+	// worker threads use the platform thread and condition variable
+	// shims, such as those of extra/win32cond.c on Windows
+	decode := func(threads int) *image.YCbCr {
+		dec, err := NewDecoder(WithSafeEncoding(true), WithThreads(threads))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dec.Free()
+		dec.Push(hdr)
+		m, err := dec.DecodeImage(data)
+		if err != nil {
+			t.Fatalf("DecodeImage with %d threads: %v", threads, err)
+		}
+		return m.(*image.YCbCr)
+	}
+	single, threaded := decode(0), decode(4)
+	if !bytes.Equal(single.Y, threaded.Y) || !bytes.Equal(single.Cr, threaded.Cr) {
+		t.Errorf("threaded output differs")
+	}
+}
+
+func TestConcurrentUsePanics(t *testing.T) {
+	dec, err := NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+
+	// simulate another goroutine inside a call
+	done := dec.enter()
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Push during another call did not panic")
+			}
+		}()
+		dec.Push(nil)
+	}()
+	done()
+
+	if err := dec.Push(nil); err != nil {
+		t.Errorf("Push after the call: %v", err)
+	}
+}
+
+func BenchmarkPushParameterSets(b *testing.B) {
+	hdr, _ := readCamel(b)
+	// a tile-heavy stream: the parameter sets many times over
+	data := bytes.Repeat(hdr, 100)
+
+	dec, err := NewDecoder()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer dec.Free()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := dec.Push(data); err != nil {
+			b.Fatal(err)
+		}
+		dec.Reset()
+	}
+}
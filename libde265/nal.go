@@ -0,0 +1,106 @@
+package libde265
+
+import (
+	"fmt"
+)
+
+// NALType is the nal_unit_type of an HEVC NAL unit.
+type NALType int
+
+const (
+	NALIDRWRADL  NALType = 19
+	NALIDRNLP    NALType = 20
+	NALCRA       NALType = 21
+	NALVPS       NALType = 32
+	NALSPS       NALType = 33
+	NALPPS       NALType = 34
+	NALAUD       NALType = 35
+	NALPrefixSEI NALType = 39
+	NALSuffixSEI NALType = 40
+)
+
+// NAL is a single NAL unit. Data includes the two byte NAL unit header and
+// still contains emulation prevention bytes.
+type NAL struct {
+	Type NALType
+	Data []byte
+}
+
+// Size returns the size of the NAL unit in bytes.
+func (n NAL) Size() int {
+	return len(n.Data)
+}
+
+// Payload returns the NAL unit without its header.
+func (n NAL) Payload() []byte {
+	if len(n.Data) < 2 {
+		return nil
+	}
+	return n.Data[2:]
+}
+
+// NALIterator walks the length-prefixed NAL units of an hvcC header or an
+// item's data, as passed to Push. The returned NAL units alias the data.
+//
+//	it := libde265.NewNALIterator(data)
+//	for it.Next() {
+//		nal := it.NAL()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type NALIterator struct {
+	data []byte
+	pos  int
+	nal  NAL
+	err  error
+}
+
+func NewNALIterator(data []byte) *NALIterator {
+	return &NALIterator{data: data}
+}
+
+// Next advances to the next NAL unit. It returns false at the end of the
+// data or on error.
+func (it *NALIterator) Next() bool {
+	if it.err != nil || it.pos >= len(it.data) {
+		return false
+	}
+
+	data, pos := it.data, it.pos
+	if pos+4 > len(data) {
+		it.err = fmt.Errorf("%w: truncated NAL length", ErrBitstream)
+		return false
+	}
+
+	nalSize := uint32(data[pos])<<24 | uint32(data[pos+1])<<16 | uint32(data[pos+2])<<8 | uint32(data[pos+3])
+	pos += 4
+
+	if pos+int(nalSize) > len(data) {
+		it.err = fmt.Errorf("%w: invalid NAL size: %d", ErrBitstream, nalSize)
+		return false
+	}
+
+	it.nal = newNAL(data[pos : pos+int(nalSize)])
+	it.pos = pos + int(nalSize)
+	return true
+}
+
+// NAL returns the current NAL unit.
+func (it *NALIterator) NAL() NAL {
+	return it.nal
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *NALIterator) Err() error {
+	return it.err
+}
+
+func newNAL(data []byte) NAL {
+	n := NAL{Type: -1, Data: data}
+	if len(data) > 0 {
+		n.Type = NALType((data[0] >> 1) & 0x3f)
+	}
+	return n
+}
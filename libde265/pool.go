@@ -0,0 +1,74 @@
+package libde265
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Pool keeps idle decoders created with the same options for reuse, since
+// creating and freeing a decoder context is expensive. It is safe for
+// concurrent use.
+type Pool struct {
+	opts    []Option
+	maxIdle int
+
+	mu     sync.Mutex
+	idle   []*Decoder
+	closed bool
+}
+
+// NewPool returns a pool creating decoders with opts. At most maxIdle
+// decoders are kept between uses; if maxIdle <= 0, GOMAXPROCS is used.
+func NewPool(maxIdle int, opts ...Option) *Pool {
+	if maxIdle <= 0 {
+		maxIdle = runtime.GOMAXPROCS(0)
+	}
+	return &Pool{opts: opts, maxIdle: maxIdle}
+}
+
+// Get returns an idle decoder, or a new one if none is available.
+func (p *Pool) Get() (*Decoder, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		dec := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return dec, nil
+	}
+	p.mu.Unlock()
+
+	return NewDecoder(p.opts...)
+}
+
+// Put resets dec and returns it to the pool, or frees it if the pool is
+// full or closed. Images previously returned by dec remain valid, as with
+// Reset. dec must not be used after Put.
+func (p *Pool) Put(dec *Decoder) {
+	dec.Reset()
+	dec.warnings = nil
+
+	p.mu.Lock()
+	if !p.closed && len(p.idle) < p.maxIdle {
+		p.idle = append(p.idle, dec)
+		dec = nil
+	}
+	p.mu.Unlock()
+
+	if dec != nil {
+		dec.Free()
+	}
+}
+
+// Close frees the idle decoders. Decoders put back afterwards are freed
+// immediately.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, dec := range idle {
+		dec.Free()
+	}
+}
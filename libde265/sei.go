@@ -0,0 +1,171 @@
+package libde265
+
+// SEI holds the supplemental enhancement information messages of interest
+// found in the NAL units pushed since the last Reset. libde265 itself only
+// acts on decoded picture hashes, so the messages are parsed here.
+type SEI struct {
+	MasteringDisplay *MasteringDisplay
+	ContentLight     *ContentLightLevel
+
+	// UserDataRegistered holds user_data_registered_itu_t_t35 payloads,
+	// starting with the country code (HDR10+ uses these).
+	UserDataRegistered [][]byte
+	// UserDataUnregistered holds user_data_unregistered payloads,
+	// starting with the 16 byte UUID.
+	UserDataUnregistered [][]byte
+}
+
+// Empty reports whether no message was found.
+func (s *SEI) Empty() bool {
+	return s == nil || s.MasteringDisplay == nil && s.ContentLight == nil &&
+		len(s.UserDataRegistered) == 0 && len(s.UserDataUnregistered) == 0
+}
+
+// MasteringDisplay is the mastering display colour volume (SMPTE ST 2086).
+type MasteringDisplay struct {
+	Primaries    [3][2]uint16 // x, y in units of 0.00002, in coded order (G, B, R)
+	WhitePoint   [2]uint16    // x, y in units of 0.00002
+	MaxLuminance uint32       // in units of 0.0001 cd/m2
+	MinLuminance uint32       // in units of 0.0001 cd/m2
+}
+
+// ContentLightLevel is the content light level information, in cd/m2.
+type ContentLightLevel struct {
+	MaxCLL  uint16
+	MaxFALL uint16
+}
+
+const (
+	seiUserDataRegistered   = 4
+	seiUserDataUnregistered = 5
+	seiMasteringDisplay     = 137
+	seiContentLightLevel    = 144
+)
+
+// SEI returns the messages found since the last Reset, or nil if there
+// were none.
+func (dec *Decoder) SEI() *SEI {
+	return dec.sei
+}
+
+// scanSEI records the messages of interest if nal is an SEI NAL unit.
+// Malformed messages are ignored; the decoder reports those.
+func (dec *Decoder) scanSEI(nal []byte) {
+	unit := newNAL(nal)
+	if unit.Size() < 3 || unit.Type != NALPrefixSEI && unit.Type != NALSuffixSEI {
+		return
+	}
+
+	rbsp := unescapeRBSP(unit.Payload())
+	for len(rbsp) > 1 || (len(rbsp) == 1 && rbsp[0] != 0x80) {
+		payloadType, n := seiValue(rbsp)
+		if n == 0 {
+			return
+		}
+		rbsp = rbsp[n:]
+		payloadSize, n := seiValue(rbsp)
+		if n == 0 || len(rbsp)-n < payloadSize {
+			return
+		}
+		payload := rbsp[n : n+payloadSize]
+		rbsp = rbsp[n+payloadSize:]
+
+		if dec.sei == nil {
+			dec.sei = &SEI{}
+		}
+		dec.sei.add(payloadType, payload)
+	}
+	if dec.sei.Empty() {
+		dec.sei = nil
+	}
+}
+
+func (s *SEI) add(payloadType int, p []byte) {
+	switch payloadType {
+	case seiMasteringDisplay:
+		if len(p) < 24 {
+			return
+		}
+		md := &MasteringDisplay{}
+		for c := 0; c < 3; c++ {
+			md.Primaries[c][0] = be16(p[4*c:])
+			md.Primaries[c][1] = be16(p[4*c+2:])
+		}
+		md.WhitePoint[0] = be16(p[12:])
+		md.WhitePoint[1] = be16(p[14:])
+		md.MaxLuminance = uint32(be16(p[16:]))<<16 | uint32(be16(p[18:]))
+		md.MinLuminance = uint32(be16(p[20:]))<<16 | uint32(be16(p[22:]))
+		s.MasteringDisplay = md
+	case seiContentLightLevel:
+		if len(p) < 4 {
+			return
+		}
+		s.ContentLight = &ContentLightLevel{MaxCLL: be16(p), MaxFALL: be16(p[2:])}
+	case seiUserDataRegistered:
+		s.UserDataRegistered = append(s.UserDataRegistered, append([]byte(nil), p...))
+	case seiUserDataUnregistered:
+		if len(p) < 16 {
+			return
+		}
+		s.UserDataUnregistered = append(s.UserDataUnregistered, append([]byte(nil), p...))
+	}
+}
+
+// seiValue reads a payload type or size, coded as a run of 0xff bytes
+// followed by a final byte. It returns the number of bytes read, or 0 if
+// b ends early.
+func seiValue(b []byte) (v, n int) {
+	for n < len(b) {
+		v += int(b[n])
+		n++
+		if b[n-1] != 0xff {
+			return v, n
+		}
+	}
+	return 0, 0
+}
+
+// unescapeRBSP removes emulation prevention bytes (00 00 03).
+func unescapeRBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// splitAnnexB calls fn with each NAL unit of an Annex-B byte stream.
+func splitAnnexB(data []byte, fn func(nal []byte)) {
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			for end > start && data[end-1] == 0 {
+				end--
+			}
+			fn(data[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		fn(data[start:])
+	}
+}
+
+func be16(b []byte) uint16 {
+	return uint16(b[0])<<8 | uint16(b[1])
+}
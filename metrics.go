@@ -0,0 +1,65 @@
+package goheif
+
+import (
+	"image"
+	"time"
+
+	"github.com/jdeng/goheif/libde265"
+)
+
+// DecodeMetrics describes where the time of a Decode call went, for
+// services exporting decode metrics. See WithMetrics.
+type DecodeMetrics struct {
+	Parse      time.Duration // reading the metadata up to the primary item
+	ItemRead   time.Duration // reading item data and pushing it to the decoder
+	TileDecode time.Duration // decoding, over all tiles
+	Assembly   time.Duration // pasting tiles into the output image
+	Tiles      int           // coded images decoded, 1 unless the image is a grid
+
+	// PeakMemory is the largest number of bytes of decoded pixels held at
+	// once: the output image plus the tile being pasted. The codec's own
+	// buffers are not included.
+	PeakMemory int64
+
+	Err error // the error returned by Decode, if any
+}
+
+// WithMetrics makes the decoder call fn with the metrics of each Decode
+// and DecodeBands call once it returns. fn may be called concurrently.
+func WithMetrics(fn func(DecodeMetrics)) Option {
+	return func(d *Decoder) {
+		d.metrics = fn
+	}
+}
+
+// add adds the time elapsed since start to *stage.
+func (m *DecodeMetrics) add(stage *time.Duration, start time.Time) {
+	*stage += time.Since(start)
+}
+
+func (m *DecodeMetrics) holding(n int64) {
+	if n > m.PeakMemory {
+		m.PeakMemory = n
+	}
+}
+
+// imageBytes returns the size of the pixel buffers of img.
+func imageBytes(img image.Image) int64 {
+	switch img := img.(type) {
+	case *image.YCbCr:
+		return int64(len(img.Y) + len(img.Cb) + len(img.Cr))
+	case *libde265.YCbCr16:
+		return 2 * int64(len(img.Y)+len(img.Cb)+len(img.Cr))
+	case *image.Gray:
+		return int64(len(img.Pix))
+	case *image.Gray16:
+		return int64(len(img.Pix))
+	case *image.RGBA:
+		return int64(len(img.Pix))
+	case *image.CMYK:
+		return int64(len(img.Pix))
+	case *libde265.Image:
+		return imageBytes(img.Image)
+	}
+	return 0
+}
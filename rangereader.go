@@ -0,0 +1,183 @@
+package goheif
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"sync"
+)
+
+// RangeFetcherFunc adapts a function fetching a byte range, such as an
+// HTTP Range request against object storage, to an io.ReaderAt.
+type RangeFetcherFunc func(p []byte, off int64) (int, error)
+
+func (f RangeFetcherFunc) ReadAt(p []byte, off int64) (int, error) {
+	return f(p, off)
+}
+
+// RangeReader reads a remote object through an io.ReaderAt, fetching
+// small reads in whole blocks and keeping the most recently used blocks.
+// Decoding reads the metadata boxes in many small pieces but each item
+// in one piece, so only the metadata and the extents of the decoded items
+// are fetched, with few round trips.
+//
+// A RangeReader implements io.Reader, io.ReaderAt and io.Seeker, so it can
+// be passed to Decode directly. ReadAt is safe for concurrent use.
+type RangeReader struct {
+	ra        io.ReaderAt
+	size      int64
+	blockSize int64
+	maxBlocks int
+
+	mu     sync.Mutex
+	blocks map[int64]*list.Element
+	lru    list.List // of *rangeBlock, most recently used first
+
+	off int64 // for Read and Seek
+}
+
+type rangeBlock struct {
+	index int64
+	data  []byte
+}
+
+// NewRangeReader returns a RangeReader over the first size bytes of ra.
+// blockSize and cacheBlocks default to 64 KiB and 16 if <= 0.
+func NewRangeReader(ra io.ReaderAt, size int64, blockSize, cacheBlocks int) *RangeReader {
+	if blockSize <= 0 {
+		blockSize = 64 << 10
+	}
+	if cacheBlocks <= 0 {
+		cacheBlocks = 16
+	}
+	return &RangeReader{
+		ra:        ra,
+		size:      size,
+		blockSize: int64(blockSize),
+		maxBlocks: cacheBlocks,
+		blocks:    make(map[int64]*list.Element),
+	}
+}
+
+// NewSeekerRangeReader is like NewRangeReader with default sizes, but
+// reads from an io.ReadSeeker, whose size it determines by seeking.
+func NewSeekerRangeReader(rs io.ReadSeeker) (*RangeReader, error) {
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return NewRangeReader(&seekerAt{rs: rs}, size, 0, 0), nil
+}
+
+// seekerAt implements io.ReaderAt on top of an io.ReadSeeker.
+type seekerAt struct {
+	mu sync.Mutex
+	rs io.ReadSeeker
+}
+
+func (s *seekerAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s.rs, p)
+}
+
+// Size returns the size of the object.
+func (r *RangeReader) Size() int64 {
+	return r.size
+}
+
+func (r *RangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("goheif: negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	var err error
+	if rem := r.size - off; int64(len(p)) > rem {
+		p = p[:rem]
+		err = io.EOF
+	}
+
+	// large reads, such as item data, bypass the cache
+	if int64(len(p)) >= 2*r.blockSize {
+		n, rerr := r.ra.ReadAt(p, off)
+		if rerr != nil && !(rerr == io.EOF && n == len(p)) {
+			return n, rerr
+		}
+		return n, err
+	}
+
+	n := 0
+	for n < len(p) {
+		b, berr := r.block((off + int64(n)) / r.blockSize)
+		if berr != nil {
+			return n, berr
+		}
+		start := off + int64(n) - b.index*r.blockSize
+		if start >= int64(len(b.data)) {
+			return n, io.ErrUnexpectedEOF
+		}
+		n += copy(p[n:], b.data[start:])
+	}
+	return n, err
+}
+
+// block returns the block with the given index, fetching it if needed.
+func (r *RangeReader) block(index int64) (*rangeBlock, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.blocks[index]; ok {
+		r.lru.MoveToFront(e)
+		return e.Value.(*rangeBlock), nil
+	}
+
+	off := index * r.blockSize
+	size := r.blockSize
+	if off+size > r.size {
+		size = r.size - off
+	}
+	data := make([]byte, size)
+	if n, err := r.ra.ReadAt(data, off); err != nil && !(err == io.EOF && n == len(data)) {
+		return nil, err
+	}
+
+	b := &rangeBlock{index: index, data: data}
+	r.blocks[index] = r.lru.PushFront(b)
+	if r.lru.Len() > r.maxBlocks {
+		last := r.lru.Remove(r.lru.Back()).(*rangeBlock)
+		delete(r.blocks, last.index)
+	}
+	return b, nil
+}
+
+func (r *RangeReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *RangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("goheif: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("goheif: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
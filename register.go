@@ -0,0 +1,7 @@
+//go:build !goheif_noregister
+
+package goheif
+
+func init() {
+	RegisterFormats()
+}
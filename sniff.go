@@ -0,0 +1,61 @@
+package goheif
+
+import "encoding/binary"
+
+// Formats reported by Sniff.
+const (
+	FormatHEIC         = "heic"
+	FormatHEICSequence = "heic-sequence"
+	FormatAVIF         = "avif"
+	FormatAVIFSequence = "avif-sequence"
+	FormatHEIF         = "heif"          // still image, codec not signalled
+	FormatHEIFSequence = "heif-sequence" // image sequence, codec not signalled
+)
+
+// sniffBrands maps ftyp brands to formats, the more specific first: when
+// several brands are present, the first format in this list wins.
+var sniffBrands = []struct {
+	format string
+	brands []string
+}{
+	{FormatHEIC, []string{"heic", "heix", "heim", "heis"}},
+	{FormatAVIF, []string{"avif"}},
+	{FormatHEICSequence, []string{"hevc", "hevx", "hevm", "hevs"}},
+	{FormatAVIFSequence, []string{"avis"}},
+	{FormatHEIF, []string{"mif1", "mif2"}},
+	{FormatHEIFSequence, []string{"msf1"}},
+}
+
+// Sniff classifies a file from its first bytes, which must hold the ftyp
+// box; 32 bytes are enough for common files. It reads the major and
+// compatible brands only, so it is much cheaper than opening the file,
+// but does not check that the rest of the file is valid.
+func Sniff(prefix []byte) (format string, ok bool) {
+	if len(prefix) < 16 || string(prefix[4:8]) != "ftyp" {
+		return "", false
+	}
+	size := binary.BigEndian.Uint32(prefix)
+	if size < 16 {
+		return "", false
+	}
+	end := len(prefix)
+	if uint64(size) < uint64(end) {
+		end = int(size)
+	}
+
+	brands := []string{string(prefix[8:12])}
+	for off := 16; off+4 <= end; off += 4 {
+		brands = append(brands, string(prefix[off:off+4]))
+	}
+
+	for _, sb := range sniffBrands {
+		for _, want := range sb.brands {
+			for _, b := range brands {
+				if b == want {
+					return sb.format, true
+				}
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,32 @@
+package goheif
+
+import "runtime"
+
+// AutoThreads, passed to WithThreads, sizes the HEVC decoder's worker
+// threads from GOMAXPROCS and the image size. It is the default.
+const AutoThreads = -1
+
+// WithThreads sets the number of HEVC decoder worker threads per decode,
+// or AutoThreads. Zero decodes on the calling goroutine's thread only.
+func WithThreads(n int) Option {
+	return func(d *Decoder) {
+		d.threads = n
+	}
+}
+
+// autoThreadPixels is the number of pixels per decoder thread under
+// AutoThreads. Starting a thread pool costs more than it saves on smaller
+// pictures.
+const autoThreadPixels = 1 << 20
+
+// autoThreads returns the decoder threads for a width x height image, when
+// concurrency images are decoded at once: one per autoThreadPixels pixels,
+// within each decode's share of GOMAXPROCS, or none if that is one.
+func autoThreads(width, height, concurrency int) int {
+	procs := runtime.GOMAXPROCS(0) / max(concurrency, 1)
+	n := min(procs, int(int64(width)*int64(height)/autoThreadPixels))
+	if n < 2 {
+		return 0
+	}
+	return n
+}
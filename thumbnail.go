@@ -0,0 +1,83 @@
+package goheif
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+
+	"github.com/jdeng/goheif/heif"
+)
+
+// Thumbnail returns a small image of the primary image of a HEIF file,
+// whose longer side is at most size pixels, for previews and photo
+// indexes. The embedded thumbnail is used if the file has one, as only it
+// is decoded; otherwise the image is decoded and scaled down. Embedded
+// thumbnails smaller than size are returned as they are. WithTransforms
+// applies to the scaled image.
+func (d *Decoder) Thumbnail(r io.Reader, size int) (image.Image, error) {
+	if size < 1 {
+		return nil, errors.New("goheif: thumbnail size must be positive")
+	}
+	ra, err := asReaderAt(r)
+	if err != nil {
+		return nil, err
+	}
+	hf := heif.Open(ra, pixelsOnly)
+	img, it, err := d.decodeThumbnail(hf)
+	if err == ErrNoThumbnail {
+		plain := *d
+		plain.transforms = false
+		if img, err = plain.decode(io.NewSectionReader(ra, 0, math.MaxInt64), nil); err == nil {
+			it, err = hf.PrimaryItem()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	img = Shrink(img, size)
+	if !d.transforms {
+		return img, nil
+	}
+	return transform(img, it), nil
+}
+
+// Shrink returns img scaled down, keeping its aspect ratio, so that its
+// longer side is at most size pixels. Pixels are area averaged; 4:2:0
+// YCbCr images, as decoded from most files, stay YCbCr with even sizes.
+// Images small enough are returned as they are.
+func Shrink(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	if m, ok := img.(*image.YCbCr); ok && m.SubsampleRatio == image.YCbCrSubsampleRatio420 {
+		return downscale(m, size)
+	}
+
+	tw, th := size, size
+	if w > h {
+		th = max(h*size/w, 1)
+	} else {
+		tw = max(w*size/h, 1)
+	}
+	out := image.NewRGBA64(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		sy0, sy1 := y*h/th, max((y+1)*h/th, y*h/th+1)
+		for x := 0; x < tw; x++ {
+			sx0, sx1 := x*w/tw, max((x+1)*w/tw, x*w/tw+1)
+			var sr, sg, sb, sa uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := img.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					sr, sg, sb, sa = sr+uint64(cr), sg+uint64(cg), sb+uint64(cb), sa+uint64(ca)
+				}
+			}
+			n := uint64((sy1 - sy0) * (sx1 - sx0))
+			out.SetRGBA64(x, y, color.RGBA64{uint16(sr / n), uint16(sg / n), uint16(sb / n), uint16(sa / n)})
+		}
+	}
+	return out
+}
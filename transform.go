@@ -0,0 +1,106 @@
+package goheif
+
+import (
+	"image"
+
+	"github.com/jdeng/goheif/heif"
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// WithTransforms makes the decoder apply the irot and imir properties of
+// the image, so that it comes out as meant to be displayed. Bands passed
+// to a BandFunc are not transformed.
+func WithTransforms(b bool) Option {
+	return func(d *Decoder) {
+		d.transforms = b
+	}
+}
+
+// transform applies the rotations and mirrorings of it to img, in the
+// order of its properties.
+func transform(img image.Image, it *heif.Item) image.Image {
+	for _, p := range it.Properties {
+		switch p := p.(type) {
+		case *bmff.ImageRotation:
+			img = rotate(img, int(p.Angle&3))
+		case *bmff.ImageMirror:
+			img = mirror(img, p.Mirror)
+		}
+	}
+	return img
+}
+
+// rotate returns img turned by n quarter turns counter-clockwise.
+func rotate(img image.Image, n int) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	switch n {
+	case 1:
+		return remap(img, h, w, true, func(x, y int) (int, int) { return w - 1 - y, x })
+	case 2:
+		return remap(img, w, h, false, func(x, y int) (int, int) { return w - 1 - x, h - 1 - y })
+	case 3:
+		return remap(img, h, w, true, func(x, y int) (int, int) { return y, h - 1 - x })
+	}
+	return img
+}
+
+// mirror returns img flipped left to right about a vertical axis (0), or
+// top to bottom about a horizontal one (1).
+func mirror(img image.Image, axis uint8) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if axis == bmff.MirrorVertical {
+		return remap(img, w, h, false, func(x, y int) (int, int) { return w - 1 - x, y })
+	}
+	return remap(img, w, h, false, func(x, y int) (int, int) { return x, h - 1 - y })
+}
+
+// remap returns a w x h image whose pixel at x, y is the pixel of img at
+// src(x, y), both relative to the top left corner, turned by an odd number
+// of quarter turns if turned is set. YCbCr images stay YCbCr, each chroma
+// sample taken from one of the pixels it covers.
+func remap(img image.Image, w, h int, turned bool, src func(x, y int) (int, int)) image.Image {
+	b := img.Bounds()
+	if m, ok := img.(*image.YCbCr); ok {
+		ratio := m.SubsampleRatio
+		if turned {
+			// quarter turns swap the subsampling of rows and columns
+			switch ratio {
+			case image.YCbCrSubsampleRatio422:
+				ratio = image.YCbCrSubsampleRatio440
+			case image.YCbCrSubsampleRatio440:
+				ratio = image.YCbCrSubsampleRatio422
+			case image.YCbCrSubsampleRatio411, image.YCbCrSubsampleRatio410:
+				ratio = image.YCbCrSubsampleRatio444
+			}
+		}
+		out := image.NewYCbCr(image.Rect(0, 0, w, h), ratio)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				sx, sy := src(x, y)
+				sx, sy = sx+b.Min.X, sy+b.Min.Y
+				out.Y[out.YOffset(x, y)] = m.Y[m.YOffset(sx, sy)]
+				c, sc := out.COffset(x, y), m.COffset(sx, sy)
+				out.Cb[c], out.Cr[c] = m.Cb[sc], m.Cr[sc]
+			}
+		}
+		return out
+	}
+
+	out := image.NewRGBA64(image.Rect(0, 0, w, h))
+	if rgba, ok := img.(image.RGBA64Image); ok {
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				sx, sy := src(x, y)
+				out.SetRGBA64(x, y, rgba.RGBA64At(sx+b.Min.X, sy+b.Min.Y))
+			}
+		}
+		return out
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sx, sy := src(x, y)
+			out.Set(x, y, img.At(sx+b.Min.X, sy+b.Min.Y))
+		}
+	}
+	return out
+}
@@ -0,0 +1,3 @@
+// Package x265 encodes HEVC images with libx265. It is only built with
+// -tags x265 and links the libx265 found by pkg-config.
+package x265
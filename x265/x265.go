@@ -0,0 +1,291 @@
+//go:build x265
+
+package x265
+
+/*
+#cgo pkg-config: x265
+#include <stdlib.h>
+#include <string.h>
+#include <x265.h>
+
+// The functions of the library built for a bit depth are reached through
+// its x265_api table, whose function pointers cgo cannot call.
+static x265_param* goheif_param_alloc(const x265_api* a) { return a->param_alloc(); }
+static void goheif_param_free(const x265_api* a, x265_param* p) { a->param_free(p); }
+static int goheif_param_default_preset(const x265_api* a, x265_param* p, const char* preset) {
+	return a->param_default_preset(p, preset, NULL);
+}
+static int goheif_param_parse(const x265_api* a, x265_param* p, const char* name, const char* value) {
+	return a->param_parse(p, name, value);
+}
+static x265_encoder* goheif_encoder_open(const x265_api* a, x265_param* p) { return a->encoder_open(p); }
+static void goheif_encoder_close(const x265_api* a, x265_encoder* e) { a->encoder_close(e); }
+static x265_picture* goheif_picture_alloc(const x265_api* a) { return a->picture_alloc(); }
+static void goheif_picture_free(const x265_api* a, x265_picture* pic) { a->picture_free(pic); }
+static void goheif_picture_init(const x265_api* a, x265_param* p, x265_picture* pic) { a->picture_init(p, pic); }
+static int goheif_encoder_encode(const x265_api* a, x265_encoder* e, x265_nal** nals, uint32_t* n, x265_picture* pic) {
+	return a->encoder_encode(e, nals, n, pic, NULL);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"unsafe"
+
+	"github.com/jdeng/goheif/libde265"
+)
+
+// Encoder codes images as single intra HEVC pictures.
+type Encoder struct {
+	quality int
+	rf      int // overrides quality if positive
+	preset  string
+	vui     [][2]string // color parameters
+}
+
+type Option func(*Encoder)
+
+// WithQuality sets the quality, from 1 to 100. It is mapped to the x265
+// constant rate factor. The default is 50.
+func WithQuality(q int) Option {
+	return func(e *Encoder) {
+		e.quality = q
+	}
+}
+
+// WithCRF sets the constant rate factor, from 0 to 51, lower is better.
+// It overrides WithQuality; 0 leaves the rate to the quality.
+func WithCRF(crf int) Option {
+	return func(e *Encoder) {
+		e.rf = crf
+	}
+}
+
+// presets are the x265 presets, from the slowest to the fastest.
+var presets = [...]string{"placebo", "veryslow", "slower", "slow", "medium", "fast", "faster", "veryfast", "superfast", "ultrafast"}
+
+// WithSpeed selects the x265 preset by speed, from 1 (placebo) to 10
+// (ultrafast). The default is 5 (medium).
+func WithSpeed(speed int) Option {
+	return func(e *Encoder) {
+		e.preset = presets[min(max(speed, 1), len(presets))-1]
+	}
+}
+
+// WithColor signals the color primaries, transfer characteristics and
+// matrix coefficients, as code points of ITU-T H.273, and the range of the
+// samples in the video usability information of the stream.
+func WithColor(primaries, transfer, matrix int, fullRange bool) Option {
+	return func(e *Encoder) {
+		colorRange := "limited"
+		if fullRange {
+			colorRange = "full"
+		}
+		e.vui = append(e.vui,
+			[2]string{"colorprim", fmt.Sprint(primaries)},
+			[2]string{"transfer", fmt.Sprint(transfer)},
+			[2]string{"colormatrix", fmt.Sprint(matrix)},
+			[2]string{"range", colorRange})
+	}
+}
+
+// WithContentLight writes a content light level SEI message, in cd/m2.
+func WithContentLight(maxCLL, maxFALL int) Option {
+	return func(e *Encoder) {
+		e.vui = append(e.vui, [2]string{"max-cll", fmt.Sprintf("%d,%d", maxCLL, maxFALL)})
+	}
+}
+
+// WithMasteringDisplay writes a mastering display colour volume SEI
+// message: the primaries and white point in units of 0.00002, in G, B, R
+// order, and the luminances in units of 0.0001 cd/m2.
+func WithMasteringDisplay(primaries [3][2]uint16, whitePoint [2]uint16, maxLuminance, minLuminance uint32) Option {
+	return func(e *Encoder) {
+		g, b, r := primaries[0], primaries[1], primaries[2]
+		e.vui = append(e.vui, [2]string{"master-display", fmt.Sprintf("G(%d,%d)B(%d,%d)R(%d,%d)WP(%d,%d)L(%d,%d)",
+			g[0], g[1], b[0], b[1], r[0], r[1], whitePoint[0], whitePoint[1], maxLuminance, minLuminance)})
+	}
+}
+
+// NewEncoder returns an Encoder.
+func NewEncoder(opts ...Option) *Encoder {
+	e := &Encoder{quality: 50, preset: "medium"}
+	for _, o := range opts {
+		o(e)
+	}
+	return e
+}
+
+// crf returns the rate factor set by WithCRF or else maps the quality, 1
+// to 100, onto the x265 rate factor range 51 to 0.
+func (e *Encoder) crf() int {
+	if e.rf > 0 {
+		return min(e.rf, 51)
+	}
+	q := min(max(e.quality, 1), 100)
+	return (100 - q) * 51 / 100
+}
+
+// Encode codes img, a 4:2:0 image with even dimensions, and returns an
+// Annex-B byte stream holding the parameter sets and the picture.
+func (e *Encoder) Encode(img *image.YCbCr) ([]byte, error) {
+	if img.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		return nil, fmt.Errorf("x265: unsupported subsample ratio %v", img.SubsampleRatio)
+	}
+	r := img.Rect
+	return e.encode(r.Dx(), r.Dy(), 8, [3]plane{
+		{unsafe.Pointer(unsafe.SliceData(img.Y[img.YOffset(r.Min.X, r.Min.Y):])), img.YStride},
+		{unsafe.Pointer(unsafe.SliceData(img.Cb[img.COffset(r.Min.X, r.Min.Y):])), img.CStride},
+		{unsafe.Pointer(unsafe.SliceData(img.Cr[img.COffset(r.Min.X, r.Min.Y):])), img.CStride},
+	})
+}
+
+// Encode16 codes img, a 4:2:0 image with even dimensions and a bit depth
+// of 8, 10 or 12, like Encode. Depths above 8 need a libx265 built for
+// them, such as a multilib build.
+func (e *Encoder) Encode16(img *libde265.YCbCr16) ([]byte, error) {
+	if img.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		return nil, fmt.Errorf("x265: unsupported subsample ratio %v", img.SubsampleRatio)
+	}
+	r := img.Rect
+	return e.encode(r.Dx(), r.Dy(), img.BitDepth, [3]plane{
+		{unsafe.Pointer(unsafe.SliceData(img.Y[img.YOffset(r.Min.X, r.Min.Y):])), 2 * img.YStride},
+		{unsafe.Pointer(unsafe.SliceData(img.Cb[img.COffset(r.Min.X, r.Min.Y):])), 2 * img.CStride},
+		{unsafe.Pointer(unsafe.SliceData(img.Cr[img.COffset(r.Min.X, r.Min.Y):])), 2 * img.CStride},
+	})
+}
+
+// plane is the start and stride, in bytes, of a plane of samples.
+type plane struct {
+	pix    unsafe.Pointer
+	stride int
+}
+
+func (e *Encoder) encode(w, h, depth int, planes [3]plane) ([]byte, error) {
+	if w == 0 || h == 0 || w%2 != 0 || h%2 != 0 {
+		return nil, fmt.Errorf("x265: invalid image size %dx%d", w, h)
+	}
+	if depth != 8 && depth != 10 && depth != 12 {
+		return nil, fmt.Errorf("x265: unsupported bit depth %d", depth)
+	}
+	api := C.x265_api_get(C.int(depth))
+	if api == nil {
+		return nil, fmt.Errorf("x265: library has no %d-bit encoder", depth)
+	}
+
+	p := C.goheif_param_alloc(api)
+	if p == nil {
+		return nil, errors.New("x265: out of memory")
+	}
+	defer C.goheif_param_free(api, p)
+	preset := C.CString(e.preset)
+	defer C.free(unsafe.Pointer(preset))
+	if C.goheif_param_default_preset(api, p, preset) != 0 {
+		return nil, fmt.Errorf("x265: invalid preset %q", e.preset)
+	}
+	params := [][2]string{
+		{"input-res", fmt.Sprintf("%dx%d", w, h)},
+		{"input-csp", "i420"},
+		{"input-depth", fmt.Sprint(depth)},
+		{"fps", "1"},
+		{"keyint", "1"},
+		{"crf", fmt.Sprint(e.crf())},
+		{"repeat-headers", "1"},
+		{"annexb", "1"},
+		{"info", "0"},
+		{"log-level", "error"},
+	}
+	for _, kv := range append(params, e.vui...) {
+		if err := parse(api, p, kv[0], kv[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	enc := C.goheif_encoder_open(api, p)
+	if enc == nil {
+		return nil, errors.New("x265: cannot open encoder")
+	}
+	defer C.goheif_encoder_close(api, enc)
+
+	pic := C.goheif_picture_alloc(api)
+	if pic == nil {
+		return nil, errors.New("x265: out of memory")
+	}
+	defer C.goheif_picture_free(api, pic)
+	C.goheif_picture_init(api, p, pic)
+
+	// x265 copies the input, but the planes must not live in Go memory
+	// while C holds on to them
+	bytesPerSample := 1
+	if depth > 8 {
+		bytesPerSample = 2
+	}
+	for i, pl := range planes {
+		pw, ph := w, h
+		if i > 0 {
+			pw, ph = w/2, h/2
+		}
+		rowSize := pw * bytesPerSample
+		buf := C.malloc(C.size_t(rowSize * ph))
+		if buf == nil {
+			return nil, errors.New("x265: out of memory")
+		}
+		defer C.free(buf)
+		dst := unsafe.Slice((*byte)(buf), rowSize*ph)
+		src := unsafe.Slice((*byte)(pl.pix), pl.stride*(ph-1)+rowSize)
+		for y := 0; y < ph; y++ {
+			copy(dst[y*rowSize:(y+1)*rowSize], src[y*pl.stride:])
+		}
+		pic.planes[i] = buf
+		pic.stride[i] = C.int(rowSize)
+	}
+	pic.bitDepth = C.int(depth)
+	pic.colorSpace = C.X265_CSP_I420
+
+	var out []byte
+	var nals *C.x265_nal
+	var n C.uint32_t
+	if C.goheif_encoder_encode(api, enc, &nals, &n, pic) < 0 {
+		return nil, errors.New("x265: encoding failed")
+	}
+	out = appendNALs(out, nals, n)
+	// flush the picture out of the lookahead
+	for {
+		ret := C.goheif_encoder_encode(api, enc, &nals, &n, nil)
+		if ret < 0 {
+			return nil, errors.New("x265: encoding failed")
+		}
+		out = appendNALs(out, nals, n)
+		if ret == 0 {
+			break
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("x265: no picture encoded")
+	}
+	return out, nil
+}
+
+func parse(api *C.x265_api, p *C.x265_param, name, value string) error {
+	cname, cvalue := C.CString(name), C.CString(value)
+	defer C.free(unsafe.Pointer(cname))
+	defer C.free(unsafe.Pointer(cvalue))
+	if C.goheif_param_parse(api, p, cname, cvalue) != 0 {
+		return fmt.Errorf("x265: invalid parameter %s=%s", name, value)
+	}
+	return nil
+}
+
+// appendNALs appends NAL units, which carry their start codes, to b.
+func appendNALs(b []byte, nals *C.x265_nal, n C.uint32_t) []byte {
+	if n == 0 {
+		return b
+	}
+	for _, nal := range unsafe.Slice(nals, int(n)) {
+		b = append(b, unsafe.Slice((*byte)(unsafe.Pointer(nal.payload)), int(nal.sizeBytes))...)
+	}
+	return b
+}